@@ -2,26 +2,40 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"path"
+	"sort"
 	"strconv"
+	"strings"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
-	"github.com/golang/glog"
+	"github.com/gorilla/mux"
 	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/shawn-hurley/osb-broker-k8s-lib/middleware"
 	clientset "k8s.io/client-go/kubernetes"
 	clientrest "k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/yaml"
 
 	"github.com/pmorie/osb-broker-lib/pkg/metrics"
 	"github.com/pmorie/osb-broker-lib/pkg/rest"
 	"github.com/pmorie/osb-broker-lib/pkg/server"
 
 	"cloudfront-broker/pkg/broker"
+	"cloudfront-broker/pkg/logging"
+	"cloudfront-broker/pkg/service"
+	"cloudfront-broker/pkg/storage"
 )
 
 var options struct {
@@ -58,7 +72,7 @@ func init() {
 	flag.StringVar(&options.KubeConfig, "kube-config", "", "specify the kube config path to be used")
 	flag.BoolVar(&options.Version, "version", false, "output version information and exit")
 
-	// glog to stderr
+	// osb-broker-lib logs with glog, to stderr
 	flag.Set("logtostderr", "true")
 
 	broker.AddFlags(&options.Options)
@@ -74,7 +88,8 @@ func main() {
 		fmt.Printf(" %-30s %s\n", "Built:", Built)
 		fmt.Printf(" %-30s %s\n", "Open Service Broker Version:", OSBVersion)
 	} else if err := run(); err != nil && err != context.Canceled && err != context.DeadlineExceeded {
-		glog.Fatalln(err)
+		logging.Root().Error("broker stopped", "error", err)
+		os.Exit(1)
 	}
 }
 
@@ -91,16 +106,60 @@ func runWithContext(ctx context.Context) error {
 		fmt.Printf("%s/%s\n", path.Base(os.Args[0]), "0.1.0")
 		return nil
 	}
+
+	if err := broker.ConfigureLogging(options.Options); err != nil {
+		return err
+	}
+
+	// the database commands work on a database the broker can not start with
+	switch flag.Arg(0) {
+	case "db":
+		return runDB(flag.Args()[1:])
+	case "catalog":
+		return runCatalog(flag.Args()[1:])
+	case "instances", "tasks":
+		return runAdmin(flag.Arg(0), flag.Args()[1:])
+	}
+
 	businessLogic, err := broker.NewBusinessLogic(ctx, options.Options)
 
 	if err != nil {
 		return err
 	}
 
+	// the database is closed once the server is drained and the tasks stopped
+	defer func() {
+		if err := businessLogic.Close(); err != nil {
+			logging.Root().Error("error closing the database", "error", err)
+		}
+	}()
+
+	switch flag.Arg(0) {
+	case "gc":
+		return runGC(ctx, businessLogic, flag.Args()[1:])
+	case "import":
+		return runImport(ctx, businessLogic, flag.Args()[1:])
+	}
+
+	shutdownTracing, err := broker.InitTracing(ctx, options.Options)
+	if err != nil {
+		return err
+	}
+	// the spans of the last requests and actions are flushed before the database is closed
+	defer func() {
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(flushCtx); err != nil {
+			logging.Root().Error("error flushing traces", "error", err)
+		}
+	}()
+
+	// Prom. metrics
+	reg := prom.NewRegistry()
+	reg.MustRegister(businessLogic.Metrics())
+
 	if options.BackgroundTasksOnly {
-		glog.V(4).Info("Starting background tasks")
-		return businessLogic.RunTasksInBackground(ctx)
-		// This should never return
+		return runTaskProcess(ctx, businessLogic, reg)
 	}
 
 	if (options.TLSCert != "" || options.TLSKey != "") &&
@@ -119,8 +178,6 @@ func runWithContext(ctx context.Context) error {
 
 	addr := ":" + port
 
-	// Prom. metrics
-	reg := prom.NewRegistry()
 	osbMetrics := metrics.New()
 	reg.MustRegister(osbMetrics)
 
@@ -132,6 +189,10 @@ func runWithContext(ctx context.Context) error {
 	s := server.New(api, reg)
 
 	businessLogic.AddRoutes(s.Router)
+	businessLogic.AddHealthRoutes(s.Router)
+	s.Router.Use(broker.TraceRequests)
+	s.Router.Use(broker.LogRequests)
+	businessLogic.AddAdminRoutes(s.Router)
 
 	if options.AuthenticateK8SToken {
 		// get k8s client
@@ -148,31 +209,491 @@ func runWithContext(ctx context.Context) error {
 			TokenReview: k8sClient.AuthenticationV1().TokenReviews(),
 			Authorizer:  authz,
 		}
-		// Use TokenReviewMiddleware.
-		s.Router.Use(tr.Middleware)
+		// Use TokenReviewMiddleware, the admin api has its own token
+		s.Router.Use(broker.ExceptAdmin(tr.Middleware))
 	}
 
-	glog.Infof("Starting broker!")
+	logging.Root().Info("starting broker")
+
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: s.Router,
+	}
+	srv.RegisterOnShutdown(businessLogic.StopStreams)
+	timeout := businessLogic.ShutdownTimeout()
 
 	if options.Insecure {
-		glog.Warningf("Starting insecure broker")
-		err = s.Run(ctx, addr)
+		logging.Root().Warn("starting insecure broker")
+		err = serve(ctx, srv, timeout, func() error {
+			return srv.ListenAndServe()
+		})
 	} else {
 		if options.TLSCert != "" && options.TLSKey != "" {
-			glog.Warningf("Starting secure broker with TLS cert and key data")
-			err = s.RunTLS(ctx, addr, options.TLSCert, options.TLSKey)
+			logging.Root().Warn("starting secure broker with TLS cert and key data")
+			var tlsCert tls.Certificate
+			if tlsCert, err = decodeTLSCert(options.TLSCert, options.TLSKey); err != nil {
+				return err
+			}
+			srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{tlsCert}}
+			err = serve(ctx, srv, timeout, func() error {
+				return srv.ListenAndServeTLS("", "")
+			})
 		} else {
 			if options.TLSCertFile == "" || options.TLSKeyFile == "" {
-				glog.Error("unable to run securely without TLS Certificate and Key. Please review options and if running with TLS, specify --tls-cert-file and --tls-private-key-file or --tlsCert and --tlsKey.")
+				logging.Root().Error("unable to run securely without TLS Certificate and Key. Please review options and if running with TLS, specify --tls-cert-file and --tls-private-key-file or --tlsCert and --tlsKey.")
 				return nil
 			}
-			glog.Warning("Starting secure broker with file based TLS cert and key")
-			err = s.RunTLSWithTLSFiles(ctx, addr, options.TLSCertFile, options.TLSKeyFile)
+			logging.Root().Warn("starting secure broker with file based TLS cert and key")
+			err = serve(ctx, srv, timeout, func() error {
+				return srv.ListenAndServeTLS(options.TLSCertFile, options.TLSKeyFile)
+			})
+		}
+	}
+	return err
+}
+
+// decodeTLSCert returns the certificate of the base-64 encoded PEM blocks
+func decodeTLSCert(cert string, key string) (tls.Certificate, error) {
+	decodedCert, err := base64.StdEncoding.DecodeString(cert)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	decodedKey, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(decodedCert, decodedKey)
+}
+
+// serve runs listenAndServe until ctx is done, then waits up to timeout for the open
+// requests to finish, unlike the osb server it returns only once the requests are drained
+func serve(ctx context.Context, srv *http.Server, timeout time.Duration, listenAndServe func() error) error {
+	logging.Root().Info("starting server", "addr", srv.Addr)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- listenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	logging.Root().Info("draining http requests")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logging.Root().Warn("error draining http requests", "error", err)
+		return srv.Close()
+	}
+	return ctx.Err()
+}
+
+// runTaskProcess runs the background tasks until ctx is done, with /metrics and the health checks
+// served when a metrics port is set, the endpoints are shut down once the tasks have stopped
+func runTaskProcess(ctx context.Context, businessLogic *broker.BusinessLogic, reg *prom.Registry) error {
+	port, err := broker.MetricsPortFromOptions(options.Options)
+	if err != nil {
+		return err
+	}
+	logging.Root().Debug("starting background tasks")
+	if port == 0 {
+		return businessLogic.RunTasksInBackground(ctx)
+	}
+
+	router := mux.NewRouter()
+	router.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	businessLogic.AddHealthRoutes(router)
+
+	srv := &http.Server{
+		Addr:    ":" + strconv.Itoa(port),
+		Handler: router,
+	}
+
+	// the tasks are stopped too when the endpoints can not be served
+	tasksCtx, stopTasks := context.WithCancel(ctx)
+	defer stopTasks()
+	srvCtx, stopServer := context.WithCancel(context.Background())
+	defer stopServer()
+
+	errs := make(chan error, 1)
+	go func() {
+		err := serve(srvCtx, srv, businessLogic.ShutdownTimeout(), srv.ListenAndServe)
+		stopTasks()
+		errs <- err
+	}()
+
+	err = businessLogic.RunTasksInBackground(tasksCtx)
+	stopServer()
+	if srvErr := <-errs; srvErr != context.Canceled && srvErr != http.ErrServerClosed && srvErr != nil {
+		logging.Root().Error("error serving task metrics and health checks", "error", srvErr)
+		if err == nil || err == context.Canceled {
+			err = srvErr
+		}
+	}
+	return err
+}
+
+// parseArgs parses the flags of a subcommand, flags may follow the positional arguments
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	positional := []string{}
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func outputFlag(fs *flag.FlagSet, formats ...string) *string {
+	return fs.String("output", formats[0], "output format, one of "+strings.Join(formats, ", "))
+}
+
+func writeJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// runAdmin runs the instances and tasks commands, they only need DATABASE_URL
+func runAdmin(command string, args []string) error {
+	businessLogic, err := broker.NewAdminLogic(options.Options)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := businessLogic.Close(); err != nil {
+			logging.Root().Error("error closing the database", "error", err)
+		}
+	}()
+
+	if command == "instances" {
+		return runInstances(businessLogic, args)
+	}
+	return runTasks(businessLogic, args)
+}
+
+// runInstances lists the instances or shows one with its origins and tasks
+func runInstances(businessLogic *broker.BusinessLogic, args []string) error {
+	usage := errors.New("usage: instances list [--status status] [--plan-id id] [--billing-code code] [--min-age duration] [--max-age duration] [--include-deleted] [--limit n] [--offset n] [--output table|json] | instances show <instance id> [--output table|json]")
+	if len(args) == 0 {
+		return usage
+	}
+
+	fs := flag.NewFlagSet("instances "+args[0], flag.ExitOnError)
+	output := outputFlag(fs, "table", "json")
+
+	switch args[0] {
+	case "list":
+		filter := &storage.DistributionFilter{}
+		fs.StringVar(&filter.Status, "status", "", "only instances with the status")
+		fs.StringVar(&filter.PlanID, "plan-id", "", "only instances of the plan")
+		fs.StringVar(&filter.BillingCode, "billing-code", "", "only instances with the billing code")
+		minAge := fs.Duration("min-age", 0, "only instances older than the duration")
+		maxAge := fs.Duration("max-age", 0, "only instances younger than the duration")
+		fs.BoolVar(&filter.IncludeDeleted, "include-deleted", false, "include deleted instances")
+		fs.IntVar(&filter.Limit, "limit", service.DefaultPageSize, "number of instances to list")
+		fs.IntVar(&filter.Offset, "offset", 0, "number of instances to skip")
+		if _, err := parseArgs(fs, args[1:]); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if *minAge > 0 {
+			t := now.Add(-*minAge)
+			filter.CreatedBefore = &t
+		}
+		if *maxAge > 0 {
+			t := now.Add(-*maxAge)
+			filter.CreatedAfter = &t
+		}
+
+		list, err := businessLogic.ListInstances(filter)
+		if err != nil {
+			return err
+		}
+		if *output == "json" {
+			return writeJSON(list)
+		}
+
+		w := newTable()
+		fmt.Fprintln(w, "INSTANCE ID\tSTATUS\tPLAN ID\tORIGIN\tBILLING CODE\tCLOUDFRONT ID\tCREATED")
+		for _, i := range list.Instances {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", i.InstanceID, i.Status, i.PlanID, i.OriginType, orDash(i.BillingCode), orDash(i.CloudfrontID), formatTime(&i.CreatedAt))
+		}
+		if err = w.Flush(); err != nil {
+			return err
+		}
+		fmt.Printf("\n%d of %d instances\n", len(list.Instances), list.Total)
+		return nil
+
+	case "show":
+		positional, err := parseArgs(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if len(positional) != 1 {
+			return usage
+		}
+
+		detail, err := businessLogic.GetInstanceDetail(positional[0])
+		if err != nil {
+			return err
+		}
+		if *output == "json" {
+			return writeJSON(detail)
+		}
+
+		w := newTable()
+		fmt.Fprintf(w, "Instance ID:\t%s\n", detail.InstanceID)
+		fmt.Fprintf(w, "Service ID:\t%s\n", detail.ServiceID)
+		fmt.Fprintf(w, "Plan ID:\t%s\n", detail.PlanID)
+		fmt.Fprintf(w, "Status:\t%s\n", detail.Status)
+		fmt.Fprintf(w, "Origin type:\t%s\n", detail.OriginType)
+		fmt.Fprintf(w, "Billing code:\t%s\n", orDash(detail.BillingCode))
+		fmt.Fprintf(w, "CloudFront ID:\t%s\n", orDash(detail.CloudfrontID))
+		fmt.Fprintf(w, "CloudFront URL:\t%s\n", orDash(detail.CloudfrontURL))
+		fmt.Fprintf(w, "Origin access identity:\t%s\n", orDash(detail.OriginAccessIdentity))
+		fmt.Fprintf(w, "Created:\t%s\n", formatTime(&detail.CreatedAt))
+		fmt.Fprintf(w, "Deleted:\t%s\n", formatTime(detail.DeletedAt))
+		if err = w.Flush(); err != nil {
+			return err
+		}
+
+		if len(detail.Origins) > 0 {
+			fmt.Println()
+			w = newTable()
+			fmt.Fprintln(w, "ORIGIN ID\tBUCKET\tIAM USER\tCREATED\tDELETED")
+			for _, o := range detail.Origins {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", o.OriginID, o.BucketName, orDash(o.IAMUser), formatTime(&o.CreatedAt), formatTime(o.DeletedAt))
+			}
+			if err = w.Flush(); err != nil {
+				return err
+			}
+		}
+
+		fmt.Println()
+		return writeTaskTable(detail.Tasks)
+	}
+
+	return usage
+}
+
+func writeTaskTable(tasks []service.TaskView) error {
+	w := newTable()
+	fmt.Fprintln(w, "TASK ID\tINSTANCE ID\tOPERATION\tACTION\tSTATUS\tRETRIES\tRESULT\tUPDATED")
+	for _, t := range tasks {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n", t.TaskID, t.DistributionID, orDash(t.OperationKey), t.Action, t.Status, t.Retries, orDash(t.Result), formatTime(&t.UpdatedAt))
+	}
+	return w.Flush()
+}
+
+// runTasks lists tasks or retries, cancels or fails one
+func runTasks(businessLogic *broker.BusinessLogic, args []string) error {
+	usage := errors.New("usage: tasks list [--status status] [--limit n] [--output table|json] | tasks retry|cancel <task id> | tasks fail <task id> [--reason reason]")
+	if len(args) == 0 {
+		return usage
+	}
+
+	fs := flag.NewFlagSet("tasks "+args[0], flag.ExitOnError)
+	output := outputFlag(fs, "table", "json")
+
+	if args[0] == "list" {
+		status := fs.String("status", "", "only tasks with the status, e.g. failed")
+		limit := fs.Int("limit", service.DefaultPageSize, "number of tasks to list, newest first")
+		if _, err := parseArgs(fs, args[1:]); err != nil {
+			return err
+		}
+
+		tasks, err := businessLogic.ListTasks(*status, *limit)
+		if err != nil {
+			return err
+		}
+		if *output == "json" {
+			return writeJSON(tasks)
 		}
+		return writeTaskTable(tasks)
+	}
+
+	reason := fs.String("reason", "", "reason stored with a failed task")
+	positional, err := parseArgs(fs, args[1:])
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usage
+	}
+
+	var task *service.TaskView
+	switch args[0] {
+	case "retry":
+		task, err = businessLogic.RetryTask(positional[0])
+	case "cancel":
+		task, err = businessLogic.CancelTask(positional[0])
+	case "fail":
+		task, err = businessLogic.FailTask(positional[0], *reason)
+	default:
+		return usage
+	}
+	if err != nil {
+		return err
 	}
+
+	if *output == "json" {
+		return writeJSON(task)
+	}
+	return writeTaskTable([]service.TaskView{*task})
+}
+
+// runCatalog prints the services and plans in the database in the format of the catalog file
+func runCatalog(args []string) error {
+	usage := errors.New("usage: catalog dump [--output yaml|json]")
+	if len(args) == 0 || args[0] != "dump" {
+		return usage
+	}
+
+	fs := flag.NewFlagSet("catalog dump", flag.ExitOnError)
+	output := outputFlag(fs, "yaml", "json")
+	if _, err := parseArgs(fs, args[1:]); err != nil {
+		return err
+	}
+
+	stg, err := storage.OpenStorage(options.DatabaseURL)
+	if err != nil {
+		return err
+	}
+
+	catalog, err := stg.DumpCatalog()
+	if err != nil {
+		return err
+	}
+
+	if *output == "json" {
+		return writeJSON(catalog)
+	}
+
+	data, err := yaml.Marshal(catalog)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
 	return err
 }
 
+// runDB checks the database is reachable and migrated, it fails when a problem is found
+func runDB(args []string) error {
+	usage := errors.New("usage: db check [--output table|json]")
+	if len(args) == 0 || args[0] != "check" {
+		return usage
+	}
+
+	fs := flag.NewFlagSet("db check", flag.ExitOnError)
+	output := outputFlag(fs, "table", "json")
+	if _, err := parseArgs(fs, args[1:]); err != nil {
+		return err
+	}
+
+	check, err := storage.CheckDatabase(options.DatabaseURL)
+	if err != nil {
+		return err
+	}
+
+	if *output == "json" {
+		if err = writeJSON(check); err != nil {
+			return err
+		}
+	} else {
+		w := newTable()
+		fmt.Fprintf(w, "Database:\t%s\n", check.Database)
+		fmt.Fprintf(w, "Reachable:\t%t\n", check.Reachable)
+		fmt.Fprintf(w, "Missing columns:\t%s\n", orDash(strings.Join(check.MissingColumns, ", ")))
+		statuses := []string{}
+		for status := range check.Tasks {
+			statuses = append(statuses, status)
+		}
+		sort.Strings(statuses)
+		for _, status := range statuses {
+			fmt.Fprintf(w, "Tasks %s:\t%d\n", status, check.Tasks[status])
+		}
+		fmt.Fprintf(w, "Stalled tasks:\t%d\n", check.StalledTasks)
+		fmt.Fprintf(w, "Open drift findings:\t%d\n", check.OpenDrift)
+		for _, problem := range check.Problems {
+			fmt.Fprintf(w, "Problem:\t%s\n", problem)
+		}
+		if err = w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if len(check.Problems) > 0 {
+		return fmt.Errorf("database check found %d problems", len(check.Problems))
+	}
+	return nil
+}
+
+// runGC prints the orphaned aws resources as json, they are only deleted with --apply
+func runGC(ctx context.Context, businessLogic *broker.BusinessLogic, args []string) error {
+	gcFlags := flag.NewFlagSet("gc", flag.ExitOnError)
+	apply := gcFlags.Bool("apply", false, "delete the orphaned resources instead of only reporting them")
+	if err := gcFlags.Parse(args); err != nil {
+		return err
+	}
+
+	report, err := businessLogic.CollectGarbage(ctx, *apply)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(report)
+}
+
+// runImport adopts an existing cloudfront distribution and prints the new instance as json
+func runImport(ctx context.Context, businessLogic *broker.BusinessLogic, args []string) error {
+	req := &service.ImportRequest{}
+
+	importFlags := flag.NewFlagSet("import", flag.ExitOnError)
+	importFlags.StringVar(&req.CloudfrontID, "cloudfront-id", "", "id of the cloudfront distribution to import")
+	importFlags.StringVar(&req.BucketName, "bucket", "", "name of the origin bucket, the distribution is imported as a custom origin without it")
+	importFlags.StringVar(&req.IAMUser, "iam-user", "", "name of the iam user with access to the bucket, required with --bucket, a new access key is created for it")
+	importFlags.StringVar(&req.PlanID, "plan-id", "", "id of the plan of the new instance")
+	importFlags.StringVar(&req.BillingCode, "billing-code", "", "billing code of the new instance")
+	importFlags.BoolVar(&req.Align, "align", false, "put the bucket policy, iam user policy and tags in line with what the broker creates")
+	if err := importFlags.Parse(args); err != nil {
+		return err
+	}
+
+	result, err := businessLogic.ImportDistribution(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(result)
+}
+
 func getKubernetesClient(kubeConfigPath string) (clientset.Interface, error) {
 	var clientConfig *clientrest.Config
 	var err error
@@ -196,17 +717,18 @@ func getKubernetesClient(kubeConfigPath string) (clientset.Interface, error) {
 }
 
 func cancelOnInterrupt(ctx context.Context, f context.CancelFunc) {
-	term := make(chan os.Signal)
+	term := make(chan os.Signal, 1)
 	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
 
-	for {
-		select {
-		case <-term:
-			glog.Warning("Received SIGTERM, exiting gracefully...")
-			f()
-			os.Exit(0)
-		case <-ctx.Done():
-			os.Exit(0)
-		}
+	select {
+	case <-term:
+		logging.Root().Warn("received SIGTERM, exiting gracefully")
+		f()
+	case <-ctx.Done():
+		return
 	}
+
+	<-term
+	logging.Root().Warn("received a second signal, exiting now")
+	os.Exit(1)
 }
@@ -0,0 +1,246 @@
+package broker
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloudfront-broker/pkg/logging"
+	"cloudfront-broker/pkg/service"
+	"cloudfront-broker/pkg/storage"
+
+	"github.com/gorilla/mux"
+)
+
+// AdminPathPrefix is the path the admin api is served under
+const AdminPathPrefix = "/admin"
+
+// adminError is the body of failed admin api requests
+type adminError struct {
+	Error string `json:"error"`
+}
+
+// adminAuth only lets requests with the admin token as bearer token through
+func (b *BusinessLogic) adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(b.adminToken)) != 1 {
+			httpWrite(w, http.StatusUnauthorized, &adminError{Error: "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ExceptAdmin applies the middleware to all requests but the admin api, which has its own authentication,
+// and the health checks, which probes call without credentials
+func ExceptAdmin(mw mux.MiddlewareFunc) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		wrapped := mw(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, AdminPathPrefix+"/") || r.URL.Path == HealthPath || r.URL.Path == ReadinessPath {
+				next.ServeHTTP(w, r)
+				return
+			}
+			wrapped.ServeHTTP(w, r)
+		})
+	}
+}
+
+// adminWriteError writes err with the status matching the error
+func adminWriteError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+
+	switch err.(type) {
+	case *service.ImportError:
+		status = http.StatusUnprocessableEntity
+	case *service.TaskStateError:
+		status = http.StatusConflict
+	default:
+		switch err.Error() {
+		case storage.DistributionNotFound, storage.TaskNotFound:
+			status = http.StatusNotFound
+		}
+	}
+
+	httpWrite(w, status, &adminError{Error: err.Error()})
+}
+
+// instanceFilter reads the instance filter from the query of the request,
+// min_age and max_age are durations like 720h
+func instanceFilter(r *http.Request) (*storage.DistributionFilter, error) {
+	q := r.URL.Query()
+	filter := &storage.DistributionFilter{
+		Status:      q.Get("status"),
+		PlanID:      q.Get("plan_id"),
+		BillingCode: q.Get("billing_code"),
+	}
+
+	now := time.Now()
+	if v := q.Get("min_age"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid min_age: %s", err.Error())
+		}
+		t := now.Add(-d)
+		filter.CreatedBefore = &t
+	}
+	if v := q.Get("max_age"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max_age: %s", err.Error())
+		}
+		t := now.Add(-d)
+		filter.CreatedAfter = &t
+	}
+
+	var err error
+	if v := q.Get("include_deleted"); v != "" {
+		if filter.IncludeDeleted, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid include_deleted: %s", err.Error())
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("invalid limit: %s", err.Error())
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if filter.Offset, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("invalid offset: %s", err.Error())
+		}
+	}
+
+	return filter, nil
+}
+
+func (b *BusinessLogic) addAdminInstancesRoutes(router *mux.Router) {
+	router.HandleFunc("/instances", func(w http.ResponseWriter, r *http.Request) {
+		filter, err := instanceFilter(r)
+		if err != nil {
+			httpWrite(w, http.StatusBadRequest, &adminError{Error: err.Error()})
+			return
+		}
+
+		list, err := b.ListInstances(filter)
+		if err != nil {
+			adminWriteError(w, err)
+			return
+		}
+		httpWrite(w, http.StatusOK, list)
+	}).Methods("GET")
+
+	router.HandleFunc("/instances/{instance_id}", func(w http.ResponseWriter, r *http.Request) {
+		detail, err := b.GetInstanceDetail(mux.Vars(r)["instance_id"])
+		if err != nil {
+			adminWriteError(w, err)
+			return
+		}
+		httpWrite(w, http.StatusOK, detail)
+	}).Methods("GET")
+
+	router.HandleFunc("/instances/{instance_id}/events", func(w http.ResponseWriter, r *http.Request) {
+		limit := 0
+		if v := r.URL.Query().Get("limit"); v != "" {
+			var err error
+			if limit, err = strconv.Atoi(v); err != nil {
+				httpWrite(w, http.StatusBadRequest, &adminError{Error: "invalid limit: " + err.Error()})
+				return
+			}
+		}
+
+		events, err := b.GetInstanceAuditEvents(mux.Vars(r)["instance_id"], limit)
+		if err != nil {
+			adminWriteError(w, err)
+			return
+		}
+		httpWrite(w, http.StatusOK, events)
+	}).Methods("GET")
+}
+
+// failTaskRequest is the optional body of the fail task request
+type failTaskRequest struct {
+	Reason string `json:"reason"`
+}
+
+func (b *BusinessLogic) addAdminTasksRoutes(router *mux.Router) {
+	router.HandleFunc("/tasks/{task_id}/{action:retry|cancel|fail}", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		taskID := vars["task_id"]
+
+		logging.FromContext(r.Context()).Info("admin request", "admin_action", vars["action"], logging.KeyTaskID, taskID)
+
+		var task *service.TaskView
+		var err error
+
+		switch vars["action"] {
+		case "retry":
+			task, err = b.RetryTask(taskID)
+		case "cancel":
+			task, err = b.CancelTask(taskID)
+		case "fail":
+			req := &failTaskRequest{}
+			if r.ContentLength != 0 {
+				if err = json.NewDecoder(r.Body).Decode(req); err != nil {
+					httpWrite(w, http.StatusBadRequest, &adminError{Error: "invalid fail request: " + err.Error()})
+					return
+				}
+			}
+			task, err = b.FailTask(taskID, req.Reason)
+		}
+
+		if err != nil {
+			adminWriteError(w, err)
+			return
+		}
+		httpWrite(w, http.StatusOK, task)
+	}).Methods("POST")
+
+	router.HandleFunc("/tasks/{task_id}/events", func(w http.ResponseWriter, r *http.Request) {
+		events, err := b.GetTaskAuditEvents(mux.Vars(r)["task_id"])
+		if err != nil {
+			adminWriteError(w, err)
+			return
+		}
+		httpWrite(w, http.StatusOK, events)
+	}).Methods("GET")
+}
+
+func (b *BusinessLogic) addAdminImportRoute(router *mux.Router) {
+	router.HandleFunc("/instances/import", func(w http.ResponseWriter, r *http.Request) {
+		req := &service.ImportRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			httpWrite(w, http.StatusBadRequest, &adminError{Error: "invalid import request: " + err.Error()})
+			return
+		}
+
+		logging.FromContext(r.Context()).Debug("import request", "cloudfront_id", req.CloudfrontID)
+
+		result, err := b.ImportDistribution(r.Context(), req)
+		if err != nil {
+			adminWriteError(w, err)
+			return
+		}
+		httpWrite(w, http.StatusCreated, result)
+	}).Methods("POST")
+}
+
+// AddAdminRoutes adds the admin api under AdminPathPrefix, requests need the admin token.
+// Without an admin token the admin api is not served.
+func (b *BusinessLogic) AddAdminRoutes(router *mux.Router) {
+	if b.adminToken == "" {
+		logging.Root().Info("no admin token, admin api disabled")
+		return
+	}
+
+	admin := router.PathPrefix(AdminPathPrefix).Subrouter()
+	admin.Use(b.adminAuth)
+
+	b.addAdminImportRoute(admin)
+	b.addAdminInstancesRoutes(admin)
+	b.addAdminTasksRoutes(admin)
+}
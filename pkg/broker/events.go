@@ -0,0 +1,110 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloudfront-broker/pkg/storage"
+
+	"github.com/gorilla/mux"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// eventsKeepalive is how often an idle event stream sends a comment, so proxies keep it open
+const eventsKeepalive = 15 * time.Second
+
+// writeEvent writes the task event as a server-sent event named task
+func writeEvent(w http.ResponseWriter, flusher http.Flusher, event *storage.TaskEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(w, "event: task\ndata: %s\n\n", data); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
+
+// instanceEvents streams the task transitions of the instance as server-sent events, the
+// current task first, until the client disconnects or the server shuts down
+func (b *BusinessLogic) instanceEvents(w http.ResponseWriter, r *http.Request) {
+	instanceID := mux.Vars(r)["instance_id"]
+	log := requestLogger(&broker.RequestContext{Writer: w, Request: r})
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpWriteError(w, InternalServerErrWithMessage("StreamingUnsupported", "the response can not be streamed"))
+		return
+	}
+
+	if _, err := b.storage.GetDistributionWithDeleted(instanceID); err != nil {
+		if err.Error() == storage.DistributionNotFound {
+			httpWriteError(w, NotFoundWithMessage("InstanceNotFound", "instance not found"))
+			return
+		}
+		log.Error("error getting instance", "error", err)
+		httpWriteError(w, InternalServerErr())
+		return
+	}
+
+	// subscribing first, a transition between reading the current task and subscribing is not lost
+	events, unsubscribe, err := b.storage.SubscribeTaskEvents(instanceID)
+	if err != nil {
+		log.Error("error subscribing to task events", "error", err)
+		httpWriteError(w, InternalServerErr())
+		return
+	}
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	if task, err := b.storage.GetTaskByDistribution(instanceID); err == nil {
+		if err = writeEvent(w, flusher, task.Event()); err != nil {
+			return
+		}
+	} else if err.Error() != storage.TaskNotFound {
+		log.Error("error getting current task", "error", err)
+	}
+
+	keepalive := time.NewTicker(eventsKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-b.streamsDone:
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if err = writeEvent(w, flusher, event); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err = fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// StopStreams ends the open event streams, they would keep a graceful shutdown from draining
+func (b *BusinessLogic) StopStreams() {
+	b.stopStreams.Do(func() {
+		close(b.streamsDone)
+	})
+}
+
+func (b *BusinessLogic) addOSBInstanceEventsRoute(router *mux.Router) {
+	router.HandleFunc("/v2/service_instances/{instance_id}/events", b.instanceEvents).Methods("GET")
+}
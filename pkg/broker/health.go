@@ -0,0 +1,48 @@
+package broker
+
+import (
+	"net/http"
+
+	"cloudfront-broker/pkg/service"
+
+	"github.com/gorilla/mux"
+)
+
+// Paths of the health checks, they are served without authentication
+const (
+	HealthPath    = "/healthz"
+	ReadinessPath = "/readyz"
+)
+
+// handleRoute sets the handler of the route with the path, replacing the handler
+// when the osb library already registered the path
+func handleRoute(router *mux.Router, path string, handler http.Handler) {
+	replaced := false
+	_ = router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		if tpl, err := route.GetPathTemplate(); err == nil && tpl == path {
+			route.Handler(handler)
+			replaced = true
+		}
+		return nil
+	})
+	if !replaced {
+		router.Handle(path, handler)
+	}
+}
+
+func (b *BusinessLogic) healthHandler(ready bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := b.service.CheckHealth(r.Context(), ready)
+		status := http.StatusOK
+		if report.Status != service.HealthOK {
+			status = http.StatusServiceUnavailable
+		}
+		httpWrite(w, status, report)
+	})
+}
+
+// AddHealthRoutes adds the liveness check on /healthz and the readiness check on /readyz
+func (b *BusinessLogic) AddHealthRoutes(router *mux.Router) {
+	handleRoute(router, HealthPath, b.healthHandler(false))
+	handleRoute(router, ReadinessPath, b.healthHandler(true))
+}
@@ -0,0 +1,75 @@
+package broker
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"cloudfront-broker/pkg/logging"
+	"cloudfront-broker/pkg/tracing"
+
+	"github.com/gorilla/mux"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// RequestIdentityHeader is the osb header identifying a request, it is logged as request_id
+const RequestIdentityHeader = "X-Broker-API-Request-Identity"
+
+// ConfigureLogging sets the format and level of the structured logs
+func ConfigureLogging(o Options) error {
+	format := o.LogFormat
+	level := o.LogLevel
+
+	if v, ok := envOption("log-format", "LOG_FORMAT"); ok {
+		format = v
+	}
+	if v, ok := envOption("log-level", "LOG_LEVEL"); ok {
+		level = v
+	}
+
+	if err := logging.Configure(format, level); err != nil {
+		return errors.New("invalid logging options, set LOG_FORMAT and LOG_LEVEL in environment or provide via the cli using -log-format and -log-level: " + err.Error())
+	}
+	return nil
+}
+
+// LogRequests puts a logger with the osb request identity and the instance id in the
+// request context and logs every request when it is answered
+func LogRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+
+		log := logging.Root()
+		if id := r.Header.Get(RequestIdentityHeader); id != "" {
+			log = log.With(logging.KeyRequestID, id)
+		}
+		if id := mux.Vars(r)["instance_id"]; id != "" {
+			log = log.With(logging.KeyInstanceID, id)
+		}
+
+		sw := tracing.NewStatusWriter(w)
+		next.ServeHTTP(sw, r.WithContext(logging.NewContext(r.Context(), log)))
+
+		keyvals := []interface{}{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", sw.Status,
+			"duration", time.Since(started).String(),
+		}
+		// probes and scrapes would drown the osb requests
+		switch r.URL.Path {
+		case HealthPath, ReadinessPath, "/metrics":
+			log.Debug("request", keyvals...)
+		default:
+			log.Info("request", keyvals...)
+		}
+	})
+}
+
+// requestLogger returns the logger of the osb request
+func requestLogger(c *broker.RequestContext) *logging.Logger {
+	if c == nil || c.Request == nil {
+		return logging.Root()
+	}
+	return logging.FromContext(c.Request.Context())
+}
@@ -5,20 +5,22 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Masterminds/semver"
 	"github.com/fatih/structs"
-	"github.com/golang/glog"
 	"github.com/nu7hatch/gouuid"
 	osb "github.com/pmorie/go-open-service-broker-client/v2"
 	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	prom "github.com/prometheus/client_golang/prometheus"
 
+	"cloudfront-broker/pkg/logging"
 	"cloudfront-broker/pkg/service"
 	"cloudfront-broker/pkg/storage"
+	"cloudfront-broker/pkg/tracing"
 )
 
 // BusinessLogic holds the data used for processing.
@@ -27,6 +29,20 @@ type BusinessLogic struct {
 
 	storage *storage.PostgresStorage
 	service *service.AwsConfig
+
+	gcInterval time.Duration
+	gcApply    bool
+
+	reconcileInterval time.Duration
+	reconcileRepair   bool
+
+	adminToken string
+
+	shutdownTimeout time.Duration
+
+	// streamsDone is closed by StopStreams
+	streamsDone chan struct{}
+	stopStreams sync.Once
 }
 
 var _ broker.Interface = &BusinessLogic{}
@@ -41,24 +57,103 @@ func NewBusinessLogic(ctx context.Context, o Options) (*BusinessLogic, error) {
 	dbStore, namePrefix, waitSecs, maxRetries, err := InitFromOptions(ctx, o)
 
 	if err != nil {
-		glog.Errorf("error initializing: %s", err.Error())
+		logging.Root().Error("error initializing", "error", err)
+		return nil, errors.New("error initializing" + ": " + err.Error())
+	}
+
+	hardening, err := BucketHardeningFromOptions(o)
+	if err != nil {
+		logging.Root().Error("error initializing", "error", err)
+		return nil, errors.New("error initializing" + ": " + err.Error())
+	}
+
+	gcInterval, gcApply, err := GCFromOptions(o)
+	if err != nil {
+		logging.Root().Error("error initializing", "error", err)
+		return nil, errors.New("error initializing" + ": " + err.Error())
+	}
+
+	reconcileInterval, reconcileRepair, err := ReconcileFromOptions(o)
+	if err != nil {
+		logging.Root().Error("error initializing", "error", err)
+		return nil, errors.New("error initializing" + ": " + err.Error())
+	}
+
+	shutdownTimeout, err := ShutdownFromOptions(o)
+	if err != nil {
+		logging.Root().Error("error initializing", "error", err)
+		return nil, errors.New("error initializing" + ": " + err.Error())
+	}
+
+	webhooks, err := WebhooksFromOptions(o)
+	if err != nil {
+		logging.Root().Error("error initializing", "error", err)
 		return nil, errors.New("error initializing" + ": " + err.Error())
 	}
 
-	awsConfig, err := service.Init(dbStore, namePrefix, waitSecs, maxRetries)
+	awsConfig, err := service.Init(dbStore, namePrefix, waitSecs, maxRetries, hardening)
 	if err != nil {
-		msg := fmt.Sprintf("error initializing the service: %s\n", err)
-		glog.Fatalln(msg)
+		logging.Root().Error("error initializing the service", "error", err)
+		return nil, errors.New("error initializing the service: " + err.Error())
+	}
+
+	if webhooks != nil {
+		if err = awsConfig.EnableWebhooks(webhooks); err != nil {
+			logging.Root().Error("error initializing", "error", err)
+			return nil, errors.New("error initializing" + ": " + err.Error())
+		}
 	}
 
 	bl := &BusinessLogic{
-		storage: dbStore,
-		service: awsConfig,
+		storage:    dbStore,
+		service:    awsConfig,
+		gcInterval: gcInterval,
+		gcApply:    gcApply,
+
+		reconcileInterval: reconcileInterval,
+		reconcileRepair:   reconcileRepair,
+
+		adminToken: o.AdminToken,
+
+		shutdownTimeout: shutdownTimeout,
+
+		streamsDone: make(chan struct{}),
+	}
+
+	if v, ok := envOption("admin-token", "ADMIN_TOKEN"); ok {
+		bl.adminToken = v
 	}
 
 	return bl, nil
 }
 
+// NewAdminLogic returns the business logic of the operator commands listing instances and
+// tasks and retrying, canceling or failing tasks. It works on the database of the options
+// as it is, without migrating it, syncing the catalog or an aws configuration. Tasks it
+// fails or cancels queue their webhooks when a webhook secret is set.
+func NewAdminLogic(o Options) (*BusinessLogic, error) {
+	dbStore, err := storage.OpenStorage(o.DatabaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	urls, secret := o.WebhookURLs, o.WebhookSecret
+	if v, ok := envOption("webhook-urls", "WEBHOOK_URLS"); ok {
+		urls = v
+	}
+	if v, ok := envOption("webhook-secret", "WEBHOOK_SECRET"); ok {
+		secret = v
+	}
+	if secret != "" {
+		dbStore.EnableWebhooks(splitWebhookURLs(urls))
+	}
+
+	return &BusinessLogic{
+		storage: dbStore,
+		service: service.NewAdmin(dbStore),
+	}, nil
+}
+
 // InitFromOptions accepts parameters for runtime initilization
 // It returns initialized values
 func InitFromOptions(ctx context.Context, o Options) (*storage.PostgresStorage, string, int64, int64, error) {
@@ -68,36 +163,218 @@ func InitFromOptions(ctx context.Context, o Options) (*storage.PostgresStorage,
 	waitSecs := o.WaitSecs
 	maxRetries := o.MaxRetries
 
-	glog.V(4).Infof("options: %#+v", o)
+	logging.Root().Debug("options", "options", fmt.Sprintf("%+v", o.redacted()))
 
-	if namePrefix == "" && os.Getenv("NAME_PREFIX") != "" {
-		namePrefix = os.Getenv("NAME_PREFIX")
+	if v, ok := envOption("name-prefix", "NAME_PREFIX"); ok {
+		namePrefix = v
 	}
 
 	if namePrefix == "" {
 		return nil, "", 0, 0, errors.New("the name prefix was not specified, set NAME_PREFIX in environment or provide it via the cli using -name-prefix")
 	}
 
-	if os.Getenv("WAIT_SECONDS") != "" {
-		s, err := strconv.ParseInt(os.Getenv("WAIT_SECONDS"), 10, 64)
+	if v, ok := envOption("wait-seconds", "WAIT_SECONDS"); ok {
+		s, err := strconv.ParseInt(v, 10, 64)
 		if err != nil {
 			return nil, "", 0, 0, errors.New("invalid value for WAIT_SECONDS, set WAIT_SECONDS in environment or provide via the cli using -wait-seconds")
 		}
 		waitSecs = s
 	}
-	glog.V(2).Infof("InitFromOptions: waitSecs: %d", waitSecs)
+	logging.Root().Debug("wait seconds", "wait_secs", waitSecs)
 
-	if os.Getenv("MAX_RETRIES") != "" {
-		s, err := strconv.ParseInt(os.Getenv("MAX_RETRIES"), 10, 64)
+	if v, ok := envOption("max-retries", "MAX_RETRIES"); ok {
+		s, err := strconv.ParseInt(v, 10, 64)
 		if err != nil {
 			return nil, "", 0, 0, errors.New("invalid value for MAX_RETRIES, set MAX_RETRIES in environment or provide via the cli using -max-retries")
 		}
 		maxRetries = s
 	}
-	glog.V(2).Infof("InitFromOptions: maxRetries: %d", maxRetries)
+	logging.Root().Debug("max retries", "max_retries", maxRetries)
+
+	catalogPath := o.CatalogPath
+	if v, ok := envOption("catalogPath", "CATALOG_PATH"); ok {
+		catalogPath = v
+	}
+
+	var catalog *storage.Catalog
+	if catalogPath != "" {
+		catalog, err = storage.LoadCatalogFile(catalogPath)
+		if err != nil {
+			return nil, "", 0, 0, err
+		}
+
+		if err = service.ValidateCatalog(catalog); err != nil {
+			return nil, "", 0, 0, errors.New("invalid catalog " + catalogPath + ": " + err.Error())
+		}
+	}
 
 	stg, err := storage.InitStorage(ctx, o.DatabaseURL)
-	return stg, namePrefix, waitSecs, maxRetries, err
+	if err != nil || catalog == nil {
+		return stg, namePrefix, waitSecs, maxRetries, err
+	}
+
+	if err = stg.SyncCatalog(catalog); err != nil {
+		return nil, "", 0, 0, err
+	}
+	logging.Root().Info("catalog synced", "catalog_path", catalogPath)
+
+	return stg, namePrefix, waitSecs, maxRetries, nil
+}
+
+// BucketHardeningFromOptions returns the public access, encryption and ownership settings of new buckets
+func BucketHardeningFromOptions(o Options) (*service.BucketHardening, error) {
+	hardening := &service.BucketHardening{
+		BlockPublicAccess:   o.BlockPublicAccess,
+		Encryption:          o.BucketEncryption,
+		KMSKeyID:            o.BucketKMSKeyID,
+		BucketOwnerEnforced: o.BucketOwnerEnforced,
+	}
+
+	if v, ok := envOption("block-public-access", "BLOCK_PUBLIC_ACCESS"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, errors.New("invalid value for BLOCK_PUBLIC_ACCESS, set BLOCK_PUBLIC_ACCESS in environment or provide via the cli using -block-public-access")
+		}
+		hardening.BlockPublicAccess = b
+	}
+
+	if v, ok := envOption("bucket-encryption", "BUCKET_ENCRYPTION"); ok {
+		hardening.Encryption = v
+	}
+
+	if v, ok := envOption("bucket-kms-key-id", "BUCKET_KMS_KEY_ID"); ok {
+		hardening.KMSKeyID = v
+	}
+
+	if v, ok := envOption("bucket-owner-enforced", "BUCKET_OWNER_ENFORCED"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, errors.New("invalid value for BUCKET_OWNER_ENFORCED, set BUCKET_OWNER_ENFORCED in environment or provide via the cli using -bucket-owner-enforced")
+		}
+		hardening.BucketOwnerEnforced = b
+	}
+
+	return hardening, nil
+}
+
+// GCFromOptions returns the interval and apply flag of the periodic scan for orphaned aws resources
+func GCFromOptions(o Options) (time.Duration, bool, error) {
+	intervalMinutes := o.GCIntervalMinutes
+	apply := o.GCApply
+
+	if v, ok := envOption("gc-interval-minutes", "GC_INTERVAL_MINUTES"); ok {
+		m, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || m < 0 {
+			return 0, false, errors.New("invalid value for GC_INTERVAL_MINUTES, set GC_INTERVAL_MINUTES in environment or provide via the cli using -gc-interval-minutes")
+		}
+		intervalMinutes = m
+	}
+
+	if v, ok := envOption("gc-apply", "GC_APPLY"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return 0, false, errors.New("invalid value for GC_APPLY, set GC_APPLY in environment or provide via the cli using -gc-apply")
+		}
+		apply = b
+	}
+
+	return time.Duration(intervalMinutes) * time.Minute, apply, nil
+}
+
+// ShutdownFromOptions returns how long a shutdown waits for requests and the running task action
+func ShutdownFromOptions(o Options) (time.Duration, error) {
+	seconds := o.ShutdownSeconds
+
+	if v, ok := envOption("shutdown-timeout-seconds", "SHUTDOWN_TIMEOUT_SECONDS"); ok {
+		s, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || s < 0 {
+			return 0, errors.New("invalid value for SHUTDOWN_TIMEOUT_SECONDS, set SHUTDOWN_TIMEOUT_SECONDS in environment or provide via the cli using -shutdown-timeout-seconds")
+		}
+		seconds = s
+	}
+
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// MetricsPortFromOptions returns the port of the metrics and health checks of the tasks process,
+// 0 when they are not served
+func MetricsPortFromOptions(o Options) (int, error) {
+	port := o.MetricsPort
+
+	if v, ok := envOption("metrics-port", "METRICS_PORT"); ok {
+		p, err := strconv.Atoi(v)
+		if err != nil || p < 0 {
+			return 0, errors.New("invalid value for METRICS_PORT, set METRICS_PORT in environment or provide via the cli using -metrics-port")
+		}
+		port = p
+	}
+
+	return port, nil
+}
+
+// WebhooksFromOptions returns the webhooks notified of finished operations, nil when no
+// secret is set
+func WebhooksFromOptions(o Options) (*service.WebhookConfig, error) {
+	urls := o.WebhookURLs
+	secret := o.WebhookSecret
+
+	if v, ok := envOption("webhook-urls", "WEBHOOK_URLS"); ok {
+		urls = v
+	}
+	if v, ok := envOption("webhook-secret", "WEBHOOK_SECRET"); ok {
+		secret = v
+	}
+
+	if secret == "" {
+		if urls != "" {
+			return nil, errors.New("webhooks require a secret, set WEBHOOK_SECRET in environment or provide via the cli using -webhook-secret")
+		}
+		return nil, nil
+	}
+
+	config := &service.WebhookConfig{Secret: secret, URLs: splitWebhookURLs(urls)}
+	for _, u := range config.URLs {
+		if err := service.ValidateWebhookURL(u); err != nil {
+			return nil, errors.New("invalid value for WEBHOOK_URLS, " + err.Error())
+		}
+	}
+
+	return config, nil
+}
+
+// splitWebhookURLs returns the urls of the comma separated list, blanks are skipped
+func splitWebhookURLs(urls string) []string {
+	list := []string{}
+	for _, u := range strings.Split(urls, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			list = append(list, u)
+		}
+	}
+	return list
+}
+
+// ReconcileFromOptions returns the interval and repair flag of the periodic drift check
+func ReconcileFromOptions(o Options) (time.Duration, bool, error) {
+	intervalMinutes := o.ReconcileMinutes
+	repair := o.ReconcileRepair
+
+	if v, ok := envOption("reconcile-interval-minutes", "RECONCILE_INTERVAL_MINUTES"); ok {
+		m, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || m < 0 {
+			return 0, false, errors.New("invalid value for RECONCILE_INTERVAL_MINUTES, set RECONCILE_INTERVAL_MINUTES in environment or provide via the cli using -reconcile-interval-minutes")
+		}
+		intervalMinutes = m
+	}
+
+	if v, ok := envOption("reconcile-repair", "RECONCILE_REPAIR"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return 0, false, errors.New("invalid value for RECONCILE_REPAIR, set RECONCILE_REPAIR in environment or provide via the cli using -reconcile-repair")
+		}
+		repair = b
+	}
+
+	return time.Duration(intervalMinutes) * time.Minute, repair, nil
 }
 
 // GetCatalog returns an  OSB catalog retrieved from the DB
@@ -110,25 +387,44 @@ func (b *BusinessLogic) GetCatalog(c *broker.RequestContext) (*broker.CatalogRes
 	osbResponse.Services, err = b.storage.GetServicesCatalog()
 	if err != nil {
 		description := "Error getting catalog"
-		glog.Errorf("%s: %s", description, err.Error())
+		requestLogger(c).Error(description, "error", err)
 		return nil, osb.HTTPStatusCodeError{
 			StatusCode:  http.StatusInternalServerError,
 			Description: &description,
 		}
 	}
-	glog.V(4).Infof("catalog response: %#+v", osbResponse)
+	logging.Root().Debug("catalog response", "response", fmt.Sprintf("%+v", osbResponse))
 
 	response.CatalogResponse = *osbResponse
 
 	return response, nil
 }
 
+// validateParameters checks the request parameters against the schema published for the plan,
+// a webhook_url is rejected when webhooks are disabled as it would never be notified
+func (b *BusinessLogic) validateParameters(planID string, parameters map[string]interface{}) error {
+	if u, ok := parameters["webhook_url"]; ok && u != "" && !b.service.WebhooksEnabled() {
+		return BadRequestError("webhook_url can not be used, webhooks are disabled on this broker")
+	}
+
+	err := b.service.ValidateParameters(planID, parameters)
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := err.(*service.ParameterError); ok {
+		return BadRequestError(err.Error())
+	}
+	return InternalServerErrWithMessage("error validating parameters", err.Error())
+}
+
 // Provision starts the provisioning process
 func (b *BusinessLogic) Provision(request *osb.ProvisionRequest, c *broker.RequestContext) (*broker.ProvisionResponse, error) {
-
 	b.Lock()
 	defer b.Unlock()
 
+	svc := b.requestService(c)
+
 	response := broker.ProvisionResponse{}
 
 	if !request.AcceptsIncomplete {
@@ -147,34 +443,77 @@ func (b *BusinessLogic) Provision(request *osb.ProvisionRequest, c *broker.Reque
 		return nil, UnprocessableEntityWithMessage("PlanRequired", "The plan ID was not provided.")
 	}
 
-	newUUID, _ := uuid.NewV4()
-	callerReference := newUUID.String()
+	if err := b.validateParameters(request.PlanID, request.Parameters); err != nil {
+		return nil, err
+	}
 
-	operationKey := newOpKey("PRV")
-	respOpKey := osb.OperationKey(operationKey)
-	response.OperationKey = &respOpKey
+	params, err := service.ParseInstanceParameters(request.Parameters)
+	if err != nil {
+		return nil, BadRequestError(err.Error())
+	}
 
-	response.Async = true
+	settings, err := svc.GetPlanSettings(request.PlanID)
+	if err != nil {
+		return nil, InternalServerErrWithMessage("error getting plan", err.Error())
+	}
+
+	if err = params.ApplyPlanSettings(settings); err != nil {
+		return nil, BadRequestError(err.Error())
+	}
 
 	distributionID := request.InstanceID
 	serviceID := request.ServiceID
 	planID := request.PlanID
+	parametersHash := service.HashParameters(request.Parameters)
 
-	ok, err := b.service.IsDuplicateInstance(distributionID)
-
+	repeated, err := svc.CheckRepeatedProvision(distributionID, serviceID, planID, parametersHash)
 	if err != nil {
 		return nil, InternalServerErrWithMessage("error checking instance", err.Error())
 	}
 
-	if ok {
-		return nil, ConflictErrorWithMessage("instance already provisioned, is provisioning or has been deleted")
+	if repeated != nil {
+		if !repeated.Identical {
+			return nil, ConflictErrorWithMessage("instance already exists with different attributes, failed or has been deleted")
+		}
+
+		if repeated.InProgress {
+			respOpKey := osb.OperationKey(repeated.OperationKey)
+			response.OperationKey = &respOpKey
+			response.Async = true
+			return &response, nil
+		}
+
+		response.Exists = true
+		return &response, nil
 	}
 
-	err = b.service.CreateCloudFrontDistribution(distributionID, callerReference, operationKey, serviceID, planID, &request.OrganizationGUID)
+	newUUID, _ := uuid.NewV4()
+	callerReference := newUUID.String()
+
+	operationKey := newOpKey("PRV")
+	respOpKey := osb.OperationKey(operationKey)
+	response.OperationKey = &respOpKey
+
+	response.Async = true
+
+	billingCode := params.BillingCode
+	if billingCode == "" {
+		billingCode = request.OrganizationGUID
+	}
+
+	instanceContext := service.NewInstanceContext(request.OrganizationGUID, request.SpaceGUID, request.Context)
+
+	log := requestLogger(c).With(logging.KeyInstanceID, distributionID, logging.KeyOperationKey, operationKey)
+	tracing.LinkOperation(requestContext(c), operationKey)
+
+	err = svc.CreateCloudFrontDistribution(distributionID, callerReference, operationKey, serviceID, planID, &billingCode, params, instanceContext, parametersHash)
 	if err != nil {
+		log.Error("provision failed", "error", err)
 		return nil, InternalServerErr()
 	}
 
+	log.Info("provision started", "plan_id", planID, "origin", params.OriginType)
+
 	return &response, nil
 }
 
@@ -183,6 +522,8 @@ func (b *BusinessLogic) Deprovision(request *osb.DeprovisionRequest, c *broker.R
 	b.Lock()
 	defer b.Unlock()
 
+	svc := b.requestService(c)
+
 	response := broker.DeprovisionResponse{}
 
 	if !request.AcceptsIncomplete {
@@ -195,7 +536,7 @@ func (b *BusinessLogic) Deprovision(request *osb.DeprovisionRequest, c *broker.R
 
 	distributionID := request.InstanceID
 
-	deployed, err := b.service.IsDeployedInstance(distributionID)
+	deployed, err := svc.IsDeployedInstance(distributionID)
 	if err != nil {
 		if err.Error() == "DistributionNotDeployed" {
 			return nil, UnprocessableEntityWithMessage("InstanceNotDeployed", "instance found but not deployed")
@@ -210,11 +551,17 @@ func (b *BusinessLogic) Deprovision(request *osb.DeprovisionRequest, c *broker.R
 	response.OperationKey = &respOpKey
 	response.Async = true
 
-	err = b.service.DeleteCloudFrontDistribution(distributionID, operationKey)
+	log := requestLogger(c).With(logging.KeyInstanceID, distributionID, logging.KeyOperationKey, operationKey)
+	tracing.LinkOperation(requestContext(c), operationKey)
+
+	err = svc.DeleteCloudFrontDistribution(distributionID, operationKey)
 	if err != nil {
+		log.Error("deprovision failed", "error", err)
 		return nil, InternalServerErr()
 	}
 
+	log.Info("deprovision started")
+
 	return &response, nil
 }
 
@@ -223,17 +570,19 @@ func (b *BusinessLogic) LastOperation(request *osb.LastOperationRequest, c *brok
 	b.Lock()
 	defer b.Unlock()
 
+	svc := b.requestService(c)
+
 	response := &broker.LastOperationResponse{}
 
 	if request.InstanceID == "" {
 		return nil, UnprocessableEntityWithMessage("InstanceRequired", "The instance ID was not provided.")
 	}
 
-	glog.V(0).Infof("LastOperation: instance id: %s", request.InstanceID)
+	requestLogger(c).Debug("last operation", logging.KeyInstanceID, request.InstanceID)
 
 	distributionID := request.InstanceID
 
-	found, err := b.service.IsDuplicateInstance(distributionID)
+	found, err := svc.IsDuplicateInstance(distributionID)
 
 	if err != nil {
 		return nil, BadRequestError(err.Error())
@@ -243,7 +592,7 @@ func (b *BusinessLogic) LastOperation(request *osb.LastOperationRequest, c *brok
 		return nil, BadRequestError("instance not found")
 	}
 
-	state, err := b.service.CheckLastOperation(distributionID)
+	state, err := svc.CheckLastOperation(distributionID)
 
 	if err != nil {
 		return nil, InternalServerErr()
@@ -302,13 +651,94 @@ func (b *BusinessLogic) Unbind(request *osb.UnbindRequest, c *broker.RequestCont
 	return nil, NotFoundWithMessage("BindingNotProvided", "Service un-binding is not provided")
 }
 
-// Update is not used
+// Update starts the process of applying changed parameters and plan to the instance
 func (b *BusinessLogic) Update(request *osb.UpdateInstanceRequest, c *broker.RequestContext) (*broker.UpdateInstanceResponse, error) {
-	// Your logic for updating a service goes here.
+	b.Lock()
+	defer b.Unlock()
+
+	svc := b.requestService(c)
+
 	response := broker.UpdateInstanceResponse{}
-	if request.AcceptsIncomplete {
-		response.Async = request.AcceptsIncomplete
+
+	if !request.AcceptsIncomplete {
+		return nil, UnprocessableEntityWithMessage("AsyncRequired", "The query parameter accepts_incomplete=true MUST be included the request.")
+	}
+
+	if request.InstanceID == "" {
+		return nil, UnprocessableEntityWithMessage("InstanceRequired", "The instance ID was not provided.")
+	}
+
+	distributionID := request.InstanceID
+
+	deployed, err := svc.IsDeployedInstance(distributionID)
+	if err != nil {
+		if err.Error() == "DistributionNotDeployed" {
+			return nil, UnprocessableEntityWithMessage("InstanceNotDeployed", "instance found but not deployed")
+		} else if err.Error() == "DistributionNotFound" {
+			return nil, NotFoundWithMessage("InstanceNotFound", "instance not found")
+		}
 	}
+	if !deployed {
+		return nil, UnprocessableEntityWithMessage("InstanceNotDeployed", "instance not deployed")
+	}
+
+	distribution, err := b.storage.GetDistribution(distributionID)
+	if err != nil {
+		return nil, InternalServerErrWithMessage("error getting instance", err.Error())
+	}
+
+	schemaPlanID := distribution.PlanID
+	if request.PlanID != nil && *request.PlanID != "" {
+		schemaPlanID = *request.PlanID
+	}
+
+	if err = b.validateParameters(schemaPlanID, request.Parameters); err != nil {
+		return nil, err
+	}
+
+	params, err := svc.MergeInstanceParameters(distributionID, request.Parameters)
+	if err != nil {
+		return nil, BadRequestError(err.Error())
+	}
+
+	planID := ""
+	if request.PlanID != nil {
+		params, planID, err = svc.ChangePlanParameters(distributionID, *request.PlanID, params)
+		if err != nil {
+			if _, ok := err.(*service.PlanChangeError); ok {
+				return nil, BadRequestError(err.Error())
+			}
+			return nil, InternalServerErrWithMessage("error checking plan change", err.Error())
+		}
+	}
+
+	if len(request.Parameters) == 0 && planID == "" {
+		return &response, nil
+	}
+
+	inProgress, err := svc.IsOperationInProgress(distributionID)
+	if err != nil {
+		return nil, InternalServerErrWithMessage("error checking instance", err.Error())
+	}
+	if inProgress {
+		return nil, UnprocessableEntityWithMessage("ConcurrencyError", "another operation for this instance is in progress")
+	}
+
+	operationKey := newOpKey("UPD")
+	respOpKey := osb.OperationKey(operationKey)
+	response.OperationKey = &respOpKey
+	response.Async = true
+
+	log := requestLogger(c).With(logging.KeyInstanceID, distributionID, logging.KeyOperationKey, operationKey)
+	tracing.LinkOperation(requestContext(c), operationKey)
+
+	err = svc.UpdateCloudFrontDistribution(distributionID, operationKey, planID, params)
+	if err != nil {
+		log.Error("update failed", "error", err)
+		return nil, InternalServerErr()
+	}
+
+	log.Info("update started", "plan_id", planID)
 
 	return &response, nil
 }
@@ -316,13 +746,15 @@ func (b *BusinessLogic) Update(request *osb.UpdateInstanceRequest, c *broker.Req
 // GetInstance returns information about an instance
 
 func (b *BusinessLogic) FetchInstance(r *GetInstanceRequest, c *broker.RequestContext) (*GetInstanceResponse, error) {
+	svc := b.requestService(c)
+
 	instanceID := r.InstanceID
 
 	if instanceID == "" {
 		return nil, UnprocessableEntityWithMessage("InstanceRequired", "The instance ID was not provided.")
 	}
 
-	deployed, err := b.service.IsDeployedInstance(instanceID)
+	deployed, err := svc.IsDeployedInstance(instanceID)
 	if err != nil {
 		if err.Error() == "DistributionNotDeployed" {
 			return nil, UnprocessableEntityWithMessage("InstanceNotDeployed", "instance found but not deployed")
@@ -334,7 +766,7 @@ func (b *BusinessLogic) FetchInstance(r *GetInstanceRequest, c *broker.RequestCo
 		return nil, UnprocessableEntityWithMessage("InstanceNotDeployed", "instance not deployed")
 	}
 
-	cloudFrontInstance, err := b.service.GetCloudFrontInstanceSpec(instanceID)
+	cloudFrontInstance, err := svc.GetCloudFrontInstanceSpec(instanceID)
 
 	if err != nil {
 		return nil, InternalServerErrWithMessage("ErrGettingInstance", err.Error())
@@ -353,11 +785,13 @@ func (b *BusinessLogic) FetchInstance(r *GetInstanceRequest, c *broker.RequestCo
 // GetBinding validates binding_id is in cf tags then returns credentials, see Bind()
 // func (b *BusinessLogic) GetBinding(instanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
 func (b *BusinessLogic) FetchBinding(r *osb.GetBindingRequest, c *broker.RequestContext) (*osb.GetBindingResponse, error) {
+	svc := b.requestService(c)
+
 	if r.InstanceID == "" {
 		return nil, UnprocessableEntityWithMessage("InstanceRequired", "The instance ID was not provided.")
 	}
 
-	deployed, err := b.service.IsDeployedInstance(r.InstanceID)
+	deployed, err := svc.IsDeployedInstance(r.InstanceID)
 	if err != nil {
 		if err.Error() == "DistributionNotDeployed" {
 			return nil, UnprocessableEntityWithMessage("InstanceNotDeployed", "instance found but not deployed")
@@ -371,7 +805,7 @@ func (b *BusinessLogic) FetchBinding(r *osb.GetBindingRequest, c *broker.Request
 
 	// TODO: check if binding id is in tags for cloudfront distribution
 
-	cloudFrontInstance, err := b.service.GetCloudFrontInstanceSpec(r.InstanceID)
+	cloudFrontInstance, err := svc.GetCloudFrontInstanceSpec(r.InstanceID)
 
 	if err != nil {
 		return nil, InternalServerErrWithMessage("ErrGettingInstance", err.Error())
@@ -408,9 +842,116 @@ func (b *BusinessLogic) ValidateBrokerAPIVersion(version string) error {
 	return nil
 }
 
-// RunTasksInBackground starts the background processing
+// RunTasksInBackground starts the background processing, it returns when ctx is done
+// and the running task action finished
 func (b *BusinessLogic) RunTasksInBackground(ctx context.Context) error {
-	b.service.RunTasks()
-	// This should never return
-	return errors.New("system error")
+	var wg sync.WaitGroup
+
+	if b.gcInterval > 0 {
+		logging.Root().Info("scanning for orphaned resources", "interval", b.gcInterval.String(), "apply", b.gcApply)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.service.RunGC(ctx, b.gcInterval, b.gcApply)
+		}()
+	}
+
+	if b.reconcileInterval > 0 {
+		logging.Root().Info("checking for drift", "interval", b.reconcileInterval.String(), "repair", b.reconcileRepair)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.service.RunReconcile(ctx, b.reconcileInterval, b.reconcileRepair)
+		}()
+	}
+
+	if b.service.WebhooksEnabled() {
+		logging.Root().Info("delivering webhooks")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.service.RunWebhooks(ctx)
+		}()
+	}
+
+	b.service.RunTasks(ctx, b.shutdownTimeout)
+
+	// a running scan is given the rest of the shutdown time
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(b.shutdownTimeout):
+		logging.Root().Warn("stopped waiting for the running scan")
+	}
+
+	return ctx.Err()
+}
+
+// ShutdownTimeout returns how long a shutdown waits for requests and the running task action
+func (b *BusinessLogic) ShutdownTimeout() time.Duration {
+	return b.shutdownTimeout
+}
+
+// Close closes the database, nothing may use the business logic afterwards
+func (b *BusinessLogic) Close() error {
+	return b.storage.Close()
+}
+
+// Metrics returns the collector of the task and aws api call metrics
+func (b *BusinessLogic) Metrics() prom.Collector {
+	return b.service.Metrics()
+}
+
+// CollectGarbage reports the orphaned aws resources, they are deleted when apply is set
+func (b *BusinessLogic) CollectGarbage(ctx context.Context, apply bool) (*service.GCReport, error) {
+	return b.service.CollectGarbage(ctx, apply)
+}
+
+// ImportDistribution adopts an existing cloudfront distribution as a new instance
+func (b *BusinessLogic) ImportDistribution(ctx context.Context, req *service.ImportRequest) (*service.ImportResult, error) {
+	return b.service.ImportDistribution(ctx, req)
+}
+
+// ListInstances returns a page of the instances matching the filter
+func (b *BusinessLogic) ListInstances(filter *storage.DistributionFilter) (*service.InstanceList, error) {
+	return b.service.ListInstances(filter)
+}
+
+// GetInstanceDetail returns the instance with its origins and task history
+func (b *BusinessLogic) GetInstanceDetail(instanceID string) (*service.InstanceDetail, error) {
+	return b.service.GetInstanceDetail(instanceID)
+}
+
+// ListTasks returns the latest tasks with the status
+func (b *BusinessLogic) ListTasks(status string, limit int) ([]service.TaskView, error) {
+	return b.service.ListTasks(status, limit)
+}
+
+// RetryTask runs a failed or canceled task again
+func (b *BusinessLogic) RetryTask(taskID string) (*service.TaskView, error) {
+	return b.service.RetryTask(taskID)
+}
+
+// CancelTask stops a new or pending task
+func (b *BusinessLogic) CancelTask(taskID string) (*service.TaskView, error) {
+	return b.service.CancelTask(taskID)
+}
+
+// FailTask marks a new or pending task as failed
+func (b *BusinessLogic) FailTask(taskID string, reason string) (*service.TaskView, error) {
+	return b.service.FailTask(taskID, reason)
+}
+
+// GetTaskAuditEvents returns the action attempts of the task
+func (b *BusinessLogic) GetTaskAuditEvents(taskID string) ([]service.TaskAuditEventView, error) {
+	return b.service.GetTaskAuditEvents(taskID)
+}
+
+// GetInstanceAuditEvents returns the latest action attempts of the tasks of the instance
+func (b *BusinessLogic) GetInstanceAuditEvents(instanceID string, limit int) ([]service.TaskAuditEventView, error) {
+	return b.service.GetInstanceAuditEvents(instanceID, limit)
 }
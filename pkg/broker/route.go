@@ -4,7 +4,8 @@ import (
 	"encoding/json"
 	"net/http"
 
-	"github.com/golang/glog"
+	"cloudfront-broker/pkg/logging"
+
 	"github.com/gorilla/mux"
 	osb "github.com/pmorie/go-open-service-broker-client/v2"
 	"github.com/pmorie/osb-broker-lib/pkg/broker"
@@ -22,6 +23,19 @@ func httpWrite(w http.ResponseWriter, status int, obj interface{}) {
 	w.Write(data)
 }
 
+// httpWriteError writes the osb error with its status, other errors as internal server errors
+func httpWriteError(w http.ResponseWriter, err error) {
+	if httpErr, ok := osb.IsHTTPError(err); ok {
+		body := &errorSpec{
+			Description:  httpErr.Description,
+			ErrorMessage: httpErr.ErrorMessage,
+		}
+		httpWrite(w, httpErr.StatusCode, body)
+	} else {
+		httpWrite(w, http.StatusInternalServerError, InternalServerErr())
+	}
+}
+
 func (b *BusinessLogic) addOSBFetchInstance(router *mux.Router) {
 	router.HandleFunc("/v2/service_instances/{instance_id}", func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
@@ -35,20 +49,12 @@ func (b *BusinessLogic) addOSBFetchInstance(router *mux.Router) {
 			Request: r,
 		}
 
-		glog.V(4).Infof("Received FetchInstanceRequest for instanceID %q", req.InstanceID)
+		logging.FromContext(r.Context()).Debug("fetch instance request")
 
 		resp, err := b.FetchInstance(&req, c)
 
 		if err != nil {
-			if httpErr, ok := osb.IsHTTPError(err); ok {
-				body := &errorSpec{
-					Description:  httpErr.Description,
-					ErrorMessage: httpErr.ErrorMessage,
-				}
-				httpWrite(w, httpErr.StatusCode, body)
-			} else {
-				httpWrite(w, http.StatusInternalServerError, InternalServerErr())
-			}
+			httpWriteError(w, err)
 			return
 		}
 		httpWrite(w, http.StatusOK, resp)
@@ -69,20 +75,12 @@ func (b *BusinessLogic) addOSBFetchBindingRoute(router *mux.Router) {
 			Request: r,
 		}
 
-		glog.V(4).Infof("Received FetchBindRequest for instanceID %q, bindingID %q", req.InstanceID, req.BindingID)
+		logging.FromContext(r.Context()).Debug("fetch binding request", "binding_id", req.BindingID)
 
 		resp, err := b.FetchBinding(&req, c)
 
 		if err != nil {
-			if httpErr, ok := osb.IsHTTPError(err); ok {
-				body := &errorSpec{
-					Description:  httpErr.Description,
-					ErrorMessage: httpErr.ErrorMessage,
-				}
-				httpWrite(w, httpErr.StatusCode, body)
-			} else {
-				httpWrite(w, http.StatusInternalServerError, InternalServerErr())
-			}
+			httpWriteError(w, err)
 			return
 		}
 		httpWrite(w, http.StatusOK, resp)
@@ -93,4 +91,5 @@ func (b *BusinessLogic) addOSBFetchBindingRoute(router *mux.Router) {
 func (b *BusinessLogic) AddRoutes(router *mux.Router) {
 	b.addOSBFetchInstance(router)
 	b.addOSBFetchBindingRoute(router)
+	b.addOSBInstanceEventsRoute(router)
 }
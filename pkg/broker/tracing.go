@@ -0,0 +1,49 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"cloudfront-broker/pkg/service"
+	"cloudfront-broker/pkg/tracing"
+
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// InitTracing exports the spans to the OTLP collector of -otlp-endpoint, or of the
+// OTEL_EXPORTER_OTLP_* variables read by the exporter, tracing is disabled without either
+func InitTracing(ctx context.Context, o Options) (func(context.Context) error, error) {
+	shutdown, err := tracing.Init(ctx, o.OTLPEndpoint, "cloudfront-broker")
+	if err != nil {
+		return nil, errors.New("unable to export traces, check -otlp-endpoint on the cli or OTEL_EXPORTER_OTLP_ENDPOINT in environment: " + err.Error())
+	}
+	return shutdown, nil
+}
+
+// requestContext returns the context of the osb request
+func requestContext(c *broker.RequestContext) context.Context {
+	if c == nil || c.Request == nil {
+		return context.Background()
+	}
+	return c.Request.Context()
+}
+
+// requestService returns the service making its aws api calls and queries in the
+// span of the osb request
+func (b *BusinessLogic) requestService(c *broker.RequestContext) *service.AwsConfig {
+	return b.service.WithContext(requestContext(c))
+}
+
+// TraceRequests starts a span for each request, probes and scrapes are not traced
+func TraceRequests(next http.Handler) http.Handler {
+	traced := tracing.Middleware(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case HealthPath, ReadinessPath, "/metrics":
+			next.ServeHTTP(w, r)
+		default:
+			traced.ServeHTTP(w, r)
+		}
+	})
+}
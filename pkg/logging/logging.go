@@ -0,0 +1,110 @@
+// Package logging writes structured log lines with log/slog, as json or as key=value text, with
+// the fields correlating a line with an osb request, an instance, an operation and a task.
+//
+// Loggers with more fields are made with With and passed along in a context with NewContext
+// and FromContext, or added to the logger of a context with WithContext.
+package logging
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Keys of the correlation fields
+const (
+	KeyRequestID    = "request_id"
+	KeyInstanceID   = "instance_id"
+	KeyOperationKey = "operation_key"
+	KeyTaskID       = "task_id"
+	KeyAction       = "action"
+	KeyAWSRequestID = "aws_request_id"
+)
+
+// Output formats
+const (
+	FormatText string = "text"
+	FormatJSON string = "json"
+)
+
+// Logger writes log lines with its fields
+type Logger = slog.Logger
+
+var (
+	level            = new(slog.LevelVar)
+	output io.Writer = os.Stderr
+	root   atomic.Pointer[Logger]
+)
+
+func init() {
+	root.Store(newLogger(FormatText))
+}
+
+// newLogger returns a logger writing to the output in the format, at the configured level
+func newLogger(format string) *Logger {
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: lowerLevel}
+	if format == FormatJSON {
+		return slog.New(slog.NewJSONHandler(output, opts))
+	}
+	return slog.New(slog.NewTextHandler(output, opts))
+}
+
+// lowerLevel writes the level names in lower case, as the broker always logged them
+func lowerLevel(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.LevelKey && len(groups) == 0 {
+		a.Value = slog.StringValue(strings.ToLower(a.Value.String()))
+	}
+	return a
+}
+
+// Configure sets the format and level of the root logger, it is called at startup
+// before loggers are made from the root logger
+func Configure(format string, lvl string) error {
+	if format != FormatText && format != FormatJSON {
+		return errors.New("log format must be " + FormatText + " or " + FormatJSON)
+	}
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(lvl)); err != nil {
+		return errors.New("unknown log level " + lvl + ", use one of debug, info, warn, error")
+	}
+
+	level.Set(l)
+	root.Store(newLogger(format))
+	return nil
+}
+
+// SetOutput sets where the loggers made by the next Configure write
+func SetOutput(w io.Writer) {
+	output = w
+}
+
+// Root returns the logger without fields
+func Root() *Logger {
+	return root.Load()
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying the logger
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the logger of the context, the root logger when it carries none
+func FromContext(ctx context.Context) *Logger {
+	if ctx != nil {
+		if l, ok := ctx.Value(contextKey{}).(*Logger); ok {
+			return l
+		}
+	}
+	return Root()
+}
+
+// WithContext returns a context carrying the logger of ctx with the fields added
+func WithContext(ctx context.Context, keyvals ...interface{}) context.Context {
+	return NewContext(ctx, FromContext(ctx).With(keyvals...))
+}
@@ -0,0 +1,64 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLogging(t *testing.T) {
+	Convey("Structured logs", t, func() {
+		var buf bytes.Buffer
+		SetOutput(&buf)
+		logger := func() *Logger {
+			return Root().With(KeyInstanceID, "inst-1", KeyOperationKey, "PRV1234")
+		}
+
+		Convey("are written as json with the logger fields", func() {
+			So(Configure(FormatJSON, "info"), ShouldBeNil)
+			logger().Error("action failed", "error", errors.New("access denied"))
+
+			line := map[string]interface{}{}
+			So(json.Unmarshal(buf.Bytes(), &line), ShouldBeNil)
+			So(line["level"], ShouldEqual, "error")
+			So(line["msg"], ShouldEqual, "action failed")
+			So(line[KeyInstanceID], ShouldEqual, "inst-1")
+			So(line[KeyOperationKey], ShouldEqual, "PRV1234")
+			So(line["error"], ShouldEqual, "access denied")
+		})
+
+		Convey("are written as key value text, quoting values with spaces", func() {
+			So(Configure(FormatText, "info"), ShouldBeNil)
+			logger().Info("provision started", "plan_id", "plan 1")
+			So(buf.String(), ShouldContainSubstring, `level=info msg="provision started" instance_id=inst-1 operation_key=PRV1234 plan_id="plan 1"`)
+			So(strings.HasSuffix(buf.String(), "\n"), ShouldBeTrue)
+		})
+
+		Convey("drop lines below the level", func() {
+			So(Configure(FormatText, "warn"), ShouldBeNil)
+			logger().Info("not written")
+			So(buf.Len(), ShouldEqual, 0)
+		})
+
+		Convey("reject unknown formats and levels", func() {
+			So(Configure("xml", "info"), ShouldNotBeNil)
+			So(Configure(FormatText, "verbose"), ShouldNotBeNil)
+		})
+
+		Convey("are carried in a context", func() {
+			So(FromContext(context.Background()), ShouldEqual, Root())
+			log := logger()
+			So(FromContext(NewContext(context.Background(), log)), ShouldEqual, log)
+			So(FromContext(WithContext(context.Background(), KeyTaskID, "42")), ShouldNotEqual, Root())
+		})
+
+		Reset(func() {
+			_ = Configure(FormatText, "info")
+		})
+	})
+}
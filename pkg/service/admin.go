@@ -0,0 +1,297 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"cloudfront-broker/pkg/logging"
+	"cloudfront-broker/pkg/storage"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// Page sizes of ListInstances
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 500
+)
+
+// InstanceSummary is an instance in the instance list of the admin api
+type InstanceSummary struct {
+	InstanceID    string     `json:"instance_id"`
+	ServiceID     string     `json:"service_id"`
+	PlanID        string     `json:"plan_id"`
+	Status        string     `json:"status"`
+	OriginType    string     `json:"origin_type"`
+	BillingCode   string     `json:"billingcode,omitempty"`
+	CloudfrontID  string     `json:"cloudfront_id,omitempty"`
+	CloudfrontURL string     `json:"cloudfront_url,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	DeletedAt     *time.Time `json:"deleted_at,omitempty"`
+}
+
+// InstanceList is a page of instances, Total counts all instances matching the filter
+type InstanceList struct {
+	Instances []InstanceSummary `json:"instances"`
+	Total     int               `json:"total"`
+	Limit     int               `json:"limit"`
+	Offset    int               `json:"offset"`
+}
+
+// OriginView is an origin of an instance, the access keys are left out
+type OriginView struct {
+	OriginID   string     `json:"origin_id"`
+	BucketName string     `json:"bucket_name"`
+	BucketURL  string     `json:"bucket_url"`
+	OriginPath string     `json:"origin_path"`
+	IAMUser    string     `json:"iam_user,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	DeletedAt  *time.Time `json:"deleted_at,omitempty"`
+}
+
+// TaskView is a task of an instance
+type TaskView struct {
+	TaskID         string       `json:"task_id"`
+	DistributionID string       `json:"instance_id"`
+	OperationKey   string       `json:"operation_key,omitempty"`
+	Action         string       `json:"action"`
+	Status         string       `json:"status"`
+	Retries        int          `json:"retries"`
+	Result         string       `json:"result,omitempty"`
+	Metadata       string       `json:"metadata,omitempty"`
+	Context        *TaskContext `json:"context,omitempty"`
+	CreatedAt      time.Time    `json:"created_at"`
+	UpdatedAt      time.Time    `json:"updated_at"`
+	StartedAt      *time.Time   `json:"started_at,omitempty"`
+	FinishedAt     *time.Time   `json:"finished_at,omitempty"`
+}
+
+// InstanceDetail is an instance with its origins and task history, newest task first
+type InstanceDetail struct {
+	InstanceSummary
+	OriginAccessIdentity string              `json:"origin_access_identity,omitempty"`
+	Parameters           *InstanceParameters `json:"parameters,omitempty"`
+	Context              *InstanceContext    `json:"context,omitempty"`
+	Origins              []OriginView        `json:"origins"`
+	Tasks                []TaskView          `json:"tasks"`
+}
+
+// TaskStateError is returned when a task is not in a state that allows the requested change
+type TaskStateError struct {
+	Reason string
+}
+
+func (e *TaskStateError) Error() string {
+	return e.Reason
+}
+
+func nullTimePtr(t pq.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func newInstanceSummary(d *storage.Distribution) InstanceSummary {
+	return InstanceSummary{
+		InstanceID:    d.DistributionID,
+		ServiceID:     d.ServiceID,
+		PlanID:        d.PlanID,
+		Status:        d.Status,
+		OriginType:    d.OriginType,
+		BillingCode:   d.BillingCode.String,
+		CloudfrontID:  d.CloudfrontID.String,
+		CloudfrontURL: d.CloudfrontURL.String,
+		CreatedAt:     d.CreatedAt,
+		UpdatedAt:     d.UpdatedAt,
+		DeletedAt:     nullTimePtr(d.DeletedAt),
+	}
+}
+
+func newTaskView(t *storage.Task) TaskView {
+	view := TaskView{
+		TaskID:         t.TaskID,
+		DistributionID: t.DistributionID,
+		OperationKey:   t.OperationKey.String,
+		Action:         t.Action,
+		Status:         t.Status,
+		Retries:        t.Retries,
+		Result:         t.Result.String,
+		Metadata:       t.Metadata.String,
+		CreatedAt:      t.CreatedAt,
+		UpdatedAt:      t.UpdatedAt,
+		StartedAt:      nullTimePtr(t.StartedAt),
+		FinishedAt:     nullTimePtr(t.FinishedAt),
+	}
+	if t.Context.Valid {
+		view.Context, _ = getTaskContext(t)
+	}
+	return view
+}
+
+// NewAdmin returns a service for the instance and task methods of the admin api, they only
+// use the database so it needs no aws configuration
+func NewAdmin(stg *storage.PostgresStorage) *AwsConfig {
+	return &AwsConfig{stg: stg}
+}
+
+// ListInstances returns a page of the instances matching the filter, newest first
+func (s *AwsConfig) ListInstances(filter *storage.DistributionFilter) (*InstanceList, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = DefaultPageSize
+	}
+	if filter.Limit > MaxPageSize {
+		filter.Limit = MaxPageSize
+	}
+	if filter.Offset < 0 {
+		filter.Offset = 0
+	}
+
+	distributions, total, err := s.stg.ListDistributions(filter)
+	if err != nil {
+		msg := fmt.Sprintf("ListInstances: %s", err.Error())
+		logging.Root().Error(msg)
+		return nil, errors.New(msg)
+	}
+
+	list := &InstanceList{
+		Instances: []InstanceSummary{},
+		Total:     total,
+		Limit:     filter.Limit,
+		Offset:    filter.Offset,
+	}
+	for i := range distributions {
+		list.Instances = append(list.Instances, newInstanceSummary(&distributions[i]))
+	}
+
+	return list, nil
+}
+
+// GetInstanceDetail returns the instance, deleted or not, with its origins and task history
+func (s *AwsConfig) GetInstanceDetail(distributionID string) (*InstanceDetail, error) {
+	distribution, err := s.stg.GetDistributionWithDeleted(distributionID)
+	if err != nil {
+		return nil, err
+	}
+
+	detail := &InstanceDetail{
+		InstanceSummary:      newInstanceSummary(distribution),
+		OriginAccessIdentity: distribution.OriginAccessIdentity.String,
+		Origins:              []OriginView{},
+		Tasks:                []TaskView{},
+	}
+
+	if distribution.Parameters.Valid {
+		detail.Parameters = &InstanceParameters{}
+		_ = json.Unmarshal([]byte(distribution.Parameters.String), detail.Parameters)
+	}
+	if distribution.Context.Valid {
+		detail.Context = &InstanceContext{}
+		_ = json.Unmarshal([]byte(distribution.Context.String), detail.Context)
+	}
+
+	origins, err := s.stg.GetOrigins(distributionID)
+	if err != nil {
+		msg := fmt.Sprintf("GetInstanceDetail: %s", err.Error())
+		logging.Root().Error(msg)
+		return nil, errors.New(msg)
+	}
+	for _, o := range origins {
+		detail.Origins = append(detail.Origins, OriginView{
+			OriginID:   o.OriginID,
+			BucketName: o.BucketName,
+			BucketURL:  o.BucketURL,
+			OriginPath: o.OriginPath,
+			IAMUser:    o.IAMUser.String,
+			CreatedAt:  o.CreatedAt,
+			DeletedAt:  nullTimePtr(o.DeletedAt),
+		})
+	}
+
+	tasks, err := s.stg.GetTaskHistory(distributionID)
+	if err != nil {
+		msg := fmt.Sprintf("GetInstanceDetail: %s", err.Error())
+		logging.Root().Error(msg)
+		return nil, errors.New(msg)
+	}
+	for i := range tasks {
+		detail.Tasks = append(detail.Tasks, newTaskView(&tasks[i]))
+	}
+
+	return detail, nil
+}
+
+// ListTasks returns the latest tasks with the status, or of all statuses when status is blank
+func (s *AwsConfig) ListTasks(status string, limit int) ([]TaskView, error) {
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+
+	tasks, err := s.stg.ListTasks(status, limit)
+	if err != nil {
+		msg := fmt.Sprintf("ListTasks: %s", err.Error())
+		logging.Root().Error(msg)
+		return nil, errors.New(msg)
+	}
+
+	views := []TaskView{}
+	for i := range tasks {
+		views = append(views, newTaskView(&tasks[i]))
+	}
+
+	return views, nil
+}
+
+// taskChanged turns the TaskNotChanged error of the storage into a TaskStateError
+func taskChanged(task *storage.Task, err error, reason string) (*TaskView, error) {
+	if err != nil {
+		if err.Error() == storage.TaskNotChanged {
+			return nil, &TaskStateError{Reason: reason}
+		}
+		return nil, err
+	}
+
+	view := newTaskView(task)
+	return &view, nil
+}
+
+// RetryTask runs a failed or canceled task again from the action it stopped at,
+// only the latest task of an instance can be retried
+func (s *AwsConfig) RetryTask(taskID string) (*TaskView, error) {
+	task, err := s.stg.GetTask(taskID)
+	if err != nil {
+		return nil, err
+	}
+
+	latest, err := s.stg.GetTaskByDistribution(task.DistributionID)
+	if err != nil {
+		return nil, err
+	}
+	if latest.TaskID != task.TaskID {
+		return nil, &TaskStateError{Reason: "only the latest task of an instance can be retried"}
+	}
+
+	task, err = s.stg.RetryTask(taskID, OperationInProgress)
+	return taskChanged(task, err, "only failed or canceled tasks can be retried")
+}
+
+// CancelTask stops a new or pending task, the action it stopped at is kept so it can be retried
+func (s *AwsConfig) CancelTask(taskID string) (*TaskView, error) {
+	task, err := s.stg.CancelTask(taskID)
+	return taskChanged(task, err, "only new or pending tasks can be canceled")
+}
+
+// FailTask marks a new or pending task as failed with the reason
+func (s *AwsConfig) FailTask(taskID string, reason string) (*TaskView, error) {
+	if reason == "" {
+		reason = "failed by operator"
+	}
+	task, err := s.stg.FailTask(taskID, reason)
+	return taskChanged(task, err, "only new or pending tasks can be failed")
+}
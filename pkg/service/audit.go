@@ -0,0 +1,165 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"cloudfront-broker/pkg/logging"
+	"cloudfront-broker/pkg/storage"
+)
+
+// TaskAuditEventView is an action attempt of a task in the admin api
+type TaskAuditEventView struct {
+	EventID        string            `json:"event_id"`
+	TaskID         string            `json:"task_id"`
+	DistributionID string            `json:"instance_id"`
+	OperationKey   string            `json:"operation_key,omitempty"`
+	Action         string            `json:"action"`
+	NextAction     string            `json:"next_action"`
+	Status         string            `json:"status"`
+	Retries        int               `json:"retries"`
+	Error          string            `json:"error,omitempty"`
+	Resources      map[string]string `json:"resources,omitempty"`
+	StartedAt      time.Time         `json:"started_at"`
+	FinishedAt     time.Time         `json:"finished_at"`
+	DurationMS     int64             `json:"duration_ms"`
+}
+
+func newTaskAuditEventView(e *storage.TaskAuditEvent) TaskAuditEventView {
+	return TaskAuditEventView{
+		EventID:        e.EventID,
+		TaskID:         e.TaskID,
+		DistributionID: e.DistributionID,
+		OperationKey:   e.OperationKey.String,
+		Action:         e.Action,
+		NextAction:     e.NextAction,
+		Status:         e.Status,
+		Retries:        e.Retries,
+		Error:          e.Error.String,
+		Resources:      e.Resources,
+		StartedAt:      e.StartedAt,
+		FinishedAt:     e.FinishedAt,
+		DurationMS:     e.FinishedAt.Sub(e.StartedAt).Milliseconds(),
+	}
+}
+
+func strValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// actionResources returns the ids of the aws resources the action created, nil when it created none
+func actionResources(action string, cf *cloudFrontInstance) map[string]string {
+	if cf == nil {
+		return nil
+	}
+
+	resources := map[string]string{}
+	switch action {
+	case actionCreateOrigin:
+		if cf.s3Bucket != nil {
+			resources["bucket"] = strValue(cf.s3Bucket.bucketName)
+		}
+	case actionCreateIAMUser:
+		if cf.s3Bucket != nil && cf.s3Bucket.iAMUser != nil {
+			resources["iam_user"] = strValue(cf.s3Bucket.iAMUser.userName)
+			resources["iam_user_arn"] = strValue(cf.s3Bucket.iAMUser.arn)
+		}
+	case actionCreateAccessKey:
+		if cf.s3Bucket != nil && cf.s3Bucket.iAMUser != nil {
+			resources["access_key_id"] = strValue(cf.s3Bucket.iAMUser.accessKey)
+		}
+	case actionCreateOriginAccessIdentity:
+		resources["origin_access_identity"] = strValue(cf.originAccessIdentity)
+	case actionCreateDistribution:
+		resources["cloudfront_id"] = strValue(cf.cloudfrontID)
+		resources["cloudfront_url"] = strValue(cf.cloudfrontURL)
+	}
+
+	for k, v := range resources {
+		if v == "" {
+			delete(resources, k)
+		}
+	}
+	if len(resources) == 0 {
+		return nil
+	}
+	return resources
+}
+
+// recordAttempt adds the attempt of the action ran to the audit log of the task, the resources are
+// only recorded when the action finished without error. A failure to record does not stop the task.
+func (svc *AwsConfig) recordAttempt(task *storage.Task, ran string, retries int, started time.Time, cf *cloudFrontInstance, actionErr error) {
+	event := &storage.TaskAuditEvent{
+		TaskID:         task.TaskID,
+		DistributionID: task.DistributionID,
+		OperationKey:   task.OperationKey,
+		Action:         ran,
+		NextAction:     task.Action,
+		Status:         task.Status,
+		Retries:        retries,
+		StartedAt:      started,
+		FinishedAt:     time.Now(),
+	}
+
+	switch {
+	case actionErr != nil:
+		event.Error = storage.SetNullString(actionErr.Error())
+	case task.Status == statusFailed:
+		event.Error = storage.SetNullString(task.Description())
+	case task.Action != ran:
+		event.Resources = actionResources(ran, cf)
+	}
+
+	if err := svc.stg.AddTaskAuditEvent(event); err != nil {
+		logging.Root().Error("error recording attempt", "error", err)
+	}
+}
+
+// GetTaskAuditEvents returns the action attempts of the task in the order they ran
+func (svc *AwsConfig) GetTaskAuditEvents(taskID string) ([]TaskAuditEventView, error) {
+	events, err := svc.stg.GetTaskAuditEvents(taskID)
+	if err != nil {
+		if err.Error() == storage.TaskNotFound {
+			return nil, err
+		}
+		msg := fmt.Sprintf("GetTaskAuditEvents: %s", err.Error())
+		logging.Root().Error(msg)
+		return nil, errors.New(msg)
+	}
+
+	views := []TaskAuditEventView{}
+	for i := range events {
+		views = append(views, newTaskAuditEventView(&events[i]))
+	}
+	return views, nil
+}
+
+// GetInstanceAuditEvents returns the latest action attempts of all tasks of the instance, newest first
+func (svc *AwsConfig) GetInstanceAuditEvents(distributionID string, limit int) ([]TaskAuditEventView, error) {
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+
+	events, err := svc.stg.GetDistributionAuditEvents(distributionID, limit)
+	if err != nil {
+		if err.Error() == storage.DistributionNotFound {
+			return nil, err
+		}
+		msg := fmt.Sprintf("GetInstanceAuditEvents: %s", err.Error())
+		logging.Root().Error(msg)
+		return nil, errors.New(msg)
+	}
+
+	views := []TaskAuditEventView{}
+	for i := range events {
+		views = append(views, newTaskAuditEventView(&events[i]))
+	}
+	return views, nil
+}
@@ -0,0 +1,38 @@
+package service
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestActionResources(t *testing.T) {
+	Convey("Action resources", t, func() {
+		bucket, user, arn, key := "cf-bucket", "cf-user", "arn:aws:iam::123456789012:user/cf-user", "AKIAEXAMPLE"
+		cfID, cfURL, oai := "E2EXAMPLE", "d111111abcdef8.cloudfront.net", "E3OAIEXAMPLE"
+		cf := &cloudFrontInstance{
+			cloudfrontID:         &cfID,
+			cloudfrontURL:        &cfURL,
+			originAccessIdentity: &oai,
+			s3Bucket: &s3Bucket{
+				bucketName: &bucket,
+				iAMUser:    &iAMUser{userName: &user, arn: &arn, accessKey: &key},
+			},
+		}
+
+		Convey("are the ids the create actions made", func() {
+			So(actionResources(actionCreateOrigin, cf), ShouldResemble, map[string]string{"bucket": bucket})
+			So(actionResources(actionCreateIAMUser, cf), ShouldResemble, map[string]string{"iam_user": user, "iam_user_arn": arn})
+			So(actionResources(actionCreateAccessKey, cf), ShouldResemble, map[string]string{"access_key_id": key})
+			So(actionResources(actionCreateOriginAccessIdentity, cf), ShouldResemble, map[string]string{"origin_access_identity": oai})
+			So(actionResources(actionCreateDistribution, cf), ShouldResemble, map[string]string{"cloudfront_id": cfID, "cloudfront_url": cfURL})
+		})
+
+		Convey("are nil for other actions and missing ids", func() {
+			So(actionResources(actionIsDistributionDeployed, cf), ShouldBeNil)
+			So(actionResources(actionCreateIAMUser, &cloudFrontInstance{s3Bucket: &s3Bucket{}}), ShouldBeNil)
+			So(actionResources(actionCreateDistribution, &cloudFrontInstance{}), ShouldBeNil)
+			So(actionResources(actionCreateOrigin, nil), ShouldBeNil)
+		})
+	})
+}
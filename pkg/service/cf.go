@@ -1,10 +1,15 @@
 package service
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"strings"
 
-	"github.com/golang/glog"
+	"cloudfront-broker/pkg/logging"
+	"cloudfront-broker/pkg/storage"
+
 	"github.com/pkg/errors"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -18,8 +23,6 @@ const ttl int64 = 2592000
 
 // IsDuplicateInstance checks if distribution id already created
 func (s *AwsConfig) IsDuplicateInstance(distributionID string) (bool, error) {
-	glog.V(4).Info(" ===== IsDuplicateInstance =====")
-
 	_, err := s.stg.GetDistributionWithDeleted(distributionID)
 
 	if err != nil {
@@ -33,10 +36,44 @@ func (s *AwsConfig) IsDuplicateInstance(distributionID string) (bool, error) {
 	return true, err
 }
 
+// CheckRepeatedProvision compares a provision request with the instance stored under the same id,
+// the service id is the one the instance was provisioned with. It returns nil when there is no such instance
+func (s *AwsConfig) CheckRepeatedProvision(distributionID string, serviceID string, planID string, parametersHash string) (*RepeatedProvision, error) {
+	dist, err := s.stg.GetDistributionWithDeleted(distributionID)
+	if err != nil {
+		if err.Error() == "DistributionNotFound" {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	repeated := &RepeatedProvision{}
+
+	if dist.DeletedAt.Valid || dist.ServiceID != serviceID || dist.PlanID != planID ||
+		!dist.ParametersHash.Valid || dist.ParametersHash.String != parametersHash {
+		return repeated, nil
+	}
+
+	task, err := s.stg.GetTaskByDistribution(distributionID)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case (task.Status == statusNew || task.Status == statusPending) && strings.HasPrefix(task.OperationKey.String, "PRV"):
+		repeated.Identical = true
+		repeated.InProgress = true
+		repeated.OperationKey = task.OperationKey.String
+	case dist.Status == statusDeployed:
+		repeated.Identical = true
+	}
+
+	// a failed provision is not identical to the request, it conflicts until deprovisioned
+	return repeated, nil
+}
+
 // IsDeployedInstance checks if distribution has been fully deployed
 func (s *AwsConfig) IsDeployedInstance(distributionID string) (bool, error) {
-	glog.V(4).Infof("===== IsDeployedInstance =====")
-
 	dist, err := s.stg.GetDistributionWithDeleted(distributionID)
 
 	if err != nil {
@@ -56,7 +93,7 @@ func (s *AwsConfig) getCloudfrontInstance(distributionID string) (*cloudFrontIns
 
 	if err != nil {
 		msg := fmt.Sprintf("getCloudfrontInstance: error finding distribution: %s", err.Error())
-		glog.Error(msg)
+		logging.Root().Error(msg)
 		return nil, errors.New(msg)
 	}
 
@@ -69,6 +106,29 @@ func (s *AwsConfig) getCloudfrontInstance(distributionID string) (*cloudFrontIns
 		cloudfrontURL:        s.stg.NullString(distribution.CloudfrontURL),
 		originAccessIdentity: s.stg.NullString(distribution.OriginAccessIdentity),
 		callerReference:      &distribution.CallerReference,
+		originType:           distribution.OriginType,
+		parameters:           &InstanceParameters{OriginType: distribution.OriginType},
+	}
+
+	if distribution.Parameters.Valid {
+		if err = json.Unmarshal([]byte(distribution.Parameters.String), cf.parameters); err != nil {
+			msg := fmt.Sprintf("getCloudfrontInstance: error decoding parameters: %s", err.Error())
+			logging.Root().Error(msg)
+			return nil, errors.New(msg)
+		}
+	}
+
+	if distribution.Context.Valid {
+		cf.context = &InstanceContext{}
+		if err = json.Unmarshal([]byte(distribution.Context.String), cf.context); err != nil {
+			msg := fmt.Sprintf("getCloudfrontInstance: error decoding context: %s", err.Error())
+			logging.Root().Error(msg)
+			return nil, errors.New(msg)
+		}
+	}
+
+	if cf.isCustomOrigin() {
+		return cf, nil
 	}
 
 	origin, err := s.stg.GetOriginByDistributionID(*cf.distributionID)
@@ -89,47 +149,120 @@ func (s *AwsConfig) getCloudfrontInstance(distributionID string) (*cloudFrontIns
 	return cf, nil
 }
 
+// GetPlanSettings reads the settings stored with the plan, a plan without settings gets the defaults
+func (s *AwsConfig) GetPlanSettings(planID string) (*PlanSettings, error) {
+	plan, err := s.stg.GetPlan(planID)
+	if err != nil {
+		msg := fmt.Sprintf("GetPlanSettings: error getting plan: %s", err.Error())
+		logging.Root().Error(msg)
+		return nil, errors.New(msg)
+	}
+
+	settings := &PlanSettings{}
+	if plan.Settings.Valid && plan.Settings.String != "" {
+		if err = json.Unmarshal([]byte(plan.Settings.String), settings); err != nil {
+			msg := fmt.Sprintf("GetPlanSettings: error decoding settings for plan %s: %s", plan.Name, err.Error())
+			logging.Root().Error(msg)
+			return nil, errors.New(msg)
+		}
+	}
+
+	return settings, nil
+}
+
+// ValidateCatalog checks the settings of each plan in the catalog are known to the broker
+// and the parameter schemas can be used to validate requests
+func ValidateCatalog(catalog *storage.Catalog) error {
+	for _, service := range catalog.Services {
+		for _, plan := range service.Plans {
+			if plan.Parameters != nil {
+				if err := validateSchemaDocument(plan.Parameters); err != nil {
+					return fmt.Errorf("plan %s parameters: %s", plan.Name, err.Error())
+				}
+			}
+
+			if plan.Settings == nil {
+				continue
+			}
+
+			settingsb, err := json.Marshal(plan.Settings)
+			if err != nil {
+				return fmt.Errorf("plan %s settings: %s", plan.Name, err.Error())
+			}
+
+			settings := &PlanSettings{}
+			decoder := json.NewDecoder(bytes.NewReader(settingsb))
+			decoder.DisallowUnknownFields()
+			if err = decoder.Decode(settings); err != nil {
+				return fmt.Errorf("plan %s settings: %s", plan.Name, err.Error())
+			}
+
+			if err = settings.Validate(); err != nil {
+				return fmt.Errorf("plan %s settings: %s", plan.Name, err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
 // GetCloudFrontInstanceSpec retrieves  instance spec from database
 func (s *AwsConfig) GetCloudFrontInstanceSpec(distributionID string) (*InstanceSpec, error) {
 	cf, err := s.getCloudfrontInstance(distributionID)
 
 	if err != nil {
 		msg := fmt.Sprintf("GetCloudFrontInstanceSpec: error getting distribution %s", err.Error())
-		glog.Error(msg)
+		logging.Root().Error(msg)
 		return nil, err
 	}
 
 	cfi := &InstanceSpec{
-		ServiceID:            cf.planID,
+		ServiceID:            cf.serviceID,
 		PlanID:               cf.planID,
 		BillingCode:          cf.billingCode,
 		CloudfrontID:         cf.cloudfrontID,
 		CloudfrontURL:        cf.cloudfrontURL,
 		OriginAccessIdentity: cf.originAccessIdentity,
-		S3Bucket: &S3BucketSpec{
-			BucketName: cf.s3Bucket.bucketName,
-			Fullname:   cf.s3Bucket.fullname,
-			BucketURI:  cf.s3Bucket.bucketURI,
-			IAMUser: &IAMUserSpec{
-				UserName:  cf.s3Bucket.iAMUser.userName,
-				ARN:       cf.s3Bucket.iAMUser.arn,
-				AccessKey: cf.s3Bucket.iAMUser.accessKey,
-				SecretKey: cf.s3Bucket.iAMUser.secretKey,
-			},
-		},
-		Access: &AccessSpec{
-			CloudFrontURL:      cf.cloudfrontURL,
-			BucketName:         cf.s3Bucket.bucketName,
-			AwsAccessKey:       cf.s3Bucket.iAMUser.accessKey,
-			AwsSecretAccessKey: cf.s3Bucket.iAMUser.secretKey,
+		OriginType:           cf.originType,
+	}
+
+	if cf.isCustomOrigin() {
+		cfi.CustomOrigin = cf.parameters.CustomOrigin
+		cfi.Access = &AccessSpec{
+			CloudFrontURL: cf.cloudfrontURL,
+		}
+		return cfi, nil
+	}
+
+	if cf.s3Bucket == nil {
+		msg := fmt.Sprintf("GetCloudFrontInstanceSpec: origin not found for distribution %s", distributionID)
+		logging.Root().Error(msg)
+		return nil, errors.New(msg)
+	}
+
+	cfi.S3Bucket = &S3BucketSpec{
+		BucketName: cf.s3Bucket.bucketName,
+		Fullname:   cf.s3Bucket.fullname,
+		BucketURI:  cf.s3Bucket.bucketURI,
+		IAMUser: &IAMUserSpec{
+			UserName:  cf.s3Bucket.iAMUser.userName,
+			ARN:       cf.s3Bucket.iAMUser.arn,
+			AccessKey: cf.s3Bucket.iAMUser.accessKey,
+			SecretKey: cf.s3Bucket.iAMUser.secretKey,
 		},
 	}
+	cfi.Access = &AccessSpec{
+		CloudFrontURL:      cf.cloudfrontURL,
+		BucketName:         cf.s3Bucket.bucketName,
+		AwsAccessKey:       cf.s3Bucket.iAMUser.accessKey,
+		AwsSecretAccessKey: cf.s3Bucket.iAMUser.secretKey,
+	}
 
 	return cfi, nil
 }
 
 // CreateCloudFrontDistribution starts the provision process by creating a new task
-func (s *AwsConfig) CreateCloudFrontDistribution(distributionID string, callerReference string, operationKey string, serviceID string, planID string, billingCode *string) error {
+func (s *AwsConfig) CreateCloudFrontDistribution(distributionID string, callerReference string, operationKey string, serviceID string, planID string, billingCode *string, params *InstanceParameters, context *InstanceContext, parametersHash string) error {
 	cf := &cloudFrontInstance{
 		callerReference: aws.String(callerReference),
 		distributionID:  aws.String(distributionID),
@@ -137,53 +270,134 @@ func (s *AwsConfig) CreateCloudFrontDistribution(distributionID string, callerRe
 		serviceID:       aws.String(serviceID),
 		operationKey:    aws.String(operationKey),
 		billingCode:     billingCode,
+		originType:      params.OriginType,
+		parameters:      params,
+		context:         context,
+		parametersHash:  parametersHash,
 	}
 
 	err := s.ActionCreateNew(cf)
 
 	if err != nil {
 		msg := fmt.Sprintf("CreateCloudFrontDistribution: error creating new task: %s", err.Error())
-		glog.Error(msg)
+		logging.Root().Error(msg)
 		return errors.New(msg)
 	}
 
 	return err
 }
 
-func (s *AwsConfig) createDistribution(cf *cloudFrontInstance) error {
-	var err error
-	var cfOut *cloudfront.CreateDistributionWithTagsOutput
-	var ttlPtr *int64
+func newS3Origin(cf *cloudFrontInstance) *cloudfront.Origin {
+	fullname := strings.Replace(*cf.s3Bucket.bucketURI, "http://", "", -1)
+	fullname = strings.Replace(fullname, "/", "", -1)
+
+	return &cloudfront.Origin{
+		DomainName: &fullname,
+		Id:         cf.s3Bucket.bucketName,
+		S3OriginConfig: &cloudfront.S3OriginConfig{
+			OriginAccessIdentity: aws.String("origin-access-identity/cloudfront/" + *cf.originAccessIdentity),
+		},
+	}
+}
+
+func newCustomOrigin(co *CustomOriginParams) *cloudfront.Origin {
+	headers := []*cloudfront.OriginCustomHeader{}
+	for _, name := range co.customHeaderNames() {
+		headers = append(headers, &cloudfront.OriginCustomHeader{
+			HeaderName:  aws.String(name),
+			HeaderValue: aws.String(co.CustomHeaders[name]),
+		})
+	}
+
+	return &cloudfront.Origin{
+		DomainName: aws.String(co.DomainName),
+		Id:         aws.String(co.DomainName),
+		OriginPath: aws.String(co.OriginPath),
+		CustomHeaders: &cloudfront.CustomHeaders{
+			Items:    headers,
+			Quantity: aws.Int64(int64(len(headers))),
+		},
+		CustomOriginConfig: &cloudfront.CustomOriginConfig{
+			HTTPPort:               aws.Int64(co.HTTPPort),
+			HTTPSPort:              aws.Int64(co.HTTPSPort),
+			OriginProtocolPolicy:   aws.String(co.ProtocolPolicy),
+			OriginReadTimeout:      aws.Int64(co.ReadTimeout),
+			OriginKeepaliveTimeout: aws.Int64(co.KeepaliveTimeout),
+			OriginSslProtocols: &cloudfront.OriginSslProtocols{
+				Items:    aws.StringSlice(co.SslProtocols),
+				Quantity: aws.Int64(int64(len(co.SslProtocols))),
+			},
+		},
+	}
+}
+
+// applyDistributionProfile sets the settings of the distribution profile on the config,
+// settings not in the profile are reset to the CloudFront defaults
+func applyDistributionProfile(config *cloudfront.DistributionConfig, profile *DistributionProfile) {
+	if profile == nil {
+		profile = &DistributionProfile{}
+	}
+
+	minTTL, defaultTTL, maxTTL := profile.ttls()
+	config.DefaultCacheBehavior.MinTTL = aws.Int64(minTTL)
+	config.DefaultCacheBehavior.DefaultTTL = aws.Int64(defaultTTL)
+	config.DefaultCacheBehavior.MaxTTL = aws.Int64(maxTTL)
+	config.DefaultCacheBehavior.Compress = aws.Bool(profile.Compress != nil && *profile.Compress)
 
-	glog.V(4).Info("==== createDistribution ====")
+	config.PriceClass = aws.String(cloudfront.PriceClassPriceClassAll)
+	if profile.PriceClass != "" {
+		config.PriceClass = aws.String(profile.PriceClass)
+	}
+
+	config.HttpVersion = aws.String(cloudfront.HttpVersionHttp2)
+	if profile.HTTPVersion != "" {
+		config.HttpVersion = aws.String(profile.HTTPVersion)
+	}
 
-	ttlPtr = aws.Int64(int64(ttl))
+	config.IsIPV6Enabled = aws.Bool(profile.IPv6 != nil && *profile.IPv6)
+	config.DefaultRootObject = aws.String(profile.DefaultRootObject)
+	config.WebACLId = aws.String(profile.WebACLID)
+
+	config.Logging = &cloudfront.LoggingConfig{
+		Enabled:        aws.Bool(false),
+		Bucket:         aws.String(""),
+		Prefix:         aws.String(""),
+		IncludeCookies: aws.Bool(false),
+	}
+	if profile.Logging != nil {
+		config.Logging = &cloudfront.LoggingConfig{
+			Enabled:        aws.Bool(true),
+			Bucket:         aws.String(profile.Logging.Bucket + ".s3.amazonaws.com"),
+			Prefix:         aws.String(profile.Logging.Prefix),
+			IncludeCookies: aws.Bool(profile.Logging.IncludeCookies),
+		}
+	}
+}
+
+func (s *AwsConfig) createDistribution(ctx context.Context, cf *cloudFrontInstance) error {
+	var err error
+	var cfOut *cloudfront.CreateDistributionWithTagsOutput
 
 	svc := cloudfront.New(s.sess)
 	if svc == nil {
 		msg := "createDistribution: error getting cloudfront session"
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return errors.New(msg)
 	}
 
-	glog.V(4).Info("createDistribution: attach origin access identity")
-	var s3Origin = []*cloudfront.Origin{}
-
-	fullname := strings.Replace(*cf.s3Bucket.bucketURI, "http://", "", -1)
-	fullname = strings.Replace(fullname, "/", "", -1)
+	var origins = []*cloudfront.Origin{}
 
-	s3Origin = append(s3Origin, &cloudfront.Origin{
-		DomainName: &fullname,
-		Id:         cf.s3Bucket.bucketName,
-		S3OriginConfig: &cloudfront.S3OriginConfig{
-			OriginAccessIdentity: aws.String("origin-access-identity/cloudfront/" + *cf.originAccessIdentity),
-		},
-	})
+	if cf.isCustomOrigin() {
+		origins = append(origins, newCustomOrigin(cf.parameters.CustomOrigin))
+	} else {
+		logging.FromContext(ctx).Debug("attaching origin access identity")
+		origins = append(origins, newS3Origin(cf))
+	}
 
-	err = s3Origin[0].Validate()
+	err = origins[0].Validate()
 	if err != nil {
-		msg := fmt.Sprintf("createDistribution: error in S3Origin: %s", err.Error())
-		glog.Errorf(msg)
+		msg := fmt.Sprintf("createDistribution: error in origin: %s", err.Error())
+		logging.FromContext(ctx).Error(msg)
 		return err
 	}
 
@@ -191,24 +405,15 @@ func (s *AwsConfig) createDistribution(cf *cloudFrontInstance) error {
 	cmi = append(cmi, aws.String("GET"))
 	cmi = append(cmi, aws.String("HEAD"))
 
-	tags := []*cloudfront.Tag{}
-
-	if cf.billingCode != nil {
-		tags = append(tags, &cloudfront.Tag{
-			Key:   aws.String("billingcode"),
-			Value: cf.billingCode,
-		})
-	}
-
 	cin := &cloudfront.CreateDistributionWithTagsInput{
 		DistributionConfigWithTags: &cloudfront.DistributionConfigWithTags{
 			DistributionConfig: &cloudfront.DistributionConfig{
 				CallerReference: cf.callerReference,
 				Origins: &cloudfront.Origins{
-					Items:    s3Origin,
+					Items:    origins,
 					Quantity: aws.Int64(1),
 				},
-				Comment: cf.s3Bucket.bucketName,
+				Comment: origins[0].Id,
 				DefaultCacheBehavior: &cloudfront.DefaultCacheBehavior{
 					AllowedMethods: &cloudfront.AllowedMethods{
 						CachedMethods: &cloudfront.CachedMethods{
@@ -218,16 +423,13 @@ func (s *AwsConfig) createDistribution(cf *cloudFrontInstance) error {
 						Items:    cmi,
 						Quantity: aws.Int64(2),
 					},
-					DefaultTTL: ttlPtr,
-					MinTTL:     ttlPtr,
-					MaxTTL:     ttlPtr,
 					ForwardedValues: &cloudfront.ForwardedValues{
 						Cookies: &cloudfront.CookiePreference{
 							Forward: aws.String("none"),
 						},
 						QueryString: aws.Bool(false),
 					},
-					TargetOriginId: s3Origin[0].Id,
+					TargetOriginId: origins[0].Id,
 					TrustedSigners: &cloudfront.TrustedSigners{
 						Enabled:  aws.Bool(false),
 						Quantity: aws.Int64(0),
@@ -237,23 +439,25 @@ func (s *AwsConfig) createDistribution(cf *cloudFrontInstance) error {
 				Enabled: aws.Bool(true),
 			},
 			Tags: &cloudfront.Tags{
-				Items: tags,
+				Items: cloudfrontTags(cf.distributionTags(cf.tags(cf.parameters, *cf.planID))),
 			},
 		},
 	}
 
+	applyDistributionProfile(cin.DistributionConfigWithTags.DistributionConfig, cf.parameters.Distribution)
+
 	err = cin.Validate()
 	if err != nil {
 		msg := fmt.Sprintf("createDistribution: error with cin: %s", err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return errors.New(msg)
 	}
 
-	cfOut, err = svc.CreateDistributionWithTags(cin)
+	cfOut, err = svc.CreateDistributionWithTagsWithContext(ctx, cin)
 
 	if err != nil {
 		msg := fmt.Sprintf("createDistribution: error creating distribution: %s", err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return errors.New(msg)
 	}
 
@@ -261,12 +465,138 @@ func (s *AwsConfig) createDistribution(cf *cloudFrontInstance) error {
 	cf.cloudfrontID = cfOut.Distribution.Id
 	cf.cloudfrontURL = &curl
 
-	glog.V(0).Infof("cloudfrontID: %s\n", *cf.cloudfrontID)
+	logging.FromContext(ctx).Info("created distribution", "cloudfront_id", *cf.cloudfrontID)
 
 	_, err = s.stg.UpdateDistributionCloudfront(*cf.distributionID, *cf.cloudfrontID, *cf.cloudfrontURL)
 	if err != nil {
 		msg := fmt.Sprintf("createDistribution: error updating distribution with cloudfront: %s", err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
+		return errors.New(msg)
+	}
+
+	return nil
+}
+
+// storeCreatedDistribution stores the cloudfront id and url of a distribution created for the
+// instance by an earlier attempt of the action
+func (s *AwsConfig) storeCreatedDistribution(ctx context.Context, cf *cloudFrontInstance, cloudfrontID string) error {
+	cf.cloudfrontID = aws.String(cloudfrontID)
+	distOut, err := s.getCloudfrontDistribution(ctx, cf)
+	if err != nil {
+		return err
+	}
+
+	curl := fmt.Sprintf("https://%s", *distOut.Distribution.DomainName)
+	cf.cloudfrontURL = &curl
+
+	_, err = s.stg.UpdateDistributionCloudfront(*cf.distributionID, *cf.cloudfrontID, *cf.cloudfrontURL)
+	if err != nil {
+		msg := fmt.Sprintf("storeCreatedDistribution: error updating distribution with cloudfront: %s", err.Error())
+		logging.FromContext(ctx).Error(msg)
+		return errors.New(msg)
+	}
+
+	return nil
+}
+
+// MergeInstanceParameters returns the current parameters of the distribution with the updates applied
+func (s *AwsConfig) MergeInstanceParameters(distributionID string, updates map[string]interface{}) (*InstanceParameters, error) {
+	cf, err := s.getCloudfrontInstance(distributionID)
+	if err != nil {
+		msg := fmt.Sprintf("MergeInstanceParameters: error getting distribution: %s", err.Error())
+		logging.Root().Error(msg)
+		return nil, errors.New(msg)
+	}
+
+	return mergeInstanceParameters(cf.parameters, updates)
+}
+
+// IsOperationInProgress checks if the last task for the distribution is still running
+func (s *AwsConfig) IsOperationInProgress(distributionID string) (bool, error) {
+	task, err := s.stg.GetTaskByDistribution(distributionID)
+	if err != nil {
+		return false, err
+	}
+
+	return task.Status == statusNew || task.Status == statusPending, nil
+}
+
+// PlanChangeError is returned when an instance can not change to the requested plan
+type PlanChangeError struct {
+	Reason string
+}
+
+func (e *PlanChangeError) Error() string {
+	return e.Reason
+}
+
+// ChangePlanParameters checks the instance may change to the plan and returns the parameters
+// with the distribution profile of the new plan, instance overrides of the old plan's profile are kept.
+// The returned plan id is blank when the plan does not change.
+func (s *AwsConfig) ChangePlanParameters(distributionID string, planID string, params *InstanceParameters) (*InstanceParameters, string, error) {
+	cf, err := s.getCloudfrontInstance(distributionID)
+	if err != nil {
+		msg := fmt.Sprintf("ChangePlanParameters: error getting distribution: %s", err.Error())
+		logging.Root().Error(msg)
+		return nil, "", errors.New(msg)
+	}
+
+	if planID == "" || planID == *cf.planID {
+		return params, "", nil
+	}
+
+	curPlan, err := s.stg.GetPlan(*cf.planID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	newPlan, err := s.stg.GetPlan(planID)
+	if err != nil || newPlan.DeletedAt.Valid || newPlan.ServiceID != curPlan.ServiceID {
+		return nil, "", &PlanChangeError{Reason: fmt.Sprintf("plan %s not found", planID)}
+	}
+
+	if !contains(curPlan.PlanUpdates, planID) {
+		return nil, "", &PlanChangeError{Reason: fmt.Sprintf("plan change from %s to %s is not allowed", curPlan.Name, newPlan.Name)}
+	}
+
+	curSettings, err := s.GetPlanSettings(curPlan.PlanID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	newSettings, err := s.GetPlanSettings(newPlan.PlanID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	changed := *params
+	if params.Distribution != nil {
+		changed.Distribution = params.Distribution.overrides(curSettings.Distribution)
+	}
+
+	if err = changed.ApplyPlanSettings(newSettings); err != nil {
+		return nil, "", &PlanChangeError{Reason: err.Error()}
+	}
+
+	logging.Root().Info("plan change", logging.KeyInstanceID, distributionID, "from", curPlan.Name, "to", newPlan.Name)
+	return &changed, newPlan.PlanID, nil
+}
+
+// UpdateCloudFrontDistribution starts the update process by creating a new task,
+// planID is blank when the plan does not change
+func (s *AwsConfig) UpdateCloudFrontDistribution(distributionID string, operationKey string, planID string, params *InstanceParameters) error {
+	cf, err := s.getCloudfrontInstance(distributionID)
+	if err != nil {
+		msg := fmt.Sprintf("UpdateCloudFrontDistribution: error getting distribution: %s", err.Error())
+		logging.Root().Error(msg)
+		return errors.New(msg)
+	}
+	cf.operationKey = aws.String(operationKey)
+
+	err = s.ActionUpdateNew(cf, params, planID)
+	if err != nil {
+		msg := fmt.Sprintf("UpdateCloudFrontDistribution: error creating new task: %s", err.Error())
+		logging.Root().Error(msg)
 		return errors.New(msg)
 	}
 
@@ -276,35 +606,36 @@ func (s *AwsConfig) createDistribution(cf *cloudFrontInstance) error {
 // DeleteCloudFrontDistribution starts the de-provision process my creating a new task
 func (s *AwsConfig) DeleteCloudFrontDistribution(distributionID string, operationKey string) error {
 
-	cf := &cloudFrontInstance{
-		distributionID: aws.String(distributionID),
-		operationKey:   aws.String(operationKey),
+	cf, err := s.getCloudfrontInstance(distributionID)
+	if err != nil {
+		msg := fmt.Sprintf("DeleteCloudFrontDistribution: error getting distribution: %s", err.Error())
+		logging.Root().Error(msg)
+		return errors.New(msg)
 	}
+	cf.operationKey = aws.String(operationKey)
 
-	err := s.ActionDeleteNew(cf)
+	err = s.ActionDeleteNew(cf)
 	if err != nil {
 		msg := fmt.Sprintf("DeleteCloudFrontDistribution: error creating new task: %s", err.Error())
-		glog.Error(msg)
+		logging.Root().Error(msg)
 		return errors.New(msg)
 	}
 
 	return nil
 }
 
-func (s *AwsConfig) getCloudfrontDistribution(cf *cloudFrontInstance) (*cloudfront.GetDistributionOutput, error) {
-	glog.V(4).Infof("==== getCloudfrontDistribution [%s] ====", *cf.operationKey)
-
+func (s *AwsConfig) getCloudfrontDistribution(ctx context.Context, cf *cloudFrontInstance) (*cloudfront.GetDistributionOutput, error) {
 	svc := cloudfront.New(s.sess)
 	if svc == nil {
 		msg := "getCloudfrontDistibution: error getting cloudfront session:"
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return nil, errors.New(msg)
 	}
 
-	getDistOut, err := svc.GetDistribution(&cloudfront.GetDistributionInput{Id: cf.cloudfrontID})
+	getDistOut, err := svc.GetDistributionWithContext(ctx, &cloudfront.GetDistributionInput{Id: cf.cloudfrontID})
 	if err != nil {
 		msg := fmt.Sprintf("getCloudfrontDistibution: getting distribution: %s", err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return nil, errors.New(msg)
 	}
 
@@ -312,18 +643,16 @@ func (s *AwsConfig) getCloudfrontDistribution(cf *cloudFrontInstance) (*cloudfro
 
 }
 
-func (s *AwsConfig) isDistributionDeployed(cf *cloudFrontInstance) (bool, error) {
-	glog.V(4).Infof("==== isDistributionDeployed [%s] ====", *cf.operationKey)
-
-	distOut, err := s.getCloudfrontDistribution(cf)
+func (s *AwsConfig) isDistributionDeployed(ctx context.Context, cf *cloudFrontInstance) (bool, error) {
+	distOut, err := s.getCloudfrontDistribution(ctx, cf)
 
 	if err != nil {
 		msg := fmt.Sprintf("isDistributionDeplyed[%s]: error checking distribution deployed: %s", *cf.operationKey, err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return false, errors.New(msg)
 	}
 
-	glog.V(4).Infof("isDistributionDeployed[%s]: %s", *cf.operationKey, *distOut.Distribution.Status)
+	logging.FromContext(ctx).Debug("distribution status", "status", *distOut.Distribution.Status)
 	if *distOut.Distribution.Status == "Deployed" && *distOut.Distribution.DistributionConfig.Enabled {
 		return true, nil
 	}
@@ -331,18 +660,16 @@ func (s *AwsConfig) isDistributionDeployed(cf *cloudFrontInstance) (bool, error)
 	return false, nil
 }
 
-func (s *AwsConfig) isDistributionDisabled(cf *cloudFrontInstance) (bool, error) {
-	glog.V(4).Infof("==== isDistributionDisabled [%s] ====", *cf.operationKey)
-
-	distOut, err := s.getCloudfrontDistribution(cf)
+func (s *AwsConfig) isDistributionDisabled(ctx context.Context, cf *cloudFrontInstance) (bool, error) {
+	distOut, err := s.getCloudfrontDistribution(ctx, cf)
 
 	if err != nil {
 		msg := fmt.Sprintf("isDistributionDisabled[%s]: error checking distribution deployed: %s", *cf.operationKey, err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return false, errors.New(msg)
 	}
 
-	glog.V(4).Infof("isDistributionDisabled[%s]: %s", *cf.operationKey, *distOut.Distribution.Status)
+	logging.FromContext(ctx).Debug("distribution status", "status", *distOut.Distribution.Status)
 	if *distOut.Distribution.Status == "Deployed" && !*distOut.Distribution.DistributionConfig.Enabled {
 		return true, nil
 	}
@@ -350,54 +677,51 @@ func (s *AwsConfig) isDistributionDisabled(cf *cloudFrontInstance) (bool, error)
 	return false, nil
 }
 
-func (s *AwsConfig) getDistributionConfig(svc *cloudfront.CloudFront, cf *cloudFrontInstance) (*cloudfront.GetDistributionConfigOutput, error) {
+func (s *AwsConfig) getDistributionConfig(ctx context.Context, svc *cloudfront.CloudFront, cf *cloudFrontInstance) (*cloudfront.GetDistributionConfigOutput, error) {
 	var err error
-
-	glog.V(4).Infof("==== getDistributionConfig [%s] ====", *cf.operationKey)
-	glog.V(1).Infof("getDistributionConfig: cloudfront id: %s", *cf.cloudfrontID)
+	logging.FromContext(ctx).Debug("getting distribution config", "cloudfront_id", *cf.cloudfrontID)
 
 	getDistConfIn := &cloudfront.GetDistributionConfigInput{
 		Id: aws.String(*cf.cloudfrontID),
 	}
 
-	getDistConfOut, err := svc.GetDistributionConfig(getDistConfIn)
+	getDistConfOut, err := svc.GetDistributionConfigWithContext(ctx, getDistConfIn)
 	if err != nil {
 		msg := fmt.Sprintf("getDistributionConfig: error getting distribution config: %s", err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return nil, errors.New(msg)
 	}
 
 	return getDistConfOut, nil
 }
 
-func (s *AwsConfig) deleteDistribution(cf *cloudFrontInstance) error {
-	glog.V(4).Infof("==== deleteDistribution [%s] ====", *cf.cloudfrontID)
-	glog.V(0).Infof("deleteDistribution operationKey: %s", *cf.operationKey)
+func (s *AwsConfig) deleteDistribution(ctx context.Context, cf *cloudFrontInstance) error {
+	logging.FromContext(ctx).Info("deleting distribution")
 
 	svc := cloudfront.New(s.sess)
 	if svc == nil {
 		msg := "error getting cloudfront session"
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return errors.New(msg)
 	}
 
-	getDistConfOut, _ := s.getDistributionConfig(svc, cf)
+	getDistConfOut, _ := s.getDistributionConfig(ctx, svc, cf)
 
 	delDistIn := &cloudfront.DeleteDistributionInput{
 		Id:      cf.cloudfrontID,
 		IfMatch: getDistConfOut.ETag,
 	}
 
-	_, err := svc.DeleteDistribution(delDistIn)
+	_, err := svc.DeleteDistributionWithContext(ctx, delDistIn)
 
 	if aerr, ok := err.(awserr.Error); ok {
 		switch aerr.Code() {
 		case cloudfront.ErrCodeDistributionNotDisabled:
 			msg := fmt.Sprintf("deleteDistribution[%s]: distribution not disabled: %s", *cf.operationKey, aerr.Error())
-			glog.V(4).Info(msg)
+			logging.FromContext(ctx).Debug(msg)
 			return errors.New(aerr.Code())
 		default:
-			glog.V(4).Infof("deleteDistribution: err deleting: %s", aerr.Error())
+			logging.FromContext(ctx).Debug("error deleting distribution", "error", aerr)
 			return err
 		}
 	}
@@ -410,26 +734,24 @@ func (s *AwsConfig) updateDistributionDeletedAt(cf *cloudFrontInstance) error {
 
 	if err != nil {
 		msg := fmt.Sprintf("updateDistributionDeletedAt: error from UpdateDeleteDistribution: %s", err.Error())
-		glog.Error(msg)
+		logging.Root().Error(msg)
 		return err
 	}
 
 	return nil
 }
 
-func (s *AwsConfig) updateDistributionEnableFlag(cf *cloudFrontInstance, enabled bool) error {
+func (s *AwsConfig) updateDistributionEnableFlag(ctx context.Context, cf *cloudFrontInstance, enabled bool) error {
 	var err error
 
-	glog.V(4).Infof("==== updateDistributionEnabledFlag [%s] <%t> ====", *cf.operationKey, enabled)
-
 	svc := cloudfront.New(s.sess)
 	if svc == nil {
 		msg := "error getting cloudfront session"
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return errors.New(msg)
 	}
 
-	getDistConfOut, err := s.getDistributionConfig(svc, cf)
+	getDistConfOut, err := s.getDistributionConfig(ctx, svc, cf)
 
 	distConfigOut := &cloudfront.DistributionConfig{}
 
@@ -442,50 +764,82 @@ func (s *AwsConfig) updateDistributionEnableFlag(cf *cloudFrontInstance, enabled
 		IfMatch:            getDistConfOut.ETag,
 	}
 
-	_, err = svc.UpdateDistribution(updateDistIn)
+	_, err = svc.UpdateDistributionWithContext(ctx, updateDistIn)
 
 	if err != nil {
 		msg := fmt.Sprintf("error setting distribution enabled flag: %s", err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return errors.New(msg)
 	}
 
 	return nil
 }
 
-func (s *AwsConfig) enableDistribution(cf *cloudFrontInstance) error {
-	return s.updateDistributionEnableFlag(cf, true)
+// updateDistributionProfile applies the distribution profile to the cloudfront distribution
+func (s *AwsConfig) updateDistributionProfile(ctx context.Context, cf *cloudFrontInstance, profile *DistributionProfile) error {
+	svc := cloudfront.New(s.sess)
+	if svc == nil {
+		msg := "updateDistributionProfile: error getting cloudfront session"
+		logging.FromContext(ctx).Error(msg)
+		return errors.New(msg)
+	}
+
+	getDistConfOut, err := s.getDistributionConfig(ctx, svc, cf)
+	if err != nil {
+		msg := fmt.Sprintf("updateDistributionProfile: error getting distribution config: %s", err.Error())
+		logging.FromContext(ctx).Error(msg)
+		return errors.New(msg)
+	}
+
+	distConfig := getDistConfOut.DistributionConfig
+	applyDistributionProfile(distConfig, profile)
+
+	_, err = svc.UpdateDistributionWithContext(ctx, &cloudfront.UpdateDistributionInput{
+		DistributionConfig: distConfig,
+		Id:                 cf.cloudfrontID,
+		IfMatch:            getDistConfOut.ETag,
+	})
+
+	if err != nil {
+		msg := fmt.Sprintf("updateDistributionProfile: error updating distribution: %s", err.Error())
+		logging.FromContext(ctx).Error(msg)
+		return errors.New(msg)
+	}
+
+	return nil
 }
 
-func (s *AwsConfig) disableDistribution(cf *cloudFrontInstance) error {
-	return s.updateDistributionEnableFlag(cf, false)
+func (s *AwsConfig) enableDistribution(ctx context.Context, cf *cloudFrontInstance) error {
+	return s.updateDistributionEnableFlag(ctx, cf, true)
 }
 
-func (s *AwsConfig) disableCloudfrontDistribution(cf *cloudFrontInstance) error {
-	glog.V(4).Infof("==== disableCloudfrontDistribution [%s] ====", *cf.operationKey)
+func (s *AwsConfig) disableDistribution(ctx context.Context, cf *cloudFrontInstance) error {
+	return s.updateDistributionEnableFlag(ctx, cf, false)
+}
 
-	if err := s.disableDistribution(cf); err != nil {
+func (s *AwsConfig) disableCloudfrontDistribution(ctx context.Context, cf *cloudFrontInstance) error {
+	if err := s.disableDistribution(ctx, cf); err != nil {
 		msg := fmt.Sprintf("disableCloudfrontDistribution: setting disable flag: %s", err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return errors.New(msg)
 	}
 
 	return nil
 }
 
-func (s *AwsConfig) createOriginAccessIdentity(cf *cloudFrontInstance) error {
+func (s *AwsConfig) createOriginAccessIdentity(ctx context.Context, cf *cloudFrontInstance) error {
 	var err error
 
-	glog.V(4).Info("==== createOriginAccessIdentity ====")
-
 	svc := cloudfront.New(s.sess)
 	if svc == nil {
 		msg := fmt.Sprint("createOriginAccessIdentity: error creating new cloudfront session")
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return errors.New(msg)
 	}
 
-	originAccessIdentity, err := svc.CreateCloudFrontOriginAccessIdentity(&cloudfront.CreateCloudFrontOriginAccessIdentityInput{
+	// origin access identities can not be tagged, the comment names the tagged bucket and the
+	// distribution records the identity in its tags
+	originAccessIdentity, err := svc.CreateCloudFrontOriginAccessIdentityWithContext(ctx, &cloudfront.CreateCloudFrontOriginAccessIdentityInput{
 		CloudFrontOriginAccessIdentityConfig: &cloudfront.OriginAccessIdentityConfig{
 			CallerReference: cf.callerReference,
 			Comment:         aws.String(*cf.s3Bucket.bucketName),
@@ -494,35 +848,33 @@ func (s *AwsConfig) createOriginAccessIdentity(cf *cloudFrontInstance) error {
 
 	if err != nil {
 		msg := fmt.Sprintf("createOriginAccessIdentity: error creating OriginAccessIdenity: %s", err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return errors.New(msg)
 	}
 
 	cf.originAccessIdentity = originAccessIdentity.CloudFrontOriginAccessIdentity.Id
 
-	glog.V(0).Infof("createOriginAccessIdentity: id: %s", *cf.originAccessIdentity)
+	logging.FromContext(ctx).Info("created origin access identity", "origin_access_identity", *cf.originAccessIdentity)
 
 	err = s.stg.UpdateDistributionWIthOriginAccessIdentity(*cf.distributionID, *cf.originAccessIdentity)
 	if err != nil {
 		msg := fmt.Sprintf("createOriginAccessIdenity: error adding: %s", err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return errors.New(msg)
 	}
 
 	return nil
 }
 
-func (s *AwsConfig) isOriginAccessIdentityReady(cf *cloudFrontInstance) (bool, error) {
-	glog.V(4).Info("==== isOriginAccessIdentityReady ====")
-
+func (s *AwsConfig) isOriginAccessIdentityReady(ctx context.Context, cf *cloudFrontInstance) (bool, error) {
 	svc := cloudfront.New(s.sess)
 	if svc == nil {
 		msg := fmt.Sprint("isOriginAccessIdentityReady: error creating new cloudfront session")
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return false, errors.New(msg)
 	}
 
-	_, err := svc.GetCloudFrontOriginAccessIdentity(&cloudfront.GetCloudFrontOriginAccessIdentityInput{
+	_, err := svc.GetCloudFrontOriginAccessIdentityWithContext(ctx, &cloudfront.GetCloudFrontOriginAccessIdentityInput{
 		Id: cf.originAccessIdentity,
 	})
 
@@ -531,10 +883,10 @@ func (s *AwsConfig) isOriginAccessIdentityReady(cf *cloudFrontInstance) (bool, e
 			switch aerr.Code() {
 			case cloudfront.ErrCodeNoSuchCloudFrontOriginAccessIdentity:
 				msg := fmt.Sprintf("isOriginAccessIdentityReady: [%s]: origin access identity not ready: %s", *cf.operationKey, aerr.Error())
-				glog.V(4).Info(msg)
+				logging.FromContext(ctx).Debug(msg)
 				return false, nil
 			default:
-				glog.V(4).Infof("isOriginAccessIdentityReady: error getting origin access identity: %s", aerr.Error())
+				logging.FromContext(ctx).Debug("error getting origin access identity", "error", aerr)
 				return false, err
 			}
 		}
@@ -543,14 +895,11 @@ func (s *AwsConfig) isOriginAccessIdentityReady(cf *cloudFrontInstance) (bool, e
 	return true, nil
 }
 
-func (s *AwsConfig) deleteOriginAccessIdentity(cf *cloudFrontInstance) error {
-	glog.V(4).Infof("==== deleteOriginAccessIdentity [%s] ====", *cf.operationKey)
-
+func (s *AwsConfig) deleteOriginAccessIdentity(ctx context.Context, cf *cloudFrontInstance) error {
 	svc := cloudfront.New(s.sess)
-	glog.V(4).Infof("cf sess: %#+v\n", svc)
 	if svc == nil {
 		msg := "error creating new cloudfront session"
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return errors.New(msg)
 	}
 
@@ -558,17 +907,17 @@ func (s *AwsConfig) deleteOriginAccessIdentity(cf *cloudFrontInstance) error {
 		Id: cf.originAccessIdentity,
 	}
 
-	gcfoaiOut, err := svc.GetCloudFrontOriginAccessIdentity(gcfoaiIn)
+	gcfoaiOut, err := svc.GetCloudFrontOriginAccessIdentityWithContext(ctx, gcfoaiIn)
 
 	dcfoaiIn := &cloudfront.DeleteCloudFrontOriginAccessIdentityInput{
 		Id:      cf.originAccessIdentity,
 		IfMatch: gcfoaiOut.ETag,
 	}
 
-	_, err = svc.DeleteCloudFrontOriginAccessIdentity(dcfoaiIn)
+	_, err = svc.DeleteCloudFrontOriginAccessIdentityWithContext(ctx, dcfoaiIn)
 	if err != nil {
 		msg := fmt.Sprintf("error deleting origin access id: %s", err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return err
 	}
 
@@ -577,12 +926,10 @@ func (s *AwsConfig) deleteOriginAccessIdentity(cf *cloudFrontInstance) error {
 
 // CheckLastOperation retrieves state from database
 func (s *AwsConfig) CheckLastOperation(distributionID string) (*osb.LastOperationResponse, error) {
-	glog.V(4).Infof("===== CheckLastOperation [%s] =====", distributionID)
-
 	response, err := s.getTaskState(distributionID)
 	if err != nil {
 		msg := fmt.Sprintf("CheckLastOperation: error getting task state: %s", err.Error())
-		glog.Error(msg)
+		logging.Root().Error(msg)
 		return nil, errors.New(msg)
 	}
 
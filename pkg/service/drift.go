@@ -0,0 +1,286 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"cloudfront-broker/pkg/logging"
+	"cloudfront-broker/pkg/storage"
+
+	"github.com/nu7hatch/gouuid"
+	"github.com/pkg/errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Kinds of drift between a deployed instance and its aws resources
+const (
+	DriftDistributionMissing  string = "distribution-missing"
+	DriftDistributionDisabled string = "distribution-disabled"
+	DriftDistributionProfile  string = "distribution-profile"
+	DriftBucketPolicy         string = "bucket-policy"
+	DriftCORS                 string = "cors"
+	DriftIAMPolicy            string = "iam-policy"
+)
+
+// driftRequest holds the kinds of drift to repair in the task context of reconcile tasks
+type driftRequest struct {
+	Kinds []string `json:"kinds"`
+}
+
+func (r *driftRequest) has(kind string) bool {
+	return contains(r.Kinds, kind)
+}
+
+// InstanceDrift lists the kinds of drift found on one instance, RepairKey is the
+// operation key of the repair task when one was started
+type InstanceDrift struct {
+	DistributionID string   `json:"distribution_id"`
+	Kinds          []string `json:"kinds"`
+	RepairKey      string   `json:"repair_key,omitempty"`
+	Error          string   `json:"error,omitempty"`
+}
+
+// DriftReport lists the deployed instances that drifted from their stored configuration
+type DriftReport struct {
+	CheckedAt time.Time        `json:"checked_at"`
+	Repair    bool             `json:"repair"`
+	Checked   int              `json:"checked"`
+	Instances []*InstanceDrift `json:"instances"`
+}
+
+// normalizeJSON re-encodes a json document so documents differing only in formatting
+// and key order compare equal
+func normalizeJSON(doc string) string {
+	if doc == "" {
+		return ""
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(doc), &v); err != nil {
+		return doc
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func marshalNormalized(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return normalizeJSON(string(b))
+}
+
+// profileSettings returns the settings of the config managed by the distribution profile
+func profileSettings(config *cloudfront.DistributionConfig) map[string]interface{} {
+	settings := map[string]interface{}{
+		"price_class":         aws.StringValue(config.PriceClass),
+		"http_version":        aws.StringValue(config.HttpVersion),
+		"ipv6":                aws.BoolValue(config.IsIPV6Enabled),
+		"default_root_object": aws.StringValue(config.DefaultRootObject),
+		"web_acl_id":          aws.StringValue(config.WebACLId),
+	}
+
+	if cb := config.DefaultCacheBehavior; cb != nil {
+		settings["min_ttl"] = aws.Int64Value(cb.MinTTL)
+		settings["default_ttl"] = aws.Int64Value(cb.DefaultTTL)
+		settings["max_ttl"] = aws.Int64Value(cb.MaxTTL)
+		settings["compress"] = aws.BoolValue(cb.Compress)
+	}
+
+	if l := config.Logging; l != nil && aws.BoolValue(l.Enabled) {
+		settings["logging"] = map[string]interface{}{
+			"bucket":          aws.StringValue(l.Bucket),
+			"prefix":          aws.StringValue(l.Prefix),
+			"include_cookies": aws.BoolValue(l.IncludeCookies),
+		}
+	}
+
+	return settings
+}
+
+func newDriftFinding(kind string, expected string, actual string) storage.DriftFinding {
+	return storage.DriftFinding{
+		Kind:     kind,
+		Expected: storage.SetNullString(expected),
+		Actual:   storage.SetNullString(actual),
+	}
+}
+
+// checkDrift compares the aws resources of the instance with its stored parameters
+func (s *AwsConfig) checkDrift(ctx context.Context, cf *cloudFrontInstance) ([]storage.DriftFinding, error) {
+	findings := []storage.DriftFinding{}
+
+	cfSvc := cloudfront.New(s.sess)
+	confOut, err := cfSvc.GetDistributionConfigWithContext(ctx, &cloudfront.GetDistributionConfigInput{Id: cf.cloudfrontID})
+	if isNotFoundCode(err, cloudfront.ErrCodeNoSuchDistribution) {
+		// nothing else can be repaired without the distribution
+		return append(findings, newDriftFinding(DriftDistributionMissing, *cf.cloudfrontID, "")), nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error getting distribution config: %s", err.Error())
+	}
+
+	config := confOut.DistributionConfig
+	if !aws.BoolValue(config.Enabled) {
+		findings = append(findings, newDriftFinding(DriftDistributionDisabled, "true", "false"))
+	}
+
+	expectedConfig := &cloudfront.DistributionConfig{DefaultCacheBehavior: &cloudfront.DefaultCacheBehavior{}}
+	applyDistributionProfile(expectedConfig, cf.parameters.Distribution)
+	expected := marshalNormalized(profileSettings(expectedConfig))
+	actual := marshalNormalized(profileSettings(config))
+	if expected != actual {
+		findings = append(findings, newDriftFinding(DriftDistributionProfile, expected, actual))
+	}
+
+	if cf.isCustomOrigin() || cf.s3Bucket == nil {
+		return findings, nil
+	}
+
+	s3Svc := s3.New(s.sess)
+
+	expected = marshalNormalized(bucketPolicyDocument(cf))
+	actual = ""
+	policyOut, err := s3Svc.GetBucketPolicyWithContext(ctx, &s3.GetBucketPolicyInput{Bucket: cf.s3Bucket.bucketName})
+	if err == nil {
+		actual = normalizeJSON(aws.StringValue(policyOut.Policy))
+	} else if !isNotFoundCode(err, "NoSuchBucketPolicy") {
+		return nil, fmt.Errorf("error getting bucket policy: %s", err.Error())
+	}
+	if expected != actual {
+		findings = append(findings, newDriftFinding(DriftBucketPolicy, expected, actual))
+	}
+
+	rules := cf.parameters.CORS
+	if rules == nil {
+		rules = defaultCORSRules
+	}
+	expected = marshalNormalized(newCORSRules(rules))
+	actual = marshalNormalized([]*s3.CORSRule{})
+	corsOut, err := s3Svc.GetBucketCorsWithContext(ctx, &s3.GetBucketCorsInput{Bucket: cf.s3Bucket.bucketName})
+	if err == nil {
+		actual = marshalNormalized(corsOut.CORSRules)
+	} else if !isNotFoundCode(err, "NoSuchCORSConfiguration") {
+		return nil, fmt.Errorf("error getting bucket cors: %s", err.Error())
+	}
+	if expected != actual {
+		findings = append(findings, newDriftFinding(DriftCORS, expected, actual))
+	}
+
+	iamSvc := iam.New(s.sess)
+
+	expected = marshalNormalized(s.userPolicyDocument(cf))
+	actual = ""
+	userPolicyOut, err := iamSvc.GetUserPolicyWithContext(ctx, &iam.GetUserPolicyInput{
+		UserName:   cf.s3Bucket.iAMUser.userName,
+		PolicyName: aws.String(userPolicyName(cf)),
+	})
+	if err == nil {
+		// iam returns the policy document url encoded
+		doc, _ := url.QueryUnescape(aws.StringValue(userPolicyOut.PolicyDocument))
+		actual = normalizeJSON(doc)
+	} else if !isNotFoundCode(err, iam.ErrCodeNoSuchEntityException) {
+		return nil, fmt.Errorf("error getting iam user policy: %s", err.Error())
+	}
+	if expected != actual {
+		findings = append(findings, newDriftFinding(DriftIAMPolicy, expected, actual))
+	}
+
+	return findings, nil
+}
+
+// repairableKinds returns the kinds of the findings the reconcile task can repair
+func repairableKinds(findings []storage.DriftFinding) []string {
+	kinds := []string{}
+	for _, finding := range findings {
+		if finding.Kind != DriftDistributionMissing {
+			kinds = append(kinds, finding.Kind)
+		}
+	}
+	return kinds
+}
+
+// Reconcile checks the deployed instances for drift from their stored configuration and
+// records the findings, a repair task is started for drifted instances when repair is set
+func (s *AwsConfig) Reconcile(ctx context.Context, repair bool) (*DriftReport, error) {
+	report := &DriftReport{
+		CheckedAt: time.Now().UTC(),
+		Repair:    repair,
+		Instances: []*InstanceDrift{},
+	}
+
+	ids, err := s.stg.GetDeployedDistributionIDs()
+	if err != nil {
+		msg := fmt.Sprintf("Reconcile: error getting distributions: %s", err.Error())
+		logging.FromContext(ctx).Error(msg)
+		return nil, errors.New(msg)
+	}
+
+	for _, id := range ids {
+		// the resources of instances being changed are expected to differ
+		if inProgress, err := s.IsOperationInProgress(id); err != nil || inProgress {
+			continue
+		}
+
+		drift := &InstanceDrift{DistributionID: id, Kinds: []string{}}
+
+		cf, err := s.getCloudfrontInstance(id)
+		if err != nil || cf.cloudfrontID == nil {
+			continue
+		}
+		cf.operationKey = aws.String("reconcile")
+
+		findings, err := s.checkDrift(ctx, cf)
+		if err != nil {
+			logging.FromContext(ctx).Error("error checking drift", logging.KeyInstanceID, id, "error", err)
+			drift.Error = err.Error()
+			report.Instances = append(report.Instances, drift)
+			continue
+		}
+		report.Checked++
+
+		if err = s.stg.RecordDriftFindings(id, findings); err != nil {
+			logging.FromContext(ctx).Error("error checking drift", logging.KeyInstanceID, id, "error", err)
+			drift.Error = err.Error()
+		}
+
+		if len(findings) == 0 {
+			continue
+		}
+		for _, finding := range findings {
+			drift.Kinds = append(drift.Kinds, finding.Kind)
+		}
+		report.Instances = append(report.Instances, drift)
+
+		if kinds := repairableKinds(findings); repair && len(kinds) > 0 {
+			newUUID, _ := uuid.NewV4()
+			cf.operationKey = aws.String("RCN" + strings.Split(newUUID.String(), "-")[0])
+			if err = s.ActionReconcileNew(cf, kinds); err != nil {
+				drift.Error = err.Error()
+				continue
+			}
+			drift.RepairKey = *cf.operationKey
+		}
+	}
+
+	return report, nil
+}
+
+// RunReconcile checks for drift every interval and logs the report,
+// drifted instances are only repaired when repair is set. It returns when ctx is done.
+func (s *AwsConfig) RunReconcile(ctx context.Context, interval time.Duration, repair bool) {
+	for sleepContext(ctx, interval) {
+		report, err := s.Reconcile(ctx, repair)
+		if err != nil {
+			logging.FromContext(ctx).Error("reconcile failed", "error", err)
+			continue
+		}
+
+		reportb, _ := json.Marshal(report)
+		logging.FromContext(ctx).Info("reconcile", "drifted", len(report.Instances), "checked", report.Checked, "report", string(reportb))
+	}
+}
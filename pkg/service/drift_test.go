@@ -0,0 +1,50 @@
+package service
+
+import (
+	"testing"
+
+	"cloudfront-broker/pkg/storage"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDrift(t *testing.T) {
+	Convey("Normalizing json documents", t, func() {
+		So(normalizeJSON(`{"b": [1, 2], "a": "x"}`), ShouldEqual, normalizeJSON(`{"a":"x","b":[1,2]}`))
+		So(normalizeJSON(""), ShouldEqual, "")
+	})
+
+	Convey("Distribution profile settings", t, func() {
+		profile := &DistributionProfile{PriceClass: cloudfront.PriceClassPriceClass100, Compress: aws.Bool(true)}
+
+		expected := &cloudfront.DistributionConfig{DefaultCacheBehavior: &cloudfront.DefaultCacheBehavior{}}
+		applyDistributionProfile(expected, profile)
+
+		actual := &cloudfront.DistributionConfig{
+			Enabled:              aws.Bool(true),
+			Comment:              aws.String("bucket"),
+			DefaultCacheBehavior: &cloudfront.DefaultCacheBehavior{TargetOriginId: aws.String("origin")},
+		}
+		applyDistributionProfile(actual, profile)
+
+		Convey("ignore settings not in the profile", func() {
+			So(marshalNormalized(profileSettings(actual)), ShouldEqual, marshalNormalized(profileSettings(expected)))
+		})
+
+		Convey("find changed settings", func() {
+			actual.PriceClass = aws.String(cloudfront.PriceClassPriceClassAll)
+			So(marshalNormalized(profileSettings(actual)), ShouldNotEqual, marshalNormalized(profileSettings(expected)))
+		})
+	})
+
+	Convey("A missing distribution can not be repaired", t, func() {
+		kinds := repairableKinds([]storage.DriftFinding{
+			{Kind: DriftDistributionMissing},
+			{Kind: DriftCORS},
+		})
+		So(kinds, ShouldResemble, []string{DriftCORS})
+	})
+}
@@ -0,0 +1,317 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloudfront-broker/pkg/logging"
+	"cloudfront-broker/pkg/storage"
+
+	"github.com/pkg/errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Types of orphaned aws resources
+const (
+	OrphanDistribution         string = "distribution"
+	OrphanOriginAccessIdentity string = "origin-access-identity"
+	OrphanIAMUser              string = "iam-user"
+	OrphanBucket               string = "bucket"
+)
+
+// Results of deleting an orphan, a distribution is disabled on one run and deleted on a later one
+const (
+	orphanDeleted   string = "deleted"
+	orphanDisabling string = "disabling"
+	orphanWaiting   string = "waiting"
+	orphanFailed    string = "failed"
+)
+
+// gcGracePeriod protects the resources of running provisions that are not stored in the database yet
+const gcGracePeriod = time.Hour
+
+// Orphan is an aws resource with the name prefix that no distribution or origin references
+type Orphan struct {
+	Type      string     `json:"type"`
+	ID        string     `json:"id"`
+	Comment   string     `json:"comment,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	Result    string     `json:"result,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	enabled   bool
+	deployed  bool
+	// uses are the origin access identities and buckets of an orphaned distribution
+	uses []string
+}
+
+// GCReport lists the orphaned aws resources found by a scan, Applied is true when they were deleted
+type GCReport struct {
+	NamePrefix string    `json:"name_prefix"`
+	ScannedAt  time.Time `json:"scanned_at"`
+	Applied    bool      `json:"applied"`
+	Orphans    []*Orphan `json:"orphans"`
+}
+
+func (s *AwsConfig) hasNamePrefix(name string) bool {
+	return strings.HasPrefix(name, s.namePrefix+"-")
+}
+
+func inGracePeriod(t *time.Time) bool {
+	return t != nil && time.Since(*t) < gcGracePeriod
+}
+
+// CollectGarbage lists the aws resources with the name prefix that the database does not reference,
+// the orphans are only deleted when apply is set
+func (s *AwsConfig) CollectGarbage(ctx context.Context, apply bool) (*GCReport, error) {
+	report := &GCReport{
+		NamePrefix: s.namePrefix,
+		ScannedAt:  time.Now().UTC(),
+		Applied:    apply,
+		Orphans:    []*Orphan{},
+	}
+
+	refs, err := s.stg.GetResourceReferences()
+	if err != nil {
+		msg := fmt.Sprintf("CollectGarbage: error getting references: %s", err.Error())
+		logging.FromContext(ctx).Error(msg)
+		return nil, errors.New(msg)
+	}
+
+	// distributions are listed first, they have to go before the identities and buckets they use
+	for _, find := range []func(context.Context, *storage.ResourceReferences) ([]*Orphan, error){
+		s.findOrphanedDistributions,
+		s.findOrphanedOriginAccessIdentities,
+		s.findOrphanedIAMUsers,
+		s.findOrphanedBuckets,
+	} {
+		orphans, err := find(ctx, refs)
+		if err != nil {
+			msg := fmt.Sprintf("CollectGarbage: error listing resources: %s", err.Error())
+			logging.FromContext(ctx).Error(msg)
+			return nil, errors.New(msg)
+		}
+		report.Orphans = append(report.Orphans, orphans...)
+	}
+
+	if apply {
+		deleteOrphans(ctx, report.Orphans, s.deleteOrphan)
+	}
+
+	return report, nil
+}
+
+// deleteOrphans deletes the orphans in their order with deleteOrphan. The identities and
+// buckets of a distribution that is not deleted in this run are still in use, they wait for
+// a later run. It stops when ctx is done.
+func deleteOrphans(ctx context.Context, orphans []*Orphan, deleteOrphan func(context.Context, *Orphan) (string, error)) {
+	inUse := map[string]bool{}
+
+	for _, orphan := range orphans {
+		if ctx.Err() != nil {
+			return
+		}
+
+		var err error
+		if (orphan.Type == OrphanOriginAccessIdentity || orphan.Type == OrphanBucket) && (inUse[orphan.ID] || inUse[orphan.Comment]) {
+			orphan.Result = orphanWaiting
+		} else if orphan.Result, err = deleteOrphan(ctx, orphan); err != nil {
+			orphan.Result = orphanFailed
+			orphan.Error = err.Error()
+		}
+
+		if orphan.Type == OrphanDistribution && orphan.Result != orphanDeleted {
+			for _, id := range orphan.uses {
+				inUse[id] = true
+			}
+		}
+		logging.FromContext(ctx).Info("orphaned resource", "type", orphan.Type, "id", orphan.ID, "result", orphan.Result)
+	}
+}
+
+// distributionUses returns the bucket names and origin access identities of the s3 origins of
+// the distribution, the comment of a distribution created by the broker is its bucket name
+func distributionUses(dist *cloudfront.DistributionSummary) []string {
+	uses := []string{}
+	if comment := aws.StringValue(dist.Comment); comment != "" {
+		uses = append(uses, comment)
+	}
+	if dist.Origins == nil {
+		return uses
+	}
+
+	for _, origin := range dist.Origins.Items {
+		if origin.S3OriginConfig == nil {
+			continue
+		}
+		uses = append(uses, aws.StringValue(origin.Id))
+		oai := strings.TrimPrefix(aws.StringValue(origin.S3OriginConfig.OriginAccessIdentity), "origin-access-identity/cloudfront/")
+		if oai != "" {
+			uses = append(uses, oai)
+		}
+	}
+	return uses
+}
+
+func (s *AwsConfig) findOrphanedDistributions(ctx context.Context, refs *storage.ResourceReferences) ([]*Orphan, error) {
+	svc := cloudfront.New(s.sess)
+	orphans := []*Orphan{}
+
+	err := svc.ListDistributionsPagesWithContext(ctx, &cloudfront.ListDistributionsInput{}, func(out *cloudfront.ListDistributionsOutput, last bool) bool {
+		for _, dist := range out.DistributionList.Items {
+			id := aws.StringValue(dist.Id)
+			comment := aws.StringValue(dist.Comment)
+
+			// custom origin distributions are only known by their id
+			_, known := refs.CloudfrontIDs[id]
+			if !known && !s.hasNamePrefix(comment) {
+				continue
+			}
+			if refs.CloudfrontIDs[id] || refs.Buckets[comment] || inGracePeriod(dist.LastModifiedTime) {
+				continue
+			}
+
+			orphans = append(orphans, &Orphan{
+				Type:     OrphanDistribution,
+				ID:       id,
+				Comment:  comment,
+				enabled:  aws.BoolValue(dist.Enabled),
+				deployed: aws.StringValue(dist.Status) == "Deployed",
+				uses:     distributionUses(dist),
+			})
+		}
+		return true
+	})
+
+	return orphans, err
+}
+
+func (s *AwsConfig) findOrphanedOriginAccessIdentities(ctx context.Context, refs *storage.ResourceReferences) ([]*Orphan, error) {
+	svc := cloudfront.New(s.sess)
+	orphans := []*Orphan{}
+
+	err := svc.ListCloudFrontOriginAccessIdentitiesPagesWithContext(ctx, &cloudfront.ListCloudFrontOriginAccessIdentitiesInput{}, func(out *cloudfront.ListCloudFrontOriginAccessIdentitiesOutput, last bool) bool {
+		for _, oai := range out.CloudFrontOriginAccessIdentityList.Items {
+			id := aws.StringValue(oai.Id)
+			comment := aws.StringValue(oai.Comment)
+
+			// the comment of an identity is the name of its bucket
+			_, known := refs.OriginAccessIdentities[id]
+			if !known && !s.hasNamePrefix(comment) {
+				continue
+			}
+			if refs.OriginAccessIdentities[id] || refs.Buckets[comment] {
+				continue
+			}
+
+			orphans = append(orphans, &Orphan{Type: OrphanOriginAccessIdentity, ID: id, Comment: comment})
+		}
+		return true
+	})
+
+	return orphans, err
+}
+
+func (s *AwsConfig) findOrphanedIAMUsers(ctx context.Context, refs *storage.ResourceReferences) ([]*Orphan, error) {
+	svc := iam.New(s.sess)
+	orphans := []*Orphan{}
+
+	err := svc.ListUsersPagesWithContext(ctx, &iam.ListUsersInput{}, func(out *iam.ListUsersOutput, last bool) bool {
+		for _, user := range out.Users {
+			name := aws.StringValue(user.UserName)
+			if !s.hasNamePrefix(name) || refs.IAMUsers[name] || refs.Buckets[name] || inGracePeriod(user.CreateDate) {
+				continue
+			}
+
+			orphans = append(orphans, &Orphan{Type: OrphanIAMUser, ID: name, CreatedAt: user.CreateDate})
+		}
+		return true
+	})
+
+	return orphans, err
+}
+
+func (s *AwsConfig) findOrphanedBuckets(ctx context.Context, refs *storage.ResourceReferences) ([]*Orphan, error) {
+	svc := s3.New(s.sess)
+	orphans := []*Orphan{}
+
+	out, err := svc.ListBucketsWithContext(ctx, &s3.ListBucketsInput{})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, bucket := range out.Buckets {
+		name := aws.StringValue(bucket.Name)
+		if !s.hasNamePrefix(name) || refs.Buckets[name] || inGracePeriod(bucket.CreationDate) {
+			continue
+		}
+
+		orphans = append(orphans, &Orphan{Type: OrphanBucket, ID: name, CreatedAt: bucket.CreationDate})
+	}
+
+	return orphans, nil
+}
+
+// deleteOrphan deletes the resource with the helpers used by the delete tasks
+func (s *AwsConfig) deleteOrphan(ctx context.Context, orphan *Orphan) (string, error) {
+	cf := &cloudFrontInstance{
+		operationKey: aws.String("gc"),
+	}
+
+	switch orphan.Type {
+	case OrphanDistribution:
+		cf.cloudfrontID = aws.String(orphan.ID)
+		if orphan.enabled {
+			return orphanDisabling, s.disableDistribution(ctx, cf)
+		}
+		if !orphan.deployed {
+			return orphanWaiting, nil
+		}
+		return orphanDeleted, s.deleteDistribution(ctx, cf)
+	case OrphanOriginAccessIdentity:
+		cf.originAccessIdentity = aws.String(orphan.ID)
+		return orphanDeleted, s.deleteOriginAccessIdentity(ctx, cf)
+	case OrphanIAMUser:
+		cf.s3Bucket = &s3Bucket{iAMUser: &iAMUser{userName: aws.String(orphan.ID)}}
+		return orphanDeleted, s.deleteIAMUser(ctx, cf)
+	case OrphanBucket:
+		cf.s3Bucket = &s3Bucket{bucketName: aws.String(orphan.ID)}
+		progress := &bucketProgress{}
+		for {
+			done, err := s.emptyS3Bucket(ctx, cf, progress)
+			if err != nil {
+				return orphanFailed, err
+			}
+			if done {
+				break
+			}
+			if ctx.Err() != nil {
+				return orphanFailed, ctx.Err()
+			}
+		}
+		return orphanDeleted, s.deleteBucket(ctx, orphan.ID)
+	}
+
+	return orphanFailed, fmt.Errorf("unknown orphan type %s", orphan.Type)
+}
+
+// RunGC scans for orphaned aws resources every interval and logs the report,
+// the orphans are only deleted when apply is set. It returns when ctx is done.
+func (s *AwsConfig) RunGC(ctx context.Context, interval time.Duration, apply bool) {
+	for sleepContext(ctx, interval) {
+		report, err := s.CollectGarbage(ctx, apply)
+		if err != nil {
+			logging.FromContext(ctx).Error("garbage collection failed", "error", err)
+			continue
+		}
+
+		reportb, _ := json.Marshal(report)
+		logging.FromContext(ctx).Info("garbage collection", "orphans", len(report.Orphans), "report", string(reportb))
+	}
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestGC(t *testing.T) {
+	Convey("Scanning for orphans", t, func() {
+		s := &AwsConfig{namePrefix: "cfdev"}
+
+		Convey("only names with the prefix belong to the broker", func() {
+			So(s.hasNamePrefix("cfdev-1a2b3c4d"), ShouldBeTrue)
+			So(s.hasNamePrefix("cfdevother-1a2b3c4d"), ShouldBeFalse)
+			So(s.hasNamePrefix("app.example.com"), ShouldBeFalse)
+		})
+
+		Convey("new resources are in the grace period", func() {
+			recent := time.Now().Add(-time.Minute)
+			old := time.Now().Add(-2 * gcGracePeriod)
+			So(inGracePeriod(&recent), ShouldBeTrue)
+			So(inGracePeriod(&old), ShouldBeFalse)
+			So(inGracePeriod(nil), ShouldBeFalse)
+		})
+	})
+}
+
+func TestDeleteOrphans(t *testing.T) {
+	Convey("Deleting orphans", t, func() {
+		deleted := []string{}
+		deleteOrphan := func(ctx context.Context, orphan *Orphan) (string, error) {
+			if orphan.enabled {
+				return orphanDisabling, nil
+			}
+			deleted = append(deleted, orphan.ID)
+			return orphanDeleted, nil
+		}
+
+		disabling := &Orphan{Type: OrphanDistribution, ID: "E1DIST", Comment: "cfdev-a", enabled: true, uses: []string{"cfdev-a", "E1OAI"}}
+		deletable := &Orphan{Type: OrphanDistribution, ID: "E2DIST", Comment: "cfdev-b", uses: []string{"cfdev-b", "E2OAI"}}
+		orphans := []*Orphan{
+			disabling,
+			deletable,
+			{Type: OrphanOriginAccessIdentity, ID: "E1OAI", Comment: "cfdev-a"},
+			{Type: OrphanOriginAccessIdentity, ID: "E2OAI", Comment: "cfdev-b"},
+			{Type: OrphanIAMUser, ID: "cfdev-a"},
+			{Type: OrphanBucket, ID: "cfdev-a"},
+			{Type: OrphanBucket, ID: "cfdev-b"},
+		}
+
+		Convey("skip the identity and bucket of a distribution being disabled", func() {
+			deleteOrphans(context.Background(), orphans, deleteOrphan)
+
+			So(deleted, ShouldResemble, []string{"E2DIST", "E2OAI", "cfdev-a", "cfdev-b"})
+			So(disabling.Result, ShouldEqual, orphanDisabling)
+			So(orphans[2].Result, ShouldEqual, orphanWaiting)
+			So(orphans[5].Result, ShouldEqual, orphanWaiting)
+		})
+
+		Convey("stop when the context is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			deleteOrphans(ctx, orphans, deleteOrphan)
+			So(deleted, ShouldBeEmpty)
+		})
+	})
+
+	Convey("A distribution uses", t, func() {
+		dist := &cloudfront.DistributionSummary{
+			Comment: aws.String("cfdev-a"),
+			Origins: &cloudfront.Origins{Items: []*cloudfront.Origin{
+				{Id: aws.String("cfdev-a"), S3OriginConfig: &cloudfront.S3OriginConfig{OriginAccessIdentity: aws.String("origin-access-identity/cloudfront/E1OAI")}},
+				{Id: aws.String("app.example.com"), CustomOriginConfig: &cloudfront.CustomOriginConfig{}},
+			}},
+		}
+		So(distributionUses(dist), ShouldResemble, []string{"cfdev-a", "cfdev-a", "E1OAI"})
+	})
+}
@@ -0,0 +1,151 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"cloudfront-broker/pkg/logging"
+
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// Results of the health checks
+const (
+	HealthOK   string = "ok"
+	HealthFail string = "fail"
+)
+
+const (
+	// healthCheckTimeout bounds each dependency check
+	healthCheckTimeout = 5 * time.Second
+	// awsCheckInterval is how long a credential check is reused, probes should not hammer sts
+	awsCheckInterval = time.Minute
+	// taskLoopStaleAfter is how long the task loop may go without polling the database,
+	// an action emptying or archiving a big bucket can take minutes
+	taskLoopStaleAfter = 10 * time.Minute
+)
+
+// HealthCheck is the result of checking one dependency
+type HealthCheck struct {
+	Status    string     `json:"status"`
+	Error     string     `json:"error,omitempty"`
+	CheckedAt time.Time  `json:"checked_at"`
+	LastPoll  *time.Time `json:"last_poll,omitempty"`
+}
+
+// HealthReport is the result of all checks, Status is HealthFail when one check failed
+type HealthReport struct {
+	Status string                  `json:"status"`
+	Checks map[string]*HealthCheck `json:"checks"`
+}
+
+// healthState holds the last poll of the task loop and the last credential check
+type healthState struct {
+	sync.Mutex
+	lastPoll *time.Time
+	aws      *HealthCheck
+}
+
+func newHealthCheck(err error) *HealthCheck {
+	check := &HealthCheck{Status: HealthOK, CheckedAt: time.Now().UTC()}
+	if err != nil {
+		check.Status = HealthFail
+		check.Error = err.Error()
+	}
+	return check
+}
+
+// taskPolled records a successful poll of the task loop
+func (svc *AwsConfig) taskPolled() {
+	now := time.Now().UTC()
+	svc.health.Lock()
+	svc.health.lastPoll = &now
+	svc.health.Unlock()
+}
+
+// checkTaskLoop fails when the task loop stopped polling, nil is returned when
+// the process does not run the task loop
+func (svc *AwsConfig) checkTaskLoop() *HealthCheck {
+	svc.health.Lock()
+	defer svc.health.Unlock()
+
+	if svc.health.lastPoll == nil {
+		return nil
+	}
+
+	check := newHealthCheck(nil)
+	check.LastPoll = svc.health.lastPoll
+	if time.Since(*svc.health.lastPoll) > taskLoopStaleAfter {
+		check.Status = HealthFail
+		check.Error = "task loop did not poll for " + taskLoopStaleAfter.String()
+	}
+	return check
+}
+
+// checkDatabase fails when the database is not reachable, or with schema set when
+// the migrations did not run
+func (svc *AwsConfig) checkDatabase(ctx context.Context, schema bool) *HealthCheck {
+	if err := svc.stg.Ping(ctx); err != nil {
+		return newHealthCheck(err)
+	}
+	if !schema {
+		return newHealthCheck(nil)
+	}
+
+	missing, err := svc.stg.MissingColumns(ctx)
+	if err != nil {
+		return newHealthCheck(err)
+	}
+	check := newHealthCheck(nil)
+	if len(missing) > 0 {
+		check.Status = HealthFail
+		check.Error = "missing columns: " + strings.Join(missing, ", ")
+	}
+	return check
+}
+
+// checkAWS fails when the aws credentials are not valid, the result is reused for a minute
+func (svc *AwsConfig) checkAWS(ctx context.Context) *HealthCheck {
+	svc.health.Lock()
+	defer svc.health.Unlock()
+
+	if svc.health.aws != nil && time.Since(svc.health.aws.CheckedAt) < awsCheckInterval {
+		return svc.health.aws
+	}
+
+	_, err := sts.New(svc.sess).GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		logging.Root().Error("aws health check failed", "error", err)
+	}
+	svc.health.aws = newHealthCheck(err)
+	return svc.health.aws
+}
+
+// CheckHealth checks the database is reachable and the task loop is polling, with ready
+// set it also checks the schema is migrated and the aws credentials are valid
+func (svc *AwsConfig) CheckHealth(ctx context.Context, ready bool) *HealthReport {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	report := &HealthReport{
+		Status: HealthOK,
+		Checks: map[string]*HealthCheck{
+			"database": svc.checkDatabase(ctx, ready),
+		},
+	}
+	if ready {
+		report.Checks["aws"] = svc.checkAWS(ctx)
+	}
+	if check := svc.checkTaskLoop(); check != nil {
+		report.Checks["task_loop"] = check
+	}
+
+	for _, check := range report.Checks {
+		if check.Status != HealthOK {
+			report.Status = HealthFail
+		}
+	}
+	return report
+}
@@ -0,0 +1,31 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTaskLoopHealth(t *testing.T) {
+	Convey("Task loop health", t, func() {
+		svc := &AwsConfig{health: &healthState{}}
+
+		Convey("is not checked when the process does not run tasks", func() {
+			So(svc.checkTaskLoop(), ShouldBeNil)
+		})
+
+		Convey("is ok after a poll", func() {
+			svc.taskPolled()
+			check := svc.checkTaskLoop()
+			So(check.Status, ShouldEqual, HealthOK)
+			So(check.LastPoll, ShouldNotBeNil)
+		})
+
+		Convey("fails when the loop stopped polling", func() {
+			stale := time.Now().Add(-taskLoopStaleAfter - time.Minute)
+			svc.health.lastPoll = &stale
+			So(svc.checkTaskLoop().Status, ShouldEqual, HealthFail)
+		})
+	})
+}
@@ -1,49 +1,41 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
+
+	"cloudfront-broker/pkg/logging"
 
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/golang/glog"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/iam"
 )
 
-func (s *AwsConfig) createIAMUser(cf *cloudFrontInstance) error {
+func (s *AwsConfig) createIAMUser(ctx context.Context, cf *cloudFrontInstance) error {
 	var err error
 	var iamIn *iam.CreateUserInput
 
-	glog.V(4).Infof("==== createIAMUser ====")
-
 	svc := iam.New(s.sess)
 	if svc == nil {
 		msg := fmt.Sprintf("createIAMUser: error getting iam session: %s", err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return errors.New(msg)
 	}
 
-	tags := []*iam.Tag{}
-
-	if cf.billingCode != nil {
-		tags = append(tags, &iam.Tag{
-			Key:   aws.String("billingcode"),
-			Value: cf.billingCode,
-		})
-	}
-
 	iamIn = &iam.CreateUserInput{
 		UserName: cf.s3Bucket.bucketName,
-		Tags:     tags,
+		Tags:     iamTags(cf.tags(cf.parameters, *cf.planID)),
 	}
 
-	iamOut, err := svc.CreateUser(iamIn)
+	iamOut, err := svc.CreateUserWithContext(ctx, iamIn)
 
 	if err != nil {
 		msg := fmt.Sprintf("createIAMUSer: error creating iam user: %s", err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return errors.New(msg)
 	}
 
@@ -58,20 +50,18 @@ func (s *AwsConfig) createIAMUser(cf *cloudFrontInstance) error {
 
 	if err != nil {
 		msg := fmt.Sprintf("createIAMUser: error adding iam user: %s", err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return errors.New(msg)
 	}
 
 	return nil
 }
 
-func (s *AwsConfig) isIAMUserReady(userName string) (bool, error) {
-	glog.V(4).Info("==== isIAMUserReady ====")
-
+func (s *AwsConfig) isIAMUserReady(ctx context.Context, userName string) (bool, error) {
 	svc := iam.New(s.sess)
 	if svc == nil {
 		msg := "checkIAMUser: error getting iam session"
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return false, errors.New(msg)
 	}
 
@@ -79,168 +69,264 @@ func (s *AwsConfig) isIAMUserReady(userName string) (bool, error) {
 		UserName: aws.String(userName),
 	}
 
-	giamOut, err := svc.GetUser(giamIn)
+	giamOut, err := svc.GetUserWithContext(ctx, giamIn)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
 			case iam.ErrCodeNoSuchEntityException:
 				msg := fmt.Sprintf("checkIAMUser: iam user not found: %s", err.Error())
-				glog.V(4).Info(msg)
+				logging.FromContext(ctx).Debug(msg)
 				return false, errors.New(aerr.Code())
 			default:
 				msg := fmt.Sprintf("checkIAMUser: error getting iam user: %s", aerr.Error())
-				glog.Error(msg)
+				logging.FromContext(ctx).Error(msg)
 				return false, errors.New(msg)
 			}
 		}
 	}
 
-	glog.V(0).Infof("isIAMUserReady: iam username: %s", *giamOut.User.UserName)
+	logging.FromContext(ctx).Info("iam user ready", "user_name", *giamOut.User.UserName)
 
 	return true, nil
 }
 
-func (s *AwsConfig) createAccessKey(cf *cloudFrontInstance) error {
-	glog.V(4).Infof("==== createAccessKey [%s] ====", *cf.operationKey)
-
+func (s *AwsConfig) createAccessKey(ctx context.Context, cf *cloudFrontInstance) error {
 	svc := iam.New(s.sess)
 	if svc == nil {
 		msg := "createAccessKey: error getting iam session"
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return errors.New(msg)
 	}
 
-	accessKeyOut, err := svc.CreateAccessKey(&iam.CreateAccessKeyInput{
+	accessKeyOut, err := svc.CreateAccessKeyWithContext(ctx, &iam.CreateAccessKeyInput{
 		UserName: cf.s3Bucket.iAMUser.userName,
 	})
 
 	if err != nil {
 		msg := fmt.Sprintf("createAccessKey: error creating access key: %s", err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
+		return errors.New(msg)
+	}
+
+	// the key is set before it is stored, so a failed action can delete it before retrying
+	logging.FromContext(ctx).Info("created access key", "access_key_id", *accessKeyOut.AccessKey.AccessKeyId)
+	cf.s3Bucket.iAMUser.accessKey = accessKeyOut.AccessKey.AccessKeyId
+	cf.s3Bucket.iAMUser.secretKey = accessKeyOut.AccessKey.SecretAccessKey
+
+	err = s.putUserPolicy(ctx, cf)
+	if err != nil {
+		return err
+	}
+
+	err = s.stg.AddAccessKey(*cf.s3Bucket.originID, *cf.s3Bucket.iAMUser.accessKey, *cf.s3Bucket.iAMUser.secretKey)
+
+	if err != nil {
+		msg := fmt.Sprintf("createAccessKey: error attaching policy: %s", err.Error())
+		logging.FromContext(ctx).Error(msg)
+		return errors.New(msg)
+	}
+
+	return nil
+}
+
+// deleteAccessKey deletes an access key of the iam user of the bucket, a key that no longer
+// exists is not an error
+func (s *AwsConfig) deleteAccessKey(ctx context.Context, cf *cloudFrontInstance, accessKeyID string) error {
+	svc := iam.New(s.sess)
+	if svc == nil {
+		msg := "deleteAccessKey: error getting iam session"
+		logging.FromContext(ctx).Error(msg)
+		return errors.New(msg)
+	}
+
+	logging.FromContext(ctx).Info("deleting access key", "access_key_id", accessKeyID)
+	_, err := svc.DeleteAccessKeyWithContext(ctx, &iam.DeleteAccessKeyInput{
+		UserName:    cf.s3Bucket.iAMUser.userName,
+		AccessKeyId: aws.String(accessKeyID),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == iam.ErrCodeNoSuchEntityException {
+			return nil
+		}
+		msg := fmt.Sprintf("deleteAccessKey: error deleting access key %s: %s", accessKeyID, err.Error())
+		logging.FromContext(ctx).Error(msg)
 		return errors.New(msg)
 	}
 
-	userPolicy, _ := json.Marshal(map[string]interface{}{
-		"Version": "2012-10-17",
-		"Statement": []map[string]interface{}{
-			{
-				"Sid":    "list",
-				"Effect": "Allow",
-				"Action": []string{
-					"s3:PutAccountPublicAccessBlock",
-					"s3:GetAccountPublicAccessBlock",
-					"s3:ListAllMyBuckets",
-					"s3:HeadBucket",
-				},
-				"Resource": "*",
+	return nil
+}
+
+// userPolicyDocument allows the iam user to manage the objects of the bucket but not its protections
+func (s *AwsConfig) userPolicyDocument(cf *cloudFrontInstance) map[string]interface{} {
+	statements := []map[string]interface{}{
+		{
+			"Sid":    "list",
+			"Effect": "Allow",
+			"Action": []string{
+				"s3:PutAccountPublicAccessBlock",
+				"s3:GetAccountPublicAccessBlock",
+				"s3:ListAllMyBuckets",
+				"s3:HeadBucket",
 			},
-			{
-				"Sid":    "access",
-				"Effect": "Allow",
-				"Action": "s3:*",
-				"Resource": []string{
-					fmt.Sprintf("arn:aws:s3:::%s", *cf.s3Bucket.bucketName),
-					fmt.Sprintf("arn:aws:s3:::%s/*", *cf.s3Bucket.bucketName),
-				},
+			"Resource": "*",
+		},
+		{
+			"Sid":    "access",
+			"Effect": "Allow",
+			"Action": "s3:*",
+			"Resource": []string{
+				fmt.Sprintf("arn:aws:s3:::%s", *cf.s3Bucket.bucketName),
+				fmt.Sprintf("arn:aws:s3:::%s/*", *cf.s3Bucket.bucketName),
 			},
 		},
-	})
+		{
+			"Sid":    "protect",
+			"Effect": "Deny",
+			"Action": []string{
+				"s3:PutBucketPublicAccessBlock",
+				"s3:PutEncryptionConfiguration",
+				"s3:PutBucketOwnershipControls",
+				"s3:PutBucketPolicy",
+				"s3:DeleteBucketPolicy",
+			},
+			"Resource": fmt.Sprintf("arn:aws:s3:::%s", *cf.s3Bucket.bucketName),
+		},
+	}
+
+	if s.hardening.KMSKeyID != "" {
+		statements = append(statements, s.kmsKeyStatement())
+	}
+
+	return map[string]interface{}{
+		"Version":   "2012-10-17",
+		"Statement": statements,
+	}
+}
+
+func userPolicyName(cf *cloudFrontInstance) string {
+	return fmt.Sprintf("%s-policy", *cf.s3Bucket.bucketName)
+}
+
+// putUserPolicy replaces the inline policy of the iam user
+func (s *AwsConfig) putUserPolicy(ctx context.Context, cf *cloudFrontInstance) error {
+	svc := iam.New(s.sess)
+	if svc == nil {
+		msg := "putUserPolicy: error getting iam session"
+		logging.FromContext(ctx).Error(msg)
+		return errors.New(msg)
+	}
 
-	policyName := aws.String(fmt.Sprintf("%s-policy", *cf.s3Bucket.bucketName))
+	userPolicy, _ := json.Marshal(s.userPolicyDocument(cf))
 
-	_, err = svc.PutUserPolicy(&iam.PutUserPolicyInput{
-		PolicyName:     policyName,
+	_, err := svc.PutUserPolicyWithContext(ctx, &iam.PutUserPolicyInput{
+		PolicyName:     aws.String(userPolicyName(cf)),
 		PolicyDocument: aws.String(string(userPolicy)),
 		UserName:       cf.s3Bucket.iAMUser.userName,
 	})
 
-	glog.V(0).Infof("createAccessKey: access key: %s", *accessKeyOut.AccessKey.AccessKeyId)
-	cf.s3Bucket.iAMUser.accessKey = accessKeyOut.AccessKey.AccessKeyId
-	cf.s3Bucket.iAMUser.secretKey = accessKeyOut.AccessKey.SecretAccessKey
-
-	err = s.stg.AddAccessKey(*cf.s3Bucket.originID, *cf.s3Bucket.iAMUser.accessKey, *cf.s3Bucket.iAMUser.secretKey)
-
 	if err != nil {
-		msg := fmt.Sprintf("createAccessKey: error attaching policy: %s", err.Error())
-		glog.Error(msg)
+		msg := fmt.Sprintf("putUserPolicy: error putting policy: %s", err.Error())
+		logging.FromContext(ctx).Error(msg)
 		return errors.New(msg)
 	}
 
 	return nil
 }
 
-func (s *AwsConfig) deleteIAMUser(cf *cloudFrontInstance) error {
-	glog.V(4).Infof("==== deleteIAMUser [%s] ====", *cf.operationKey)
+// kmsKeyStatement allows the iam user to use the bucket kms key for reading and writing objects
+func (s *AwsConfig) kmsKeyStatement() map[string]interface{} {
+	statement := map[string]interface{}{
+		"Sid":    "kms",
+		"Effect": "Allow",
+		"Action": []string{
+			"kms:Decrypt",
+			"kms:GenerateDataKey",
+		},
+		"Resource": s.hardening.KMSKeyID,
+	}
+
+	if !strings.HasPrefix(s.hardening.KMSKeyID, "arn:") {
+		statement["Resource"] = "*"
+		statement["Condition"] = map[string]interface{}{
+			"StringEquals": map[string]interface{}{
+				"kms:ViaService": fmt.Sprintf("s3.%s.amazonaws.com", *s.conf.Region),
+			},
+		}
+	}
+
+	return statement
+}
 
+func (s *AwsConfig) deleteIAMUser(ctx context.Context, cf *cloudFrontInstance) error {
 	svc := iam.New(s.sess)
 	if svc == nil {
 		msg := "error getting iam session"
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return errors.New(msg)
 	}
 
-	glog.V(4).Infof("deleteIAMUser [%s]: deleting iam user: %s", *cf.operationKey, *cf.s3Bucket.iAMUser.userName)
+	logging.FromContext(ctx).Debug("deleting iam user", "user_name", *cf.s3Bucket.iAMUser.userName)
 
-	accessKeysOut, err := svc.ListAccessKeys(&iam.ListAccessKeysInput{
+	accessKeysOut, err := svc.ListAccessKeysWithContext(ctx, &iam.ListAccessKeysInput{
 		UserName: cf.s3Bucket.iAMUser.userName,
 	})
 
 	if err != nil {
 		msg := fmt.Sprintf("deleteIAMUser [%s]: error listing access keys: %s", *cf.operationKey, err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return errors.New(msg)
 	}
 
 	for i, accessKeyMeta := range accessKeysOut.AccessKeyMetadata {
-		glog.V(4).Infof("deleteIAMUser [%s]: deleting access key[%d]: %s", *cf.operationKey, i, *accessKeyMeta.AccessKeyId)
+		logging.FromContext(ctx).Debug("deleting access key", "index", i, "access_key_id", *accessKeyMeta.AccessKeyId)
 
-		_, err := svc.DeleteAccessKey(&iam.DeleteAccessKeyInput{
+		_, err := svc.DeleteAccessKeyWithContext(ctx, &iam.DeleteAccessKeyInput{
 			UserName:    cf.s3Bucket.iAMUser.userName,
 			AccessKeyId: accessKeyMeta.AccessKeyId,
 		})
 
 		if err != nil {
 			msg := fmt.Sprintf("deleteIAMUser [%s]: error deleting access key: %s", *cf.operationKey, err.Error())
-			glog.Error(msg)
+			logging.FromContext(ctx).Error(msg)
 			return errors.New(msg)
 		}
 	}
 
-	userPolicyOut, err := svc.ListUserPolicies(&iam.ListUserPoliciesInput{
+	userPolicyOut, err := svc.ListUserPoliciesWithContext(ctx, &iam.ListUserPoliciesInput{
 		UserName: cf.s3Bucket.iAMUser.userName,
 	})
 
 	if err != nil {
 		msg := fmt.Sprintf("deleteIAMUser [%s]: error listing policies: %s", *cf.operationKey, err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return errors.New(msg)
 	}
 
 	for i, policyName := range userPolicyOut.PolicyNames {
 
-		glog.V(4).Infof("deleteIAMUser [%s]: delete user policy{%d]: %s", *cf.operationKey, i, *policyName)
+		logging.FromContext(ctx).Debug("deleting user policy", "index", i, "policy_name", *policyName)
 
-		_, err = svc.DeleteUserPolicy(&iam.DeleteUserPolicyInput{
+		_, err = svc.DeleteUserPolicyWithContext(ctx, &iam.DeleteUserPolicyInput{
 			UserName:   cf.s3Bucket.iAMUser.userName,
 			PolicyName: policyName,
 		})
 
 		if err != nil {
 			msg := fmt.Sprintf("deleteIAMUser [%s]: error deleting user policy: %s", *cf.operationKey, err.Error())
-			glog.Error(msg)
+			logging.FromContext(ctx).Error(msg)
 			return errors.New(msg)
 		}
 	}
 
-	glog.V(4).Infof("deleteIAMUser [%s]: delete user: %s", *cf.operationKey, *cf.s3Bucket.iAMUser.userName)
+	logging.FromContext(ctx).Debug("deleting user", "user_name", *cf.s3Bucket.iAMUser.userName)
 
-	_, err = svc.DeleteUser(&iam.DeleteUserInput{
+	_, err = svc.DeleteUserWithContext(ctx, &iam.DeleteUserInput{
 		UserName: cf.s3Bucket.iAMUser.userName,
 	})
 
 	if err != nil {
 		msg := fmt.Sprintf("deleteIAMUser [%s]: error deleting iam user: %s", *cf.operationKey, err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return errors.New(msg)
 	}
 
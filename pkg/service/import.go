@@ -0,0 +1,399 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloudfront-broker/pkg/logging"
+	"cloudfront-broker/pkg/storage"
+
+	"github.com/nu7hatch/gouuid"
+	"github.com/pkg/errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ImportRequest names the aws resources of a distribution created outside the broker,
+// without a bucket the distribution is imported as a custom origin
+type ImportRequest struct {
+	CloudfrontID string `json:"cloudfront_id"`
+	BucketName   string `json:"bucket_name,omitempty"`
+	IAMUser      string `json:"iam_user,omitempty"`
+	PlanID       string `json:"plan_id"`
+	BillingCode  string `json:"billingcode,omitempty"`
+	Align        bool   `json:"align,omitempty"`
+}
+
+// ImportResult is the instance created for an imported distribution
+type ImportResult struct {
+	InstanceID    string              `json:"instance_id"`
+	CloudfrontID  string              `json:"cloudfront_id"`
+	CloudfrontURL string              `json:"cloudfront_url"`
+	OriginType    string              `json:"origin_type"`
+	Parameters    *InstanceParameters `json:"parameters"`
+	Aligned       bool                `json:"aligned"`
+}
+
+// ImportError is returned when the aws resources can not be adopted by the broker
+type ImportError struct {
+	Reason string
+}
+
+func (e *ImportError) Error() string {
+	return e.Reason
+}
+
+func importErrorf(format string, args ...interface{}) error {
+	return &ImportError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// profileFromConfig returns the distribution profile matching the settings of the config
+func profileFromConfig(config *cloudfront.DistributionConfig) *DistributionProfile {
+	cb := config.DefaultCacheBehavior
+	profile := &DistributionProfile{
+		PriceClass:        aws.StringValue(config.PriceClass),
+		MinTTL:            aws.Int64(aws.Int64Value(cb.MinTTL)),
+		DefaultTTL:        aws.Int64(aws.Int64Value(cb.DefaultTTL)),
+		MaxTTL:            aws.Int64(aws.Int64Value(cb.MaxTTL)),
+		HTTPVersion:       aws.StringValue(config.HttpVersion),
+		IPv6:              aws.Bool(aws.BoolValue(config.IsIPV6Enabled)),
+		Compress:          aws.Bool(aws.BoolValue(cb.Compress)),
+		DefaultRootObject: aws.StringValue(config.DefaultRootObject),
+		WebACLID:          aws.StringValue(config.WebACLId),
+	}
+
+	if l := config.Logging; l != nil && aws.BoolValue(l.Enabled) {
+		profile.Logging = &LoggingParams{
+			Bucket:         strings.TrimSuffix(aws.StringValue(l.Bucket), ".s3.amazonaws.com"),
+			Prefix:         aws.StringValue(l.Prefix),
+			IncludeCookies: aws.BoolValue(l.IncludeCookies),
+		}
+	}
+
+	return profile
+}
+
+// customOriginFromConfig returns the custom origin parameters of a cloudfront origin
+func customOriginFromConfig(origin *cloudfront.Origin) *CustomOriginParams {
+	config := origin.CustomOriginConfig
+	co := &CustomOriginParams{
+		DomainName:       aws.StringValue(origin.DomainName),
+		OriginPath:       aws.StringValue(origin.OriginPath),
+		ProtocolPolicy:   aws.StringValue(config.OriginProtocolPolicy),
+		HTTPPort:         aws.Int64Value(config.HTTPPort),
+		HTTPSPort:        aws.Int64Value(config.HTTPSPort),
+		ReadTimeout:      aws.Int64Value(config.OriginReadTimeout),
+		KeepaliveTimeout: aws.Int64Value(config.OriginKeepaliveTimeout),
+	}
+
+	if config.OriginSslProtocols != nil {
+		co.SslProtocols = aws.StringValueSlice(config.OriginSslProtocols.Items)
+	}
+
+	if origin.CustomHeaders != nil && len(origin.CustomHeaders.Items) > 0 {
+		co.CustomHeaders = map[string]string{}
+		for _, header := range origin.CustomHeaders.Items {
+			co.CustomHeaders[aws.StringValue(header.HeaderName)] = aws.StringValue(header.HeaderValue)
+		}
+	}
+
+	return co
+}
+
+// importedTags returns the tags of the imported resources without the keys the broker sets,
+// the first resource with a key gives its value, nil when there are none
+func importedTags(resourceTags ...map[string]string) map[string]string {
+	var tags map[string]string
+	for _, current := range resourceTags {
+		for k, v := range current {
+			if isReservedTag(k) {
+				continue
+			}
+			if tags == nil {
+				tags = map[string]string{}
+			}
+			if _, ok := tags[k]; !ok {
+				tags[k] = v
+			}
+		}
+	}
+	return tags
+}
+
+// bucketOrigin returns the origin of the config reading from the bucket
+func bucketOrigin(config *cloudfront.DistributionConfig, bucketName string) *cloudfront.Origin {
+	if config.Origins == nil {
+		return nil
+	}
+	for _, origin := range config.Origins.Items {
+		if strings.HasPrefix(aws.StringValue(origin.DomainName), bucketName+".s3") && origin.S3OriginConfig != nil {
+			return origin
+		}
+	}
+	return nil
+}
+
+// ImportDistribution adopts a deployed cloudfront distribution, and the bucket and iam user of
+// its s3 origin, as a new instance. The parameters of the instance are read from the current
+// aws configuration, with Align set the bucket policy, user policy and tags are put in line
+// with what the broker creates.
+func (s *AwsConfig) ImportDistribution(ctx context.Context, req *ImportRequest) (*ImportResult, error) {
+	if req.CloudfrontID == "" || req.PlanID == "" {
+		return nil, importErrorf("cloudfront_id and plan_id are required")
+	}
+	if req.IAMUser != "" && req.BucketName == "" {
+		return nil, importErrorf("iam_user needs a bucket_name")
+	}
+	// the access key of the iam user is what a binding of an s3 origin hands out
+	if req.BucketName != "" && req.IAMUser == "" {
+		return nil, importErrorf("bucket_name needs the iam_user with access to the bucket")
+	}
+
+	plan, err := s.stg.GetPlan(req.PlanID)
+	if err != nil {
+		return nil, importErrorf("plan %s not found", req.PlanID)
+	}
+
+	refs, err := s.stg.GetResourceReferences()
+	if err != nil {
+		msg := fmt.Sprintf("ImportDistribution: error getting references: %s", err.Error())
+		logging.FromContext(ctx).Error(msg)
+		return nil, errors.New(msg)
+	}
+	if _, ok := refs.CloudfrontIDs[req.CloudfrontID]; ok {
+		return nil, importErrorf("distribution %s is already managed by the broker", req.CloudfrontID)
+	}
+	if _, ok := refs.Buckets[req.BucketName]; ok && req.BucketName != "" {
+		return nil, importErrorf("bucket %s is already managed by the broker", req.BucketName)
+	}
+
+	cfSvc := cloudfront.New(s.sess)
+	distOut, err := cfSvc.GetDistributionWithContext(ctx, &cloudfront.GetDistributionInput{Id: aws.String(req.CloudfrontID)})
+	if isNotFoundCode(err, cloudfront.ErrCodeNoSuchDistribution) {
+		return nil, importErrorf("distribution %s not found", req.CloudfrontID)
+	} else if err != nil {
+		msg := fmt.Sprintf("ImportDistribution: error getting distribution: %s", err.Error())
+		logging.FromContext(ctx).Error(msg)
+		return nil, errors.New(msg)
+	}
+
+	dist := distOut.Distribution
+	config := dist.DistributionConfig
+	if aws.StringValue(dist.Status) != "Deployed" || !aws.BoolValue(config.Enabled) {
+		return nil, importErrorf("distribution %s must be enabled and deployed", req.CloudfrontID)
+	}
+
+	newUUID, _ := uuid.NewV4()
+	cf := &cloudFrontInstance{
+		distributionID:  aws.String(newUUID.String()),
+		planID:          &plan.PlanID,
+		serviceID:       &plan.ServiceID,
+		cloudfrontID:    dist.Id,
+		cloudfrontURL:   aws.String("https://" + aws.StringValue(dist.DomainName)),
+		callerReference: config.CallerReference,
+		operationKey:    aws.String("import"),
+		parameters: &InstanceParameters{
+			BillingCode:  req.BillingCode,
+			Distribution: profileFromConfig(config),
+		},
+	}
+	if req.BillingCode != "" {
+		cf.billingCode = aws.String(req.BillingCode)
+	}
+
+	// the current tags are kept as user tags so aligning the tags does not remove them
+	tagsOut, err := cfSvc.ListTagsForResourceWithContext(ctx, &cloudfront.ListTagsForResourceInput{Resource: dist.ARN})
+	if err != nil {
+		msg := fmt.Sprintf("ImportDistribution: error listing distribution tags: %s", err.Error())
+		logging.FromContext(ctx).Error(msg)
+		return nil, errors.New(msg)
+	}
+	currentTags := []map[string]string{{}}
+	for _, tag := range tagsOut.Tags.Items {
+		currentTags[0][aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+
+	var origin *storage.Origin
+
+	if req.BucketName == "" {
+		if config.Origins == nil || len(config.Origins.Items) != 1 || config.Origins.Items[0].CustomOriginConfig == nil {
+			return nil, importErrorf("distribution %s must have a single custom origin when no bucket_name is given", req.CloudfrontID)
+		}
+		cf.originType = OriginTypeCustom
+		cf.parameters.CustomOrigin = customOriginFromConfig(config.Origins.Items[0])
+	} else {
+		cf.originType = OriginTypeS3
+
+		s3Origin := bucketOrigin(config, req.BucketName)
+		if s3Origin == nil {
+			return nil, importErrorf("distribution %s has no s3 origin for bucket %s", req.CloudfrontID, req.BucketName)
+		}
+
+		oai := strings.TrimPrefix(aws.StringValue(s3Origin.S3OriginConfig.OriginAccessIdentity), "origin-access-identity/cloudfront/")
+		if oai == "" {
+			return nil, importErrorf("s3 origin of distribution %s must use an origin access identity", req.CloudfrontID)
+		}
+		cf.originAccessIdentity = aws.String(oai)
+
+		s3Svc := s3.New(s.sess)
+		if _, err = s3Svc.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(req.BucketName)}); err != nil {
+			return nil, importErrorf("bucket %s not found: %s", req.BucketName, err.Error())
+		}
+
+		// the current cors rules are kept so the import does not change the bucket
+		cf.parameters.CORS = []CORSRuleParams{}
+		corsOut, err := s3Svc.GetBucketCorsWithContext(ctx, &s3.GetBucketCorsInput{Bucket: aws.String(req.BucketName)})
+		if err == nil {
+			for _, rule := range corsOut.CORSRules {
+				cf.parameters.CORS = append(cf.parameters.CORS, CORSRuleParams{
+					AllowedOrigins: aws.StringValueSlice(rule.AllowedOrigins),
+					AllowedMethods: aws.StringValueSlice(rule.AllowedMethods),
+					AllowedHeaders: aws.StringValueSlice(rule.AllowedHeaders),
+					ExposeHeaders:  aws.StringValueSlice(rule.ExposeHeaders),
+					MaxAgeSeconds:  aws.Int64Value(rule.MaxAgeSeconds),
+				})
+			}
+		} else if !isNotFoundCode(err, "NoSuchCORSConfiguration") {
+			msg := fmt.Sprintf("ImportDistribution: error getting bucket cors: %s", err.Error())
+			logging.FromContext(ctx).Error(msg)
+			return nil, errors.New(msg)
+		}
+
+		bucketTags := map[string]string{}
+		bucketTagsOut, err := s3Svc.GetBucketTaggingWithContext(ctx, &s3.GetBucketTaggingInput{Bucket: aws.String(req.BucketName)})
+		if err == nil {
+			for _, tag := range bucketTagsOut.TagSet {
+				bucketTags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+			}
+		} else if !isNotFoundCode(err, "NoSuchTagSet") {
+			msg := fmt.Sprintf("ImportDistribution: error getting bucket tags: %s", err.Error())
+			logging.FromContext(ctx).Error(msg)
+			return nil, errors.New(msg)
+		}
+		currentTags = append(currentTags, bucketTags)
+
+		iamSvc := iam.New(s.sess)
+		if _, err = iamSvc.GetUserWithContext(ctx, &iam.GetUserInput{UserName: aws.String(req.IAMUser)}); err != nil {
+			return nil, importErrorf("iam user %s not found: %s", req.IAMUser, err.Error())
+		}
+
+		userTagsOut, err := iamSvc.ListUserTagsWithContext(ctx, &iam.ListUserTagsInput{UserName: aws.String(req.IAMUser)})
+		if err != nil {
+			msg := fmt.Sprintf("ImportDistribution: error listing iam user tags: %s", err.Error())
+			logging.FromContext(ctx).Error(msg)
+			return nil, errors.New(msg)
+		}
+		userTags := map[string]string{}
+		for _, tag := range userTagsOut.Tags {
+			userTags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+		currentTags = append(currentTags, userTags)
+
+		origin = &storage.Origin{
+			BucketName: req.BucketName,
+			BucketURL:  fmt.Sprintf("http://%s/", aws.StringValue(s3Origin.DomainName)),
+			IAMUser:    storage.SetNullString(req.IAMUser),
+		}
+		cf.s3Bucket = &s3Bucket{
+			bucketName: aws.String(req.BucketName),
+			iAMUser:    &iAMUser{userName: aws.String(req.IAMUser)},
+		}
+	}
+
+	cf.parameters.OriginType = cf.originType
+	cf.parameters.Tags = importedTags(currentTags...)
+	if err = cf.parameters.Validate(); err != nil {
+		return nil, importErrorf("distribution %s can not be managed by the broker: %s", req.CloudfrontID, err.Error())
+	}
+
+	if req.Align {
+		if err = s.alignImport(ctx, cf); err != nil {
+			return nil, err
+		}
+	}
+
+	// a binding hands out an access key of the iam user, the existing keys are not known to the broker
+	if origin != nil {
+		keyOut, err := iam.New(s.sess).CreateAccessKeyWithContext(ctx, &iam.CreateAccessKeyInput{UserName: aws.String(req.IAMUser)})
+		if err != nil {
+			return nil, importErrorf("unable to create an access key for iam user %s: %s", req.IAMUser, err.Error())
+		}
+		logging.FromContext(ctx).Info("created access key", "access_key_id", *keyOut.AccessKey.AccessKeyId)
+		origin.AccessKey = storage.SetNullStringPtr(keyOut.AccessKey.AccessKeyId)
+		origin.SecretKey = storage.SetNullStringPtr(keyOut.AccessKey.SecretAccessKey)
+	}
+
+	parameters, _ := json.Marshal(cf.parameters)
+	now := time.Now()
+	err = s.stg.ImportDistribution(&storage.Distribution{
+		DistributionID:       *cf.distributionID,
+		ServiceID:            plan.ServiceID,
+		PlanID:               plan.PlanID,
+		BillingCode:          storage.SetNullStringPtr(cf.billingCode),
+		CallerReference:      aws.StringValue(cf.callerReference),
+		Status:               statusDeployed,
+		OriginType:           cf.originType,
+		Parameters:           storage.SetNullString(string(parameters)),
+		CloudfrontID:         storage.SetNullStringPtr(cf.cloudfrontID),
+		CloudfrontURL:        storage.SetNullStringPtr(cf.cloudfrontURL),
+		OriginAccessIdentity: storage.SetNullStringPtr(cf.originAccessIdentity),
+	}, origin, &storage.Task{
+		Action:       actionDone,
+		Status:       statusFinished,
+		OperationKey: storage.SetNullString("IMP" + strings.Split(*cf.distributionID, "-")[0]),
+		Result:       storage.SetNullString(statusDeployed),
+		Metadata:     storage.SetNullString(fmt.Sprintf("cloudfront distribution %s imported", req.CloudfrontID)),
+		StartedAt:    storage.SetNullTime(&now),
+	})
+	if err != nil {
+		msg := fmt.Sprintf("ImportDistribution: error storing distribution: %s", err.Error())
+		logging.FromContext(ctx).Error(msg)
+		if origin != nil {
+			_ = s.deleteAccessKey(ctx, cf, origin.AccessKey.String)
+		}
+		return nil, errors.New(msg)
+	}
+
+	logging.FromContext(ctx).Info("imported distribution", "cloudfront_id", req.CloudfrontID, logging.KeyInstanceID, *cf.distributionID)
+
+	return &ImportResult{
+		InstanceID:    *cf.distributionID,
+		CloudfrontID:  *cf.cloudfrontID,
+		CloudfrontURL: *cf.cloudfrontURL,
+		OriginType:    cf.originType,
+		Parameters:    cf.parameters,
+		Aligned:       req.Align,
+	}, nil
+}
+
+// alignImport puts the bucket policy, iam user policy and tags of an imported distribution
+// in line with the ones the broker creates
+func (s *AwsConfig) alignImport(ctx context.Context, cf *cloudFrontInstance) error {
+	tags := cf.tags(cf.parameters, *cf.planID)
+
+	if err := s.tagDistribution(ctx, cf, tags); err != nil {
+		return err
+	}
+
+	if cf.isCustomOrigin() {
+		return nil
+	}
+
+	if err := s.addBucketPolicy(ctx, cf); err != nil {
+		return err
+	}
+	if err := s.tagBucket(ctx, cf, tags); err != nil {
+		return err
+	}
+
+	if err := s.putUserPolicy(ctx, cf); err != nil {
+		return err
+	}
+	return s.tagIAMUser(ctx, cf, tags)
+}
@@ -0,0 +1,70 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestImport(t *testing.T) {
+	Convey("The profile read from an imported distribution", t, func() {
+		config := &cloudfront.DistributionConfig{
+			PriceClass:        aws.String(cloudfront.PriceClassPriceClass200),
+			HttpVersion:       aws.String(cloudfront.HttpVersionHttp11),
+			IsIPV6Enabled:     aws.Bool(true),
+			DefaultRootObject: aws.String("index.html"),
+			WebACLId:          aws.String(""),
+			DefaultCacheBehavior: &cloudfront.DefaultCacheBehavior{
+				MinTTL:     aws.Int64(0),
+				DefaultTTL: aws.Int64(300),
+				MaxTTL:     aws.Int64(3600),
+				Compress:   aws.Bool(true),
+			},
+			Logging: &cloudfront.LoggingConfig{
+				Enabled:        aws.Bool(true),
+				Bucket:         aws.String("logs.s3.amazonaws.com"),
+				Prefix:         aws.String("cdn/"),
+				IncludeCookies: aws.Bool(false),
+			},
+		}
+
+		profile := profileFromConfig(config)
+		So(profile.Logging.Bucket, ShouldEqual, "logs")
+		So(profile.Validate(), ShouldBeNil)
+
+		Convey("does not change the distribution when applied", func() {
+			applied := &cloudfront.DistributionConfig{DefaultCacheBehavior: &cloudfront.DefaultCacheBehavior{}}
+			applyDistributionProfile(applied, profile)
+			So(marshalNormalized(profileSettings(applied)), ShouldEqual, marshalNormalized(profileSettings(config)))
+		})
+	})
+
+	Convey("The s3 origin of an imported distribution", t, func() {
+		config := &cloudfront.DistributionConfig{
+			Origins: &cloudfront.Origins{Items: []*cloudfront.Origin{
+				{DomainName: aws.String("example.com"), CustomOriginConfig: &cloudfront.CustomOriginConfig{}},
+				{DomainName: aws.String("assets.s3.amazonaws.com"), S3OriginConfig: &cloudfront.S3OriginConfig{}},
+			}},
+		}
+
+		So(bucketOrigin(config, "assets"), ShouldNotBeNil)
+		So(bucketOrigin(config, "other"), ShouldBeNil)
+	})
+
+	Convey("The tags of an imported distribution", t, func() {
+		Convey("are kept without the keys the broker sets", func() {
+			tags := importedTags(
+				map[string]string{"team": "web", tagBillingCode: "cc-1", tagInstanceID: "old", "aws:cloudformation:stack-name": "cdn"},
+				map[string]string{"team": "assets", "owner": "ops"},
+			)
+			So(tags, ShouldResemble, map[string]string{"team": "web", "owner": "ops"})
+		})
+
+		Convey("are nil without user tags", func() {
+			So(importedTags(map[string]string{}, map[string]string{tagPlanID: "plan-1"}), ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"time"
+
+	"cloudfront-broker/pkg/logging"
+	"cloudfront-broker/pkg/storage"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "cloudfront_broker"
+
+// operationOfAction names the operation finished by the last action of a task chain
+var operationOfAction = map[string]string{
+	actionCreated:    "provision",
+	actionDeleted:    "deprovision",
+	actionUpdated:    "update",
+	actionReconciled: "reconcile",
+}
+
+// Metrics collects the metrics of the task engine and the aws api calls
+type Metrics struct {
+	stg *storage.PostgresStorage
+
+	queuedTasks        *prom.Desc
+	ActionDuration     *prom.HistogramVec
+	ActionRetries      *prom.CounterVec
+	ActionFailures     *prom.CounterVec
+	OperationDuration  *prom.HistogramVec
+	AWSRequests        *prom.CounterVec
+	AWSRequestErrors   *prom.CounterVec
+	AWSRequestDuration *prom.HistogramVec
+}
+
+// NewMetrics constructs the collector, the task queue depth is read from the storage when scraped
+func NewMetrics(stg *storage.PostgresStorage) *Metrics {
+	return &Metrics{
+		stg: stg,
+		queuedTasks: prom.NewDesc(
+			prom.BuildFQName(metricsNamespace, "", "tasks_queued"),
+			"Number of new and pending tasks.",
+			[]string{"action", "status"}, nil,
+		),
+		ActionDuration: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "task_action_duration_seconds",
+			Help:      "Duration of task action runs.",
+			Buckets:   prom.ExponentialBuckets(0.05, 2, 12),
+		}, []string{"action"}),
+		ActionRetries: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "task_action_retries_total",
+			Help:      "Total amount of task action runs that have to be retried.",
+		}, []string{"action"}),
+		ActionFailures: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "task_action_failures_total",
+			Help:      "Total amount of task actions that failed their task.",
+		}, []string{"action"}),
+		OperationDuration: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "operation_duration_seconds",
+			Help:      "Time from the start of an operation until it finished.",
+			Buckets:   prom.ExponentialBuckets(30, 2, 10),
+		}, []string{"operation"}),
+		AWSRequests: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "aws_requests_total",
+			Help:      "Total amount of aws api calls.",
+		}, []string{"service", "operation"}),
+		AWSRequestErrors: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "aws_request_errors_total",
+			Help:      "Total amount of aws api calls that returned an error.",
+		}, []string{"service", "operation", "code"}),
+		AWSRequestDuration: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "aws_request_duration_seconds",
+			Help:      "Duration of aws api calls including retries.",
+			Buckets:   prom.DefBuckets,
+		}, []string{"service", "operation"}),
+	}
+}
+
+// Describe returns all descriptions of the collector.
+func (m *Metrics) Describe(ch chan<- *prom.Desc) {
+	ch <- m.queuedTasks
+	m.ActionDuration.Describe(ch)
+	m.ActionRetries.Describe(ch)
+	m.ActionFailures.Describe(ch)
+	m.OperationDuration.Describe(ch)
+	m.AWSRequests.Describe(ch)
+	m.AWSRequestErrors.Describe(ch)
+	m.AWSRequestDuration.Describe(ch)
+}
+
+// Collect returns the current state of all metrics of the collector.
+func (m *Metrics) Collect(ch chan<- prom.Metric) {
+	if counts, err := m.stg.CountQueuedTasks(); err != nil {
+		logging.Root().Error("error collecting metrics", "error", err)
+	} else {
+		for _, c := range counts {
+			ch <- prom.MustNewConstMetric(m.queuedTasks, prom.GaugeValue, float64(c.Count), c.Action, c.Status)
+		}
+	}
+
+	m.ActionDuration.Collect(ch)
+	m.ActionRetries.Collect(ch)
+	m.ActionFailures.Collect(ch)
+	m.OperationDuration.Collect(ch)
+	m.AWSRequests.Collect(ch)
+	m.AWSRequestErrors.Collect(ch)
+	m.AWSRequestDuration.Collect(ch)
+}
+
+// observeAWSRequest is a complete handler of the aws session counting every api call
+func (m *Metrics) observeAWSRequest(r *request.Request) {
+	service := r.ClientInfo.ServiceName
+	operation := ""
+	if r.Operation != nil {
+		operation = r.Operation.Name
+	}
+
+	m.AWSRequests.WithLabelValues(service, operation).Inc()
+	m.AWSRequestDuration.WithLabelValues(service, operation).Observe(time.Since(r.Time).Seconds())
+
+	if r.Error != nil {
+		code := "unknown"
+		if aerr, ok := r.Error.(interface{ Code() string }); ok {
+			code = aerr.Code()
+		}
+		m.AWSRequestErrors.WithLabelValues(service, operation, code).Inc()
+	}
+}
+
+// observeAction records a run of the action, retries is the retry count of the task before the run.
+// The operation duration is measured from the created_at of the popped task
+func (m *Metrics) observeAction(action string, retries int, started time.Time, curTask *storage.Task) {
+	m.ActionDuration.WithLabelValues(action).Observe(time.Since(started).Seconds())
+
+	switch {
+	case curTask.Status == statusFailed:
+		m.ActionFailures.WithLabelValues(action).Inc()
+	case curTask.Retries > retries:
+		m.ActionRetries.WithLabelValues(action).Inc()
+	case curTask.Status == statusFinished && !curTask.CreatedAt.IsZero():
+		if operation, ok := operationOfAction[action]; ok {
+			m.OperationDuration.WithLabelValues(operation).Observe(time.Since(curTask.CreatedAt).Seconds())
+		}
+	}
+}
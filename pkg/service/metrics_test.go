@@ -0,0 +1,70 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"cloudfront-broker/pkg/storage"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func countMetrics(c prom.Collector) int {
+	ch := make(chan prom.Metric, 10)
+	c.Collect(ch)
+	close(ch)
+	return len(ch)
+}
+
+func TestMetrics(t *testing.T) {
+	Convey("Task metrics", t, func() {
+		m := NewMetrics(nil)
+		started := time.Now()
+
+		Convey("count a retried action", func() {
+			m.observeAction(actionIsDistributionDeployed, 2, started, &storage.Task{Status: statusPending, Retries: 3})
+			So(testutil.ToFloat64(m.ActionRetries.WithLabelValues(actionIsDistributionDeployed)), ShouldEqual, 1)
+			So(testutil.ToFloat64(m.ActionFailures.WithLabelValues(actionIsDistributionDeployed)), ShouldEqual, 0)
+		})
+
+		Convey("count a failed action", func() {
+			m.observeAction(actionCreateOrigin, 0, started, &storage.Task{Status: statusFailed})
+			So(testutil.ToFloat64(m.ActionFailures.WithLabelValues(actionCreateOrigin)), ShouldEqual, 1)
+		})
+
+		Convey("skip the operation duration of a task not read from the tasks table", func() {
+			m.observeAction(actionCreated, 0, started, &storage.Task{Status: statusFinished})
+			So(countMetrics(m.OperationDuration), ShouldEqual, 0)
+		})
+	})
+
+	Convey("AWS request metrics", t, func() {
+		m := NewMetrics(nil)
+		r := &request.Request{
+			ClientInfo: metadata.ClientInfo{ServiceName: "s3"},
+			Operation:  &request.Operation{Name: "PutBucketPolicy"},
+			Time:       time.Now(),
+		}
+
+		Convey("count calls", func() {
+			m.observeAWSRequest(r)
+			So(testutil.ToFloat64(m.AWSRequests.WithLabelValues("s3", "PutBucketPolicy")), ShouldEqual, 1)
+		})
+
+		Convey("count errors by code", func() {
+			r.Error = awserr.New("AccessDenied", "denied", nil)
+			m.observeAWSRequest(r)
+			r.Error = errors.New("connection reset")
+			m.observeAWSRequest(r)
+			So(testutil.ToFloat64(m.AWSRequestErrors.WithLabelValues("s3", "PutBucketPolicy", "AccessDenied")), ShouldEqual, 1)
+			So(testutil.ToFloat64(m.AWSRequestErrors.WithLabelValues("s3", "PutBucketPolicy", "unknown")), ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,671 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Origin types
+const (
+	OriginTypeS3     string = "s3"
+	OriginTypeCustom string = "custom"
+)
+
+const (
+	defaultHTTPPort         int64 = 80
+	defaultHTTPSPort        int64 = 443
+	defaultReadTimeout      int64 = 30
+	defaultKeepaliveTimeout int64 = 5
+)
+
+var validProtocolPolicies = []string{
+	cloudfront.OriginProtocolPolicyHttpOnly,
+	cloudfront.OriginProtocolPolicyMatchViewer,
+	cloudfront.OriginProtocolPolicyHttpsOnly,
+}
+
+var validSslProtocols = []string{
+	cloudfront.SslProtocolSslv3,
+	cloudfront.SslProtocolTlsv1,
+	cloudfront.SslProtocolTlsv11,
+	cloudfront.SslProtocolTlsv12,
+}
+
+var validStorageClasses = []string{
+	s3.TransitionStorageClassStandardIa,
+	s3.TransitionStorageClassOnezoneIa,
+	s3.TransitionStorageClassIntelligentTiering,
+	s3.TransitionStorageClassGlacierIr,
+	s3.TransitionStorageClassGlacier,
+	s3.TransitionStorageClassDeepArchive,
+}
+
+var validPriceClasses = []string{
+	cloudfront.PriceClassPriceClass100,
+	cloudfront.PriceClassPriceClass200,
+	cloudfront.PriceClassPriceClassAll,
+}
+
+var validHTTPVersions = []string{
+	cloudfront.HttpVersionHttp11,
+	cloudfront.HttpVersionHttp2,
+	cloudfront.HttpVersionHttp2and3,
+	cloudfront.HttpVersionHttp3,
+}
+
+var validCORSMethods = []string{"GET", "PUT", "POST", "DELETE", "HEAD"}
+
+// CustomOriginParams holds the settings for a custom (non-S3) origin
+type CustomOriginParams struct {
+	DomainName       string            `json:"domain_name"`
+	OriginPath       string            `json:"origin_path,omitempty"`
+	ProtocolPolicy   string            `json:"protocol_policy,omitempty"`
+	HTTPPort         int64             `json:"http_port,omitempty"`
+	HTTPSPort        int64             `json:"https_port,omitempty"`
+	SslProtocols     []string          `json:"ssl_protocols,omitempty"`
+	CustomHeaders    map[string]string `json:"custom_headers,omitempty"`
+	ReadTimeout      int64             `json:"read_timeout,omitempty"`
+	KeepaliveTimeout int64             `json:"keepalive_timeout,omitempty"`
+}
+
+// TransitionParams moves objects to a cheaper storage class after a number of days
+type TransitionParams struct {
+	Days         int64  `json:"days"`
+	StorageClass string `json:"storage_class"`
+}
+
+// LifecycleParams holds the lifecycle rules for the origin bucket, an empty
+// lifecycle removes the rules from the bucket
+type LifecycleParams struct {
+	NoncurrentVersionExpirationDays    int64              `json:"noncurrent_version_expiration_days,omitempty"`
+	Transitions                        []TransitionParams `json:"transitions,omitempty"`
+	NoncurrentVersionTransitions       []TransitionParams `json:"noncurrent_version_transitions,omitempty"`
+	AbortIncompleteMultipartUploadDays int64              `json:"abort_incomplete_multipart_upload_days,omitempty"`
+}
+
+// CORSRuleParams holds one CORS rule for the origin bucket
+type CORSRuleParams struct {
+	AllowedOrigins []string `json:"allowed_origins"`
+	AllowedMethods []string `json:"allowed_methods"`
+	AllowedHeaders []string `json:"allowed_headers,omitempty"`
+	ExposeHeaders  []string `json:"expose_headers,omitempty"`
+	MaxAgeSeconds  int64    `json:"max_age_seconds,omitempty"`
+}
+
+// LoggingParams holds the standard logging settings of the distribution
+type LoggingParams struct {
+	Bucket         string `json:"bucket"`
+	Prefix         string `json:"prefix,omitempty"`
+	IncludeCookies bool   `json:"include_cookies,omitempty"`
+}
+
+// DistributionProfile holds the distribution settings a plan sets by default,
+// unset values use the CloudFront defaults
+type DistributionProfile struct {
+	PriceClass        string         `json:"price_class,omitempty"`
+	MinTTL            *int64         `json:"min_ttl,omitempty"`
+	DefaultTTL        *int64         `json:"default_ttl,omitempty"`
+	MaxTTL            *int64         `json:"max_ttl,omitempty"`
+	HTTPVersion       string         `json:"http_version,omitempty"`
+	IPv6              *bool          `json:"ipv6,omitempty"`
+	Compress          *bool          `json:"compress,omitempty"`
+	DefaultRootObject string         `json:"default_root_object,omitempty"`
+	Logging           *LoggingParams `json:"logging,omitempty"`
+	WebACLID          string         `json:"web_acl_id,omitempty"`
+}
+
+// InstanceParameters holds the parameters passed in with a provision or update request,
+// CORS is not omitted so an empty list of rules can be told apart from the default rules
+type InstanceParameters struct {
+	BillingCode  string               `json:"billingcode,omitempty"`
+	OriginType   string               `json:"origin_type,omitempty"`
+	CustomOrigin *CustomOriginParams  `json:"custom_origin,omitempty"`
+	Versioning   *bool                `json:"versioning,omitempty"`
+	Lifecycle    *LifecycleParams     `json:"lifecycle,omitempty"`
+	CORS         []CORSRuleParams     `json:"cors"`
+	Distribution *DistributionProfile `json:"distribution,omitempty"`
+	Tags         map[string]string    `json:"tags,omitempty"`
+	WebhookURL   string               `json:"webhook_url,omitempty"`
+}
+
+// defaultCORSRules are applied to the origin bucket when no cors parameter is given
+var defaultCORSRules = []CORSRuleParams{
+	{
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{"GET", "HEAD"},
+		AllowedHeaders: []string{"Authorization"},
+		MaxAgeSeconds:  3600,
+	},
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseInstanceParameters converts the OSB request parameters into InstanceParameters,
+// applies the defaults and validates the result
+func ParseInstanceParameters(parameters map[string]interface{}) (*InstanceParameters, error) {
+	params := &InstanceParameters{}
+
+	if parameters != nil {
+		b, err := json.Marshal(parameters)
+		if err != nil {
+			return nil, errors.New("invalid parameters: " + err.Error())
+		}
+
+		// unknown parameters are rejected so the published schema and the broker can not drift apart
+		decoder := json.NewDecoder(bytes.NewReader(b))
+		decoder.DisallowUnknownFields()
+		if err = decoder.Decode(params); err != nil {
+			return nil, errors.New("invalid parameters: " + err.Error())
+		}
+	}
+
+	params.setDefaults()
+
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+
+	return params, nil
+}
+
+// HashParameters returns the sha256 of the OSB request parameters, no parameters and an
+// empty object hash the same, map keys are sorted when encoding so the hash is stable
+func HashParameters(parameters map[string]interface{}) string {
+	if parameters == nil {
+		parameters = map[string]interface{}{}
+	}
+
+	b, _ := json.Marshal(parameters)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func (p *InstanceParameters) setDefaults() {
+	if p.OriginType == "" {
+		p.OriginType = OriginTypeS3
+	}
+
+	if co := p.CustomOrigin; co != nil {
+		if co.ProtocolPolicy == "" {
+			co.ProtocolPolicy = cloudfront.OriginProtocolPolicyHttpsOnly
+		}
+		if co.HTTPPort == 0 {
+			co.HTTPPort = defaultHTTPPort
+		}
+		if co.HTTPSPort == 0 {
+			co.HTTPSPort = defaultHTTPSPort
+		}
+		if len(co.SslProtocols) == 0 {
+			co.SslProtocols = []string{cloudfront.SslProtocolTlsv12}
+		}
+		if co.ReadTimeout == 0 {
+			co.ReadTimeout = defaultReadTimeout
+		}
+		if co.KeepaliveTimeout == 0 {
+			co.KeepaliveTimeout = defaultKeepaliveTimeout
+		}
+	}
+}
+
+// mergeInstanceParameters applies the parameters of an update request on top of the
+// current parameters, parameters not in the update keep their current value
+func mergeInstanceParameters(current *InstanceParameters, updates map[string]interface{}) (*InstanceParameters, error) {
+	b, err := json.Marshal(current)
+	if err != nil {
+		return nil, errors.New("invalid parameters: " + err.Error())
+	}
+
+	merged := map[string]interface{}{}
+	if err = json.Unmarshal(b, &merged); err != nil {
+		return nil, errors.New("invalid parameters: " + err.Error())
+	}
+
+	for k, v := range updates {
+		merged[k] = v
+	}
+
+	// distribution settings are overlaid on the current profile so plan defaults are kept
+	if v, ok := updates["distribution"]; ok && v != nil {
+		profile, err := mergeDistributionProfile(current.Distribution, v)
+		if err != nil {
+			return nil, err
+		}
+		merged["distribution"] = profile
+	}
+
+	params, err := ParseInstanceParameters(merged)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.OriginType != current.OriginType {
+		return nil, errors.New("origin_type can not be changed")
+	}
+
+	if !reflect.DeepEqual(params.CustomOrigin, current.CustomOrigin) {
+		return nil, errors.New("custom_origin can not be changed")
+	}
+
+	return params, nil
+}
+
+// Validate checks the instance parameters for allowed values
+func (p *InstanceParameters) Validate() error {
+	if err := validateTags(p.Tags); err != nil {
+		return err
+	}
+
+	if p.WebhookURL != "" {
+		if err := ValidateWebhookURL(p.WebhookURL); err != nil {
+			return err
+		}
+	}
+
+	if p.Distribution != nil {
+		if err := p.Distribution.Validate(); err != nil {
+			return err
+		}
+	}
+
+	switch p.OriginType {
+	case OriginTypeS3:
+		if p.CustomOrigin != nil {
+			return errors.New("custom_origin can only be used with origin_type custom")
+		}
+		if p.Lifecycle != nil {
+			if err := p.Lifecycle.Validate(p.Versioning != nil && *p.Versioning); err != nil {
+				return err
+			}
+		}
+		return validateCORSRules(p.CORS)
+	case OriginTypeCustom:
+		if p.CustomOrigin == nil {
+			return errors.New("custom_origin is required with origin_type custom")
+		}
+		if p.Versioning != nil || p.Lifecycle != nil || p.CORS != nil {
+			return errors.New("versioning, lifecycle and cors can only be used with origin_type s3")
+		}
+		return p.CustomOrigin.Validate()
+	default:
+		return fmt.Errorf("origin_type must be one of %s, %s", OriginTypeS3, OriginTypeCustom)
+	}
+}
+
+// isEmpty returns true when the lifecycle has no rules
+func (l *LifecycleParams) isEmpty() bool {
+	return l.NoncurrentVersionExpirationDays == 0 && len(l.Transitions) == 0 &&
+		len(l.NoncurrentVersionTransitions) == 0 && l.AbortIncompleteMultipartUploadDays == 0
+}
+
+// Validate checks the lifecycle rules, noncurrent version rules require versioning
+func (l *LifecycleParams) Validate(versioning bool) error {
+	if l.NoncurrentVersionExpirationDays < 0 || l.AbortIncompleteMultipartUploadDays < 0 {
+		return errors.New("lifecycle days must be a positive number")
+	}
+
+	if !versioning && (l.NoncurrentVersionExpirationDays > 0 || len(l.NoncurrentVersionTransitions) > 0) {
+		return errors.New("lifecycle noncurrent version rules require versioning")
+	}
+
+	if err := validateTransitions("lifecycle.transitions", l.Transitions); err != nil {
+		return err
+	}
+
+	if err := validateTransitions("lifecycle.noncurrent_version_transitions", l.NoncurrentVersionTransitions); err != nil {
+		return err
+	}
+
+	for _, t := range l.NoncurrentVersionTransitions {
+		if l.NoncurrentVersionExpirationDays > 0 && t.Days >= l.NoncurrentVersionExpirationDays {
+			return errors.New("lifecycle noncurrent version transitions must happen before noncurrent versions expire")
+		}
+	}
+
+	return nil
+}
+
+func validateCORSRules(rules []CORSRuleParams) error {
+	if len(rules) > 100 {
+		return errors.New("cors can not have more than 100 rules")
+	}
+
+	for i, rule := range rules {
+		if len(rule.AllowedOrigins) == 0 {
+			return fmt.Errorf("cors[%d].allowed_origins is required", i)
+		}
+
+		for _, origin := range rule.AllowedOrigins {
+			if origin == "" || strings.Count(origin, "*") > 1 {
+				return fmt.Errorf("cors[%d].allowed_origins can not be blank or have more than one *", i)
+			}
+		}
+
+		if len(rule.AllowedMethods) == 0 {
+			return fmt.Errorf("cors[%d].allowed_methods is required", i)
+		}
+
+		for _, method := range rule.AllowedMethods {
+			if !contains(validCORSMethods, method) {
+				return fmt.Errorf("cors[%d].allowed_methods must be in %s", i, strings.Join(validCORSMethods, ", "))
+			}
+		}
+
+		for _, header := range rule.AllowedHeaders {
+			if header == "" || strings.Count(header, "*") > 1 {
+				return fmt.Errorf("cors[%d].allowed_headers can not be blank or have more than one *", i)
+			}
+		}
+
+		for _, header := range rule.ExposeHeaders {
+			if header == "" || strings.Contains(header, "*") {
+				return fmt.Errorf("cors[%d].expose_headers can not be blank or have a *", i)
+			}
+		}
+
+		if rule.MaxAgeSeconds < 0 {
+			return fmt.Errorf("cors[%d].max_age_seconds must be a positive number", i)
+		}
+	}
+
+	return nil
+}
+
+func validateTransitions(name string, transitions []TransitionParams) error {
+	classes := map[string]bool{}
+
+	for _, t := range transitions {
+		if !contains(validStorageClasses, t.StorageClass) {
+			return fmt.Errorf("%s storage_class must be one of %s", name, strings.Join(validStorageClasses, ", "))
+		}
+
+		if classes[t.StorageClass] {
+			return fmt.Errorf("%s can only have one transition to %s", name, t.StorageClass)
+		}
+		classes[t.StorageClass] = true
+
+		if t.Days < 0 {
+			return fmt.Errorf("%s days must be a positive number", name)
+		}
+
+		if (t.StorageClass == s3.TransitionStorageClassStandardIa || t.StorageClass == s3.TransitionStorageClassOnezoneIa) && t.Days < 30 {
+			return fmt.Errorf("%s to %s must be at least 30 days", name, t.StorageClass)
+		}
+	}
+
+	return nil
+}
+
+// Validate checks the custom origin settings for allowed values
+func (co *CustomOriginParams) Validate() error {
+	if co.DomainName == "" {
+		return errors.New("custom_origin.domain_name is required")
+	}
+
+	if strings.Contains(co.DomainName, "://") || strings.Contains(co.DomainName, "/") {
+		return errors.New("custom_origin.domain_name must be a host name without scheme or path")
+	}
+
+	if co.OriginPath != "" && (!strings.HasPrefix(co.OriginPath, "/") || strings.HasSuffix(co.OriginPath, "/")) {
+		return errors.New("custom_origin.origin_path must start with / and not end with /")
+	}
+
+	if !contains(validProtocolPolicies, co.ProtocolPolicy) {
+		return fmt.Errorf("custom_origin.protocol_policy must be one of %s", strings.Join(validProtocolPolicies, ", "))
+	}
+
+	if co.HTTPPort != 80 && co.HTTPPort != 443 && (co.HTTPPort < 1024 || co.HTTPPort > 65535) {
+		return errors.New("custom_origin.http_port must be 80, 443 or between 1024 and 65535")
+	}
+
+	if co.HTTPSPort != 80 && co.HTTPSPort != 443 && (co.HTTPSPort < 1024 || co.HTTPSPort > 65535) {
+		return errors.New("custom_origin.https_port must be 80, 443 or between 1024 and 65535")
+	}
+
+	for _, p := range co.SslProtocols {
+		if !contains(validSslProtocols, p) {
+			return fmt.Errorf("custom_origin.ssl_protocols must be in %s", strings.Join(validSslProtocols, ", "))
+		}
+	}
+
+	if len(co.CustomHeaders) > 10 {
+		return errors.New("custom_origin.custom_headers can not have more than 10 headers")
+	}
+
+	for name, value := range co.CustomHeaders {
+		if name == "" || value == "" {
+			return errors.New("custom_origin.custom_headers names and values can not be blank")
+		}
+	}
+
+	if co.ReadTimeout < 1 || co.ReadTimeout > 60 {
+		return errors.New("custom_origin.read_timeout must be between 1 and 60 seconds")
+	}
+
+	if co.KeepaliveTimeout < 1 || co.KeepaliveTimeout > 60 {
+		return errors.New("custom_origin.keepalive_timeout must be between 1 and 60 seconds")
+	}
+
+	return nil
+}
+
+// customHeaderNames returns the custom header names in a stable order
+func (co *CustomOriginParams) customHeaderNames() []string {
+	names := make([]string, 0, len(co.CustomHeaders))
+	for name := range co.CustomHeaders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Validate checks the plan settings
+func (s *PlanSettings) Validate() error {
+	if s.ArchiveBucket != "" && (strings.Contains(s.ArchiveBucket, "/") || strings.Contains(s.ArchiveBucket, ":")) {
+		return errors.New("archive_bucket must be a bucket name")
+	}
+	if s.Distribution != nil {
+		return s.Distribution.Validate()
+	}
+	return nil
+}
+
+// ApplyPlanSettings merges the distribution profile of the plan with the distribution
+// parameters of the instance, values set on the instance take precedence
+func (p *InstanceParameters) ApplyPlanSettings(settings *PlanSettings) error {
+	if settings == nil || settings.Distribution == nil {
+		return nil
+	}
+
+	profile := *settings.Distribution
+	if p.Distribution != nil {
+		profile.merge(p.Distribution)
+	}
+
+	if err := profile.Validate(); err != nil {
+		return err
+	}
+
+	p.Distribution = &profile
+	return nil
+}
+
+func mergeDistributionProfile(current *DistributionProfile, updates interface{}) (*DistributionProfile, error) {
+	b, err := json.Marshal(updates)
+	if err != nil {
+		return nil, errors.New("invalid distribution: " + err.Error())
+	}
+
+	overrides := &DistributionProfile{}
+	if err = json.Unmarshal(b, overrides); err != nil {
+		return nil, errors.New("invalid distribution: " + err.Error())
+	}
+
+	profile := &DistributionProfile{}
+	if current != nil {
+		*profile = *current
+	}
+	profile.merge(overrides)
+	return profile, nil
+}
+
+// overrides returns the values of the profile that differ from the plan profile
+func (d *DistributionProfile) overrides(plan *DistributionProfile) *DistributionProfile {
+	if plan == nil {
+		plan = &DistributionProfile{}
+	}
+
+	o := &DistributionProfile{}
+	if d.PriceClass != plan.PriceClass {
+		o.PriceClass = d.PriceClass
+	}
+	if !reflect.DeepEqual(d.MinTTL, plan.MinTTL) {
+		o.MinTTL = d.MinTTL
+	}
+	if !reflect.DeepEqual(d.DefaultTTL, plan.DefaultTTL) {
+		o.DefaultTTL = d.DefaultTTL
+	}
+	if !reflect.DeepEqual(d.MaxTTL, plan.MaxTTL) {
+		o.MaxTTL = d.MaxTTL
+	}
+	if d.HTTPVersion != plan.HTTPVersion {
+		o.HTTPVersion = d.HTTPVersion
+	}
+	if !reflect.DeepEqual(d.IPv6, plan.IPv6) {
+		o.IPv6 = d.IPv6
+	}
+	if !reflect.DeepEqual(d.Compress, plan.Compress) {
+		o.Compress = d.Compress
+	}
+	if d.DefaultRootObject != plan.DefaultRootObject {
+		o.DefaultRootObject = d.DefaultRootObject
+	}
+	if !reflect.DeepEqual(d.Logging, plan.Logging) {
+		o.Logging = d.Logging
+	}
+	if d.WebACLID != plan.WebACLID {
+		o.WebACLID = d.WebACLID
+	}
+	return o
+}
+
+// merge overlays the values set in updates
+func (d *DistributionProfile) merge(updates *DistributionProfile) {
+	if updates.PriceClass != "" {
+		d.PriceClass = updates.PriceClass
+	}
+	if updates.MinTTL != nil {
+		d.MinTTL = updates.MinTTL
+	}
+	if updates.DefaultTTL != nil {
+		d.DefaultTTL = updates.DefaultTTL
+	}
+	if updates.MaxTTL != nil {
+		d.MaxTTL = updates.MaxTTL
+	}
+	if updates.HTTPVersion != "" {
+		d.HTTPVersion = updates.HTTPVersion
+	}
+	if updates.IPv6 != nil {
+		d.IPv6 = updates.IPv6
+	}
+	if updates.Compress != nil {
+		d.Compress = updates.Compress
+	}
+	if updates.DefaultRootObject != "" {
+		d.DefaultRootObject = updates.DefaultRootObject
+	}
+	if updates.Logging != nil {
+		d.Logging = updates.Logging
+	}
+	if updates.WebACLID != "" {
+		d.WebACLID = updates.WebACLID
+	}
+}
+
+// ttls returns the min, default and max ttl, without any ttls set all three use the
+// broker default ttl, otherwise unset values are derived from the ones that are set
+func (d *DistributionProfile) ttls() (int64, int64, int64) {
+	if d.MinTTL == nil && d.DefaultTTL == nil && d.MaxTTL == nil {
+		return ttl, ttl, ttl
+	}
+
+	var minTTL int64
+	if d.MinTTL != nil {
+		minTTL = *d.MinTTL
+	}
+
+	maxTTL := ttl
+	if d.MaxTTL != nil {
+		maxTTL = *d.MaxTTL
+	} else if d.DefaultTTL != nil && *d.DefaultTTL > maxTTL {
+		maxTTL = *d.DefaultTTL
+	}
+	if minTTL > maxTTL {
+		maxTTL = minTTL
+	}
+
+	defaultTTL := ttl
+	if d.DefaultTTL != nil {
+		defaultTTL = *d.DefaultTTL
+	} else if defaultTTL < minTTL {
+		defaultTTL = minTTL
+	} else if defaultTTL > maxTTL {
+		defaultTTL = maxTTL
+	}
+
+	return minTTL, defaultTTL, maxTTL
+}
+
+// Validate checks the distribution profile for allowed values
+func (d *DistributionProfile) Validate() error {
+	if d.PriceClass != "" && !contains(validPriceClasses, d.PriceClass) {
+		return fmt.Errorf("distribution.price_class must be one of %s", strings.Join(validPriceClasses, ", "))
+	}
+
+	for name, value := range map[string]*int64{"min_ttl": d.MinTTL, "default_ttl": d.DefaultTTL, "max_ttl": d.MaxTTL} {
+		if value != nil && *value < 0 {
+			return fmt.Errorf("distribution.%s must be a positive number", name)
+		}
+	}
+
+	if d.MinTTL != nil && d.DefaultTTL != nil && *d.MinTTL > *d.DefaultTTL {
+		return errors.New("distribution.min_ttl can not be greater than default_ttl")
+	}
+	if d.DefaultTTL != nil && d.MaxTTL != nil && *d.DefaultTTL > *d.MaxTTL {
+		return errors.New("distribution.default_ttl can not be greater than max_ttl")
+	}
+	if d.MinTTL != nil && d.MaxTTL != nil && *d.MinTTL > *d.MaxTTL {
+		return errors.New("distribution.min_ttl can not be greater than max_ttl")
+	}
+
+	if d.HTTPVersion != "" && !contains(validHTTPVersions, d.HTTPVersion) {
+		return fmt.Errorf("distribution.http_version must be one of %s", strings.Join(validHTTPVersions, ", "))
+	}
+
+	if strings.HasPrefix(d.DefaultRootObject, "/") {
+		return errors.New("distribution.default_root_object can not start with /")
+	}
+
+	if d.Logging != nil && (d.Logging.Bucket == "" || strings.Contains(d.Logging.Bucket, "/")) {
+		return errors.New("distribution.logging.bucket must be a bucket name")
+	}
+
+	return nil
+}
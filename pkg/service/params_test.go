@@ -0,0 +1,321 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseInstanceParameters(t *testing.T) {
+	Convey("Parsing instance parameters", t, func() {
+		Convey("without parameters defaults to s3 origin", func() {
+			params, err := ParseInstanceParameters(nil)
+			So(err, ShouldBeNil)
+			So(params.OriginType, ShouldEqual, OriginTypeS3)
+			So(params.CustomOrigin, ShouldBeNil)
+		})
+
+		Convey("custom origin gets defaults", func() {
+			params, err := ParseInstanceParameters(map[string]interface{}{
+				"origin_type": "custom",
+				"custom_origin": map[string]interface{}{
+					"domain_name": "app.example.com",
+					"custom_headers": map[string]interface{}{
+						"X-Origin-Verify": "secret",
+					},
+				},
+			})
+			So(err, ShouldBeNil)
+			So(params.OriginType, ShouldEqual, OriginTypeCustom)
+			So(params.CustomOrigin.ProtocolPolicy, ShouldEqual, "https-only")
+			So(params.CustomOrigin.HTTPSPort, ShouldEqual, 443)
+			So(params.CustomOrigin.SslProtocols, ShouldResemble, []string{"TLSv1.2"})
+			So(params.CustomOrigin.ReadTimeout, ShouldEqual, 30)
+			So(params.CustomOrigin.KeepaliveTimeout, ShouldEqual, 5)
+		})
+
+		Convey("custom origin requires domain name", func() {
+			_, err := ParseInstanceParameters(map[string]interface{}{
+				"origin_type":   "custom",
+				"custom_origin": map[string]interface{}{},
+			})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("custom origin domain name can not be a url", func() {
+			_, err := ParseInstanceParameters(map[string]interface{}{
+				"origin_type": "custom",
+				"custom_origin": map[string]interface{}{
+					"domain_name": "https://app.example.com/",
+				},
+			})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("custom origin settings require custom origin type", func() {
+			_, err := ParseInstanceParameters(map[string]interface{}{
+				"custom_origin": map[string]interface{}{
+					"domain_name": "app.example.com",
+				},
+			})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("invalid protocol policy and timeouts are rejected", func() {
+			_, err := ParseInstanceParameters(map[string]interface{}{
+				"origin_type": "custom",
+				"custom_origin": map[string]interface{}{
+					"domain_name":     "app.example.com",
+					"protocol_policy": "ftp",
+				},
+			})
+			So(err, ShouldNotBeNil)
+
+			_, err = ParseInstanceParameters(map[string]interface{}{
+				"origin_type": "custom",
+				"custom_origin": map[string]interface{}{
+					"domain_name":  "app.example.com",
+					"read_timeout": 90,
+				},
+			})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("unknown origin type is rejected", func() {
+			_, err := ParseInstanceParameters(map[string]interface{}{
+				"origin_type": "ftp",
+			})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("lifecycle noncurrent rules require versioning", func() {
+			_, err := ParseInstanceParameters(map[string]interface{}{
+				"lifecycle": map[string]interface{}{
+					"noncurrent_version_expiration_days": 30,
+				},
+			})
+			So(err, ShouldNotBeNil)
+
+			params, err := ParseInstanceParameters(map[string]interface{}{
+				"versioning": true,
+				"lifecycle": map[string]interface{}{
+					"noncurrent_version_expiration_days":     90,
+					"abort_incomplete_multipart_upload_days": 7,
+					"noncurrent_version_transitions": []interface{}{
+						map[string]interface{}{"days": 30, "storage_class": "STANDARD_IA"},
+					},
+				},
+			})
+			So(err, ShouldBeNil)
+			So(*params.Versioning, ShouldBeTrue)
+			So(params.Lifecycle.NoncurrentVersionExpirationDays, ShouldEqual, 90)
+		})
+
+		Convey("lifecycle transitions are validated", func() {
+			_, err := ParseInstanceParameters(map[string]interface{}{
+				"lifecycle": map[string]interface{}{
+					"transitions": []interface{}{
+						map[string]interface{}{"days": 10, "storage_class": "STANDARD_IA"},
+					},
+				},
+			})
+			So(err, ShouldNotBeNil)
+
+			_, err = ParseInstanceParameters(map[string]interface{}{
+				"lifecycle": map[string]interface{}{
+					"transitions": []interface{}{
+						map[string]interface{}{"days": 10, "storage_class": "TAPE"},
+					},
+				},
+			})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("cors rules are validated", func() {
+			params, err := ParseInstanceParameters(map[string]interface{}{
+				"cors": []interface{}{
+					map[string]interface{}{
+						"allowed_origins": []interface{}{"https://*.example.com"},
+						"allowed_methods": []interface{}{"GET", "PUT"},
+						"expose_headers":  []interface{}{"ETag"},
+						"max_age_seconds": 600,
+					},
+				},
+			})
+			So(err, ShouldBeNil)
+			So(params.CORS, ShouldHaveLength, 1)
+			So(params.CORS[0].MaxAgeSeconds, ShouldEqual, 600)
+
+			_, err = ParseInstanceParameters(map[string]interface{}{
+				"cors": []interface{}{
+					map[string]interface{}{
+						"allowed_origins": []interface{}{"*"},
+						"allowed_methods": []interface{}{"PATCH"},
+					},
+				},
+			})
+			So(err, ShouldNotBeNil)
+
+			_, err = ParseInstanceParameters(map[string]interface{}{
+				"cors": []interface{}{
+					map[string]interface{}{
+						"allowed_methods": []interface{}{"GET"},
+					},
+				},
+			})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("empty cors rules are kept apart from the default", func() {
+			params, err := ParseInstanceParameters(map[string]interface{}{
+				"cors": []interface{}{},
+			})
+			So(err, ShouldBeNil)
+			So(params.CORS, ShouldNotBeNil)
+			So(params.CORS, ShouldBeEmpty)
+
+			params, err = ParseInstanceParameters(nil)
+			So(err, ShouldBeNil)
+			So(params.CORS, ShouldBeNil)
+		})
+
+		Convey("versioning is only allowed for s3 origins", func() {
+			_, err := ParseInstanceParameters(map[string]interface{}{
+				"origin_type": "custom",
+				"versioning":  true,
+				"custom_origin": map[string]interface{}{
+					"domain_name": "app.example.com",
+				},
+			})
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Applying plan settings", t, func() {
+		settings := &PlanSettings{
+			Distribution: &DistributionProfile{
+				PriceClass:        "PriceClass_100",
+				DefaultTTL:        aws.Int64(3600),
+				DefaultRootObject: "index.html",
+			},
+		}
+
+		Convey("instance parameters override the plan profile", func() {
+			params, err := ParseInstanceParameters(map[string]interface{}{
+				"distribution": map[string]interface{}{
+					"price_class": "PriceClass_All",
+					"compress":    true,
+				},
+			})
+			So(err, ShouldBeNil)
+
+			err = params.ApplyPlanSettings(settings)
+			So(err, ShouldBeNil)
+			So(params.Distribution.PriceClass, ShouldEqual, "PriceClass_All")
+			So(*params.Distribution.Compress, ShouldBeTrue)
+			So(params.Distribution.DefaultRootObject, ShouldEqual, "index.html")
+			So(settings.Distribution.PriceClass, ShouldEqual, "PriceClass_100")
+		})
+
+		Convey("the merged profile is validated", func() {
+			params, err := ParseInstanceParameters(map[string]interface{}{
+				"distribution": map[string]interface{}{
+					"max_ttl": 60,
+				},
+			})
+			So(err, ShouldBeNil)
+
+			err = params.ApplyPlanSettings(settings)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("unset ttls are derived", func() {
+			minTTL, defaultTTL, maxTTL := settings.Distribution.ttls()
+			So(minTTL, ShouldEqual, 0)
+			So(defaultTTL, ShouldEqual, 3600)
+			So(maxTTL, ShouldEqual, ttl)
+
+			minTTL, defaultTTL, maxTTL = (&DistributionProfile{}).ttls()
+			So(minTTL, ShouldEqual, ttl)
+			So(defaultTTL, ShouldEqual, ttl)
+			So(maxTTL, ShouldEqual, ttl)
+		})
+
+		Convey("invalid profile values are rejected", func() {
+			_, err := ParseInstanceParameters(map[string]interface{}{
+				"distribution": map[string]interface{}{
+					"http_version": "http4",
+				},
+			})
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Merging update parameters", t, func() {
+		current, err := ParseInstanceParameters(map[string]interface{}{
+			"versioning": true,
+		})
+		So(err, ShouldBeNil)
+
+		Convey("keeps parameters not in the update", func() {
+			params, err := mergeInstanceParameters(current, map[string]interface{}{
+				"lifecycle": map[string]interface{}{
+					"noncurrent_version_expiration_days": 30,
+				},
+			})
+			So(err, ShouldBeNil)
+			So(*params.Versioning, ShouldBeTrue)
+			So(params.Lifecycle.NoncurrentVersionExpirationDays, ShouldEqual, 30)
+		})
+
+		Convey("distribution settings are merged with the current profile", func() {
+			current.Distribution = &DistributionProfile{PriceClass: "PriceClass_100", DefaultRootObject: "index.html"}
+			params, err := mergeInstanceParameters(current, map[string]interface{}{
+				"distribution": map[string]interface{}{
+					"price_class": "PriceClass_200",
+				},
+			})
+			So(err, ShouldBeNil)
+			So(params.Distribution.PriceClass, ShouldEqual, "PriceClass_200")
+			So(params.Distribution.DefaultRootObject, ShouldEqual, "index.html")
+		})
+
+		Convey("plan changes keep the instance overrides", func() {
+			oldPlan := &DistributionProfile{PriceClass: "PriceClass_100", DefaultRootObject: "index.html"}
+			profile := &DistributionProfile{PriceClass: "PriceClass_100", DefaultRootObject: "home.html"}
+
+			params := &InstanceParameters{OriginType: OriginTypeS3, Distribution: profile.overrides(oldPlan)}
+			err := params.ApplyPlanSettings(&PlanSettings{Distribution: &DistributionProfile{PriceClass: "PriceClass_All"}})
+			So(err, ShouldBeNil)
+			So(params.Distribution.PriceClass, ShouldEqual, "PriceClass_All")
+			So(params.Distribution.DefaultRootObject, ShouldEqual, "home.html")
+		})
+
+		Convey("can not change the origin type", func() {
+			_, err := mergeInstanceParameters(current, map[string]interface{}{
+				"origin_type": "custom",
+				"custom_origin": map[string]interface{}{
+					"domain_name": "app.example.com",
+				},
+			})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestHashParameters(t *testing.T) {
+	Convey("Hashing provision parameters", t, func() {
+		Convey("no parameters hash like an empty object", func() {
+			So(HashParameters(nil), ShouldEqual, HashParameters(map[string]interface{}{}))
+		})
+
+		Convey("the hash does not depend on key order", func() {
+			a := HashParameters(map[string]interface{}{"versioning": true, "billingcode": "cc"})
+			b := HashParameters(map[string]interface{}{"billingcode": "cc", "versioning": true})
+			So(a, ShouldEqual, b)
+			So(a, ShouldNotEqual, HashParameters(map[string]interface{}{"versioning": false, "billingcode": "cc"}))
+		})
+	})
+}
@@ -1,12 +1,15 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
 	"strings"
 
-	"github.com/golang/glog"
+	"cloudfront-broker/pkg/logging"
+
 	"github.com/nu7hatch/gouuid"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -23,32 +26,30 @@ func (s *AwsConfig) genBucketName() *string {
 	return &bucketName
 }
 
-func (s *AwsConfig) createS3Bucket(cf *cloudFrontInstance) error {
-
-	glog.V(4).Info("==== createS3Bucket ====")
+func (s *AwsConfig) createS3Bucket(ctx context.Context, cf *cloudFrontInstance) error {
 	svc := s3.New(s.sess)
 	if svc == nil {
 		msg := "createS3Bucket: error getting s3 session"
-		glog.Errorf(msg)
+		logging.FromContext(ctx).Error(msg)
 		return errors.New(msg)
 	}
 
 	bucketName := s.genBucketName()
 
-	glog.V(0).Infof("createS3Bucket: bucket name: %s", *bucketName)
-
 	s3in := &s3.CreateBucketInput{
 		Bucket: bucketName,
 	}
 
-	s3out, err := svc.CreateBucket(s3in)
+	s3out, err := svc.CreateBucketWithContext(ctx, s3in)
 
 	if err != nil {
 		msg := fmt.Sprintf("error creating s3 bucket: %s", err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return errors.New(msg)
 	}
 
+	logging.FromContext(ctx).Info("created bucket", "bucket_name", *bucketName)
+
 	fullname := strings.Replace(*s3out.Location, "http://", "", -1)
 	fullname = strings.Replace(fullname, "/", "", -1)
 
@@ -62,7 +63,7 @@ func (s *AwsConfig) createS3Bucket(cf *cloudFrontInstance) error {
 
 	if err != nil {
 		msg := fmt.Sprintf("createS3Bucket: error adding origin: %s", err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return errors.New(msg)
 	}
 
@@ -71,14 +72,14 @@ func (s *AwsConfig) createS3Bucket(cf *cloudFrontInstance) error {
 	return nil
 }
 
-func (s *AwsConfig) isBucketReady(s3BucketIn *s3Bucket) bool {
+func (s *AwsConfig) isBucketReady(ctx context.Context, s3BucketIn *s3Bucket) bool {
 	getBucketLocationIn := &s3.GetBucketLocationInput{
 		Bucket: s3BucketIn.bucketName,
 	}
 
 	svc := s3.New(s.sess)
 
-	_, err := svc.GetBucketLocation(getBucketLocationIn)
+	_, err := svc.GetBucketLocationWithContext(ctx, getBucketLocationIn)
 
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
@@ -87,7 +88,7 @@ func (s *AwsConfig) isBucketReady(s3BucketIn *s3Bucket) bool {
 				return false
 			default:
 				msg := fmt.Sprintf("isBucketReady: error checking bucket: %s", err.Error())
-				glog.Error(msg)
+				logging.FromContext(ctx).Error(msg)
 				return false
 			}
 		}
@@ -102,7 +103,7 @@ func (s *AwsConfig) getBucket(originID string) *s3Bucket {
 
 	if err != nil {
 		msg := fmt.Sprintf("getBucket: error finding bucket: %s", err.Error())
-		glog.Error(msg)
+		logging.Root().Error(msg)
 		return nil
 	}
 
@@ -120,10 +121,9 @@ func (s *AwsConfig) getBucket(originID string) *s3Bucket {
 	return s3BucketOut
 }
 
-func (s *AwsConfig) addBucketPolicy(cf *cloudFrontInstance) error {
-	glog.V(4).Infof("==== addBucketPolicy [%s] ====", *cf.operationKey)
-
-	policy, _ := json.Marshal(map[string]interface{}{
+// bucketPolicyDocument allows the origin access identity to read the objects of the bucket
+func bucketPolicyDocument(cf *cloudFrontInstance) map[string]interface{} {
+	return map[string]interface{}{
 		"Version": "2012-10-17",
 		"Id":      fmt.Sprintf("Policy%s", *cf.cloudfrontID),
 		"Statement": []map[string]interface{}{
@@ -137,79 +137,582 @@ func (s *AwsConfig) addBucketPolicy(cf *cloudFrontInstance) error {
 				"Resource": fmt.Sprintf("arn:aws:s3:::%s/*", *cf.s3Bucket.bucketName),
 			},
 		},
-	})
+	}
+}
 
-	glog.V(4).Infof("addBucketPolicy [%s]: policy %#v", *cf.operationKey, string(policy))
+func (s *AwsConfig) addBucketPolicy(ctx context.Context, cf *cloudFrontInstance) error {
+	policy, _ := json.Marshal(bucketPolicyDocument(cf))
+
+	logging.FromContext(ctx).Debug("adding bucket policy", "policy", string(policy))
 	svc := s3.New(s.sess)
 	if svc == nil {
 		msg := "error getting s3 session"
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return errors.New(msg)
 	}
 
-	_, err := svc.PutBucketPolicy(&s3.PutBucketPolicyInput{
+	_, err := svc.PutBucketPolicyWithContext(ctx, &s3.PutBucketPolicyInput{
 		Bucket: cf.s3Bucket.bucketName,
 		Policy: aws.String(string(policy)),
 	})
 
 	if err != nil {
 		msg := fmt.Sprintf("error adding bucketpolicy to %s: %s", *cf.s3Bucket.bucketName, err.Error())
-		glog.Errorf(msg)
+		logging.FromContext(ctx).Error(msg)
+		return errors.New(msg)
+	}
+
+	return nil
+}
+
+// putBucketCors replaces the CORS rules on the bucket, nil rules installs the default
+// rules and an empty list of rules deletes the CORS configuration
+func (s *AwsConfig) putBucketCors(ctx context.Context, cf *cloudFrontInstance, rules []CORSRuleParams) error {
+	svc := s3.New(s.sess)
+	if svc == nil {
+		msg := "putBucketCors: error getting s3 session"
+		logging.FromContext(ctx).Error(msg)
 		return errors.New(msg)
 	}
 
-	corsRule := s3.CORSRule{
-		AllowedHeaders: aws.StringSlice([]string{"Authorization"}),
-		AllowedOrigins: aws.StringSlice([]string{"*"}),
-		AllowedMethods: aws.StringSlice([]string{"GET", "HEAD"}),
-		MaxAgeSeconds:  aws.Int64(3600),
+	if rules == nil {
+		rules = defaultCORSRules
+	}
+
+	if len(rules) == 0 {
+		_, err := svc.DeleteBucketCorsWithContext(ctx, &s3.DeleteBucketCorsInput{
+			Bucket: cf.s3Bucket.bucketName,
+		})
+
+		if err != nil {
+			msg := fmt.Sprintf("error deleting CORS Policy from %s: %s", *cf.s3Bucket.bucketName, err.Error())
+			logging.FromContext(ctx).Error(msg)
+			return errors.New(msg)
+		}
+
+		return nil
 	}
 
 	corsIn := &s3.PutBucketCorsInput{
 		Bucket: cf.s3Bucket.bucketName,
 		CORSConfiguration: &s3.CORSConfiguration{
-			CORSRules: []*s3.CORSRule{&corsRule},
+			CORSRules: newCORSRules(rules),
 		},
 	}
 
-	_, err = svc.PutBucketCors(corsIn)
+	_, err := svc.PutBucketCorsWithContext(ctx, corsIn)
 
 	if err != nil {
 		msg := fmt.Sprintf("error adding CORS Policy to %s: %s", *cf.s3Bucket.bucketName, err.Error())
-		glog.Errorf(msg)
+		logging.FromContext(ctx).Error(msg)
 		return errors.New(msg)
 	}
 
 	return nil
 }
 
-func (s *AwsConfig) deleteS3Bucket(cf *cloudFrontInstance) error {
-	glog.V(4).Infof("==== deleteS3Bucket [%s] ====", *cf.operationKey)
+func newCORSRules(rules []CORSRuleParams) []*s3.CORSRule {
+	corsRules := []*s3.CORSRule{}
+	for _, rule := range rules {
+		corsRule := &s3.CORSRule{
+			AllowedOrigins: aws.StringSlice(rule.AllowedOrigins),
+			AllowedMethods: aws.StringSlice(rule.AllowedMethods),
+		}
+		if len(rule.AllowedHeaders) > 0 {
+			corsRule.AllowedHeaders = aws.StringSlice(rule.AllowedHeaders)
+		}
+		if len(rule.ExposeHeaders) > 0 {
+			corsRule.ExposeHeaders = aws.StringSlice(rule.ExposeHeaders)
+		}
+		if rule.MaxAgeSeconds > 0 {
+			corsRule.MaxAgeSeconds = aws.Int64(rule.MaxAgeSeconds)
+		}
+		corsRules = append(corsRules, corsRule)
+	}
+	return corsRules
+}
+
+// bucketPagesPerRun limits how many pages of 1000 objects are archived or deleted
+// each time an action runs, progress is saved in the task context between runs
+const bucketPagesPerRun = 10
+
+// copySource url encodes each segment of the key for the CopySource header
+func copySource(bucket string, key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return bucket + "/" + strings.Join(segments, "/")
+}
+
+// archiveS3Bucket copies the current version of each object to the archive bucket
+// under a prefix of the bucket name, returns true when all objects are copied.
+// When ctx is canceled it stops without an error, progress holds what was copied.
+func (s *AwsConfig) archiveS3Bucket(ctx context.Context, cf *cloudFrontInstance, archiveBucket string, progress *bucketProgress) (bool, error) {
+	svc := s3.New(s.sess)
+	if svc == nil {
+		msg := "archiveS3Bucket: error getting s3 session"
+		logging.FromContext(ctx).Error(msg)
+		return false, errors.New(msg)
+	}
+
+	for page := 0; page < bucketPagesPerRun; page++ {
+		listIn := &s3.ListObjectsV2Input{
+			Bucket:  cf.s3Bucket.bucketName,
+			MaxKeys: aws.Int64(1000),
+		}
+		if progress.ArchiveStartAfter != "" {
+			listIn.StartAfter = aws.String(progress.ArchiveStartAfter)
+		}
+
+		listOut, err := svc.ListObjectsV2WithContext(ctx, listIn)
+		if ctx.Err() != nil {
+			return false, nil
+		}
+		if err != nil {
+			msg := fmt.Sprintf("archiveS3Bucket: error listing objects in %s: %s", *cf.s3Bucket.bucketName, err.Error())
+			logging.FromContext(ctx).Error(msg)
+			return false, errors.New(msg)
+		}
+
+		for _, object := range listOut.Contents {
+			_, err = svc.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+				Bucket:     aws.String(archiveBucket),
+				Key:        aws.String(*cf.s3Bucket.bucketName + "/" + *object.Key),
+				CopySource: aws.String(copySource(*cf.s3Bucket.bucketName, *object.Key)),
+			})
+			if ctx.Err() != nil {
+				return false, nil
+			}
+			if err != nil {
+				msg := fmt.Sprintf("archiveS3Bucket: error copying %s from %s to %s: %s", *object.Key, *cf.s3Bucket.bucketName, archiveBucket, err.Error())
+				logging.FromContext(ctx).Error(msg)
+				return false, errors.New(msg)
+			}
+
+			progress.Archived++
+			progress.ArchiveStartAfter = *object.Key
+		}
+
+		if !aws.BoolValue(listOut.IsTruncated) {
+			return true, nil
+		}
+	}
+
+	logging.FromContext(ctx).Debug("archiving bucket", "archived", progress.Archived)
+	return false, nil
+}
+
+// emptyS3Bucket deletes all object versions and delete markers in batches,
+// returns true when the bucket is empty. When ctx is canceled it stops without an error.
+func (s *AwsConfig) emptyS3Bucket(ctx context.Context, cf *cloudFrontInstance, progress *bucketProgress) (bool, error) {
+	svc := s3.New(s.sess)
+	if svc == nil {
+		msg := "emptyS3Bucket: error getting s3 session"
+		logging.FromContext(ctx).Error(msg)
+		return false, errors.New(msg)
+	}
+
+	for page := 0; page < bucketPagesPerRun; page++ {
+		// deleted versions drop out of the listing so every page starts at the beginning
+		listOut, err := svc.ListObjectVersionsWithContext(ctx, &s3.ListObjectVersionsInput{
+			Bucket:  cf.s3Bucket.bucketName,
+			MaxKeys: aws.Int64(1000),
+		})
+		if ctx.Err() != nil {
+			return false, nil
+		}
+		if err != nil {
+			msg := fmt.Sprintf("emptyS3Bucket: error listing object versions in %s: %s", *cf.s3Bucket.bucketName, err.Error())
+			logging.FromContext(ctx).Error(msg)
+			return false, errors.New(msg)
+		}
+
+		objects := []*s3.ObjectIdentifier{}
+		for _, version := range listOut.Versions {
+			objects = append(objects, &s3.ObjectIdentifier{Key: version.Key, VersionId: version.VersionId})
+		}
+		for _, marker := range listOut.DeleteMarkers {
+			objects = append(objects, &s3.ObjectIdentifier{Key: marker.Key, VersionId: marker.VersionId})
+		}
+
+		if len(objects) == 0 {
+			return true, nil
+		}
+
+		deleteOut, err := svc.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+			Bucket: cf.s3Bucket.bucketName,
+			Delete: &s3.Delete{
+				Objects: objects,
+				Quiet:   aws.Bool(true),
+			},
+		})
+		if ctx.Err() != nil {
+			return false, nil
+		}
+		if err != nil {
+			msg := fmt.Sprintf("emptyS3Bucket: error deleting objects from %s: %s", *cf.s3Bucket.bucketName, err.Error())
+			logging.FromContext(ctx).Error(msg)
+			return false, errors.New(msg)
+		}
+
+		if len(deleteOut.Errors) > 0 {
+			deleteErr := deleteOut.Errors[0]
+			msg := fmt.Sprintf("emptyS3Bucket: error deleting %d objects from %s, first %s: %s", len(deleteOut.Errors), *cf.s3Bucket.bucketName, aws.StringValue(deleteErr.Key), aws.StringValue(deleteErr.Message))
+			logging.FromContext(ctx).Error(msg)
+			return false, errors.New(msg)
+		}
+
+		progress.Deleted += int64(len(objects))
+
+		if !aws.BoolValue(listOut.IsTruncated) {
+			return true, nil
+		}
+	}
+
+	logging.FromContext(ctx).Debug("emptying bucket", "deleted", progress.Deleted)
+	return false, nil
+}
+
+func (s *AwsConfig) deleteS3Bucket(ctx context.Context, cf *cloudFrontInstance) error {
+	err := s.deleteBucket(ctx, *cf.s3Bucket.bucketName)
+	if err != nil {
+		return err
+	}
 
+	_, err = s.stg.UpdateDeleteOrigin(*cf.distributionID, *cf.s3Bucket.originID)
+
+	if err != nil {
+		logging.FromContext(ctx).Error("error updating deleted at", "error", err)
+		return err
+	}
+
+	return nil
+}
+
+// deleteBucket deletes the empty bucket
+func (s *AwsConfig) deleteBucket(ctx context.Context, bucketName string) error {
 	svc := s3.New(s.sess)
 
 	input := &s3.DeleteBucketInput{
-		Bucket: cf.s3Bucket.bucketName,
+		Bucket: aws.String(bucketName),
 	}
 
 	err := input.Validate()
 	if err != nil {
-		glog.Errorf("deleteS3Bucket: error validating delete bucket input: %s", err)
+		logging.FromContext(ctx).Error("error validating delete bucket input", "error", err)
 		return err
 	}
 
-	_, err = svc.DeleteBucket(input)
+	_, err = svc.DeleteBucketWithContext(ctx, input)
 
 	if err != nil {
-		glog.Errorf("deleteS3Bucket: error deleting bucket %s: %s\n", *cf.s3Bucket.bucketName, err)
+		logging.FromContext(ctx).Error("error deleting bucket", "bucket_name", bucketName, "error", err)
 		return err
 	}
 
-	_, err = s.stg.UpdateDeleteOrigin(*cf.distributionID, *cf.s3Bucket.originID)
+	return nil
+}
+
+func (s *AwsConfig) sseAlgorithm() string {
+	if s.hardening.Encryption == EncryptionSSEKMS {
+		return s3.ServerSideEncryptionAwsKms
+	}
+	return s3.ServerSideEncryptionAes256
+}
+
+func (s *AwsConfig) putPublicAccessBlock(ctx context.Context, cf *cloudFrontInstance) error {
+	svc := s3.New(s.sess)
+	if svc == nil {
+		msg := "putPublicAccessBlock: error getting s3 session"
+		logging.FromContext(ctx).Error(msg)
+		return errors.New(msg)
+	}
+
+	_, err := svc.PutPublicAccessBlockWithContext(ctx, &s3.PutPublicAccessBlockInput{
+		Bucket: cf.s3Bucket.bucketName,
+		PublicAccessBlockConfiguration: &s3.PublicAccessBlockConfiguration{
+			BlockPublicAcls:       aws.Bool(true),
+			BlockPublicPolicy:     aws.Bool(true),
+			IgnorePublicAcls:      aws.Bool(true),
+			RestrictPublicBuckets: aws.Bool(true),
+		},
+	})
 
 	if err != nil {
-		glog.Errorf("deleteS3Bucket: error updating deleted at: %s\n", err)
-		return err
+		msg := fmt.Sprintf("putPublicAccessBlock: error blocking public access on %s: %s", *cf.s3Bucket.bucketName, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		return errors.New(msg)
+	}
+
+	return nil
+}
+
+func (s *AwsConfig) putBucketEncryption(ctx context.Context, cf *cloudFrontInstance) error {
+	svc := s3.New(s.sess)
+	if svc == nil {
+		msg := "putBucketEncryption: error getting s3 session"
+		logging.FromContext(ctx).Error(msg)
+		return errors.New(msg)
+	}
+
+	rule := &s3.ServerSideEncryptionRule{
+		ApplyServerSideEncryptionByDefault: &s3.ServerSideEncryptionByDefault{
+			SSEAlgorithm: aws.String(s.sseAlgorithm()),
+		},
+	}
+
+	if s.hardening.Encryption == EncryptionSSEKMS {
+		rule.BucketKeyEnabled = aws.Bool(true)
+		if s.hardening.KMSKeyID != "" {
+			rule.ApplyServerSideEncryptionByDefault.KMSMasterKeyID = aws.String(s.hardening.KMSKeyID)
+		}
+	}
+
+	_, err := svc.PutBucketEncryptionWithContext(ctx, &s3.PutBucketEncryptionInput{
+		Bucket: cf.s3Bucket.bucketName,
+		ServerSideEncryptionConfiguration: &s3.ServerSideEncryptionConfiguration{
+			Rules: []*s3.ServerSideEncryptionRule{rule},
+		},
+	})
+
+	if err != nil {
+		msg := fmt.Sprintf("putBucketEncryption: error setting encryption on %s: %s", *cf.s3Bucket.bucketName, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		return errors.New(msg)
+	}
+
+	return nil
+}
+
+func (s *AwsConfig) putBucketOwnershipControls(ctx context.Context, cf *cloudFrontInstance) error {
+	svc := s3.New(s.sess)
+	if svc == nil {
+		msg := "putBucketOwnershipControls: error getting s3 session"
+		logging.FromContext(ctx).Error(msg)
+		return errors.New(msg)
+	}
+
+	_, err := svc.PutBucketOwnershipControlsWithContext(ctx, &s3.PutBucketOwnershipControlsInput{
+		Bucket: cf.s3Bucket.bucketName,
+		OwnershipControls: &s3.OwnershipControls{
+			Rules: []*s3.OwnershipControlsRule{
+				{ObjectOwnership: aws.String(s3.ObjectOwnershipBucketOwnerEnforced)},
+			},
+		},
+	})
+
+	if err != nil {
+		msg := fmt.Sprintf("putBucketOwnershipControls: error setting ownership controls on %s: %s", *cf.s3Bucket.bucketName, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		return errors.New(msg)
+	}
+
+	return nil
+}
+
+// isNotFoundCode returns true if err is an aws error with one of the passed codes
+func isNotFoundCode(err error, codes ...string) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		for _, code := range codes {
+			if aerr.Code() == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isBucketHardened checks the public access block, encryption and ownership controls
+// configured on the bucket match the broker settings
+func (s *AwsConfig) isBucketHardened(ctx context.Context, cf *cloudFrontInstance) (bool, error) {
+	svc := s3.New(s.sess)
+	if svc == nil {
+		msg := "isBucketHardened: error getting s3 session"
+		logging.FromContext(ctx).Error(msg)
+		return false, errors.New(msg)
+	}
+
+	if s.hardening.BlockPublicAccess {
+		pabOut, err := svc.GetPublicAccessBlockWithContext(ctx, &s3.GetPublicAccessBlockInput{Bucket: cf.s3Bucket.bucketName})
+		if isNotFoundCode(err, "NoSuchPublicAccessBlockConfiguration") {
+			logging.FromContext(ctx).Debug("bucket not hardened, public access block not found")
+			return false, nil
+		} else if err != nil {
+			msg := fmt.Sprintf("isBucketHardened: error getting public access block: %s", err.Error())
+			logging.FromContext(ctx).Error(msg)
+			return false, errors.New(msg)
+		}
+
+		pab := pabOut.PublicAccessBlockConfiguration
+		if !aws.BoolValue(pab.BlockPublicAcls) || !aws.BoolValue(pab.BlockPublicPolicy) ||
+			!aws.BoolValue(pab.IgnorePublicAcls) || !aws.BoolValue(pab.RestrictPublicBuckets) {
+			logging.FromContext(ctx).Debug("bucket not hardened, public access not blocked")
+			return false, nil
+		}
+	}
+
+	encOut, err := svc.GetBucketEncryptionWithContext(ctx, &s3.GetBucketEncryptionInput{Bucket: cf.s3Bucket.bucketName})
+	if isNotFoundCode(err, "ServerSideEncryptionConfigurationNotFoundError") {
+		logging.FromContext(ctx).Debug("bucket not hardened, bucket encryption not found")
+		return false, nil
+	} else if err != nil {
+		msg := fmt.Sprintf("isBucketHardened: error getting bucket encryption: %s", err.Error())
+		logging.FromContext(ctx).Error(msg)
+		return false, errors.New(msg)
+	}
+
+	encrypted := false
+	for _, rule := range encOut.ServerSideEncryptionConfiguration.Rules {
+		def := rule.ApplyServerSideEncryptionByDefault
+		if def == nil || aws.StringValue(def.SSEAlgorithm) != s.sseAlgorithm() {
+			continue
+		}
+		if s.hardening.KMSKeyID != "" && !strings.HasSuffix(aws.StringValue(def.KMSMasterKeyID), s.hardening.KMSKeyID) {
+			continue
+		}
+		encrypted = true
+	}
+
+	if !encrypted {
+		logging.FromContext(ctx).Debug("bucket not hardened, bucket encryption does not match")
+		return false, nil
+	}
+
+	if s.hardening.BucketOwnerEnforced {
+		ocOut, err := svc.GetBucketOwnershipControlsWithContext(ctx, &s3.GetBucketOwnershipControlsInput{Bucket: cf.s3Bucket.bucketName})
+		if isNotFoundCode(err, "OwnershipControlsNotFoundError") {
+			logging.FromContext(ctx).Debug("bucket not hardened, ownership controls not found")
+			return false, nil
+		} else if err != nil {
+			msg := fmt.Sprintf("isBucketHardened: error getting ownership controls: %s", err.Error())
+			logging.FromContext(ctx).Error(msg)
+			return false, errors.New(msg)
+		}
+
+		enforced := false
+		for _, rule := range ocOut.OwnershipControls.Rules {
+			if aws.StringValue(rule.ObjectOwnership) == s3.ObjectOwnershipBucketOwnerEnforced {
+				enforced = true
+			}
+		}
+
+		if !enforced {
+			logging.FromContext(ctx).Debug("bucket not hardened, bucket owner not enforced")
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func (s *AwsConfig) putBucketVersioning(ctx context.Context, cf *cloudFrontInstance, enabled bool) error {
+	svc := s3.New(s.sess)
+	if svc == nil {
+		msg := "putBucketVersioning: error getting s3 session"
+		logging.FromContext(ctx).Error(msg)
+		return errors.New(msg)
+	}
+
+	status := s3.BucketVersioningStatusSuspended
+	if enabled {
+		status = s3.BucketVersioningStatusEnabled
+	}
+
+	_, err := svc.PutBucketVersioningWithContext(ctx, &s3.PutBucketVersioningInput{
+		Bucket: cf.s3Bucket.bucketName,
+		VersioningConfiguration: &s3.VersioningConfiguration{
+			Status: aws.String(status),
+		},
+	})
+
+	if err != nil {
+		msg := fmt.Sprintf("putBucketVersioning: error setting versioning on %s: %s", *cf.s3Bucket.bucketName, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		return errors.New(msg)
+	}
+
+	return nil
+}
+
+func newTransitions(params []TransitionParams) ([]*s3.Transition, []*s3.NoncurrentVersionTransition) {
+	transitions := []*s3.Transition{}
+	noncurrent := []*s3.NoncurrentVersionTransition{}
+
+	for _, t := range params {
+		transitions = append(transitions, &s3.Transition{
+			Days:         aws.Int64(t.Days),
+			StorageClass: aws.String(t.StorageClass),
+		})
+		noncurrent = append(noncurrent, &s3.NoncurrentVersionTransition{
+			NoncurrentDays: aws.Int64(t.Days),
+			StorageClass:   aws.String(t.StorageClass),
+		})
+	}
+
+	return transitions, noncurrent
+}
+
+// putBucketLifecycle replaces the lifecycle rules on the bucket, an empty lifecycle deletes the rules
+func (s *AwsConfig) putBucketLifecycle(ctx context.Context, cf *cloudFrontInstance, lifecycle *LifecycleParams) error {
+	svc := s3.New(s.sess)
+	if svc == nil {
+		msg := "putBucketLifecycle: error getting s3 session"
+		logging.FromContext(ctx).Error(msg)
+		return errors.New(msg)
+	}
+
+	if lifecycle.isEmpty() {
+		_, err := svc.DeleteBucketLifecycleWithContext(ctx, &s3.DeleteBucketLifecycleInput{
+			Bucket: cf.s3Bucket.bucketName,
+		})
+
+		if err != nil {
+			msg := fmt.Sprintf("putBucketLifecycle: error deleting lifecycle on %s: %s", *cf.s3Bucket.bucketName, err.Error())
+			logging.FromContext(ctx).Error(msg)
+			return errors.New(msg)
+		}
+
+		return nil
+	}
+
+	rule := &s3.LifecycleRule{
+		ID:     aws.String(s.namePrefix + "-lifecycle"),
+		Filter: &s3.LifecycleRuleFilter{Prefix: aws.String("")},
+		Status: aws.String(s3.ExpirationStatusEnabled),
+	}
+
+	if len(lifecycle.Transitions) > 0 {
+		rule.Transitions, _ = newTransitions(lifecycle.Transitions)
+	}
+
+	if len(lifecycle.NoncurrentVersionTransitions) > 0 {
+		_, rule.NoncurrentVersionTransitions = newTransitions(lifecycle.NoncurrentVersionTransitions)
+	}
+
+	if lifecycle.NoncurrentVersionExpirationDays > 0 {
+		rule.NoncurrentVersionExpiration = &s3.NoncurrentVersionExpiration{
+			NoncurrentDays: aws.Int64(lifecycle.NoncurrentVersionExpirationDays),
+		}
+	}
+
+	if lifecycle.AbortIncompleteMultipartUploadDays > 0 {
+		rule.AbortIncompleteMultipartUpload = &s3.AbortIncompleteMultipartUpload{
+			DaysAfterInitiation: aws.Int64(lifecycle.AbortIncompleteMultipartUploadDays),
+		}
+	}
+
+	_, err := svc.PutBucketLifecycleConfigurationWithContext(ctx, &s3.PutBucketLifecycleConfigurationInput{
+		Bucket: cf.s3Bucket.bucketName,
+		LifecycleConfiguration: &s3.BucketLifecycleConfiguration{
+			Rules: []*s3.LifecycleRule{rule},
+		},
+	})
+
+	if err != nil {
+		msg := fmt.Sprintf("putBucketLifecycle: error setting lifecycle on %s: %s", *cf.s3Bucket.bucketName, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		return errors.New(msg)
 	}
 
 	return nil
@@ -4,6 +4,7 @@
 package service
 
 import (
+	"context"
 	"testing"
 
 	"cloudfront-broker/pkg/storage"
@@ -42,7 +43,7 @@ func TestAwsConfig_deleteS3Bucket(t *testing.T) {
 				maxRetries: tt.fields.maxRetries,
 				stg:        tt.fields.stg,
 			}
-			if err := s.deleteS3Bucket(tt.args.cf); (err != nil) != tt.wantErr {
+			if err := s.deleteS3Bucket(context.TODO(), tt.args.cf); (err != nil) != tt.wantErr {
 				t.Errorf("AwsConfig.deleteS3Bucket() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -0,0 +1,88 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"cloudfront-broker/pkg/logging"
+	"cloudfront-broker/pkg/storage"
+
+	"github.com/pkg/errors"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// ParameterError is returned when request parameters do not match the plan's schema
+type ParameterError struct {
+	Field       string
+	Description string
+}
+
+func (e *ParameterError) Error() string {
+	return fmt.Sprintf("invalid parameter %s: %s", e.Field, e.Description)
+}
+
+// validateSchema checks the parameters against the json schema, the first failing field is returned
+func validateSchema(schema map[string]interface{}, parameters map[string]interface{}) error {
+	if parameters == nil {
+		parameters = map[string]interface{}{}
+	}
+
+	result, err := gojsonschema.Validate(gojsonschema.NewGoLoader(schema), gojsonschema.NewGoLoader(parameters))
+	if err != nil {
+		return errors.New("error validating parameters: " + err.Error())
+	}
+
+	if result.Valid() {
+		return nil
+	}
+
+	failures := []*ParameterError{}
+	for _, e := range result.Errors() {
+		field := e.Field()
+		// required and unknown property errors are reported on the parent object
+		property, ok := e.Details()["property"].(string)
+		if ok && (e.Type() == "required" || e.Type() == "additional_property_not_allowed") {
+			if field == gojsonschema.STRING_CONTEXT_ROOT {
+				field = property
+			} else {
+				field = field + "." + property
+			}
+		}
+		failures = append(failures, &ParameterError{Field: field, Description: e.Description()})
+	}
+
+	sort.SliceStable(failures, func(i, j int) bool {
+		return failures[i].Field < failures[j].Field
+	})
+	return failures[0]
+}
+
+// ValidateParameters checks the provision or update parameters against the schema published for the plan
+func (s *AwsConfig) ValidateParameters(planID string, parameters map[string]interface{}) error {
+	plan, err := s.stg.GetPlan(planID)
+	if err != nil && err.Error() == storage.PlanNotFound {
+		return &ParameterError{Field: "plan_id", Description: "plan " + planID + " not found"}
+	} else if err != nil {
+		msg := fmt.Sprintf("ValidateParameters: error getting plan: %s", err.Error())
+		logging.Root().Error(msg)
+		return errors.New(msg)
+	}
+
+	schema, err := plan.ParametersSchema()
+	if err != nil {
+		msg := fmt.Sprintf("ValidateParameters: %s", err.Error())
+		logging.Root().Error(msg)
+		return errors.New(msg)
+	}
+
+	return validateSchema(schema, parameters)
+}
+
+// validateSchemaDocument checks the schema can be used to validate parameters
+func validateSchemaDocument(schema map[string]interface{}) error {
+	if _, err := gojsonschema.NewSchema(gojsonschema.NewGoLoader(schema)); err != nil {
+		return errors.New(strings.TrimSpace(err.Error()))
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloudfront-broker/pkg/storage"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestValidateSchema(t *testing.T) {
+	schema := storage.DefaultParametersSchema()
+
+	Convey("Validating parameters against the default schema", t, func() {
+		Convey("every instance parameter is published", func() {
+			properties := schema["properties"].(map[string]interface{})
+			fields := reflect.TypeOf(InstanceParameters{})
+			for i := 0; i < fields.NumField(); i++ {
+				name := strings.Split(fields.Field(i).Tag.Get("json"), ",")[0]
+				So(properties, ShouldContainKey, name)
+			}
+		})
+
+		Convey("valid parameters pass", func() {
+			err := validateSchema(schema, map[string]interface{}{
+				"billingcode": "cdn",
+				"versioning":  true,
+				"cors": []interface{}{
+					map[string]interface{}{
+						"allowed_origins": []interface{}{"*"},
+						"allowed_methods": []interface{}{"GET"},
+					},
+				},
+			})
+			So(err, ShouldBeNil)
+
+			So(validateSchema(schema, nil), ShouldBeNil)
+		})
+
+		Convey("the failing field is reported", func() {
+			err := validateSchema(schema, map[string]interface{}{
+				"distribution": map[string]interface{}{
+					"default_ttl": "forever",
+				},
+			})
+			So(err, ShouldNotBeNil)
+			So(err.(*ParameterError).Field, ShouldEqual, "distribution.default_ttl")
+		})
+
+		Convey("missing required fields are reported with their name", func() {
+			err := validateSchema(schema, map[string]interface{}{
+				"origin_type":   "custom",
+				"custom_origin": map[string]interface{}{},
+			})
+			So(err, ShouldNotBeNil)
+			So(err.(*ParameterError).Field, ShouldEqual, "custom_origin.domain_name")
+		})
+
+		Convey("origin ports are checked as parameter validation does", func() {
+			for _, field := range []string{"http_port", "https_port"} {
+				for _, port := range []int{1, 79, 80, 81, 443, 444, 1023, 1024, 8080, 65535, 65536} {
+					parameters := map[string]interface{}{
+						"origin_type": "custom",
+						"custom_origin": map[string]interface{}{
+							"domain_name": "app.example.com",
+							field:         port,
+						},
+					}
+					_, parseErr := ParseInstanceParameters(parameters)
+					schemaErr := validateSchema(schema, parameters)
+					So(schemaErr == nil, ShouldEqual, parseErr == nil)
+				}
+			}
+		})
+
+		Convey("unknown parameters are rejected", func() {
+			err := validateSchema(schema, map[string]interface{}{
+				"bucket_name": "mine",
+			})
+			So(err, ShouldNotBeNil)
+			So(err.(*ParameterError).Field, ShouldEqual, "bucket_name")
+		})
+	})
+}
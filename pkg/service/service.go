@@ -6,28 +6,49 @@
 //    AWS_ACCESS_KEY
 //    AWS_SECRET_ACCESS_KEY
 //    WAIT_SECS - seconds between each task run
+//    BUCKET_ENCRYPTION - sse-s3 or sse-kms default encryption for new buckets
+//    BUCKET_KMS_KEY_ID - optional kms key for sse-kms bucket encryption
 
 package service
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"os"
 
+	"cloudfront-broker/pkg/logging"
 	"cloudfront-broker/pkg/storage"
+	"cloudfront-broker/pkg/tracing"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/golang/glog"
 )
 
 // Init takes parameters to initialize service package
-func Init(stg *storage.PostgresStorage, namePrefix string, waitSecs int64, maxRetries int64) (*AwsConfig, error) {
+func Init(stg *storage.PostgresStorage, namePrefix string, waitSecs int64, maxRetries int64, hardening *BucketHardening) (*AwsConfig, error) {
 	c := AwsConfig{
 		namePrefix: namePrefix,
 		waitSecs:   waitSecs,
 		maxRetries: maxRetries,
 		conf:       &aws.Config{},
 		stg:        stg,
+		hardening:  hardening,
+		metrics:    NewMetrics(stg),
+		health:     &healthState{},
+	}
+
+	if hardening.Encryption != EncryptionSSES3 && hardening.Encryption != EncryptionSSEKMS {
+		msg := fmt.Sprintf("bucket encryption must be %s or %s", EncryptionSSES3, EncryptionSSEKMS)
+		logging.Root().Error(msg)
+		return nil, errors.New(msg)
+	}
+
+	if hardening.KMSKeyID != "" && hardening.Encryption != EncryptionSSEKMS {
+		msg := fmt.Sprintf("a kms key can only be used with %s bucket encryption", EncryptionSSEKMS)
+		logging.Root().Error(msg)
+		return nil, errors.New(msg)
 	}
 
 	c.waitSecs = waitSecs
@@ -35,30 +56,65 @@ func Init(stg *storage.PostgresStorage, namePrefix string, waitSecs int64, maxRe
 	region := os.Getenv("REGION")
 	if region == "" {
 		msg := "REGION environment variable not set"
-		glog.Errorln(msg)
+		logging.Root().Error(msg)
 		return nil, errors.New(msg)
 	}
 
 	awsAccessKey := os.Getenv("AWS_ACCESS_KEY")
 	if awsAccessKey == "" {
 		msg := "AWS_ACCESS_KEY not set"
-		glog.Errorln(msg)
+		logging.Root().Error(msg)
 		return nil, errors.New(msg)
 	}
 
 	awsSecretAccessKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
 	if awsSecretAccessKey == "" {
 		msg := "AWS_SECRET_ACCESS_KEY not set"
-		glog.Errorln(msg)
+		logging.Root().Error(msg)
 		return nil, errors.New(msg)
 	}
 
 	c.conf.Region = &region
 
-	glog.V(0).Infof("namePrefix: %s", c.namePrefix)
-	glog.V(0).Infof("region: %s", *c.conf.Region)
-	glog.V(0).Infof("AWS_ACCESS_KEY=%s", os.Getenv("AWS_ACCESS_KEY"))
+	logging.Root().Info("aws config", "name_prefix", c.namePrefix, "region", *c.conf.Region, "aws_access_key", os.Getenv("AWS_ACCESS_KEY"), "bucket_hardening", fmt.Sprintf("%+v", *c.hardening))
 
 	c.sess = session.Must(session.NewSession(c.conf))
+	c.sess.Handlers.Complete.PushBack(c.metrics.observeAWSRequest)
+	c.sess.Handlers.Complete.PushBack(logAWSRequest)
+	tracing.AWSHandlers(&c.sess.Handlers)
 	return &c, nil
 }
+
+// WithContext returns a copy of the service making its queries with ctx, they are canceled with
+// ctx and traced as children of its span. The aws api calls are made with the context passed to them.
+func (svc *AwsConfig) WithContext(ctx context.Context) *AwsConfig {
+	c := *svc
+	c.stg = svc.stg.WithContext(ctx)
+	return &c
+}
+
+// logAWSRequest is a complete handler of the aws session logging every api call with its
+// request id, calls made with the context of a task action carry the task fields
+func logAWSRequest(r *request.Request) {
+	operation := ""
+	if r.Operation != nil {
+		operation = r.Operation.Name
+	}
+
+	log := logging.FromContext(r.Context()).With(
+		logging.KeyAWSRequestID, r.RequestID,
+		"aws_service", r.ClientInfo.ServiceName,
+		"aws_operation", operation,
+	)
+	if r.Error != nil {
+		// not found errors are expected by most callers, they log what matters to them
+		log.Debug("aws request failed", "error", r.Error)
+		return
+	}
+	log.Debug("aws request")
+}
+
+// Metrics returns the collector of the task and aws api call metrics
+func (svc *AwsConfig) Metrics() *Metrics {
+	return svc.metrics
+}
@@ -17,6 +17,37 @@ type AwsConfig struct {
 	waitSecs   int64
 	maxRetries int64
 	stg        *storage.PostgresStorage
+	hardening  *BucketHardening
+	metrics    *Metrics
+	health     *healthState
+	webhooks   *WebhookConfig
+}
+
+// Bucket encryption types
+const (
+	EncryptionSSES3  string = "sse-s3"
+	EncryptionSSEKMS string = "sse-kms"
+)
+
+// BucketHardening holds the security settings applied to new origin buckets
+type BucketHardening struct {
+	BlockPublicAccess   bool
+	Encryption          string
+	KMSKeyID            string
+	BucketOwnerEnforced bool
+}
+
+// PlanSettings holds the broker settings stored with a plan
+type PlanSettings struct {
+	ArchiveBucket string               `json:"archive_bucket,omitempty"`
+	Distribution  *DistributionProfile `json:"distribution,omitempty"`
+}
+
+// bucketProgress holds the progress of archiving and emptying a bucket in the delete task context
+type bucketProgress struct {
+	Archived          int64  `json:"archived"`
+	ArchiveStartAfter string `json:"archive_start_after,omitempty"`
+	Deleted           int64  `json:"deleted"`
 }
 
 type cloudFrontInstance struct {
@@ -30,6 +61,15 @@ type cloudFrontInstance struct {
 	originAccessIdentity *string   `json:"origin_access_identity"`
 	s3Bucket             *s3Bucket `json:"s3_bucket"`
 	operationKey         *string
+	originType           string
+	parameters           *InstanceParameters
+	context              *InstanceContext
+	parametersHash       string
+}
+
+// isCustomOrigin returns true when the distribution fronts a custom origin instead of an s3 bucket
+func (cf *cloudFrontInstance) isCustomOrigin() bool {
+	return cf.originType == OriginTypeCustom
 }
 
 type s3Bucket struct {
@@ -51,9 +91,9 @@ type iAMUser struct {
 
 type AccessSpec struct {
 	CloudFrontURL      *string `structs:"CLOUDFRONT_URL"`
-	BucketName         *string `structs:"CLOUDFRONT_BUCKET_NAME"`
-	AwsAccessKey       *string `structs:"CLOUDFRONT_AWS_ACCESS_KEY"`
-	AwsSecretAccessKey *string `structs:"CLOUDFRONT_AWS_SECRET_ACCESS_KEY"`
+	BucketName         *string `structs:"CLOUDFRONT_BUCKET_NAME,omitempty"`
+	AwsAccessKey       *string `structs:"CLOUDFRONT_AWS_ACCESS_KEY,omitempty"`
+	AwsSecretAccessKey *string `structs:"CLOUDFRONT_AWS_SECRET_ACCESS_KEY,omitempty"`
 }
 
 type IAMUserSpec struct {
@@ -71,14 +111,24 @@ type S3BucketSpec struct {
 }
 
 type InstanceSpec struct {
-	ServiceID            *string       `json:"service_id"`
-	PlanID               *string       `json:"plan_id"`
-	BillingCode          *string       `json:"billingcode"`
-	CloudfrontID         *string       `json:"cloudfront_id"`
-	CloudfrontURL        *string       `json:"cloudfront_url"`
-	OriginAccessIdentity *string       `json:"origin_access_identity"`
-	S3Bucket             *S3BucketSpec `json:"s3_bucket"`
-	Access               *AccessSpec   `json:"credentials"`
+	ServiceID            *string             `json:"service_id"`
+	PlanID               *string             `json:"plan_id"`
+	BillingCode          *string             `json:"billingcode"`
+	CloudfrontID         *string             `json:"cloudfront_id"`
+	CloudfrontURL        *string             `json:"cloudfront_url"`
+	OriginAccessIdentity *string             `json:"origin_access_identity"`
+	OriginType           string              `json:"origin_type"`
+	CustomOrigin         *CustomOriginParams `json:"custom_origin,omitempty"`
+	S3Bucket             *S3BucketSpec       `json:"s3_bucket,omitempty"`
+	Access               *AccessSpec         `json:"credentials"`
+}
+
+// RepeatedProvision is how an existing instance matches a repeated provision request,
+// OperationKey is set while the provision of an identical instance is still running
+type RepeatedProvision struct {
+	Identical    bool
+	InProgress   bool
+	OperationKey string
 }
 
 // Status strings from osb-service-lib
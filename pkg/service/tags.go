@@ -0,0 +1,307 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"cloudfront-broker/pkg/logging"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Tag keys set by the broker on the distribution, bucket and iam user
+const (
+	tagBillingCode  string = "billingcode"
+	tagPrefix       string = "broker:"
+	tagInstanceID   string = "broker:instance-id"
+	tagPlanID       string = "broker:plan-id"
+	tagOrganization string = "broker:organization"
+	tagSpace        string = "broker:space"
+	tagApp          string = "broker:app"
+
+	// tagOriginAccessIdentity is only set on the distribution, see distributionTags
+	tagOriginAccessIdentity string = "broker:origin-access-identity"
+)
+
+// AWS allows 50 tags per resource, the rest is left for the broker tags
+const maxUserTags = 40
+
+var tagRegexp = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]*$`)
+
+// InstanceContext holds the platform the instance was provisioned from, it is tagged on the aws resources
+type InstanceContext struct {
+	OrganizationGUID string `json:"organization_guid,omitempty"`
+	SpaceGUID        string `json:"space_guid,omitempty"`
+	AppGUID          string `json:"app_guid,omitempty"`
+}
+
+// NewInstanceContext reads the organization, space and app from the OSB context,
+// the organization and space of the request are used when the context has none
+func NewInstanceContext(organizationGUID string, spaceGUID string, context map[string]interface{}) *InstanceContext {
+	ic := &InstanceContext{
+		OrganizationGUID: organizationGUID,
+		SpaceGUID:        spaceGUID,
+	}
+
+	if v, ok := context["organization_guid"].(string); ok && v != "" {
+		ic.OrganizationGUID = v
+	}
+	if v, ok := context["space_guid"].(string); ok && v != "" {
+		ic.SpaceGUID = v
+	}
+	if v, ok := context["app_guid"].(string); ok && v != "" {
+		ic.AppGUID = v
+	}
+
+	return ic
+}
+
+// validateTags checks the user tags fit the limits of all tagged aws resources,
+// keys used by the broker and aws can not be set
+// isReservedTag is true for the keys set by the broker or aws
+func isReservedTag(key string) bool {
+	lower := strings.ToLower(key)
+	return lower == tagBillingCode || strings.HasPrefix(lower, tagPrefix) || strings.HasPrefix(lower, "aws:")
+}
+
+func validateTags(tags map[string]string) error {
+	if len(tags) > maxUserTags {
+		return fmt.Errorf("tags can have at most %d entries", maxUserTags)
+	}
+
+	for k, v := range tags {
+		if isReservedTag(k) {
+			return fmt.Errorf("tag %s is reserved", k)
+		}
+		if k == "" || len(k) > 128 || !tagRegexp.MatchString(k) {
+			return fmt.Errorf("tag key %s must be 1 to 128 letters, numbers, spaces or _.:/=+-@", k)
+		}
+		if len(v) > 256 || !tagRegexp.MatchString(v) {
+			return fmt.Errorf("tag %s value must be at most 256 letters, numbers, spaces or _.:/=+-@", k)
+		}
+	}
+
+	return nil
+}
+
+// tags returns the user tags of the parameters with the broker tags of the instance,
+// planID is the plan the tags are for
+func (cf *cloudFrontInstance) tags(params *InstanceParameters, planID string) map[string]string {
+	tags := map[string]string{}
+
+	for k, v := range params.Tags {
+		tags[k] = v
+	}
+
+	if params.BillingCode != "" {
+		tags[tagBillingCode] = params.BillingCode
+	} else if cf.billingCode != nil && *cf.billingCode != "" {
+		tags[tagBillingCode] = *cf.billingCode
+	}
+
+	tags[tagInstanceID] = *cf.distributionID
+	tags[tagPlanID] = planID
+
+	if ic := cf.context; ic != nil {
+		if ic.OrganizationGUID != "" {
+			tags[tagOrganization] = ic.OrganizationGUID
+		}
+		if ic.SpaceGUID != "" {
+			tags[tagSpace] = ic.SpaceGUID
+		}
+		if ic.AppGUID != "" {
+			tags[tagApp] = ic.AppGUID
+		}
+	}
+
+	return tags
+}
+
+// distributionTags returns tags with the origin access identity of the instance added.
+// CloudFront origin access identities can not be tagged, so the distribution serving the
+// bucket through the identity records it, and the identity is found by the instance tags
+func (cf *cloudFrontInstance) distributionTags(tags map[string]string) map[string]string {
+	if aws.StringValue(cf.originAccessIdentity) == "" {
+		return tags
+	}
+
+	distTags := map[string]string{tagOriginAccessIdentity: *cf.originAccessIdentity}
+	for k, v := range tags {
+		distTags[k] = v
+	}
+	return distTags
+}
+
+func sortedTagKeys(tags map[string]string) []string {
+	keys := []string{}
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func cloudfrontTags(tags map[string]string) []*cloudfront.Tag {
+	items := []*cloudfront.Tag{}
+	for _, k := range sortedTagKeys(tags) {
+		items = append(items, &cloudfront.Tag{Key: aws.String(k), Value: aws.String(tags[k])})
+	}
+	return items
+}
+
+func iamTags(tags map[string]string) []*iam.Tag {
+	items := []*iam.Tag{}
+	for _, k := range sortedTagKeys(tags) {
+		items = append(items, &iam.Tag{Key: aws.String(k), Value: aws.String(tags[k])})
+	}
+	return items
+}
+
+func s3Tags(tags map[string]string) []*s3.Tag {
+	items := []*s3.Tag{}
+	for _, k := range sortedTagKeys(tags) {
+		items = append(items, &s3.Tag{Key: aws.String(k), Value: aws.String(tags[k])})
+	}
+	return items
+}
+
+// staleTagKeys returns the keys of the current tags not in tags, aws tags are left alone
+func staleTagKeys(current map[string]string, tags map[string]string) []*string {
+	stale := []*string{}
+	for _, k := range sortedTagKeys(current) {
+		if _, ok := tags[k]; !ok && !strings.HasPrefix(strings.ToLower(k), "aws:") {
+			stale = append(stale, aws.String(k))
+		}
+	}
+	return stale
+}
+
+// tagDistribution replaces the tags of the cloudfront distribution with tags and the
+// origin access identity of the instance
+func (s *AwsConfig) tagDistribution(ctx context.Context, cf *cloudFrontInstance, tags map[string]string) error {
+	tags = cf.distributionTags(tags)
+
+	svc := cloudfront.New(s.sess)
+	if svc == nil {
+		msg := "tagDistribution: error getting cloudfront session"
+		logging.FromContext(ctx).Error(msg)
+		return errors.New(msg)
+	}
+
+	distOut, err := s.getCloudfrontDistribution(ctx, cf)
+	if err != nil {
+		msg := fmt.Sprintf("tagDistribution: error getting distribution: %s", err.Error())
+		logging.FromContext(ctx).Error(msg)
+		return errors.New(msg)
+	}
+	arn := distOut.Distribution.ARN
+
+	listOut, err := svc.ListTagsForResourceWithContext(ctx, &cloudfront.ListTagsForResourceInput{Resource: arn})
+	if err != nil {
+		msg := fmt.Sprintf("tagDistribution: error listing tags: %s", err.Error())
+		logging.FromContext(ctx).Error(msg)
+		return errors.New(msg)
+	}
+
+	current := map[string]string{}
+	for _, tag := range listOut.Tags.Items {
+		current[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+
+	if stale := staleTagKeys(current, tags); len(stale) > 0 {
+		_, err = svc.UntagResourceWithContext(ctx, &cloudfront.UntagResourceInput{
+			Resource: arn,
+			TagKeys:  &cloudfront.TagKeys{Items: stale},
+		})
+		if err != nil {
+			msg := fmt.Sprintf("tagDistribution: error removing tags: %s", err.Error())
+			logging.FromContext(ctx).Error(msg)
+			return errors.New(msg)
+		}
+	}
+
+	_, err = svc.TagResourceWithContext(ctx, &cloudfront.TagResourceInput{
+		Resource: arn,
+		Tags:     &cloudfront.Tags{Items: cloudfrontTags(tags)},
+	})
+	if err != nil {
+		msg := fmt.Sprintf("tagDistribution: error adding tags: %s", err.Error())
+		logging.FromContext(ctx).Error(msg)
+		return errors.New(msg)
+	}
+
+	return nil
+}
+
+// tagBucket replaces the tags of the origin bucket with tags
+func (s *AwsConfig) tagBucket(ctx context.Context, cf *cloudFrontInstance, tags map[string]string) error {
+	svc := s3.New(s.sess)
+	if svc == nil {
+		msg := "tagBucket: error getting s3 session"
+		logging.FromContext(ctx).Error(msg)
+		return errors.New(msg)
+	}
+
+	_, err := svc.PutBucketTaggingWithContext(ctx, &s3.PutBucketTaggingInput{
+		Bucket: cf.s3Bucket.bucketName,
+		Tagging: &s3.Tagging{
+			TagSet: s3Tags(tags),
+		},
+	})
+	if err != nil {
+		msg := fmt.Sprintf("tagBucket: error tagging bucket %s: %s", *cf.s3Bucket.bucketName, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		return errors.New(msg)
+	}
+
+	return nil
+}
+
+// tagIAMUser replaces the tags of the iam user of the origin bucket with tags
+func (s *AwsConfig) tagIAMUser(ctx context.Context, cf *cloudFrontInstance, tags map[string]string) error {
+	svc := iam.New(s.sess)
+	if svc == nil {
+		msg := "tagIAMUser: error getting iam session"
+		logging.FromContext(ctx).Error(msg)
+		return errors.New(msg)
+	}
+
+	userName := cf.s3Bucket.iAMUser.userName
+
+	listOut, err := svc.ListUserTagsWithContext(ctx, &iam.ListUserTagsInput{UserName: userName})
+	if err != nil {
+		msg := fmt.Sprintf("tagIAMUser: error listing tags: %s", err.Error())
+		logging.FromContext(ctx).Error(msg)
+		return errors.New(msg)
+	}
+
+	current := map[string]string{}
+	for _, tag := range listOut.Tags {
+		current[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+
+	if stale := staleTagKeys(current, tags); len(stale) > 0 {
+		_, err = svc.UntagUserWithContext(ctx, &iam.UntagUserInput{UserName: userName, TagKeys: stale})
+		if err != nil {
+			msg := fmt.Sprintf("tagIAMUser: error removing tags: %s", err.Error())
+			logging.FromContext(ctx).Error(msg)
+			return errors.New(msg)
+		}
+	}
+
+	_, err = svc.TagUserWithContext(ctx, &iam.TagUserInput{UserName: userName, Tags: iamTags(tags)})
+	if err != nil {
+		msg := fmt.Sprintf("tagIAMUser: error adding tags: %s", err.Error())
+		logging.FromContext(ctx).Error(msg)
+		return errors.New(msg)
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTags(t *testing.T) {
+	Convey("Instance tags", t, func() {
+		cf := &cloudFrontInstance{
+			distributionID: aws.String("dist-1"),
+			billingCode:    aws.String("org-1"),
+			context:        NewInstanceContext("org-1", "space-1", map[string]interface{}{"app_guid": "app-1"}),
+		}
+
+		Convey("include the broker tags", func() {
+			tags := cf.tags(&InstanceParameters{Tags: map[string]string{"team": "web"}}, "plan-1")
+			So(tags, ShouldResemble, map[string]string{
+				"team":          "web",
+				tagBillingCode:  "org-1",
+				tagInstanceID:   "dist-1",
+				tagPlanID:       "plan-1",
+				tagOrganization: "org-1",
+				tagSpace:        "space-1",
+				tagApp:          "app-1",
+			})
+		})
+
+		Convey("billing code parameter wins over the stored billing code", func() {
+			tags := cf.tags(&InstanceParameters{BillingCode: "cc-42"}, "plan-1")
+			So(tags[tagBillingCode], ShouldEqual, "cc-42")
+		})
+
+		Convey("context overrides the request organization and space", func() {
+			ic := NewInstanceContext("org-1", "space-1", map[string]interface{}{"space_guid": "space-2"})
+			So(ic.OrganizationGUID, ShouldEqual, "org-1")
+			So(ic.SpaceGUID, ShouldEqual, "space-2")
+			So(ic.AppGUID, ShouldEqual, "")
+		})
+
+		Convey("distribution records the origin access identity", func() {
+			tags := map[string]string{"team": "web"}
+			So(cf.distributionTags(tags), ShouldResemble, tags)
+
+			cf.originAccessIdentity = aws.String("E2QWRUHAPOMQZL")
+			So(cf.distributionTags(tags), ShouldResemble, map[string]string{
+				"team":                  "web",
+				tagOriginAccessIdentity: "E2QWRUHAPOMQZL",
+			})
+			So(tags, ShouldResemble, map[string]string{"team": "web"})
+		})
+
+		Convey("stale keys leave aws tags alone", func() {
+			stale := staleTagKeys(map[string]string{"old": "1", "aws:cloudformation:stack-name": "x", "team": "web"}, map[string]string{"team": "web"})
+			So(aws.StringValueSlice(stale), ShouldResemble, []string{"old"})
+		})
+	})
+
+	Convey("Validating user tags", t, func() {
+		So(validateTags(map[string]string{"team": "web", "cost center": "a/b+c@d"}), ShouldBeNil)
+		So(validateTags(map[string]string{"billingcode": "x"}), ShouldNotBeNil)
+		So(validateTags(map[string]string{"broker:plan-id": "x"}), ShouldNotBeNil)
+		So(validateTags(map[string]string{"AWS:name": "x"}), ShouldNotBeNil)
+		So(validateTags(map[string]string{"bad#key": "x"}), ShouldNotBeNil)
+
+		tags := map[string]string{}
+		for i := 0; i <= maxUserTags; i++ {
+			tags[string(rune('a'+i%26))+string(rune('a'+i/26))] = "x"
+		}
+		So(validateTags(tags), ShouldNotBeNil)
+	})
+}
@@ -1,16 +1,21 @@
 package service
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"reflect"
 	"time"
 
+	"cloudfront-broker/pkg/logging"
 	"cloudfront-broker/pkg/storage"
+	"cloudfront-broker/pkg/tracing"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/golang/glog"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	osb "github.com/pmorie/go-open-service-broker-client/v2"
 )
@@ -18,17 +23,27 @@ import (
 const (
 	actionCreateNew                   string = "create-new"
 	actionCreateOrigin                string = "create-origin"
+	actionBlockPublicAccess           string = "block-public-access"
+	actionEncryptBucket               string = "encrypt-bucket"
+	actionEnforceBucketOwner          string = "enforce-bucket-owner"
+	actionConfigureVersioning         string = "configure-versioning"
+	actionConfigureLifecycle          string = "configure-lifecycle"
+	actionTagOrigin                   string = "tag-origin"
 	actionCreateIAMUser               string = "create-iam-user"
 	actionCreateAccessKey             string = "create-access-key"
 	actionCreateOriginAccessIdentity  string = "create-origin-access-identity"
 	actionIsOriginAccessIdentityReady string = "is-origin-access-identity-ready"
 	actionCreateDistribution          string = "create-distribution"
 	actionAddBucketPolicy             string = "add-bucket-policy"
+	actionConfigureCors               string = "configure-cors"
+	actionIsBucketHardened            string = "is-bucket-hardened"
 	actionIsDistributionDeployed      string = "is-distribution-deployed"
 	actionCreated                     string = "created"
 
 	actionDeleteNew                  string = "delete-new"
 	actionDisableDistribution        string = "disable-distribution"
+	actionArchiveOrigin              string = "archive-origin"
+	actionEmptyOrigin                string = "empty-origin"
 	actionDeleteOrigin               string = "delete-origin"
 	actionDeleteIAMUser              string = "delete-iam-user"
 	actionIsDistributionDisabled     string = "is-distribution-disabled"
@@ -36,6 +51,23 @@ const (
 	actionDeleteOriginAccessIdentity string = "delete-origin-access-identity"
 	actionDeleted                    string = "deleted"
 
+	actionUpdateNew        string = "update-new"
+	actionUpdateVersioning string = "update-versioning"
+	actionUpdateLifecycle  string = "update-lifecycle"
+	actionUpdateCors       string = "update-cors"
+	actionUpdateTags       string = "update-tags"
+	actionUpdateProfile    string = "update-distribution"
+	actionIsUpdateDeployed string = "is-update-deployed"
+	actionUpdated          string = "updated"
+
+	actionReconcileNew       string = "reconcile-new"
+	actionRepairDistribution string = "repair-distribution"
+	actionRepairBucketPolicy string = "repair-bucket-policy"
+	actionRepairCors         string = "repair-cors"
+	actionRepairIAMPolicy    string = "repair-iam-policy"
+	actionIsRepairDeployed   string = "is-repair-deployed"
+	actionReconciled         string = "reconciled"
+
 	actionDone string = "done"
 
 	statusNew       string = "new"
@@ -45,39 +77,97 @@ const (
 	statusDeleted   string = "deleted"
 	statusFailed    string = "failed"
 	statusFinished  string = "finished"
+	statusUpdated   string = "updated"
 )
 
-// OriginID type cast to string
-type OriginID struct {
-	OriginID string
-}
-
-// IAMUser holds AWS IAM user
-type IAMUser struct {
-	OriginID string
-	UserName string
+// updateRequest holds the requested changes in the task context of update tasks,
+// PlanID is only set when the plan changes
+type updateRequest struct {
+	Parameters *InstanceParameters `json:"parameters"`
+	PlanID     string              `json:"plan_id,omitempty"`
 }
 
 var nextAction = map[string]string{
 	actionCreateNew:                   actionCreateOrigin,
-	actionCreateOrigin:                actionCreateIAMUser,
+	actionCreateOrigin:                actionBlockPublicAccess,
+	actionBlockPublicAccess:           actionEncryptBucket,
+	actionEncryptBucket:               actionEnforceBucketOwner,
+	actionEnforceBucketOwner:          actionConfigureVersioning,
+	actionConfigureVersioning:         actionConfigureLifecycle,
+	actionConfigureLifecycle:          actionTagOrigin,
+	actionTagOrigin:                   actionCreateIAMUser,
 	actionCreateIAMUser:               actionCreateAccessKey,
 	actionCreateAccessKey:             actionCreateOriginAccessIdentity,
 	actionCreateOriginAccessIdentity:  actionIsOriginAccessIdentityReady,
 	actionIsOriginAccessIdentityReady: actionCreateDistribution,
 	actionCreateDistribution:          actionAddBucketPolicy,
-	actionAddBucketPolicy:             actionIsDistributionDeployed,
+	actionAddBucketPolicy:             actionConfigureCors,
+	actionConfigureCors:               actionIsBucketHardened,
+	actionIsBucketHardened:            actionIsDistributionDeployed,
 	actionIsDistributionDeployed:      actionCreated,
 	actionCreated:                     actionDone,
 
 	actionDeleteNew:                  actionDisableDistribution,
 	actionDisableDistribution:        actionDeleteIAMUser,
-	actionDeleteIAMUser:              actionDeleteOrigin,
+	actionDeleteIAMUser:              actionArchiveOrigin,
+	actionArchiveOrigin:              actionEmptyOrigin,
+	actionEmptyOrigin:                actionDeleteOrigin,
 	actionDeleteOrigin:               actionIsDistributionDisabled,
 	actionIsDistributionDisabled:     actionDeleteDistribution,
 	actionDeleteDistribution:         actionDeleteOriginAccessIdentity,
 	actionDeleteOriginAccessIdentity: actionDeleted,
 	actionDeleted:                    actionDone,
+
+	actionUpdateNew:        actionUpdateVersioning,
+	actionUpdateVersioning: actionUpdateLifecycle,
+	actionUpdateLifecycle:  actionUpdateCors,
+	actionUpdateCors:       actionUpdateTags,
+	actionUpdateTags:       actionUpdateProfile,
+	actionUpdateProfile:    actionIsUpdateDeployed,
+	actionIsUpdateDeployed: actionUpdated,
+	actionUpdated:          actionDone,
+
+	actionReconcileNew:       actionRepairDistribution,
+	actionRepairDistribution: actionRepairBucketPolicy,
+	actionRepairBucketPolicy: actionRepairCors,
+	actionRepairCors:         actionRepairIAMPolicy,
+	actionRepairIAMPolicy:    actionIsRepairDeployed,
+	actionIsRepairDeployed:   actionReconciled,
+	actionReconciled:         actionDone,
+}
+
+// customOriginNextAction skips the bucket, iam user and origin access identity
+// actions for distributions fronting a custom origin
+var customOriginNextAction = map[string]string{
+	actionCreateNew:              actionCreateDistribution,
+	actionCreateDistribution:     actionIsDistributionDeployed,
+	actionIsDistributionDeployed: actionCreated,
+	actionCreated:                actionDone,
+
+	actionDeleteNew:              actionDisableDistribution,
+	actionDisableDistribution:    actionIsDistributionDisabled,
+	actionIsDistributionDisabled: actionDeleteDistribution,
+	actionDeleteDistribution:     actionDeleted,
+	actionDeleted:                actionDone,
+
+	actionUpdateNew:        actionUpdateTags,
+	actionUpdateTags:       actionUpdateProfile,
+	actionUpdateProfile:    actionIsUpdateDeployed,
+	actionIsUpdateDeployed: actionUpdated,
+	actionUpdated:          actionDone,
+
+	actionReconcileNew:       actionRepairDistribution,
+	actionRepairDistribution: actionIsRepairDeployed,
+	actionIsRepairDeployed:   actionReconciled,
+	actionReconciled:         actionDone,
+}
+
+// getNextAction returns the action to run after action based on the origin type of the distribution
+func getNextAction(cf *cloudFrontInstance, action string) string {
+	if cf.isCustomOrigin() {
+		return customOriginNextAction[action]
+	}
+	return nextAction[action]
 }
 
 func curTaskStop(curTask *storage.Task) *storage.Task {
@@ -86,13 +176,29 @@ func curTaskStop(curTask *storage.Task) *storage.Task {
 	return curTask
 }
 
+// curTaskFailed fails the task with msg as the error in its context, the metadata is left as it is
 func curTaskFailed(curTask *storage.Task, msg string) *storage.Task {
+	curTask = setTaskError(curTask, msg)
 	curTask.Status = statusFailed
 	curTask.Result = storage.SetNullString(statusFailed)
-	curTask.Metadata = storage.SetNullString(msg)
 	return curTaskStop(curTask)
 }
 
+// curTaskRequeued undoes the failure an action stopped by the shutdown recorded, so the task
+// is picked up again and runs the action after the restart. The progress in the task context is kept.
+func curTaskRequeued(curTask *storage.Task, before *storage.Task) *storage.Task {
+	curTask.Action = before.Action
+	curTask.Status = statusPending
+	curTask.Result = before.Result
+	curTask.Metadata = before.Metadata
+	curTask.FinishedAt = before.FinishedAt
+	if tc, err := getTaskContext(curTask); err == nil && tc.Error != nil {
+		tc.Error = nil
+		curTask = setTaskContext(curTask, tc)
+	}
+	return curTask
+}
+
 func curTaskFinished(curTask *storage.Task, result string, msg string) *storage.Task {
 	curTask.Status = statusFinished
 	curTask.Result = storage.SetNullString(result)
@@ -101,13 +207,12 @@ func curTaskFinished(curTask *storage.Task, result string, msg string) *storage.
 }
 
 func (svc *AwsConfig) getTaskState(distributionID string) (*osb.LastOperationResponse, error) {
-	glog.V(4).Infof("===== getTaskState [%s] =====", distributionID)
 
 	task, err := svc.stg.GetTaskByDistribution(distributionID)
 
 	if err != nil {
 		msg := fmt.Sprintf("getTaskState [%s]: error getting task: %s", distributionID, err.Error())
-		glog.Error(msg)
+		logging.Root().Error(msg)
 		return nil, errors.New(msg)
 	}
 
@@ -141,20 +246,32 @@ func (svc *AwsConfig) getTaskState(distributionID string) (*osb.LastOperationRes
 
 // ActionCreateNew sets up the action to create a new distribution
 func (svc *AwsConfig) ActionCreateNew(cf *cloudFrontInstance) error {
-	glog.V(4).Infof("===== actionCreateNew [%s] =====", *cf.operationKey)
 
-	err := svc.stg.NewDistribution(*cf.distributionID, *cf.planID, cf.billingCode, *cf.callerReference, statusPending)
+	parameters, err := json.Marshal(cf.parameters)
+	if err != nil {
+		msg := fmt.Sprintf("actionCreateNew[%s]: error encoding parameters: %s", *cf.operationKey, err.Error())
+		logging.Root().Error(msg)
+		return errors.New(msg)
+	}
+
+	var context *string
+	if cf.context != nil {
+		contextb, _ := json.Marshal(cf.context)
+		context = aws.String(string(contextb))
+	}
+
+	err = svc.stg.NewDistribution(*cf.distributionID, *cf.serviceID, *cf.planID, cf.billingCode, *cf.callerReference, statusPending, cf.originType, aws.String(string(parameters)), context, cf.parametersHash)
 
 	if err != nil {
 		msg := fmt.Sprintf("actionCreateNew[%s]: error adding new distribution: %s", *cf.operationKey, err.Error())
-		glog.Error(msg)
+		logging.Root().Error(msg)
 		return errors.New(msg)
 	}
 
 	now := time.Now()
 	task := &storage.Task{
 		DistributionID: *cf.distributionID,
-		Action:         nextAction[actionCreateNew],
+		Action:         getNextAction(cf, actionCreateNew),
 		Status:         statusNew,
 		Retries:        0,
 		OperationKey:   sql.NullString{String: *cf.operationKey, Valid: true},
@@ -167,46 +284,148 @@ func (svc *AwsConfig) ActionCreateNew(cf *cloudFrontInstance) error {
 
 	if err != nil {
 		msg := fmt.Sprintf("actionCreateNew: error adding task: %s", err.Error())
-		glog.Error(msg)
+		logging.Root().Error(msg)
 		return errors.New(msg)
 	}
 
 	return nil
 }
 
-func (svc *AwsConfig) actionCreateOrigin(curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
-	glog.V(4).Infof("===== actionCreateOrigin [%s] =====", *cf.operationKey)
+func (svc *AwsConfig) actionCreateOrigin(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
 
-	if err := svc.createS3Bucket(cf); err != nil {
+	if err := svc.createS3Bucket(ctx, cf); err != nil {
 		msg := fmt.Sprintf("actionCreateOrigin[%s]: error: %s", *cf.operationKey, err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		curTask = curTaskFailed(curTask, "error creating s3 bucket for origin")
 		return curTask, errors.New(msg)
 	}
 
-	/*
-	   encode originID into json to store as metadata
-	*/
-	originID := &OriginID{OriginID: *cf.s3Bucket.originID}
-	originIDb, _ := json.Marshal(originID)
-	curTask.Metadata = storage.SetNullString(string(originIDb))
-	curTask.Action = nextAction[curTask.Action]
+	tc, err := getTaskContext(curTask)
+	if err != nil {
+		msg := fmt.Sprintf("actionCreateOrigin[%s]: error: %s", *cf.operationKey, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		curTask = curTaskFailed(curTask, "error reading task context")
+		return curTask, errors.New(msg)
+	}
+
+	tc.OriginID = *cf.s3Bucket.originID
+	tc.BucketName = *cf.s3Bucket.bucketName
+	curTask = setTaskContext(curTask, tc)
+	curTask.Action = getNextAction(cf, curTask.Action)
+	return curTask, nil
+}
+
+func (svc *AwsConfig) actionBlockPublicAccess(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
+
+	if !svc.isBucketReady(ctx, cf.s3Bucket) {
+		curTask.Retries++
+		logging.FromContext(ctx).Debug("waiting for aws", "retries", curTask.Retries)
+		return curTask, nil
+	}
+
+	if svc.hardening.BlockPublicAccess {
+		if err := svc.putPublicAccessBlock(ctx, cf); err != nil {
+			msg := fmt.Sprintf("actionBlockPublicAccess[%s]: error: %s", *cf.operationKey, err.Error())
+			logging.FromContext(ctx).Error(msg)
+			curTask = curTaskFailed(curTask, "error blocking public access to s3 bucket")
+			return curTask, errors.New(msg)
+		}
+	}
+
+	curTask.Retries = 0
+	curTask.Action = getNextAction(cf, curTask.Action)
+	return curTask, nil
+}
+
+func (svc *AwsConfig) actionEncryptBucket(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
+
+	if err := svc.putBucketEncryption(ctx, cf); err != nil {
+		msg := fmt.Sprintf("actionEncryptBucket[%s]: error: %s", *cf.operationKey, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		curTask = curTaskFailed(curTask, "error setting s3 bucket encryption")
+		return curTask, errors.New(msg)
+	}
+
+	curTask.Action = getNextAction(cf, curTask.Action)
+	return curTask, nil
+}
+
+func (svc *AwsConfig) actionEnforceBucketOwner(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
+
+	if svc.hardening.BucketOwnerEnforced {
+		if err := svc.putBucketOwnershipControls(ctx, cf); err != nil {
+			msg := fmt.Sprintf("actionEnforceBucketOwner[%s]: error: %s", *cf.operationKey, err.Error())
+			logging.FromContext(ctx).Error(msg)
+			curTask = curTaskFailed(curTask, "error setting s3 bucket ownership controls")
+			return curTask, errors.New(msg)
+		}
+	}
+
+	curTask.Action = getNextAction(cf, curTask.Action)
+	return curTask, nil
+}
+
+func (svc *AwsConfig) actionConfigureVersioning(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
+
+	if cf.parameters.Versioning != nil && *cf.parameters.Versioning {
+		if err := svc.putBucketVersioning(ctx, cf, true); err != nil {
+			msg := fmt.Sprintf("actionConfigureVersioning[%s]: error: %s", *cf.operationKey, err.Error())
+			logging.FromContext(ctx).Error(msg)
+			curTask = curTaskFailed(curTask, "error enabling s3 bucket versioning")
+			return curTask, errors.New(msg)
+		}
+	}
+
+	curTask.Action = getNextAction(cf, curTask.Action)
+	return curTask, nil
+}
+
+func (svc *AwsConfig) actionConfigureLifecycle(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
+
+	if cf.parameters.Lifecycle != nil && !cf.parameters.Lifecycle.isEmpty() {
+		if err := svc.putBucketLifecycle(ctx, cf, cf.parameters.Lifecycle); err != nil {
+			msg := fmt.Sprintf("actionConfigureLifecycle[%s]: error: %s", *cf.operationKey, err.Error())
+			logging.FromContext(ctx).Error(msg)
+			curTask = curTaskFailed(curTask, "error setting s3 bucket lifecycle")
+			return curTask, errors.New(msg)
+		}
+	}
+
+	curTask.Action = getNextAction(cf, curTask.Action)
+	return curTask, nil
+}
+
+func (svc *AwsConfig) actionTagOrigin(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
+
+	if err := svc.tagBucket(ctx, cf, cf.tags(cf.parameters, *cf.planID)); err != nil {
+		msg := fmt.Sprintf("actionTagOrigin[%s]: error: %s", *cf.operationKey, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		curTask = curTaskFailed(curTask, "error tagging s3 bucket")
+		return curTask, errors.New(msg)
+	}
+
+	curTask.Action = getNextAction(cf, curTask.Action)
 	return curTask, nil
 }
 
-func (svc *AwsConfig) actionCreateIAMUser(curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
-	glog.V(4).Infof("===== actionCreateIAMUser [%s] =====", *cf.operationKey)
+func (svc *AwsConfig) actionCreateIAMUser(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
+
+	tc, err := getTaskContext(curTask)
+	if err != nil {
+		msg := fmt.Sprintf("actionCreateIAMUser[%s]: error: %s", *cf.operationKey, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		curTask = curTaskFailed(curTask, "error reading task context")
+		return curTask, errors.New(msg)
+	}
 
-	originID := &OriginID{}
-	_ = json.Unmarshal([]byte(curTask.Metadata.String), originID)
-	s3BucketIn := svc.getBucket(originID.OriginID)
+	s3BucketIn := svc.getBucket(tc.OriginID)
 
 	if s3BucketIn != nil {
-		if svc.isBucketReady(s3BucketIn) {
+		if svc.isBucketReady(ctx, s3BucketIn) {
 			cf.s3Bucket = s3BucketIn
-			if err := svc.createIAMUser(cf); err != nil {
+			if err := svc.createIAMUser(ctx, cf); err != nil {
 				msg := fmt.Sprintf("actionCreateIAMUser[%s]: error: %s", *cf.operationKey, err.Error())
-				glog.Error(msg)
+				logging.FromContext(ctx).Error(msg)
 				curTask = curTaskFailed(curTask, "error creating iam user")
 				return curTask, errors.New(msg)
 			}
@@ -216,43 +435,54 @@ func (svc *AwsConfig) actionCreateIAMUser(curTask *storage.Task, cf *cloudFrontI
 		}
 	}
 
-	iAMUser := &IAMUser{
-		OriginID: *cf.s3Bucket.originID,
-		UserName: *cf.s3Bucket.iAMUser.userName,
-	}
-
-	iAMUserb, _ := json.Marshal(iAMUser)
-	curTask.Metadata = sql.NullString{
-		String: string(iAMUserb),
-		Valid:  true,
-	}
+	tc.OriginID = *cf.s3Bucket.originID
+	tc.IAMUser = *cf.s3Bucket.iAMUser.userName
+	curTask = setTaskContext(curTask, tc)
 
-	curTask.Action = nextAction[curTask.Action]
+	curTask.Action = getNextAction(cf, curTask.Action)
 	return curTask, nil
 }
 
-func (svc *AwsConfig) actionCreateAccessKey(curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
-	glog.V(4).Infof("===== actionCreateAccessKey [%s] =====", *cf.operationKey)
+func (svc *AwsConfig) actionCreateAccessKey(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
 
-	iAMUser := &IAMUser{}
-	_ = json.Unmarshal([]byte(curTask.Metadata.String), iAMUser)
+	tc, err := getTaskContext(curTask)
+	if err != nil {
+		msg := fmt.Sprintf("actionCreateAccessKey[%s]: error: %s", *cf.operationKey, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		curTask = curTaskFailed(curTask, "error reading task context")
+		return curTask, errors.New(msg)
+	}
 
-	s3BucketIn := svc.getBucket(iAMUser.OriginID)
+	s3BucketIn := svc.getBucket(tc.OriginID)
 	cf.s3Bucket = s3BucketIn
 
-	if ok, err := svc.isIAMUserReady(iAMUser.UserName); ok {
-		err = svc.createAccessKey(cf)
+	if ok, err := svc.isIAMUserReady(ctx, tc.IAMUser); ok {
+		// the secret of a key an earlier attempt created was not stored, the key is replaced
+		if tc.AccessKeyID != "" {
+			if err = svc.deleteAccessKey(ctx, cf, tc.AccessKeyID); err != nil {
+				msg := fmt.Sprintf("actionCreateAccessKey[%s]: error: %s", *cf.operationKey, err.Error())
+				logging.FromContext(ctx).Error(msg)
+				curTask = curTaskFailed(curTask, "error deleting access key of an earlier attempt")
+				return curTask, errors.New(msg)
+			}
+			tc.AccessKeyID = ""
+		}
+
+		err = svc.createAccessKey(ctx, cf)
+		if cf.s3Bucket != nil && cf.s3Bucket.iAMUser != nil && cf.s3Bucket.iAMUser.accessKey != nil {
+			tc.AccessKeyID = *cf.s3Bucket.iAMUser.accessKey
+		}
+		curTask = setTaskContext(curTask, tc)
 		if err != nil {
 			msg := fmt.Sprintf("actionCreateAccessKey[%s]: error: %s", *cf.operationKey, err.Error())
-			glog.Error(msg)
+			logging.FromContext(ctx).Error(msg)
 			curTask = curTaskFailed(curTask, "error creating access key")
 			return curTask, errors.New(msg)
 		}
 		curTask.Result = storage.SetNullString("")
-		curTask.Metadata = storage.SetNullString("")
 	} else if err != nil {
 		msg := fmt.Sprintf("actionCreateAccessKey[%s]: error: %s", *cf.operationKey, err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		curTask = curTaskFailed(curTask, "error checking iam user")
 		return curTask, errors.New(msg)
 	} else {
@@ -260,127 +490,193 @@ func (svc *AwsConfig) actionCreateAccessKey(curTask *storage.Task, cf *cloudFron
 		return curTask, nil
 	}
 
-	curTask.Action = nextAction[curTask.Action]
+	curTask.Action = getNextAction(cf, curTask.Action)
 	curTask.Retries = 0
 	return curTask, nil
 }
 
-func (svc *AwsConfig) actionCreateOriginAccessIdentity(curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
-	glog.V(4).Infof("===== actionCreateOriginAccessIdentity [%s] =====", *cf.operationKey)
+func (svc *AwsConfig) actionCreateOriginAccessIdentity(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
 
-	err := svc.createOriginAccessIdentity(cf)
+	tc, err := getTaskContext(curTask)
+	if err != nil {
+		msg := fmt.Sprintf("actionCreateOriginAccessIdentity[%s]: error: %s", *cf.operationKey, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		curTask = curTaskFailed(curTask, "error reading task context")
+		return curTask, errors.New(msg)
+	}
+
+	// an identity created by an earlier attempt is stored instead of creating another
+	if tc.OriginAccessIdentity != "" {
+		cf.originAccessIdentity = aws.String(tc.OriginAccessIdentity)
+		err = svc.stg.UpdateDistributionWIthOriginAccessIdentity(*cf.distributionID, tc.OriginAccessIdentity)
+	} else {
+		err = svc.createOriginAccessIdentity(ctx, cf)
+		if cf.originAccessIdentity != nil {
+			tc.OriginAccessIdentity = *cf.originAccessIdentity
+			curTask = setTaskContext(curTask, tc)
+		}
+	}
 	if err != nil {
 		msg := fmt.Sprintf("actionCreateOriginAccessIdentity[%s]: error: %s", *cf.operationKey, err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		curTask = curTaskFailed(curTask, "error creating origin access identity")
 		return curTask, errors.New(msg)
 	}
 
-	curTask.Action = nextAction[curTask.Action]
+	curTask.Action = getNextAction(cf, curTask.Action)
 	return curTask, nil
 }
 
-func (svc *AwsConfig) actionIsOriginAccessIdentityReady(curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
-	glog.V(4).Infof("===== actionIsOriginAccessIdentityReady [%s] =====", *cf.operationKey)
+func (svc *AwsConfig) actionIsOriginAccessIdentityReady(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
 
-	ready, err := svc.isOriginAccessIdentityReady(cf)
+	ready, err := svc.isOriginAccessIdentityReady(ctx, cf)
 	if err != nil {
 		msg := fmt.Sprintf("actionIsOriginAccessIdentityReady [%s]: error: %s", *cf.operationKey, err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		curTask = curTaskFailed(curTask, "error creating origin access identity")
 		return curTask, errors.New(msg)
 	} else if !ready {
 		curTask.Retries++
-		glog.V(3).Infof("actionIsOriginAccessIdentityReady [%s]: retries: %3d", *cf.operationKey, curTask.Retries)
+		logging.FromContext(ctx).Debug("waiting for aws", "retries", curTask.Retries)
 		return curTask, nil
 	} else {
 		curTask.Retries = 0
 	}
 
-	curTask.Action = nextAction[curTask.Action]
+	curTask.Action = getNextAction(cf, curTask.Action)
 	return curTask, nil
 }
 
-func (svc *AwsConfig) actionCreateDistribution(curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
-	glog.V(4).Infof("===== actionCreateDistribution [%s] =====", *cf.operationKey)
+func (svc *AwsConfig) actionCreateDistribution(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
 
-	err := svc.createDistribution(cf)
+	tc, err := getTaskContext(curTask)
 	if err != nil {
 		msg := fmt.Sprintf("actionCreateDistribution[%s]: error: %s", *cf.operationKey, err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
+		curTask = curTaskFailed(curTask, "error reading task context")
+		return curTask, errors.New(msg)
+	}
+
+	// a distribution created by an earlier attempt is stored instead of creating another
+	if tc.CloudfrontID != "" {
+		err = svc.storeCreatedDistribution(ctx, cf, tc.CloudfrontID)
+	} else {
+		err = svc.createDistribution(ctx, cf)
+		if cf.cloudfrontID != nil {
+			tc.CloudfrontID = *cf.cloudfrontID
+			curTask = setTaskContext(curTask, tc)
+		}
+	}
+	if err != nil {
+		msg := fmt.Sprintf("actionCreateDistribution[%s]: error: %s", *cf.operationKey, err.Error())
+		logging.FromContext(ctx).Error(msg)
 		curTask = curTaskFailed(curTask, "error creating distribution")
 		return curTask, errors.New(msg)
 	}
 
-	curTask.Action = nextAction[curTask.Action]
+	curTask.Action = getNextAction(cf, curTask.Action)
 	return curTask, nil
 }
 
-func (svc *AwsConfig) actionAddBucketPolicy(curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
-	glog.V(4).Infof("===== actionAddBucketPolicy [%s] =====", *cf.operationKey)
+func (svc *AwsConfig) actionAddBucketPolicy(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
 
-	if err := svc.addBucketPolicy(cf); err != nil {
+	if err := svc.addBucketPolicy(ctx, cf); err != nil {
 		msg := fmt.Sprintf("actionAddBucketPolicy[%s]: error: %s", *cf.operationKey, err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		curTask = curTaskFailed(curTask, "error adding bucket policy")
 		return curTask, errors.New(msg)
 	}
 
-	curTask.Action = nextAction[curTask.Action]
+	curTask.Action = getNextAction(cf, curTask.Action)
 	return curTask, nil
 }
 
-func (svc *AwsConfig) actionIsDistributionDeployed(curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
-	glog.V(4).Infof("===== actionIsDistributionDeployed [%s] =====", *cf.operationKey)
-	deployed, err := svc.isDistributionDeployed(cf)
+func (svc *AwsConfig) actionConfigureCors(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
+
+	if err := svc.putBucketCors(ctx, cf, cf.parameters.CORS); err != nil {
+		msg := fmt.Sprintf("actionConfigureCors[%s]: error: %s", *cf.operationKey, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		curTask = curTaskFailed(curTask, "error adding s3 bucket cors rules")
+		return curTask, errors.New(msg)
+	}
+
+	curTask.Action = getNextAction(cf, curTask.Action)
+	return curTask, nil
+}
+
+func (svc *AwsConfig) actionIsBucketHardened(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
+
+	hardened, err := svc.isBucketHardened(ctx, cf)
+	if err != nil {
+		msg := fmt.Sprintf("actionIsBucketHardened [%s]: error: %s", *cf.operationKey, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		curTask = curTaskFailed(curTask, "error checking s3 bucket security settings")
+		return curTask, errors.New(msg)
+	} else if !hardened {
+		curTask.Retries++
+		logging.FromContext(ctx).Debug("waiting for aws", "retries", curTask.Retries)
+		if int64(curTask.Retries) >= svc.maxRetries {
+			msg := fmt.Sprintf("actionIsBucketHardened [%s]: s3 bucket security settings not applied after %d retries", *cf.operationKey, curTask.Retries)
+			logging.FromContext(ctx).Error(msg)
+			curTask = curTaskFailed(curTask, "s3 bucket security settings not applied")
+			return curTask, errors.New(msg)
+		}
+		return curTask, nil
+	}
+
+	curTask.Retries = 0
+	curTask.Action = getNextAction(cf, curTask.Action)
+	return curTask, nil
+}
+
+func (svc *AwsConfig) actionIsDistributionDeployed(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
+	deployed, err := svc.isDistributionDeployed(ctx, cf)
 
 	if err != nil {
 		msg := fmt.Sprintf("actionIsDistributionDeployed [%s]: error checking distribution deployed: %s", *cf.operationKey, err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return curTask, errors.New(msg)
 	} else if !deployed {
 		curTask.Retries++
-		glog.V(3).Infof("actionIsDistributionDeployed [%s]: retries: %3d", *cf.operationKey, curTask.Retries)
+		logging.FromContext(ctx).Debug("waiting for aws", "retries", curTask.Retries)
 		return curTask, nil
 	} else {
 		curTask.Retries = 0
 	}
 
-	curTask.Action = nextAction[curTask.Action]
+	curTask.Action = getNextAction(cf, curTask.Action)
 
 	return curTask, nil
 }
 
-func (svc *AwsConfig) actionCreated(curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
-	glog.V(4).Infof("===== actionCreated [%s] =====", *cf.operationKey)
+func (svc *AwsConfig) actionCreated(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
 
 	err := svc.stg.UpdateDistributionStatus(*cf.distributionID, statusDeployed, false)
 	if err != nil {
 		msg := fmt.Sprintf("actionCreated: error updating distribution status: %s", err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return curTask, errors.New(msg)
 	}
 
 	curTask = curTaskFinished(curTask, statusDeployed, "cloudfront distribution created and deployed")
-	curTask.Action = nextAction[curTask.Action]
+	curTask.Action = getNextAction(cf, curTask.Action)
 	return curTask, nil
 }
 
 // ActionDeleteNew sets up the action to delete a distribution
 func (svc *AwsConfig) ActionDeleteNew(cf *cloudFrontInstance) error {
-	glog.V(4).Infof("===== actionDeleteNew [%s] =====", *cf.operationKey)
 
 	err := svc.stg.UpdateDistributionStatus(*cf.distributionID, statusDisabling, false)
 	if err != nil {
 		msg := fmt.Sprintf("actionDeleteNew: error updating distribution status: %s", err.Error())
-		glog.Error(msg)
+		logging.Root().Error(msg)
 		return errors.New(msg)
 	}
 
 	now := time.Now()
 	task := &storage.Task{
 		DistributionID: *cf.distributionID,
-		Action:         nextAction[actionDeleteNew],
+		Action:         getNextAction(cf, actionDeleteNew),
 		Status:         statusNew,
 		Retries:        0,
 		OperationKey:   storage.SetNullString(*cf.operationKey),
@@ -393,205 +689,745 @@ func (svc *AwsConfig) ActionDeleteNew(cf *cloudFrontInstance) error {
 
 	if err != nil {
 		msg := fmt.Sprintf("actionDeleteNew: error adding task: %s", err.Error())
-		glog.Error(msg)
+		logging.Root().Error(msg)
 		return errors.New(msg)
 	}
 
 	return nil
 }
 
-func (svc *AwsConfig) actionDisableDistribution(curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
-	glog.V(4).Infof("===== actionDisableDistribution [%s] =====", *cf.operationKey)
+func (svc *AwsConfig) actionDisableDistribution(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
 
-	_, err := svc.getCloudfrontDistribution(cf)
+	_, err := svc.getCloudfrontDistribution(ctx, cf)
 
 	if err != nil {
 		msg := fmt.Sprintf("actionDisableDistribution [%s]: getting distribution from aws: %s", *cf.operationKey, err.Error())
 		curTask = curTaskFailed(curTask, "cloudfront distribution error")
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return curTask, errors.New(msg)
 	}
 
-	err = svc.disableCloudfrontDistribution(cf)
+	err = svc.disableCloudfrontDistribution(ctx, cf)
 	if err != nil {
 		msg := fmt.Sprintf("actionDisableDistribution [%s]: getting disabling distribution: %s", *cf.operationKey, err.Error())
 		curTask = curTaskFailed(curTask, "error disabling distribution")
-		glog.Error(msg)
-		return nil, errors.New(msg)
+		logging.FromContext(ctx).Error(msg)
+		return curTask, errors.New(msg)
+	}
+
+	curTask.Action = getNextAction(cf, curTask.Action)
+	return curTask, nil
+}
+
+// getBucketProgress returns the task context with the archive and delete progress of the bucket
+func getBucketProgress(curTask *storage.Task) (*TaskContext, error) {
+	tc, err := getTaskContext(curTask)
+	if err != nil {
+		return nil, err
+	}
+	if tc.Progress == nil {
+		tc.Progress = &bucketProgress{}
+	}
+	return tc, nil
+}
+
+func (svc *AwsConfig) actionArchiveOrigin(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
+
+	settings, err := svc.GetPlanSettings(*cf.planID)
+	if err != nil {
+		msg := fmt.Sprintf("actionArchiveOrigin [%s]: getting plan settings: %s", *cf.operationKey, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		return curTask, errors.New(msg)
+	}
+
+	if settings.ArchiveBucket == "" {
+		curTask.Action = getNextAction(cf, curTask.Action)
+		return curTask, nil
+	}
+
+	tc, err := getBucketProgress(curTask)
+	if err != nil {
+		msg := fmt.Sprintf("actionArchiveOrigin [%s]: error: %s", *cf.operationKey, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		curTask = curTaskFailed(curTask, "error reading task context")
+		return curTask, errors.New(msg)
 	}
 
-	curTask.Action = nextAction[curTask.Action]
+	done, err := svc.archiveS3Bucket(ctx, cf, settings.ArchiveBucket, tc.Progress)
+	curTask = setTaskContext(curTask, tc)
+
+	if err != nil {
+		msg := fmt.Sprintf("actionArchiveOrigin [%s]: archiving s3 bucket: %s", *cf.operationKey, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		return curTask, errors.New(msg)
+	}
+
+	if done {
+		logging.FromContext(ctx).Info("archived origin", "objects", tc.Progress.Archived, "archive_bucket", settings.ArchiveBucket)
+		curTask.Action = getNextAction(cf, curTask.Action)
+	}
 	return curTask, nil
 }
 
-func (svc *AwsConfig) actionDeleteOrigin(curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
-	glog.V(4).Infof("===== actionDeleteOrigin [%s] =====", *cf.operationKey)
+func (svc *AwsConfig) actionEmptyOrigin(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
 
-	err := svc.deleteS3Bucket(cf)
+	tc, err := getBucketProgress(curTask)
+	if err != nil {
+		msg := fmt.Sprintf("actionEmptyOrigin [%s]: error: %s", *cf.operationKey, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		curTask = curTaskFailed(curTask, "error reading task context")
+		return curTask, errors.New(msg)
+	}
+
+	done, err := svc.emptyS3Bucket(ctx, cf, tc.Progress)
+	curTask = setTaskContext(curTask, tc)
+
+	if err != nil {
+		msg := fmt.Sprintf("actionEmptyOrigin [%s]: emptying s3 bucket: %s", *cf.operationKey, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		return curTask, errors.New(msg)
+	}
+
+	if done {
+		logging.FromContext(ctx).Info("emptied origin", "objects", tc.Progress.Deleted)
+		curTask.Action = getNextAction(cf, curTask.Action)
+	}
+	return curTask, nil
+}
+
+func (svc *AwsConfig) actionDeleteOrigin(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
+
+	err := svc.deleteS3Bucket(ctx, cf)
 	if err != nil {
 		msg := fmt.Sprintf("actionDeleteOrigin [%s]: deleting s3 bucket: %s", *cf.operationKey, err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return curTask, errors.New(msg)
 	}
 
-	curTask.Action = nextAction[curTask.Action]
+	curTask.Action = getNextAction(cf, curTask.Action)
 	return curTask, nil
 }
 
-func (svc *AwsConfig) actionDeleteIAMUser(curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
-	glog.V(4).Infof("===== actionDeleteIAMUser [%s] =====", *cf.operationKey)
+func (svc *AwsConfig) actionDeleteIAMUser(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
 
-	err := svc.deleteIAMUser(cf)
+	err := svc.deleteIAMUser(ctx, cf)
 	if err != nil {
 		msg := fmt.Sprintf("actionDeleteIAMUser [%s]: deleting iam user: %s", *cf.operationKey, err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return curTask, errors.New(msg)
 	}
 
-	curTask.Action = nextAction[curTask.Action]
+	curTask.Action = getNextAction(cf, curTask.Action)
 	return curTask, nil
 }
 
-func (svc *AwsConfig) actionIsDistributionDisabled(curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
-	glog.V(4).Infof("===== actionIsDistributionDisabled [%s] =====", *cf.operationKey)
-	disabled, err := svc.isDistributionDisabled(cf)
+func (svc *AwsConfig) actionIsDistributionDisabled(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
+	disabled, err := svc.isDistributionDisabled(ctx, cf)
 
 	if err != nil {
 		msg := fmt.Sprintf("actionIsDistributionDisabled[%s]: error checking distribution disabled: %s", *cf.operationKey, err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		curTask = curTaskFinished(curTask, statusFailed, msg)
 		return curTask, errors.New(msg)
 	} else if !disabled {
 		curTask.Retries++
-		glog.V(3).Infof("actionIsDistributionDisabled [%s]: retries: %3d", *cf.operationKey, curTask.Retries)
+		logging.FromContext(ctx).Debug("waiting for aws", "retries", curTask.Retries)
 		return curTask, nil
 	} else {
 		curTask.Retries = 0
 	}
 
-	curTask.Action = nextAction[curTask.Action]
+	curTask.Action = getNextAction(cf, curTask.Action)
 	return curTask, nil
 }
 
-func (svc *AwsConfig) actionDeleteDistribution(curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
-	glog.V(4).Infof("===== actionDeleteDistribution [%s] =====", *cf.operationKey)
+func (svc *AwsConfig) actionDeleteDistribution(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
 
-	err := svc.deleteDistribution(cf)
+	err := svc.deleteDistribution(ctx, cf)
 	if err != nil {
 		msg := fmt.Sprintf("actionDeleteDistribution [%s]: deleting distribution: %s", *cf.operationKey, err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return curTask, errors.New(msg)
 	}
 
-	curTask.Action = nextAction[curTask.Action]
+	curTask.Action = getNextAction(cf, curTask.Action)
 	return curTask, nil
 }
 
-func (svc *AwsConfig) actionDeleteOriginAccessIdentity(curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
-	glog.V(4).Infof("===== actionDeleteOriginAccessIdentity [%s] =====", *cf.operationKey)
+func (svc *AwsConfig) actionDeleteOriginAccessIdentity(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
 
-	err := svc.deleteOriginAccessIdentity(cf)
+	err := svc.deleteOriginAccessIdentity(ctx, cf)
 	if err != nil {
 		msg := fmt.Sprintf("actionDeleteOriginAccessIdentity [%s]: deleting origin access identity: %s", *cf.operationKey, err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return curTask, errors.New(msg)
 	}
 
-	curTask.Action = nextAction[curTask.Action]
+	curTask.Action = getNextAction(cf, curTask.Action)
 	return curTask, nil
 }
 
-func (svc *AwsConfig) actionDeleted(curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
-	glog.V(4).Infof("===== actionCreated [%s] =====", *cf.operationKey)
+func (svc *AwsConfig) actionDeleted(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
 	err := svc.stg.UpdateDistributionStatus(*cf.distributionID, statusDeleted, true)
 	if err != nil {
 		msg := fmt.Sprintf("actionCreated: error updating distribution status: %s", err.Error())
-		glog.Error(msg)
+		logging.FromContext(ctx).Error(msg)
 		return curTask, errors.New(msg)
 	}
 
 	curTask = curTaskFinished(curTask, statusDeleted, "cloudfront distribution disabled and deleted")
-	curTask.Action = nextAction[curTask.Action]
+	curTask.Action = getNextAction(cf, curTask.Action)
+	return curTask, nil
+}
+
+// ActionUpdateNew sets up the action to update a distribution with the new parameters and plan
+func (svc *AwsConfig) ActionUpdateNew(cf *cloudFrontInstance, params *InstanceParameters, planID string) error {
+
+	now := time.Now()
+	task := &storage.Task{
+		DistributionID: *cf.distributionID,
+		Action:         getNextAction(cf, actionUpdateNew),
+		Status:         statusNew,
+		Retries:        0,
+		OperationKey:   storage.SetNullString(*cf.operationKey),
+		Result:         storage.SetNullString(OperationInProgress),
+		StartedAt:      storage.SetNullTime(&now),
+	}
+	task = setTaskContext(task, &TaskContext{Update: &updateRequest{Parameters: params, PlanID: planID}})
+
+	task, err := svc.stg.AddTask(task)
+
+	if err != nil {
+		msg := fmt.Sprintf("actionUpdateNew: error adding task: %s", err.Error())
+		logging.Root().Error(msg)
+		return errors.New(msg)
+	}
+
+	return nil
+}
+
+func getUpdateRequest(curTask *storage.Task) (*updateRequest, error) {
+	tc, err := getTaskContext(curTask)
+	if err != nil {
+		return nil, err
+	}
+
+	if tc.Update == nil || tc.Update.Parameters == nil {
+		return nil, errors.New("update request has no parameters")
+	}
+
+	return tc.Update, nil
+}
+
+func (svc *AwsConfig) actionUpdateVersioning(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
+
+	req, err := getUpdateRequest(curTask)
+	if err != nil {
+		msg := fmt.Sprintf("actionUpdateVersioning[%s]: error: %s", *cf.operationKey, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		curTask = curTaskFailed(curTask, "error reading update request")
+		return curTask, errors.New(msg)
+	}
+
+	if req.Parameters.Versioning != nil {
+		if err = svc.putBucketVersioning(ctx, cf, *req.Parameters.Versioning); err != nil {
+			msg := fmt.Sprintf("actionUpdateVersioning[%s]: error: %s", *cf.operationKey, err.Error())
+			logging.FromContext(ctx).Error(msg)
+			curTask = curTaskFailed(curTask, "error updating s3 bucket versioning")
+			return curTask, errors.New(msg)
+		}
+	}
+
+	curTask.Action = getNextAction(cf, curTask.Action)
+	return curTask, nil
+}
+
+func (svc *AwsConfig) actionUpdateLifecycle(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
+
+	req, err := getUpdateRequest(curTask)
+	if err != nil {
+		msg := fmt.Sprintf("actionUpdateLifecycle[%s]: error: %s", *cf.operationKey, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		curTask = curTaskFailed(curTask, "error reading update request")
+		return curTask, errors.New(msg)
+	}
+
+	if req.Parameters.Lifecycle != nil {
+		if err = svc.putBucketLifecycle(ctx, cf, req.Parameters.Lifecycle); err != nil {
+			msg := fmt.Sprintf("actionUpdateLifecycle[%s]: error: %s", *cf.operationKey, err.Error())
+			logging.FromContext(ctx).Error(msg)
+			curTask = curTaskFailed(curTask, "error updating s3 bucket lifecycle")
+			return curTask, errors.New(msg)
+		}
+	}
+
+	curTask.Action = getNextAction(cf, curTask.Action)
+	return curTask, nil
+}
+
+func (svc *AwsConfig) actionUpdateCors(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
+
+	req, err := getUpdateRequest(curTask)
+	if err != nil {
+		msg := fmt.Sprintf("actionUpdateCors[%s]: error: %s", *cf.operationKey, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		curTask = curTaskFailed(curTask, "error reading update request")
+		return curTask, errors.New(msg)
+	}
+
+	if err = svc.putBucketCors(ctx, cf, req.Parameters.CORS); err != nil {
+		msg := fmt.Sprintf("actionUpdateCors[%s]: error: %s", *cf.operationKey, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		curTask = curTaskFailed(curTask, "error updating s3 bucket cors rules")
+		return curTask, errors.New(msg)
+	}
+
+	curTask.Action = getNextAction(cf, curTask.Action)
+	return curTask, nil
+}
+
+func (svc *AwsConfig) actionUpdateTags(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
+
+	req, err := getUpdateRequest(curTask)
+	if err != nil {
+		msg := fmt.Sprintf("actionUpdateTags[%s]: error: %s", *cf.operationKey, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		curTask = curTaskFailed(curTask, "error reading update request")
+		return curTask, errors.New(msg)
+	}
+
+	planID := *cf.planID
+	if req.PlanID != "" {
+		planID = req.PlanID
+	}
+	tags := cf.tags(req.Parameters, planID)
+
+	if err = svc.tagDistribution(ctx, cf, tags); err != nil {
+		msg := fmt.Sprintf("actionUpdateTags[%s]: error: %s", *cf.operationKey, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		curTask = curTaskFailed(curTask, "error tagging cloudfront distribution")
+		return curTask, errors.New(msg)
+	}
+
+	if !cf.isCustomOrigin() {
+		if err = svc.tagBucket(ctx, cf, tags); err != nil {
+			msg := fmt.Sprintf("actionUpdateTags[%s]: error: %s", *cf.operationKey, err.Error())
+			logging.FromContext(ctx).Error(msg)
+			curTask = curTaskFailed(curTask, "error tagging s3 bucket")
+			return curTask, errors.New(msg)
+		}
+
+		if err = svc.tagIAMUser(ctx, cf, tags); err != nil {
+			msg := fmt.Sprintf("actionUpdateTags[%s]: error: %s", *cf.operationKey, err.Error())
+			logging.FromContext(ctx).Error(msg)
+			curTask = curTaskFailed(curTask, "error tagging iam user")
+			return curTask, errors.New(msg)
+		}
+	}
+
+	curTask.Action = getNextAction(cf, curTask.Action)
+	return curTask, nil
+}
+
+func (svc *AwsConfig) actionUpdateProfile(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
+
+	req, err := getUpdateRequest(curTask)
+	if err != nil {
+		msg := fmt.Sprintf("actionUpdateProfile[%s]: error: %s", *cf.operationKey, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		curTask = curTaskFailed(curTask, "error reading update request")
+		return curTask, errors.New(msg)
+	}
+
+	if !reflect.DeepEqual(req.Parameters.Distribution, cf.parameters.Distribution) {
+		if err = svc.updateDistributionProfile(ctx, cf, req.Parameters.Distribution); err != nil {
+			msg := fmt.Sprintf("actionUpdateProfile[%s]: error: %s", *cf.operationKey, err.Error())
+			logging.FromContext(ctx).Error(msg)
+			curTask = curTaskFailed(curTask, "error updating cloudfront distribution")
+			return curTask, errors.New(msg)
+		}
+	}
+
+	curTask.Action = getNextAction(cf, curTask.Action)
+	return curTask, nil
+}
+
+func (svc *AwsConfig) actionIsUpdateDeployed(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
+
+	deployed, err := svc.isDistributionDeployed(ctx, cf)
+	if err != nil {
+		msg := fmt.Sprintf("actionIsUpdateDeployed[%s]: error: %s", *cf.operationKey, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		return curTask, errors.New(msg)
+	}
+
+	if !deployed {
+		curTask.Retries++
+		logging.FromContext(ctx).Debug("waiting for aws", "retries", curTask.Retries)
+		return curTask, nil
+	}
+
+	curTask.Retries = 0
+	curTask.Action = getNextAction(cf, curTask.Action)
+	return curTask, nil
+}
+
+func (svc *AwsConfig) actionUpdated(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
+
+	req, err := getUpdateRequest(curTask)
+	if err != nil {
+		msg := fmt.Sprintf("actionUpdated[%s]: error: %s", *cf.operationKey, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		curTask = curTaskFailed(curTask, "error reading update request")
+		return curTask, errors.New(msg)
+	}
+
+	parameters, _ := json.Marshal(req.Parameters)
+	if req.PlanID != "" {
+		err = svc.stg.UpdateDistributionPlan(*cf.distributionID, req.PlanID, string(parameters))
+	} else {
+		err = svc.stg.UpdateDistributionParameters(*cf.distributionID, string(parameters))
+	}
+	if err != nil {
+		msg := fmt.Sprintf("actionUpdated: error updating distribution parameters: %s", err.Error())
+		logging.FromContext(ctx).Error(msg)
+		return curTask, errors.New(msg)
+	}
+
+	if req.Parameters.BillingCode != "" && (cf.billingCode == nil || *cf.billingCode != req.Parameters.BillingCode) {
+		if err = svc.stg.UpdateDistributionBillingCode(*cf.distributionID, req.Parameters.BillingCode); err != nil {
+			msg := fmt.Sprintf("actionUpdated: error updating distribution billing code: %s", err.Error())
+			logging.FromContext(ctx).Error(msg)
+			return curTask, errors.New(msg)
+		}
+	}
+
+	curTask = curTaskFinished(curTask, statusUpdated, "cloudfront distribution updated")
+	curTask.Action = getNextAction(cf, curTask.Action)
 	return curTask, nil
 }
 
-var actions = map[string]func(*AwsConfig, *storage.Task, *cloudFrontInstance) (*storage.Task, error){
+// ActionReconcileNew sets up the action to repair the kinds of drift found on a distribution
+func (svc *AwsConfig) ActionReconcileNew(cf *cloudFrontInstance, kinds []string) error {
+
+	now := time.Now()
+	task := &storage.Task{
+		DistributionID: *cf.distributionID,
+		Action:         getNextAction(cf, actionReconcileNew),
+		Status:         statusNew,
+		Retries:        0,
+		OperationKey:   storage.SetNullString(*cf.operationKey),
+		Result:         storage.SetNullString(OperationInProgress),
+		StartedAt:      storage.SetNullTime(&now),
+	}
+	task = setTaskContext(task, &TaskContext{Drift: &driftRequest{Kinds: kinds}})
+
+	if _, err := svc.stg.AddTask(task); err != nil {
+		msg := fmt.Sprintf("actionReconcileNew: error adding task: %s", err.Error())
+		logging.Root().Error(msg)
+		return errors.New(msg)
+	}
+
+	return nil
+}
+
+func getDriftRequest(curTask *storage.Task) (*driftRequest, error) {
+	tc, err := getTaskContext(curTask)
+	if err != nil {
+		return nil, err
+	}
+
+	if tc.Drift == nil {
+		return nil, errors.New("task has no drift request")
+	}
+
+	return tc.Drift, nil
+}
+
+func (svc *AwsConfig) actionRepairDistribution(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
+
+	req, err := getDriftRequest(curTask)
+	if err != nil {
+		msg := fmt.Sprintf("actionRepairDistribution[%s]: error: %s", *cf.operationKey, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		curTask = curTaskFailed(curTask, "error reading drift request")
+		return curTask, errors.New(msg)
+	}
+
+	if req.has(DriftDistributionDisabled) {
+		if err = svc.enableDistribution(ctx, cf); err != nil {
+			msg := fmt.Sprintf("actionRepairDistribution[%s]: error: %s", *cf.operationKey, err.Error())
+			logging.FromContext(ctx).Error(msg)
+			curTask = curTaskFailed(curTask, "error enabling cloudfront distribution")
+			return curTask, errors.New(msg)
+		}
+	}
+
+	if req.has(DriftDistributionProfile) {
+		if err = svc.updateDistributionProfile(ctx, cf, cf.parameters.Distribution); err != nil {
+			msg := fmt.Sprintf("actionRepairDistribution[%s]: error: %s", *cf.operationKey, err.Error())
+			logging.FromContext(ctx).Error(msg)
+			curTask = curTaskFailed(curTask, "error updating cloudfront distribution")
+			return curTask, errors.New(msg)
+		}
+	}
+
+	curTask.Action = getNextAction(cf, curTask.Action)
+	return curTask, nil
+}
+
+func (svc *AwsConfig) actionRepairBucketPolicy(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
+
+	req, err := getDriftRequest(curTask)
+	if err != nil {
+		msg := fmt.Sprintf("actionRepairBucketPolicy[%s]: error: %s", *cf.operationKey, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		curTask = curTaskFailed(curTask, "error reading drift request")
+		return curTask, errors.New(msg)
+	}
+
+	if req.has(DriftBucketPolicy) {
+		if err = svc.addBucketPolicy(ctx, cf); err != nil {
+			msg := fmt.Sprintf("actionRepairBucketPolicy[%s]: error: %s", *cf.operationKey, err.Error())
+			logging.FromContext(ctx).Error(msg)
+			curTask = curTaskFailed(curTask, "error adding bucket policy")
+			return curTask, errors.New(msg)
+		}
+	}
+
+	curTask.Action = getNextAction(cf, curTask.Action)
+	return curTask, nil
+}
+
+func (svc *AwsConfig) actionRepairCors(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
+
+	req, err := getDriftRequest(curTask)
+	if err != nil {
+		msg := fmt.Sprintf("actionRepairCors[%s]: error: %s", *cf.operationKey, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		curTask = curTaskFailed(curTask, "error reading drift request")
+		return curTask, errors.New(msg)
+	}
+
+	if req.has(DriftCORS) {
+		if err = svc.putBucketCors(ctx, cf, cf.parameters.CORS); err != nil {
+			msg := fmt.Sprintf("actionRepairCors[%s]: error: %s", *cf.operationKey, err.Error())
+			logging.FromContext(ctx).Error(msg)
+			curTask = curTaskFailed(curTask, "error configuring cors")
+			return curTask, errors.New(msg)
+		}
+	}
+
+	curTask.Action = getNextAction(cf, curTask.Action)
+	return curTask, nil
+}
+
+func (svc *AwsConfig) actionRepairIAMPolicy(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
+
+	req, err := getDriftRequest(curTask)
+	if err != nil {
+		msg := fmt.Sprintf("actionRepairIAMPolicy[%s]: error: %s", *cf.operationKey, err.Error())
+		logging.FromContext(ctx).Error(msg)
+		curTask = curTaskFailed(curTask, "error reading drift request")
+		return curTask, errors.New(msg)
+	}
+
+	if req.has(DriftIAMPolicy) {
+		if err = svc.putUserPolicy(ctx, cf); err != nil {
+			msg := fmt.Sprintf("actionRepairIAMPolicy[%s]: error: %s", *cf.operationKey, err.Error())
+			logging.FromContext(ctx).Error(msg)
+			curTask = curTaskFailed(curTask, "error putting iam user policy")
+			return curTask, errors.New(msg)
+		}
+	}
+
+	curTask.Action = getNextAction(cf, curTask.Action)
+	return curTask, nil
+}
+
+func (svc *AwsConfig) actionReconciled(ctx context.Context, curTask *storage.Task, cf *cloudFrontInstance) (*storage.Task, error) {
+
+	curTask = curTaskFinished(curTask, statusDeployed, "cloudfront distribution drift repaired")
+	curTask.Action = getNextAction(cf, curTask.Action)
+	return curTask, nil
+}
+
+var actions = map[string]func(*AwsConfig, context.Context, *storage.Task, *cloudFrontInstance) (*storage.Task, error){
 	actionCreateOrigin:                (*AwsConfig).actionCreateOrigin,
+	actionBlockPublicAccess:           (*AwsConfig).actionBlockPublicAccess,
+	actionEncryptBucket:               (*AwsConfig).actionEncryptBucket,
+	actionEnforceBucketOwner:          (*AwsConfig).actionEnforceBucketOwner,
+	actionConfigureVersioning:         (*AwsConfig).actionConfigureVersioning,
+	actionConfigureLifecycle:          (*AwsConfig).actionConfigureLifecycle,
+	actionTagOrigin:                   (*AwsConfig).actionTagOrigin,
 	actionCreateIAMUser:               (*AwsConfig).actionCreateIAMUser,
 	actionCreateAccessKey:             (*AwsConfig).actionCreateAccessKey,
 	actionCreateOriginAccessIdentity:  (*AwsConfig).actionCreateOriginAccessIdentity,
 	actionIsOriginAccessIdentityReady: (*AwsConfig).actionIsOriginAccessIdentityReady,
 	actionCreateDistribution:          (*AwsConfig).actionCreateDistribution,
 	actionAddBucketPolicy:             (*AwsConfig).actionAddBucketPolicy,
+	actionConfigureCors:               (*AwsConfig).actionConfigureCors,
+	actionIsBucketHardened:            (*AwsConfig).actionIsBucketHardened,
 	actionIsDistributionDeployed:      (*AwsConfig).actionIsDistributionDeployed,
 	actionCreated:                     (*AwsConfig).actionCreated,
 	actionDisableDistribution:         (*AwsConfig).actionDisableDistribution,
 	actionDeleteIAMUser:               (*AwsConfig).actionDeleteIAMUser,
+	actionArchiveOrigin:               (*AwsConfig).actionArchiveOrigin,
+	actionEmptyOrigin:                 (*AwsConfig).actionEmptyOrigin,
 	actionDeleteOrigin:                (*AwsConfig).actionDeleteOrigin,
 	actionIsDistributionDisabled:      (*AwsConfig).actionIsDistributionDisabled,
 	actionDeleteDistribution:          (*AwsConfig).actionDeleteDistribution,
 	actionDeleteOriginAccessIdentity:  (*AwsConfig).actionDeleteOriginAccessIdentity,
 	actionDeleted:                     (*AwsConfig).actionDeleted,
+	actionUpdateVersioning:            (*AwsConfig).actionUpdateVersioning,
+	actionUpdateLifecycle:             (*AwsConfig).actionUpdateLifecycle,
+	actionUpdateCors:                  (*AwsConfig).actionUpdateCors,
+	actionUpdateTags:                  (*AwsConfig).actionUpdateTags,
+	actionUpdateProfile:               (*AwsConfig).actionUpdateProfile,
+	actionIsUpdateDeployed:            (*AwsConfig).actionIsUpdateDeployed,
+	actionUpdated:                     (*AwsConfig).actionUpdated,
+	actionRepairDistribution:          (*AwsConfig).actionRepairDistribution,
+	actionRepairBucketPolicy:          (*AwsConfig).actionRepairBucketPolicy,
+	actionRepairCors:                  (*AwsConfig).actionRepairCors,
+	actionRepairIAMPolicy:             (*AwsConfig).actionRepairIAMPolicy,
+	actionIsRepairDeployed:            (*AwsConfig).actionIsUpdateDeployed,
+	actionReconciled:                  (*AwsConfig).actionReconciled,
+}
+
+// sleepContext waits for the duration, it returns false when ctx is done first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// afterDone returns a context that is canceled timeout after ctx is done, work started
+// before a shutdown gets until the deadline to finish
+func afterDone(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	actionCtx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-actionCtx.Done():
+			return
+		}
+		if sleepContext(actionCtx, timeout) {
+			cancel()
+		}
+	}()
+	return actionCtx, cancel
 }
 
 // RunTasks is a go routine to run the actions in correct order.
 // It will wait for AWS service to be available before going to next service
 // Task status is in the tasks database table, so is safe to restart.
-func (svc *AwsConfig) RunTasks() {
+// When ctx is done no new action is started, the running action gets shutdownTimeout
+// to finish and its task update is stored before RunTasks returns.
+func (svc *AwsConfig) RunTasks(ctx context.Context, shutdownTimeout time.Duration) {
 	var err error
 
 	waitDur := time.Duration(time.Second * time.Duration(svc.waitSecs))
 
-	glog.V(4).Info("===== RunTasks =====")
-	for {
+	for ctx.Err() == nil {
 		var cf *cloudFrontInstance
 		var curTask *storage.Task
 
 		curTask, err = svc.stg.PopNextTask()
+		if err == nil || err == sql.ErrNoRows {
+			svc.taskPolled()
+		}
 
 		if err != nil {
 			if err == sql.ErrNoRows {
-				glog.Error("RunTasks: no tasks")
-				// <-ticker.C
-				time.Sleep(waitDur)
+				logging.Root().Debug("no tasks")
+				sleepContext(ctx, waitDur)
 				continue
 			} else {
-				msg := fmt.Sprintf("RunTask: error popping next task: %s", err.Error())
-				glog.Error(msg)
+				logging.Root().Error("error popping next task", "error", err)
 				continue
 			}
 		}
 
-		taskDur := time.Now().Sub(curTask.UpdatedAt)
-
-		msg := fmt.Sprintf("RunTask: %s: %v < %v", curTask.TaskID, taskDur, waitDur)
-		glog.V(4).Info(msg)
+		log := logging.Root().With(
+			logging.KeyInstanceID, curTask.DistributionID,
+			logging.KeyOperationKey, curTask.OperationKey.String,
+			logging.KeyTaskID, curTask.TaskID,
+			logging.KeyAction, curTask.Action,
+		)
 
+		taskDur := time.Now().Sub(curTask.UpdatedAt)
 		if taskDur < waitDur {
-			time.Sleep(time.Duration(time.Second))
+			log.Debug("task waiting", "since_update", taskDur.String(), "wait", waitDur.String())
+			sleepContext(ctx, time.Second)
 			continue
 		}
 
 		cf, err = svc.getCloudfrontInstance(curTask.DistributionID)
+		if err != nil {
+			// an instance that can not be read fails its task instead of stopping the loop
+			log.Error("error getting instance", "error", err)
+			ran, started := curTask.Action, time.Now()
+			curTask = curTaskFailed(curTask, err.Error())
+			svc.recordAttempt(curTask, ran, curTask.Retries, started, nil, nil)
+			if _, err = svc.stg.UpdateTaskAction(curTask); err != nil {
+				log.Error("error updating task", "error", err)
+			}
+			continue
+		}
 		cf.operationKey = &curTask.OperationKey.String
 
 		if action, ok := actions[curTask.Action]; ok {
+			ran, retries, started := curTask.Action, curTask.Retries, time.Now()
+			before := *curTask
+			actionCtx, cancel := afterDone(ctx, shutdownTimeout)
+			// all actions of an operation are children of the span derived from its key
+			actionCtx, span := tracing.Tracer().Start(
+				trace.ContextWithRemoteSpanContext(actionCtx, tracing.OperationSpanContext(curTask.OperationKey.String)),
+				curTask.Action,
+				trace.WithAttributes(
+					tracing.KeyInstanceID.String(curTask.DistributionID),
+					tracing.KeyOperationKey.String(curTask.OperationKey.String),
+					tracing.KeyTaskID.String(curTask.TaskID),
+					tracing.KeyAction.String(curTask.Action),
+					attribute.Int("retries", retries),
+				),
+			)
+			actionCtx = logging.NewContext(actionCtx, log)
+			log.Debug("running action", "retries", retries)
 			curTask.Status = statusPending
-			curTask, err = action(svc, curTask, cf)
-
-			if err != nil {
-				msg := fmt.Sprintf("RunTask: error: %s", err.Error())
-				glog.Error(msg)
+			curTask, err = action(svc.WithContext(actionCtx), actionCtx, curTask, cf)
+			tracing.End(span, err)
+
+			if err != nil && actionCtx.Err() != nil {
+				// the shutdown deadline passed, the action runs again after the restart
+				log.Warn("action stopped by shutdown", "error", err)
+				curTask = curTaskRequeued(curTask, &before)
+			} else if err != nil {
+				log.Error("action failed", "error", err)
 				curTask = curTaskFailed(curTask, err.Error())
+			} else if curTask.Action != ran {
+				log.Info("action finished", "next_action", curTask.Action, "status", curTask.Status, "duration", time.Since(started).String())
 			}
+			cancel()
+			svc.metrics.observeAction(ran, retries, started, curTask)
+			svc.recordAttempt(curTask, ran, retries, started, cf, err)
 		} else {
-			msg := fmt.Sprintf("RunTasks[%s]: action %s not found", *cf.operationKey, curTask.Action)
-			glog.Error(msg)
+			msg := fmt.Sprintf("action %s not found", curTask.Action)
+			log.Error(msg)
+			ran, started := curTask.Action, time.Now()
 			curTask = curTaskFailed(curTask, msg)
+			svc.recordAttempt(curTask, ran, curTask.Retries, started, cf, nil)
 		}
 		if curTask, err = svc.stg.UpdateTaskAction(curTask); err != nil {
-			msg := fmt.Sprintf("RunTask: error: %s", err.Error())
-			glog.Error(msg)
+			log.Error("error updating task", "error", err)
 		}
 	}
+
+	logging.Root().Info("task loop stopped")
 }
@@ -0,0 +1,54 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloudfront-broker/pkg/storage"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestShutdownContext(t *testing.T) {
+	Convey("Action context", t, func() {
+		ctx, stop := context.WithCancel(context.Background())
+		actionCtx, cancel := afterDone(ctx, 50*time.Millisecond)
+		defer cancel()
+
+		Convey("is not canceled with the run context", func() {
+			stop()
+			So(actionCtx.Err(), ShouldBeNil)
+
+			Convey("but after the shutdown timeout", func() {
+				<-actionCtx.Done()
+				So(actionCtx.Err(), ShouldEqual, context.Canceled)
+			})
+		})
+
+		Convey("stops sleeping when the run context is done", func() {
+			stop()
+			So(sleepContext(ctx, time.Hour), ShouldBeFalse)
+		})
+	})
+}
+
+func TestRequeuedTask(t *testing.T) {
+	Convey("A task stopped by the shutdown", t, func() {
+		task := &storage.Task{Action: actionCreateDistribution, Status: statusPending, Result: storage.SetNullString(OperationInProgress)}
+		before := *task
+		task = curTaskFailed(task, "RequestCanceled: request context canceled")
+		task = curTaskRequeued(task, &before)
+
+		Convey("is pending again without the failure", func() {
+			So(task.Status, ShouldEqual, statusPending)
+			So(task.FinishedAt.Valid, ShouldBeFalse)
+			So(task.Result.String, ShouldEqual, OperationInProgress)
+			So(task.Action, ShouldEqual, actionCreateDistribution)
+
+			tc, err := getTaskContext(task)
+			So(err, ShouldBeNil)
+			So(tc.Error, ShouldBeNil)
+		})
+	})
+}
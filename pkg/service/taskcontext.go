@@ -0,0 +1,114 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"cloudfront-broker/pkg/logging"
+	"cloudfront-broker/pkg/storage"
+)
+
+// TaskContextVersion is the version of the task context written by the broker, a task with a
+// newer context is failed instead of run by an older broker
+const TaskContextVersion = 1
+
+// TaskError is the error a task failed with, Action is the action that failed
+type TaskError struct {
+	Action  string    `json:"action"`
+	Message string    `json:"message"`
+	At      time.Time `json:"at"`
+}
+
+// TaskContext is the state a task passes between its actions, stored as jsonb with the task.
+// It carries the ids of the aws resources created so far, so an action can resume after a
+// restart or retry and a failed task can be rolled back.
+type TaskContext struct {
+	Version              int             `json:"version"`
+	OriginID             string          `json:"origin_id,omitempty"`
+	BucketName           string          `json:"bucket_name,omitempty"`
+	IAMUser              string          `json:"iam_user,omitempty"`
+	AccessKeyID          string          `json:"access_key_id,omitempty"`
+	OriginAccessIdentity string          `json:"origin_access_identity,omitempty"`
+	CloudfrontID         string          `json:"cloudfront_id,omitempty"`
+	Update               *updateRequest  `json:"update,omitempty"`
+	Drift                *driftRequest   `json:"drift,omitempty"`
+	Progress             *bucketProgress `json:"progress,omitempty"`
+	Error                *TaskError      `json:"error,omitempty"`
+}
+
+// legacyTaskMetadata is the state tasks kept in their metadata before the task context,
+// tasks created by an older broker are resumed from it
+type legacyTaskMetadata struct {
+	OriginID          string
+	UserName          string
+	Parameters        *InstanceParameters `json:"parameters"`
+	PlanID            string              `json:"plan_id"`
+	Kinds             []string            `json:"kinds"`
+	Archived          int64               `json:"archived"`
+	ArchiveStartAfter string              `json:"archive_start_after"`
+	Deleted           int64               `json:"deleted"`
+}
+
+// legacyTaskContext reads the task context from the metadata of a task without one,
+// metadata that is not json is a description and gives an empty context
+func legacyTaskContext(curTask *storage.Task) *TaskContext {
+	tc := &TaskContext{Version: TaskContextVersion}
+
+	legacy := &legacyTaskMetadata{}
+	if !curTask.Metadata.Valid || json.Unmarshal([]byte(curTask.Metadata.String), legacy) != nil {
+		return tc
+	}
+
+	tc.OriginID = legacy.OriginID
+	tc.IAMUser = legacy.UserName
+	if legacy.Parameters != nil {
+		tc.Update = &updateRequest{Parameters: legacy.Parameters, PlanID: legacy.PlanID}
+	}
+	if legacy.Kinds != nil {
+		tc.Drift = &driftRequest{Kinds: legacy.Kinds}
+	}
+	if legacy.Archived != 0 || legacy.ArchiveStartAfter != "" || legacy.Deleted != 0 {
+		tc.Progress = &bucketProgress{Archived: legacy.Archived, ArchiveStartAfter: legacy.ArchiveStartAfter, Deleted: legacy.Deleted}
+	}
+	return tc
+}
+
+// getTaskContext returns the context of the task, an error when it can not be read or was
+// written by a newer broker
+func getTaskContext(curTask *storage.Task) (*TaskContext, error) {
+	if !curTask.Context.Valid {
+		return legacyTaskContext(curTask), nil
+	}
+
+	tc := &TaskContext{}
+	if err := json.Unmarshal([]byte(curTask.Context.String), tc); err != nil {
+		return nil, fmt.Errorf("error decoding task context: %s", err.Error())
+	}
+	if tc.Version > TaskContextVersion {
+		return nil, fmt.Errorf("task context version %d is newer than the supported version %d", tc.Version, TaskContextVersion)
+	}
+
+	return tc, nil
+}
+
+// setTaskContext stores the context with the task, it is saved with the task by UpdateTaskAction
+func setTaskContext(curTask *storage.Task, tc *TaskContext) *storage.Task {
+	tc.Version = TaskContextVersion
+	tcb, _ := json.Marshal(tc)
+	curTask.Context = storage.SetNullString(string(tcb))
+	return curTask
+}
+
+// setTaskError records msg as the error of the current action in the task context,
+// a context that can not be read is left as it is
+func setTaskError(curTask *storage.Task, msg string) *storage.Task {
+	tc, err := getTaskContext(curTask)
+	if err != nil {
+		logging.Root().Error("keeping task context", logging.KeyTaskID, curTask.TaskID, "error", err)
+		return curTask
+	}
+
+	tc.Error = &TaskError{Action: curTask.Action, Message: msg, At: time.Now().UTC()}
+	return setTaskContext(curTask, tc)
+}
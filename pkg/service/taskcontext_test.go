@@ -0,0 +1,75 @@
+package service
+
+import (
+	"testing"
+
+	"cloudfront-broker/pkg/storage"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTaskContext(t *testing.T) {
+	Convey("Task context", t, func() {
+		Convey("is stored with its version", func() {
+			task := setTaskContext(&storage.Task{}, &TaskContext{OriginID: "origin-1", BucketName: "cf-bucket"})
+			So(task.Context.String, ShouldContainSubstring, `"version":1`)
+
+			tc, err := getTaskContext(task)
+			So(err, ShouldBeNil)
+			So(tc.OriginID, ShouldEqual, "origin-1")
+			So(tc.BucketName, ShouldEqual, "cf-bucket")
+		})
+
+		Convey("of a newer broker is not read", func() {
+			_, err := getTaskContext(&storage.Task{Context: storage.SetNullString(`{"version": 2}`)})
+			So(err, ShouldNotBeNil)
+
+			_, err = getTaskContext(&storage.Task{Context: storage.SetNullString(`{"version": `)})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("is read from the metadata of tasks of an older broker", func() {
+			tc, err := getTaskContext(&storage.Task{Metadata: storage.SetNullString(`{"OriginID": "origin-1", "UserName": "cf-user"}`)})
+			So(err, ShouldBeNil)
+			So(tc.OriginID, ShouldEqual, "origin-1")
+			So(tc.IAMUser, ShouldEqual, "cf-user")
+
+			tc, err = getTaskContext(&storage.Task{Metadata: storage.SetNullString(`{"parameters": {"billingcode": "b1"}, "plan_id": "plan-1"}`)})
+			So(err, ShouldBeNil)
+			So(tc.Update.PlanID, ShouldEqual, "plan-1")
+			So(tc.Update.Parameters.BillingCode, ShouldEqual, "b1")
+
+			tc, err = getTaskContext(&storage.Task{Metadata: storage.SetNullString(`{"archived": 10, "deleted": 4}`)})
+			So(err, ShouldBeNil)
+			So(tc.Progress.Archived, ShouldEqual, 10)
+			So(tc.Progress.Deleted, ShouldEqual, 4)
+
+			tc, err = getTaskContext(&storage.Task{Metadata: storage.SetNullString("cloudfront distribution created and deployed")})
+			So(err, ShouldBeNil)
+			So(tc, ShouldResemble, &TaskContext{Version: TaskContextVersion})
+		})
+
+		Convey("keeps the update request of a failed task with the error", func() {
+			task := setTaskContext(&storage.Task{Action: actionUpdateCors}, &TaskContext{Update: &updateRequest{PlanID: "plan-1"}})
+			task.Metadata = storage.SetNullString("updating")
+			task = curTaskFailed(task, "access denied")
+			So(task.Metadata.String, ShouldEqual, "updating")
+			So(task.Description(), ShouldEqual, "access denied")
+
+			tc, err := getTaskContext(task)
+			So(err, ShouldBeNil)
+			So(tc.Update.PlanID, ShouldEqual, "plan-1")
+			So(tc.Error.Action, ShouldEqual, actionUpdateCors)
+			So(tc.Error.Message, ShouldEqual, "access denied")
+		})
+
+		Convey("of an older broker keeps its state when the task fails", func() {
+			task := curTaskFailed(&storage.Task{Action: actionCreateAccessKey, Metadata: storage.SetNullString(`{"OriginID": "origin-1", "UserName": "cf-user"}`)}, "error creating access key")
+
+			tc, err := getTaskContext(task)
+			So(err, ShouldBeNil)
+			So(tc.IAMUser, ShouldEqual, "cf-user")
+			So(tc.Error.Action, ShouldEqual, actionCreateAccessKey)
+		})
+	})
+}
@@ -0,0 +1,270 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"cloudfront-broker/pkg/logging"
+	"cloudfront-broker/pkg/storage"
+)
+
+// Headers of a webhook request
+const (
+	WebhookIDHeader        = "X-Broker-Webhook-Id"
+	WebhookTimestampHeader = "X-Broker-Webhook-Timestamp"
+	WebhookSignatureHeader = "X-Broker-Webhook-Signature"
+)
+
+const (
+	// webhookPollInterval is how often the outbox is checked for due deliveries
+	webhookPollInterval = 5 * time.Second
+	// webhookBatch is the number of deliveries claimed at once
+	webhookBatch = 20
+	// webhookTimeout bounds each attempt
+	webhookTimeout = 10 * time.Second
+	// webhookLease keeps a claimed batch from other tasks processes while it is sent
+	webhookLease = 5 * time.Minute
+	// webhookMaxAttempts is the number of attempts before a delivery fails,
+	// the backoff doubles from webhookRetryDelay up to webhookMaxRetryDelay
+	webhookMaxAttempts   = 10
+	webhookRetryDelay    = 30 * time.Second
+	webhookMaxRetryDelay = time.Hour
+)
+
+// WebhookConfig holds the webhooks called for every finished operation and the secret signing them
+type WebhookConfig struct {
+	URLs   []string
+	Secret string
+}
+
+// lookupIPAddr resolves the host of a webhook, tests replace it
+var lookupIPAddr = net.DefaultResolver.LookupIPAddr
+
+// blockedNetworks are the networks webhooks must not reach besides the loopback, private,
+// link-local and multicast addresses, the carrier-grade nat and the nat64 ranges
+var blockedNetworks = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("192.0.0.0/24"),
+	mustParseCIDR("64:ff9b::/96"),
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// isPublicIP returns true when a webhook may be sent to the address, the loopback, private
+// (rfc1918 and unique local), link-local and metadata service (169.254.169.254) addresses
+// of the broker network are not
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range blockedNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateWebhookURL checks the webhook is an absolute http or https url whose host
+// resolves only to public addresses
+func ValidateWebhookURL(webhookURL string) error {
+	u, err := url.Parse(webhookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook %s must be an absolute http or https url", webhookURL)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	addrs, err := lookupIPAddr(ctx, u.Hostname())
+	if err != nil || len(addrs) == 0 {
+		return fmt.Errorf("webhook %s can not be resolved", webhookURL)
+	}
+	for _, addr := range addrs {
+		if !isPublicIP(addr.IP) {
+			return fmt.Errorf("webhook %s must not resolve to the private address %s", webhookURL, addr.IP)
+		}
+	}
+	return nil
+}
+
+// dialPublic refuses connections to addresses that are not public, it checks the address
+// dialed so a webhook host resolving to a private address after it was validated is refused
+func dialPublic(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("webhook address %s is not public", host)
+	}
+	return nil
+}
+
+// newWebhookClient returns the client sending the webhooks, it only connects to public addresses
+// and does not use the proxy of the environment, which would dial on its behalf
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{Timeout: webhookTimeout, Control: dialPublic}
+	return &http.Client{
+		Timeout: webhookTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: webhookTimeout,
+			MaxIdleConns:        webhookBatch,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
+
+// EnableWebhooks queues a webhook delivery for every finished or failed operation, the
+// deliveries are sent by RunWebhooks
+func (svc *AwsConfig) EnableWebhooks(config *WebhookConfig) error {
+	if config.Secret == "" {
+		return errors.New("webhooks require a secret to sign the payloads")
+	}
+	for _, u := range config.URLs {
+		if err := ValidateWebhookURL(u); err != nil {
+			return err
+		}
+	}
+
+	svc.webhooks = config
+	svc.stg.EnableWebhooks(config.URLs)
+	return nil
+}
+
+// WebhooksEnabled returns true when finished operations are queued for webhook delivery
+func (svc *AwsConfig) WebhooksEnabled() bool {
+	return svc.webhooks != nil
+}
+
+// signWebhook returns the signature of the payload, the hex hmac-sha256 of the timestamp,
+// a dot and the payload
+func signWebhook(secret string, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookRetryAt returns when a delivery is attempted again after attempts failed, nil
+// when it is not retried
+func webhookRetryAt(attempts int, now time.Time) *time.Time {
+	if attempts >= webhookMaxAttempts {
+		return nil
+	}
+
+	delay := webhookRetryDelay
+	for i := 1; i < attempts && delay < webhookMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > webhookMaxRetryDelay {
+		delay = webhookMaxRetryDelay
+	}
+
+	retryAt := now.Add(delay)
+	return &retryAt
+}
+
+// sendWebhook posts the payload of the delivery, any status but 2xx is an error
+func (svc *AwsConfig) sendWebhook(ctx context.Context, client *http.Client, delivery *storage.WebhookDelivery) error {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	payload := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "cloudfront-broker")
+	req.Header.Set(WebhookIDHeader, delivery.DeliveryID)
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, signWebhook(svc.webhooks.Secret, timestamp, payload))
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// deliverWebhooks sends the due deliveries, it returns the number of deliveries claimed
+func (svc *AwsConfig) deliverWebhooks(ctx context.Context, client *http.Client) int {
+	deliveries, err := svc.stg.ClaimWebhookDeliveries(webhookBatch, webhookLease)
+	if err != nil {
+		logging.Root().Error("error claiming webhook deliveries", "error", err)
+		return 0
+	}
+
+	for i := range deliveries {
+		delivery := &deliveries[i]
+		log := logging.Root().With(
+			logging.KeyInstanceID, delivery.DistributionID,
+			logging.KeyTaskID, delivery.TaskID,
+			"delivery_id", delivery.DeliveryID,
+			"url", delivery.URL,
+			"attempt", delivery.Attempts,
+		)
+
+		if ctx.Err() != nil {
+			// the claim lapses and the delivery is sent after the restart
+			return len(deliveries)
+		}
+
+		if err = svc.sendWebhook(ctx, client, delivery); err == nil {
+			log.Info("webhook delivered")
+			err = svc.stg.WebhookDelivered(delivery.DeliveryID)
+		} else {
+			retryAt := webhookRetryAt(delivery.Attempts, time.Now())
+			if retryAt == nil {
+				log.Error("webhook failed, giving up", "error", err)
+			} else {
+				log.Warn("webhook failed", "error", err, "retry_at", retryAt.UTC().Format(time.RFC3339))
+			}
+			err = svc.stg.WebhookAttemptFailed(delivery.DeliveryID, err.Error(), retryAt)
+		}
+		if err != nil {
+			log.Error("error updating webhook delivery", "error", err)
+		}
+	}
+
+	return len(deliveries)
+}
+
+// RunWebhooks sends the queued webhook deliveries until ctx is done
+func (svc *AwsConfig) RunWebhooks(ctx context.Context) {
+	client := newWebhookClient()
+
+	for ctx.Err() == nil {
+		// a full batch means more deliveries are due
+		if svc.deliverWebhooks(ctx, client) < webhookBatch {
+			sleepContext(ctx, webhookPollInterval)
+		}
+	}
+}
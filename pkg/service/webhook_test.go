@@ -0,0 +1,100 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"cloudfront-broker/pkg/storage"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWebhooks(t *testing.T) {
+	Convey("Webhooks", t, func() {
+		svc := &AwsConfig{webhooks: &WebhookConfig{Secret: "s3cret"}}
+
+		Convey("are signed with the timestamp and the payload", func() {
+			So(signWebhook("s3cret", "1700000000", []byte(`{"result":"succeeded"}`)), ShouldEqual, signWebhook("s3cret", "1700000000", []byte(`{"result":"succeeded"}`)))
+			So(signWebhook("s3cret", "1700000000", []byte(`{"result":"succeeded"}`)), ShouldStartWith, "sha256=")
+			So(signWebhook("s3cret", "1700000001", []byte(`{"result":"succeeded"}`)), ShouldNotEqual, signWebhook("s3cret", "1700000000", []byte(`{"result":"succeeded"}`)))
+			So(signWebhook("other", "1700000000", []byte(`{"result":"succeeded"}`)), ShouldNotEqual, signWebhook("s3cret", "1700000000", []byte(`{"result":"succeeded"}`)))
+		})
+
+		Convey("are retried with a doubling backoff", func() {
+			now := time.Now()
+			So(webhookRetryAt(1, now).Sub(now), ShouldEqual, webhookRetryDelay)
+			So(webhookRetryAt(3, now).Sub(now), ShouldEqual, 4*webhookRetryDelay)
+			So(webhookRetryAt(webhookMaxAttempts-1, now).Sub(now), ShouldEqual, webhookMaxRetryDelay)
+			So(webhookRetryAt(webhookMaxAttempts, now), ShouldBeNil)
+		})
+
+		Convey("post the payload with the signature headers", func() {
+			var received *http.Request
+			var body []byte
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received = r
+				body, _ = ioutil.ReadAll(r.Body)
+			}))
+			defer server.Close()
+
+			delivery := &storage.WebhookDelivery{DeliveryID: "d-1", URL: server.URL, Payload: `{"instance_id":"inst-1"}`}
+			So(svc.sendWebhook(context.Background(), server.Client(), delivery), ShouldBeNil)
+			So(string(body), ShouldEqual, delivery.Payload)
+			So(received.Header.Get(WebhookIDHeader), ShouldEqual, "d-1")
+			So(received.Header.Get(WebhookSignatureHeader), ShouldEqual,
+				signWebhook("s3cret", received.Header.Get(WebhookTimestampHeader), body))
+		})
+
+		Convey("fail on a status other than 2xx", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadGateway)
+			}))
+			defer server.Close()
+
+			delivery := &storage.WebhookDelivery{DeliveryID: "d-1", URL: server.URL, Payload: `{}`}
+			So(svc.sendWebhook(context.Background(), server.Client(), delivery), ShouldNotBeNil)
+		})
+
+		Convey("of an instance must be http or https urls", func() {
+			_, err := ParseInstanceParameters(map[string]interface{}{"webhook_url": "https://93.184.215.14/cdn"})
+			So(err, ShouldBeNil)
+			_, err = ParseInstanceParameters(map[string]interface{}{"webhook_url": "ftp://93.184.215.14"})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("must not resolve to the addresses of the broker network", func() {
+			for _, u := range []string{
+				"http://169.254.169.254/latest/meta-data/",
+				"http://127.0.0.1:8080/",
+				"http://10.1.2.3/",
+				"http://172.16.0.1/",
+				"http://192.168.1.1/",
+				"http://100.64.0.1/",
+				"http://[::1]/",
+				"http://[fd00::1]/",
+			} {
+				So(ValidateWebhookURL(u), ShouldNotBeNil)
+			}
+
+			lookup := lookupIPAddr
+			defer func() { lookupIPAddr = lookup }()
+			lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+				return []net.IPAddr{{IP: net.ParseIP("93.184.215.14")}, {IP: net.ParseIP("10.0.0.1")}}, nil
+			}
+			So(ValidateWebhookURL("https://hooks.example.com/cdn"), ShouldNotBeNil)
+		})
+
+		Convey("are not sent to private addresses", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			defer server.Close()
+
+			delivery := &storage.WebhookDelivery{DeliveryID: "d-1", URL: server.URL, Payload: `{}`}
+			So(svc.sendWebhook(context.Background(), newWebhookClient(), delivery), ShouldNotBeNil)
+		})
+	})
+}
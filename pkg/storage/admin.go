@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DistributionFilter selects the distributions listed by ListDistributions, blank fields match all
+type DistributionFilter struct {
+	Status         string
+	PlanID         string
+	BillingCode    string
+	CreatedAfter   *time.Time
+	CreatedBefore  *time.Time
+	IncludeDeleted bool
+	Limit          int
+	Offset         int
+}
+
+// where returns the conditions and arguments of the filter, numbered from the first argument
+func (f *DistributionFilter) where() (string, []interface{}) {
+	where := ""
+	args := []interface{}{}
+
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where += fmt.Sprintf("  and "+cond+"\n", len(args))
+	}
+
+	if f.Status != "" {
+		add("d.status = $%d", f.Status)
+	}
+	if f.PlanID != "" {
+		add("d.plan_id = $%d", f.PlanID)
+	}
+	if f.BillingCode != "" {
+		add("d.billing_code = $%d", f.BillingCode)
+	}
+	if f.CreatedAfter != nil {
+		add("d.created_at >= $%d", *f.CreatedAfter)
+	}
+	if f.CreatedBefore != nil {
+		add("d.created_at < $%d", *f.CreatedBefore)
+	}
+	if !f.IncludeDeleted {
+		where += "  and d.deleted_at is null\n"
+	}
+
+	return where, args
+}
+
+// ListDistributions returns a page of the distributions matching the filter, newest first,
+// with the number of matching distributions
+func (p *PostgresStorage) ListDistributions(filter *DistributionFilter) ([]Distribution, int, error) {
+	where, args := filter.where()
+
+	var total int
+	if err := p.db.QueryRow(countDistributionsScript+where, args...).Scan(&total); err != nil {
+		msg := fmt.Sprintf("ListDistributions: error counting distributions: %s", err.Error())
+		return nil, 0, errors.New(msg)
+	}
+
+	args = append(args, filter.Limit, filter.Offset)
+	page := fmt.Sprintf("  order by d.created_at desc limit $%d offset $%d", len(args)-1, len(args))
+
+	rows, err := p.db.Query(listDistributionsScript+where+page, args...)
+	if err != nil {
+		msg := fmt.Sprintf("ListDistributions: error selecting distributions: %s", err.Error())
+		return nil, 0, errors.New(msg)
+	}
+	defer rows.Close()
+
+	distributions := []Distribution{}
+	for rows.Next() {
+		d := Distribution{}
+		err = rows.Scan(
+			&d.DistributionID,
+			&d.PlanID,
+			&d.ServiceID,
+			&d.CloudfrontID,
+			&d.CloudfrontURL,
+			&d.OriginAccessIdentity,
+			&d.Claimed,
+			&d.Status,
+			&d.BillingCode,
+			&d.CallerReference,
+			&d.OriginType,
+			&d.Parameters,
+			&d.Context,
+			&d.ParametersHash,
+			&d.CreatedAt,
+			&d.UpdatedAt,
+			&d.DeletedAt,
+		)
+		if err != nil {
+			msg := fmt.Sprintf("ListDistributions: error scanning distribution: %s", err.Error())
+			return nil, 0, errors.New(msg)
+		}
+		distributions = append(distributions, d)
+	}
+
+	return distributions, total, nil
+}
+
+// GetOrigins returns the origins of the distribution including deleted ones, without access keys
+func (p *PostgresStorage) GetOrigins(distributionID string) ([]Origin, error) {
+	rows, err := p.db.Query(selectOriginsScript, distributionID)
+	if err != nil {
+		msg := fmt.Sprintf("GetOrigins: error selecting origins: %s", err.Error())
+		return nil, errors.New(msg)
+	}
+	defer rows.Close()
+
+	origins := []Origin{}
+	for rows.Next() {
+		o := Origin{}
+		err = rows.Scan(&o.OriginID, &o.DistributionID, &o.BucketName, &o.BucketURL, &o.OriginPath, &o.IAMUser, &o.CreatedAt, &o.UpdatedAt, &o.DeletedAt)
+		if err != nil {
+			msg := fmt.Sprintf("GetOrigins: error scanning origin: %s", err.Error())
+			return nil, errors.New(msg)
+		}
+		origins = append(origins, o)
+	}
+
+	return origins, nil
+}
+
+func (p *PostgresStorage) queryTasks(query string, args ...interface{}) ([]Task, error) {
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tasks := []Task{}
+	for rows.Next() {
+		t := Task{}
+		err = rows.Scan(&t.TaskID, &t.DistributionID, &t.OperationKey, &t.Status, &t.Action, &t.Retries, &t.Metadata, &t.Context, &t.Result, &t.CreatedAt, &t.UpdatedAt, &t.StartedAt, &t.FinishedAt)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, t)
+	}
+
+	return tasks, nil
+}
+
+// GetTaskHistory returns all tasks of the distribution, newest first
+func (p *PostgresStorage) GetTaskHistory(distributionID string) ([]Task, error) {
+	tasks, err := p.queryTasks(selectTaskHistoryScript+"and distribution_id = $1 order by created_at desc", distributionID)
+	if err != nil {
+		msg := fmt.Sprintf("GetTaskHistory: error selecting tasks: %s", err.Error())
+		return nil, errors.New(msg)
+	}
+
+	return tasks, nil
+}
+
+// ListTasks returns the latest tasks with the status, or of all statuses when status is blank
+func (p *PostgresStorage) ListTasks(status string, limit int) ([]Task, error) {
+	tasks, err := p.queryTasks(selectTaskHistoryScript+"and ($1 = '' or status = $1) order by created_at desc limit $2", status, limit)
+	if err != nil {
+		msg := fmt.Sprintf("ListTasks: error selecting tasks: %s", err.Error())
+		return nil, errors.New(msg)
+	}
+
+	return tasks, nil
+}
+
+// GetTask returns the task with the task id
+func (p *PostgresStorage) GetTask(taskID string) (*Task, error) {
+	tasks, err := p.queryTasks(selectTaskHistoryScript+"and task_id = $1", taskID)
+	if err != nil {
+		msg := fmt.Sprintf("GetTask: error selecting task: %s", err.Error())
+		return nil, errors.New(msg)
+	}
+	if len(tasks) == 0 {
+		return nil, errors.New(TaskNotFound)
+	}
+
+	return &tasks[0], nil
+}
+
+// changeTask runs a script changing the state of a task, TaskNotChanged is returned
+// when the task is not in a state the script changes. A task the script finishes queues
+// its webhooks in the same transaction, as UpdateTaskAction does
+func (p *PostgresStorage) changeTask(script string, taskID string, args ...interface{}) (*Task, error) {
+	task, err := p.GetTask(taskID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		msg := fmt.Sprintf("changeTask: error starting transaction: %s", err.Error())
+		return nil, errors.New(msg)
+	}
+
+	err = tx.QueryRow(script, append([]interface{}{taskID}, args...)...).Scan(&task.Status, &task.Result, &task.Metadata, &task.FinishedAt)
+	switch {
+	case err == sql.ErrNoRows:
+		_ = tx.Rollback()
+		return nil, errors.New(TaskNotChanged)
+	case err != nil:
+		_ = tx.Rollback()
+		msg := fmt.Sprintf("changeTask: error updating task: %s", err.Error())
+		return nil, errors.New(msg)
+	}
+
+	if p.webhooks && task.FinishedAt.Valid {
+		if err = p.queueWebhooks(tx, task); err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		msg := fmt.Sprintf("changeTask: error committing task: %s", err.Error())
+		return nil, errors.New(msg)
+	}
+
+	return p.GetTask(taskID)
+}
+
+// RetryTask starts a failed or canceled task again from the action it stopped at,
+// result is the result of the task while it runs
+func (p *PostgresStorage) RetryTask(taskID string, result string) (*Task, error) {
+	return p.changeTask(retryTaskScript, taskID, result)
+}
+
+// CancelTask stops a new or pending task
+func (p *PostgresStorage) CancelTask(taskID string) (*Task, error) {
+	return p.changeTask(cancelTaskScript, taskID)
+}
+
+// FailTask marks a new or pending task as failed with the reason
+func (p *PostgresStorage) FailTask(taskID string, reason string) (*Task, error) {
+	return p.changeTask(failTaskScript, taskID, reason)
+}
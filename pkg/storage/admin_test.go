@@ -0,0 +1,25 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDistributionFilter(t *testing.T) {
+	Convey("Filtering distributions", t, func() {
+		Convey("without filters only skips deleted distributions", func() {
+			where, args := (&DistributionFilter{}).where()
+			So(where, ShouldEqual, "  and d.deleted_at is null\n")
+			So(args, ShouldBeEmpty)
+		})
+
+		Convey("numbers the arguments in order", func() {
+			before := time.Now()
+			where, args := (&DistributionFilter{Status: "deployed", BillingCode: "cc-42", CreatedBefore: &before, IncludeDeleted: true}).where()
+			So(where, ShouldEqual, "  and d.status = $1\n  and d.billing_code = $2\n  and d.created_at < $3\n")
+			So(args, ShouldResemble, []interface{}{"deployed", "cc-42", before})
+		})
+	})
+}
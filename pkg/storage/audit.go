@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// AddTaskAuditEvent records an action attempt of a task
+func (p *PostgresStorage) AddTaskAuditEvent(event *TaskAuditEvent) error {
+	var resources sql.NullString
+	if len(event.Resources) > 0 {
+		data, err := json.Marshal(event.Resources)
+		if err != nil {
+			msg := fmt.Sprintf("AddTaskAuditEvent: error encoding resources: %s", err.Error())
+			return errors.New(msg)
+		}
+		resources = SetNullString(string(data))
+	}
+
+	_, err := p.db.Exec(insertTaskAuditEventScript, event.TaskID, event.DistributionID, event.OperationKey, event.Action, event.NextAction,
+		event.Status, event.Retries, event.Error, resources, event.StartedAt, event.FinishedAt)
+	if err != nil {
+		msg := fmt.Sprintf("AddTaskAuditEvent: error inserting event of task %s: %s", event.TaskID, err.Error())
+		return errors.New(msg)
+	}
+
+	return nil
+}
+
+func (p *PostgresStorage) queryTaskAuditEvents(query string, args ...interface{}) ([]TaskAuditEvent, error) {
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []TaskAuditEvent{}
+	for rows.Next() {
+		e := TaskAuditEvent{}
+		var resources sql.NullString
+		err = rows.Scan(&e.EventID, &e.TaskID, &e.DistributionID, &e.OperationKey, &e.Action, &e.NextAction, &e.Status, &e.Retries, &e.Error, &resources, &e.StartedAt, &e.FinishedAt, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if resources.Valid {
+			if err = json.Unmarshal([]byte(resources.String), &e.Resources); err != nil {
+				return nil, err
+			}
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+// GetTaskAuditEvents returns the action attempts of the task in the order they ran
+func (p *PostgresStorage) GetTaskAuditEvents(taskID string) ([]TaskAuditEvent, error) {
+	if _, err := p.GetTask(taskID); err != nil {
+		return nil, err
+	}
+
+	events, err := p.queryTaskAuditEvents(selectTaskAuditEventsScript+"where task_id = $1 order by created_at, started_at", taskID)
+	if err != nil {
+		msg := fmt.Sprintf("GetTaskAuditEvents: error selecting events: %s", err.Error())
+		return nil, errors.New(msg)
+	}
+
+	return events, nil
+}
+
+// GetDistributionAuditEvents returns the latest action attempts of all tasks of the distribution, newest first
+func (p *PostgresStorage) GetDistributionAuditEvents(distributionID string, limit int) ([]TaskAuditEvent, error) {
+	if _, err := p.GetDistributionWithDeleted(distributionID); err != nil {
+		return nil, err
+	}
+
+	events, err := p.queryTaskAuditEvents(selectTaskAuditEventsScript+"where distribution_id = $1 order by created_at desc, started_at desc limit $2", distributionID, limit)
+	if err != nil {
+		msg := fmt.Sprintf("GetDistributionAuditEvents: error selecting events: %s", err.Error())
+		return nil, errors.New(msg)
+	}
+
+	return events, nil
+}
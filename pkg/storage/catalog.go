@@ -0,0 +1,354 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+var uuidRegexp = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+var alphaNumericRegexp = regexp.MustCompile(`^[A-Za-z0-9\-]+$`)
+
+var validCostUnits = []string{"year", "month", "day", "hour", "minute", "second", "cycle", "byte", "megabyte", "gigabyte", "terabyte", "petabyte", "op", "unit"}
+
+// Catalog is the service catalog file, yaml or json
+type Catalog struct {
+	Services []CatalogService `json:"services"`
+}
+
+// CatalogService is a service in the catalog file
+type CatalogService struct {
+	ID            string        `json:"id"`
+	Name          string        `json:"name"`
+	HumanName     string        `json:"human_name,omitempty"`
+	Description   string        `json:"description,omitempty"`
+	Categories    []string      `json:"categories,omitempty"`
+	Image         string        `json:"image,omitempty"`
+	PlanUpdatable bool          `json:"plan_updateable,omitempty"`
+	Plans         []CatalogPlan `json:"plans"`
+}
+
+// CatalogPlan is a plan in the catalog file, Settings holds the distribution defaults
+// for the plan, Parameters the json schema for provision and update parameters and
+// PlanUpdates the names of the plans in the same service an instance can change to
+type CatalogPlan struct {
+	ID          string                 `json:"id"`
+	Name        string                 `json:"name"`
+	HumanName   string                 `json:"human_name,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Categories  []string               `json:"categories,omitempty"`
+	Free        bool                   `json:"free,omitempty"`
+	CostCents   int                    `json:"cost_cents"`
+	CostUnit    string                 `json:"cost_unit,omitempty"`
+	Settings    map[string]interface{} `json:"settings,omitempty"`
+	Parameters  map[string]interface{} `json:"parameters,omitempty"`
+	PlanUpdates []string               `json:"plan_updates,omitempty"`
+}
+
+// LoadCatalogFile reads and validates the catalog from a yaml or json file
+func LoadCatalogFile(catalogPath string) (*Catalog, error) {
+	data, err := ioutil.ReadFile(catalogPath)
+	if err != nil {
+		msg := fmt.Sprintf("LoadCatalogFile: error reading %s: %s", catalogPath, err.Error())
+		return nil, errors.New(msg)
+	}
+
+	catalog := &Catalog{}
+	if err = yaml.UnmarshalStrict(data, catalog); err != nil {
+		msg := fmt.Sprintf("LoadCatalogFile: error decoding %s: %s", catalogPath, err.Error())
+		return nil, errors.New(msg)
+	}
+
+	if err = catalog.Validate(); err != nil {
+		msg := fmt.Sprintf("LoadCatalogFile: invalid catalog %s: %s", catalogPath, err.Error())
+		return nil, errors.New(msg)
+	}
+
+	return catalog, nil
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the catalog can be stored in the services and plans tables
+func (c *Catalog) Validate() error {
+	if len(c.Services) == 0 {
+		return errors.New("at least one service is required")
+	}
+
+	ids := map[string]bool{}
+	names := map[string]bool{}
+	planNames := map[string]bool{}
+
+	for i := range c.Services {
+		service := &c.Services[i]
+		if !uuidRegexp.MatchString(service.ID) {
+			return fmt.Errorf("services[%d].id must be a uuid", i)
+		}
+		if !alphaNumericRegexp.MatchString(service.Name) {
+			return fmt.Errorf("services[%d].name must be letters, numbers and dashes", i)
+		}
+		if ids[service.ID] || names[service.Name] {
+			return fmt.Errorf("services[%d] id or name %s is used more than once", i, service.Name)
+		}
+		ids[service.ID] = true
+		names[service.Name] = true
+
+		if len(service.Plans) == 0 {
+			return fmt.Errorf("service %s must have at least one plan", service.Name)
+		}
+
+		for j := range service.Plans {
+			plan := &service.Plans[j]
+			if plan.CostUnit == "" {
+				plan.CostUnit = "month"
+			}
+
+			if !uuidRegexp.MatchString(plan.ID) {
+				return fmt.Errorf("service %s plans[%d].id must be a uuid", service.Name, j)
+			}
+			if !alphaNumericRegexp.MatchString(plan.Name) {
+				return fmt.Errorf("service %s plans[%d].name must be letters, numbers and dashes", service.Name, j)
+			}
+			if ids[plan.ID] || planNames[plan.Name] {
+				return fmt.Errorf("plan id or name %s is used more than once", plan.Name)
+			}
+			ids[plan.ID] = true
+			planNames[plan.Name] = true
+
+			if plan.CostCents < 0 {
+				return fmt.Errorf("plan %s cost_cents can not be negative", plan.Name)
+			}
+			if !containsString(validCostUnits, plan.CostUnit) {
+				return fmt.Errorf("plan %s cost_unit must be one of %s", plan.Name, strings.Join(validCostUnits, ", "))
+			}
+			if plan.Parameters != nil {
+				if t, ok := plan.Parameters["type"]; !ok || t != "object" {
+					return fmt.Errorf("plan %s parameters must be a json schema of type object", plan.Name)
+				}
+			}
+		}
+
+		for _, plan := range service.Plans {
+			if len(plan.PlanUpdates) > 0 && !service.PlanUpdatable {
+				return fmt.Errorf("plan %s has plan_updates but service %s is not plan_updateable", plan.Name, service.Name)
+			}
+			for _, name := range plan.PlanUpdates {
+				if name == plan.Name || service.planID(name) == "" {
+					return fmt.Errorf("plan %s plan_updates %s must be another plan of service %s", plan.Name, name, service.Name)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// planID returns the id of the plan with the name, or blank if the service has no such plan
+func (s *CatalogService) planID(name string) string {
+	for _, plan := range s.Plans {
+		if plan.Name == name {
+			return plan.ID
+		}
+	}
+	return ""
+}
+
+func marshalNullString(value map[string]interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// SyncCatalog inserts or updates the services and plans in the catalog,
+// services and plans not in the catalog are marked deleted
+func (p *PostgresStorage) SyncCatalog(catalog *Catalog) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		msg := fmt.Sprintf("SyncCatalog: error starting transaction: %s", err.Error())
+		return errors.New(msg)
+	}
+
+	// all plans are marked deleted and the plans of the catalog restored by their upsert, so a
+	// plan can take the name of a removed plan or of another plan renamed in the same catalog
+	if _, err = tx.Exec(deletePlansScript); err != nil {
+		_ = tx.Rollback()
+		msg := fmt.Sprintf("SyncCatalog: error marking plans deleted: %s", err.Error())
+		return errors.New(msg)
+	}
+
+	serviceIDs := []string{}
+
+	for _, service := range catalog.Services {
+		_, err = tx.Exec(upsertServiceScript, service.ID, service.Name, SetNullString(service.HumanName), SetNullString(service.Description), SetNullString(strings.Join(service.Categories, ",")), SetNullString(service.Image), service.PlanUpdatable)
+		if err != nil {
+			_ = tx.Rollback()
+			msg := fmt.Sprintf("SyncCatalog: error syncing service %s: %s", service.Name, err.Error())
+			return errors.New(msg)
+		}
+		serviceIDs = append(serviceIDs, service.ID)
+
+		for _, plan := range service.Plans {
+			settings, err := marshalNullString(plan.Settings)
+			if err != nil {
+				_ = tx.Rollback()
+				msg := fmt.Sprintf("SyncCatalog: error encoding settings for plan %s: %s", plan.Name, err.Error())
+				return errors.New(msg)
+			}
+
+			parameters, err := marshalNullString(plan.Parameters)
+			if err != nil {
+				_ = tx.Rollback()
+				msg := fmt.Sprintf("SyncCatalog: error encoding parameters for plan %s: %s", plan.Name, err.Error())
+				return errors.New(msg)
+			}
+
+			planUpdates := []string{}
+			for _, name := range plan.PlanUpdates {
+				planUpdates = append(planUpdates, service.planID(name))
+			}
+
+			_, err = tx.Exec(upsertPlanScript, plan.ID, service.ID, plan.Name, SetNullString(plan.HumanName), SetNullString(plan.Description), SetNullString(strings.Join(plan.Categories, ", ")), plan.Free, plan.CostCents, plan.CostUnit, settings, parameters, pq.Array(planUpdates))
+			if err != nil {
+				_ = tx.Rollback()
+				msg := fmt.Sprintf("SyncCatalog: error syncing plan %s: %s", plan.Name, err.Error())
+				return errors.New(msg)
+			}
+		}
+	}
+
+	if _, err = tx.Exec(deleteRemovedServicesScript, pq.Array(serviceIDs)); err != nil {
+		_ = tx.Rollback()
+		msg := fmt.Sprintf("SyncCatalog: error marking removed services deleted: %s", err.Error())
+		return errors.New(msg)
+	}
+
+	if err = tx.Commit(); err != nil {
+		msg := fmt.Sprintf("SyncCatalog: error committing catalog: %s", err.Error())
+		return errors.New(msg)
+	}
+
+	return nil
+}
+
+func splitCategories(categories sql.NullString) []string {
+	list := []string{}
+	for _, c := range strings.Split(categories.String, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			list = append(list, c)
+		}
+	}
+	return list
+}
+
+func unmarshalNullString(value sql.NullString) (map[string]interface{}, error) {
+	if !value.Valid || value.String == "" {
+		return nil, nil
+	}
+
+	m := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(value.String), &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// DumpCatalog reads the services and plans from the database in the format of the catalog file
+func (p *PostgresStorage) DumpCatalog() (*Catalog, error) {
+	rows, err := p.db.Query(servicesQuery + "order by name")
+	if err != nil {
+		msg := fmt.Sprintf("DumpCatalog: error selecting services: %s", err.Error())
+		return nil, errors.New(msg)
+	}
+	defer rows.Close()
+
+	catalog := &Catalog{Services: []CatalogService{}}
+	for rows.Next() {
+		service := CatalogService{Plans: []CatalogPlan{}}
+		var humanName, description, categories, image sql.NullString
+		if err = rows.Scan(&service.ID, &service.Name, &humanName, &description, &categories, &image, &service.PlanUpdatable); err != nil {
+			msg := fmt.Sprintf("DumpCatalog: error scanning service: %s", err.Error())
+			return nil, errors.New(msg)
+		}
+		service.HumanName = humanName.String
+		service.Description = description.String
+		service.Categories = splitCategories(categories)
+		service.Image = image.String
+		catalog.Services = append(catalog.Services, service)
+	}
+
+	for i := range catalog.Services {
+		service := &catalog.Services[i]
+		if service.Plans, err = p.dumpPlans(service.ID); err != nil {
+			msg := fmt.Sprintf("DumpCatalog: error reading plans of %s: %s", service.Name, err.Error())
+			return nil, errors.New(msg)
+		}
+	}
+
+	return catalog, nil
+}
+
+func (p *PostgresStorage) dumpPlans(serviceID string) ([]CatalogPlan, error) {
+	rows, err := p.db.Query(dumpPlansScript, serviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	plans := []CatalogPlan{}
+	planUpdateIDs := [][]string{}
+	for rows.Next() {
+		plan := CatalogPlan{}
+		var humanName, description, categories, settings, parameters sql.NullString
+		var planUpdates pq.StringArray
+		err = rows.Scan(&plan.ID, &plan.Name, &humanName, &description, &categories, &plan.Free, &plan.CostCents, &plan.CostUnit, &settings, &parameters, &planUpdates)
+		if err != nil {
+			return nil, err
+		}
+		plan.HumanName = humanName.String
+		plan.Description = description.String
+		plan.Categories = splitCategories(categories)
+		if plan.Settings, err = unmarshalNullString(settings); err != nil {
+			return nil, err
+		}
+		if plan.Parameters, err = unmarshalNullString(parameters); err != nil {
+			return nil, err
+		}
+		plans = append(plans, plan)
+		planUpdateIDs = append(planUpdateIDs, planUpdates)
+	}
+
+	// the database holds the ids of the plans an instance can change to, the catalog their names
+	names := map[string]string{}
+	for _, plan := range plans {
+		names[plan.ID] = plan.Name
+	}
+	for i, ids := range planUpdateIDs {
+		for _, id := range ids {
+			if name, ok := names[id]; ok {
+				plans[i].PlanUpdates = append(plans[i].PlanUpdates, name)
+			}
+		}
+	}
+
+	return plans, nil
+}
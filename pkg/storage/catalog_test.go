@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func writeCatalog(contents string) string {
+	f, _ := ioutil.TempFile("", "catalog-*.yaml")
+	_, _ = f.WriteString(contents)
+	_ = f.Close()
+	return f.Name()
+}
+
+func TestLoadCatalogFile(t *testing.T) {
+	Convey("Loading the catalog file", t, func() {
+		Convey("the example catalog is valid", func() {
+			catalog, err := LoadCatalogFile("../../catalog.yaml")
+			So(err, ShouldBeNil)
+			So(catalog.Services, ShouldHaveLength, 1)
+			So(catalog.Services[0].Plans[0].Name, ShouldEqual, "distribution")
+			So(catalog.Services[0].Plans[0].Parameters, ShouldBeNil)
+		})
+
+		Convey("plans default to a monthly cost", func() {
+			path := writeCatalog(`{"services": [{"id": "3b8d2e75-ca9f-463f-84e4-4b85513f1bc8", "name": "cloudfront",
+				"plans": [{"id": "5eac120c-5303-4f55-8a62-46cde1b52d0b", "name": "distribution", "cost_cents": 500}]}]}`)
+			defer os.Remove(path)
+
+			catalog, err := LoadCatalogFile(path)
+			So(err, ShouldBeNil)
+			So(catalog.Services[0].Plans[0].CostUnit, ShouldEqual, "month")
+		})
+
+		Convey("unknown fields are rejected", func() {
+			path := writeCatalog("services:\n  - id: 3b8d2e75-ca9f-463f-84e4-4b85513f1bc8\n    name: cloudfront\n    price: 10\n")
+			defer os.Remove(path)
+
+			_, err := LoadCatalogFile(path)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("duplicate plan names are rejected", func() {
+			path := writeCatalog(`
+services:
+  - id: 3b8d2e75-ca9f-463f-84e4-4b85513f1bc8
+    name: cloudfront
+    plans:
+      - id: 5eac120c-5303-4f55-8a62-46cde1b52d0b
+        name: distribution
+      - id: 0f5d4d4e-9c8a-4b43-9d36-3c4f61b7f0a1
+        name: distribution
+`)
+			defer os.Remove(path)
+
+			_, err := LoadCatalogFile(path)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("plan updates must name another plan of an updatable service", func() {
+			catalog := `
+services:
+  - id: 3b8d2e75-ca9f-463f-84e4-4b85513f1bc8
+    name: cloudfront
+    plan_updateable: %s
+    plans:
+      - id: 5eac120c-5303-4f55-8a62-46cde1b52d0b
+        name: distribution
+        plan_updates: [%s]
+      - id: 0f5d4d4e-9c8a-4b43-9d36-3c4f61b7f0a1
+        name: website
+`
+			path := writeCatalog(fmt.Sprintf(catalog, "true", "website"))
+			defer os.Remove(path)
+			_, err := LoadCatalogFile(path)
+			So(err, ShouldBeNil)
+
+			path = writeCatalog(fmt.Sprintf(catalog, "false", "website"))
+			defer os.Remove(path)
+			_, err = LoadCatalogFile(path)
+			So(err, ShouldNotBeNil)
+
+			path = writeCatalog(fmt.Sprintf(catalog, "true", "private"))
+			defer os.Remove(path)
+			_, err = LoadCatalogFile(path)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("invalid cost units are rejected", func() {
+			path := writeCatalog(`
+services:
+  - id: 3b8d2e75-ca9f-463f-84e4-4b85513f1bc8
+    name: cloudfront
+    plans:
+      - id: 5eac120c-5303-4f55-8a62-46cde1b52d0b
+        name: distribution
+        cost_unit: fortnight
+`)
+			defer os.Remove(path)
+
+			_, err := LoadCatalogFile(path)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestSyncCatalog(t *testing.T) {
+	stg, err := InitStorage(context.TODO(), "")
+	if err != nil {
+		t.Skipf("error init db: %s", err)
+	}
+
+	smallID := "1d9c2f0e-5b7a-4a53-8e0a-6c1b2d3e4f50"
+	largeID := "2e8d3a1f-6c8b-4b64-9f1b-7d2c3e4f5a61"
+	mediumID := "3f7e4b2a-7d9c-4c75-a02c-8e3d4f5a6b72"
+
+	catalog := func(plans ...CatalogPlan) *Catalog {
+		plans = append([]CatalogPlan{{ID: "5eac120c-5303-4f55-8a62-46cde1b52d0b", Name: "distribution", CostCents: 1000, CostUnit: "month"}}, plans...)
+		return &Catalog{Services: []CatalogService{{ID: "3b8d2e75-ca9f-463f-84e4-4b85513f1bc8", Name: "cloudfront", Plans: plans}}}
+	}
+	plan := func(id string, name string) CatalogPlan {
+		return CatalogPlan{ID: id, Name: name, CostCents: 1000, CostUnit: "month"}
+	}
+
+	Convey("Syncing the catalog", t, func() {
+		So(stg.SyncCatalog(catalog(plan(smallID, "small"), plan(largeID, "large"))), ShouldBeNil)
+
+		Convey("a plan takes the name of a removed plan", func() {
+			So(stg.SyncCatalog(catalog(plan(smallID, "small"), plan(mediumID, "large"))), ShouldBeNil)
+
+			medium, err := stg.GetPlan(mediumID)
+			So(err, ShouldBeNil)
+			So(medium.Name, ShouldEqual, "large")
+			So(medium.DeletedAt.Valid, ShouldBeFalse)
+
+			large, err := stg.GetPlan(largeID)
+			So(err, ShouldBeNil)
+			So(large.DeletedAt.Valid, ShouldBeTrue)
+		})
+
+		Convey("two plans swap their names", func() {
+			So(stg.SyncCatalog(catalog(plan(smallID, "large"), plan(largeID, "small"))), ShouldBeNil)
+
+			small, err := stg.GetPlan(smallID)
+			So(err, ShouldBeNil)
+			So(small.Name, ShouldEqual, "large")
+			So(small.DeletedAt.Valid, ShouldBeFalse)
+
+			large, err := stg.GetPlan(largeID)
+			So(err, ShouldBeNil)
+			So(large.Name, ShouldEqual, "small")
+			So(large.DeletedAt.Valid, ShouldBeFalse)
+		})
+
+		Reset(func() {
+			_ = stg.SyncCatalog(catalog())
+		})
+	})
+}
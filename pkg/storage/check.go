@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// schemaColumns are the columns the broker needs, the tables and the columns added by migrations
+var schemaColumns = map[string][]string{
+	"services":           {"service_id", "plan_updatable"},
+	"plans":              {"plan_id", "settings", "parameters", "plan_updates"},
+	"distributions":      {"distribution_id", "origin_type", "parameters", "context", "parameters_hash", "service_id"},
+	"origins":            {"origin_id", "iam_user", "access_key"},
+	"tasks":              {"task_id", "operation_key", "context"},
+	"drift_findings":     {"finding_id", "resolved_at"},
+	"webhook_deliveries": {"delivery_id", "next_attempt_at"},
+	"task_events":        {"event_id", "resources"},
+}
+
+// DBCheck is the result of checking the database, Problems is empty when the database is usable
+type DBCheck struct {
+	Database       string         `json:"database"`
+	Reachable      bool           `json:"reachable"`
+	MissingColumns []string       `json:"missing_columns"`
+	Tasks          map[string]int `json:"tasks"`
+	StalledTasks   int            `json:"stalled_tasks"`
+	OpenDrift      int            `json:"open_drift_findings"`
+	Problems       []string       `json:"problems"`
+}
+
+// OpenStorage connects to the database without creating or migrating the tables
+func OpenStorage(databaseURL string) (*PostgresStorage, error) {
+	if databaseURL == "" {
+		databaseURL = os.Getenv("DATABASE_URL")
+	}
+	if databaseURL == "" {
+		return nil, errors.New("unable to connect to database, none was specified in the environment via DATABASE_URL or through the -database cli option")
+	}
+
+	db, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		return nil, errors.New("Unable to open database: " + err.Error())
+	}
+
+	return &PostgresStorage{db: &tracedDB{DB: db}, events: newTaskEventHub(databaseURL)}, nil
+}
+
+// MissingColumns returns the columns the broker needs that are not in the database, sorted
+func (p *PostgresStorage) MissingColumns(ctx context.Context) ([]string, error) {
+	missing := []string{}
+	for table, columns := range schemaColumns {
+		for _, column := range columns {
+			var cnt int
+			if err := p.db.QueryRowContext(ctx, checkColumnScript, table, column).Scan(&cnt); err != nil {
+				msg := fmt.Sprintf("MissingColumns: error checking %s.%s: %s", table, column, err.Error())
+				return nil, errors.New(msg)
+			}
+			if cnt == 0 {
+				missing = append(missing, table+"."+column)
+			}
+		}
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+// Ping checks the database is reachable
+func (p *PostgresStorage) Ping(ctx context.Context) error {
+	return p.db.PingContext(ctx)
+}
+
+// CheckDatabase checks the database is reachable, has the current schema and no stalled tasks,
+// a task is stalled when it is unfinished and was not updated for an hour
+func CheckDatabase(databaseURL string) (*DBCheck, error) {
+	if databaseURL == "" {
+		databaseURL = os.Getenv("DATABASE_URL")
+	}
+
+	check := &DBCheck{
+		Database:       redactDatabaseURL(databaseURL),
+		MissingColumns: []string{},
+		Tasks:          map[string]int{},
+		Problems:       []string{},
+	}
+
+	p, err := OpenStorage(databaseURL)
+	if err != nil {
+		return nil, err
+	}
+	defer p.db.Close()
+
+	if err = p.db.Ping(); err != nil {
+		check.Problems = append(check.Problems, "database is not reachable: "+err.Error())
+		return check, nil
+	}
+	check.Reachable = true
+
+	if check.MissingColumns, err = p.MissingColumns(context.Background()); err != nil {
+		return nil, err
+	}
+	if len(check.MissingColumns) > 0 {
+		check.Problems = append(check.Problems, "schema is not current, start the broker to migrate it")
+		return check, nil
+	}
+
+	rows, err := p.db.Query(countTasksByStatusScript)
+	if err != nil {
+		msg := fmt.Sprintf("CheckDatabase: error counting tasks: %s", err.Error())
+		return nil, errors.New(msg)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var status sql.NullString
+		var cnt int
+		if err = rows.Scan(&status, &cnt); err != nil {
+			msg := fmt.Sprintf("CheckDatabase: error scanning task count: %s", err.Error())
+			return nil, errors.New(msg)
+		}
+		check.Tasks[status.String] = cnt
+	}
+
+	if err = p.db.QueryRow(countStalledTasksScript).Scan(&check.StalledTasks); err != nil {
+		msg := fmt.Sprintf("CheckDatabase: error counting stalled tasks: %s", err.Error())
+		return nil, errors.New(msg)
+	}
+	if check.StalledTasks > 0 {
+		check.Problems = append(check.Problems, fmt.Sprintf("%d tasks were not updated for an hour, is the tasks process running?", check.StalledTasks))
+	}
+
+	if err = p.db.QueryRow(countOpenDriftScript).Scan(&check.OpenDrift); err != nil {
+		msg := fmt.Sprintf("CheckDatabase: error counting drift findings: %s", err.Error())
+		return nil, errors.New(msg)
+	}
+
+	return check, nil
+}
@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// GetDeployedDistributionIDs returns the ids of the deployed distributions that are not deleted
+func (p *PostgresStorage) GetDeployedDistributionIDs() ([]string, error) {
+	rows, err := p.db.Query(selectDeployedDistributionsScript)
+	if err != nil {
+		msg := fmt.Sprintf("GetDeployedDistributionIDs: error selecting distributions: %s", err.Error())
+		return nil, errors.New(msg)
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			msg := fmt.Sprintf("GetDeployedDistributionIDs: error scanning distribution: %s", err.Error())
+			return nil, errors.New(msg)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// RecordDriftFindings stores the findings of a drift check of the distribution,
+// open findings of kinds the check no longer found are resolved
+func (p *PostgresStorage) RecordDriftFindings(distributionID string, findings []DriftFinding) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		msg := fmt.Sprintf("RecordDriftFindings: error starting transaction: %s", err.Error())
+		return errors.New(msg)
+	}
+
+	kinds := []string{}
+	for _, finding := range findings {
+		if _, err = tx.Exec(upsertDriftFindingScript, distributionID, finding.Kind, finding.Expected, finding.Actual); err != nil {
+			_ = tx.Rollback()
+			msg := fmt.Sprintf("RecordDriftFindings: error recording %s: %s", finding.Kind, err.Error())
+			return errors.New(msg)
+		}
+		kinds = append(kinds, finding.Kind)
+	}
+
+	if _, err = tx.Exec(resolveDriftFindingsScript, distributionID, pq.Array(kinds)); err != nil {
+		_ = tx.Rollback()
+		msg := fmt.Sprintf("RecordDriftFindings: error resolving findings: %s", err.Error())
+		return errors.New(msg)
+	}
+
+	if err = tx.Commit(); err != nil {
+		msg := fmt.Sprintf("RecordDriftFindings: error committing findings: %s", err.Error())
+		return errors.New(msg)
+	}
+
+	return nil
+}
+
+// GetDriftFindings returns the open and resolved drift findings of the distribution, newest first
+func (p *PostgresStorage) GetDriftFindings(distributionID string) ([]DriftFinding, error) {
+	rows, err := p.db.Query(selectDriftFindingsScript, distributionID)
+	if err != nil {
+		msg := fmt.Sprintf("GetDriftFindings: error selecting findings: %s", err.Error())
+		return nil, errors.New(msg)
+	}
+	defer rows.Close()
+
+	findings := []DriftFinding{}
+	for rows.Next() {
+		f := DriftFinding{}
+		err = rows.Scan(&f.FindingID, &f.DistributionID, &f.Kind, &f.Expected, &f.Actual, &f.DetectedAt, &f.LastSeenAt, &f.ResolvedAt)
+		if err != nil {
+			msg := fmt.Sprintf("GetDriftFindings: error scanning finding: %s", err.Error())
+			return nil, errors.New(msg)
+		}
+		findings = append(findings, f)
+	}
+
+	return findings, nil
+}
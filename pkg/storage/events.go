@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"cloudfront-broker/pkg/logging"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// TaskEventsChannel is the notification channel the tasks trigger sends the transitions on
+const TaskEventsChannel = "task_events"
+
+const (
+	// taskEventBuffer is the number of events a subscriber may fall behind, later events are dropped
+	taskEventBuffer = 64
+	// listenerPingInterval is how often an idle listener checks its connection
+	listenerPingInterval = 90 * time.Second
+)
+
+// TaskEvent is a transition of a task to another action, status or retry, it is notified
+// by the database for every change so the api server sees the transitions of the tasks process
+type TaskEvent struct {
+	TaskID         string     `json:"task_id"`
+	DistributionID string     `json:"distribution_id"`
+	OperationKey   string     `json:"operation_key,omitempty"`
+	Action         string     `json:"action"`
+	Status         string     `json:"status"`
+	Retries        int        `json:"retries"`
+	Result         string     `json:"result,omitempty"`
+	Description    string     `json:"description,omitempty"`
+	UpdatedAt      *time.Time `json:"updated_at,omitempty"`
+}
+
+// Event returns the task as an event, the description is only set once the task stopped
+func (t *Task) Event() *TaskEvent {
+	event := &TaskEvent{
+		TaskID:         t.TaskID,
+		DistributionID: t.DistributionID,
+		OperationKey:   t.OperationKey.String,
+		Action:         t.Action,
+		Status:         t.Status,
+		Retries:        t.Retries,
+		Result:         t.Result.String,
+	}
+	if t.Status == "finished" || t.Status == "failed" {
+		event.Description = t.Description()
+	}
+	if !t.UpdatedAt.IsZero() {
+		updatedAt := t.UpdatedAt
+		event.UpdatedAt = &updatedAt
+	}
+	return event
+}
+
+// taskEventHub listens on TaskEventsChannel once the first subscriber arrives and passes
+// each event to the subscribers of its distribution
+type taskEventHub struct {
+	sync.Mutex
+	databaseURL string
+	listener    *pq.Listener
+	subscribers map[string]map[chan *TaskEvent]bool
+}
+
+func newTaskEventHub(databaseURL string) *taskEventHub {
+	return &taskEventHub{
+		databaseURL: databaseURL,
+		subscribers: map[string]map[chan *TaskEvent]bool{},
+	}
+}
+
+// SubscribeTaskEvents returns the transitions of the tasks of the distribution as they happen,
+// the returned function ends the subscription and closes the channel
+func (p *PostgresStorage) SubscribeTaskEvents(distributionID string) (<-chan *TaskEvent, func(), error) {
+	return p.events.subscribe(distributionID)
+}
+
+func (h *taskEventHub) subscribe(distributionID string) (<-chan *TaskEvent, func(), error) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.listener == nil {
+		listener := pq.NewListener(h.databaseURL, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+			switch ev {
+			case pq.ListenerEventDisconnected:
+				logging.Root().Warn("task events: listener disconnected", "error", err)
+			case pq.ListenerEventReconnected:
+				logging.Root().Info("task events: listener reconnected, events in between are lost")
+			}
+		})
+		if err := listener.Listen(TaskEventsChannel); err != nil {
+			_ = listener.Close()
+			return nil, nil, errors.New("SubscribeTaskEvents: error listening for task events: " + err.Error())
+		}
+		h.listener = listener
+		go h.run(listener)
+	}
+
+	ch := make(chan *TaskEvent, taskEventBuffer)
+	if h.subscribers[distributionID] == nil {
+		h.subscribers[distributionID] = map[chan *TaskEvent]bool{}
+	}
+	h.subscribers[distributionID][ch] = true
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			h.Lock()
+			defer h.Unlock()
+			if h.subscribers[distributionID][ch] {
+				delete(h.subscribers[distributionID], ch)
+				if len(h.subscribers[distributionID]) == 0 {
+					delete(h.subscribers, distributionID)
+				}
+				close(ch)
+			}
+		})
+	}
+	return ch, unsubscribe, nil
+}
+
+// run passes the notifications to the subscribers until the listener is closed
+func (h *taskEventHub) run(listener *pq.Listener) {
+	ticker := time.NewTicker(listenerPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case n, ok := <-listener.Notify:
+			if !ok {
+				return
+			}
+			// a nil notification follows a reconnect
+			if n != nil {
+				h.publish(n.Extra)
+			}
+		case <-ticker.C:
+			go func() {
+				_ = listener.Ping()
+			}()
+		}
+	}
+}
+
+func (h *taskEventHub) publish(payload string) {
+	event := &TaskEvent{}
+	if err := json.Unmarshal([]byte(payload), event); err != nil {
+		logging.Root().Error("task events: error decoding", "payload", payload, "error", err)
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	for ch := range h.subscribers[event.DistributionID] {
+		select {
+		case ch <- event:
+		default:
+			logging.Root().Warn("task events: subscriber is behind, event dropped", logging.KeyInstanceID, event.DistributionID)
+		}
+	}
+}
+
+// close stops listening and ends all subscriptions
+func (h *taskEventHub) close() {
+	if h == nil {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	if h.listener != nil {
+		_ = h.listener.Close()
+		h.listener = nil
+	}
+	for distributionID, subscribers := range h.subscribers {
+		for ch := range subscribers {
+			close(ch)
+		}
+		delete(h.subscribers, distributionID)
+	}
+}
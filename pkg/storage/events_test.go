@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTaskEvents(t *testing.T) {
+	Convey("Task events", t, func() {
+		Convey("describe a task once it stopped", func() {
+			task := &Task{TaskID: "task-1", DistributionID: "inst-1", Action: "is-distribution-deployed", Status: "pending", Retries: 3, Metadata: SetNullString("{}")}
+			event := task.Event()
+			So(event.Retries, ShouldEqual, 3)
+			So(event.Description, ShouldBeEmpty)
+			So(event.UpdatedAt, ShouldBeNil)
+
+			task.Status = "failed"
+			task.Metadata = SetNullString("access denied")
+			So(task.Event().Description, ShouldEqual, "access denied")
+
+			task.Context = SetNullString(`{"version": 1, "error": {"action": "create-distribution", "message": "error creating distribution"}}`)
+			So(task.Event().Description, ShouldEqual, "error creating distribution")
+		})
+
+		Convey("are passed to the subscribers of their distribution", func() {
+			hub := newTaskEventHub("")
+			mine := make(chan *TaskEvent, 1)
+			other := make(chan *TaskEvent, 1)
+			hub.subscribers["inst-1"] = map[chan *TaskEvent]bool{mine: true}
+			hub.subscribers["inst-2"] = map[chan *TaskEvent]bool{other: true}
+
+			hub.publish(`{"task_id":"task-1","distribution_id":"inst-1","action":"create-origin","status":"pending","retries":0,"updated_at":"2024-05-01T12:00:00.123456+00:00"}`)
+			So(len(other), ShouldEqual, 0)
+			event := <-mine
+			So(event.Action, ShouldEqual, "create-origin")
+			So(event.UpdatedAt, ShouldNotBeNil)
+
+			Convey("dropping events a subscriber is too far behind for", func() {
+				hub.publish(`{"distribution_id":"inst-1","action":"a"}`)
+				hub.publish(`{"distribution_id":"inst-1","action":"b"}`)
+				So((<-mine).Action, ShouldEqual, "a")
+				So(len(mine), ShouldEqual, 0)
+			})
+
+			Convey("ending the subscriptions on close", func() {
+				hub.close()
+				_, open := <-mine
+				So(open, ShouldBeFalse)
+			})
+		})
+	})
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// ResourceReferences holds the names and ids of the aws resources the database references,
+// the distribution maps are true when a distribution that is not deleted references the key
+type ResourceReferences struct {
+	Buckets                map[string]bool
+	IAMUsers               map[string]bool
+	CallerReferences       map[string]bool
+	CloudfrontIDs          map[string]bool
+	OriginAccessIdentities map[string]bool
+}
+
+func addReference(refs map[string]bool, key sql.NullString, active bool) {
+	if !key.Valid || key.String == "" {
+		return
+	}
+	refs[key.String] = refs[key.String] || active
+}
+
+// GetResourceReferences reads the aws resources referenced by the origins and distributions tables
+func (p *PostgresStorage) GetResourceReferences() (*ResourceReferences, error) {
+	refs := &ResourceReferences{
+		Buckets:                map[string]bool{},
+		IAMUsers:               map[string]bool{},
+		CallerReferences:       map[string]bool{},
+		CloudfrontIDs:          map[string]bool{},
+		OriginAccessIdentities: map[string]bool{},
+	}
+
+	rows, err := p.db.Query(selectOriginReferencesScript)
+	if err != nil {
+		msg := fmt.Sprintf("GetResourceReferences: error selecting origins: %s", err.Error())
+		return nil, errors.New(msg)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bucketName, iamUser sql.NullString
+		if err = rows.Scan(&bucketName, &iamUser); err != nil {
+			msg := fmt.Sprintf("GetResourceReferences: error scanning origin: %s", err.Error())
+			return nil, errors.New(msg)
+		}
+		addReference(refs.Buckets, bucketName, true)
+		addReference(refs.IAMUsers, iamUser, true)
+	}
+
+	distRows, err := p.db.Query(selectDistributionReferencesScript)
+	if err != nil {
+		msg := fmt.Sprintf("GetResourceReferences: error selecting distributions: %s", err.Error())
+		return nil, errors.New(msg)
+	}
+	defer distRows.Close()
+
+	for distRows.Next() {
+		var callerReference, cloudfrontID, originAccessIdentity sql.NullString
+		var active bool
+		if err = distRows.Scan(&callerReference, &cloudfrontID, &originAccessIdentity, &active); err != nil {
+			msg := fmt.Sprintf("GetResourceReferences: error scanning distribution: %s", err.Error())
+			return nil, errors.New(msg)
+		}
+		addReference(refs.CallerReferences, callerReference, active)
+		addReference(refs.CloudfrontIDs, cloudfrontID, active)
+		addReference(refs.OriginAccessIdentities, originAccessIdentity, active)
+	}
+
+	return refs, nil
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// ImportDistribution inserts a distribution adopted from aws with its origin and a finished task,
+// origin is nil for a custom origin, the rows are only stored when all inserts succeed
+func (p *PostgresStorage) ImportDistribution(distribution *Distribution, origin *Origin, task *Task) error {
+	if _, err := p.GetDistributionWithDeleted(distribution.DistributionID); err == nil {
+		return errors.New(DistributionFound)
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		msg := fmt.Sprintf("ImportDistribution: error starting transaction: %s", err.Error())
+		return errors.New(msg)
+	}
+
+	fail := func(step string, err error) error {
+		_ = tx.Rollback()
+		msg := fmt.Sprintf("ImportDistribution: error %s: %s", step, err.Error())
+		return errors.New(msg)
+	}
+
+	_, err = tx.Exec(insertDistScript,
+		distribution.DistributionID,
+		distribution.PlanID,
+		distribution.BillingCode,
+		distribution.CallerReference,
+		distribution.Status,
+		distribution.OriginType,
+		distribution.Parameters,
+		distribution.Context,
+		distribution.ParametersHash,
+		distribution.ServiceID,
+	)
+	if err != nil {
+		return fail("inserting distribution", err)
+	}
+
+	if _, err = tx.Exec(updateDistributionWithCloudfrontScript, distribution.DistributionID, distribution.CloudfrontID, distribution.CloudfrontURL); err != nil {
+		return fail("updating cloudfront", err)
+	}
+
+	if distribution.OriginAccessIdentity.Valid {
+		if _, err = tx.Exec(updateDistWithOAIScript, distribution.DistributionID, distribution.OriginAccessIdentity); err != nil {
+			return fail("updating origin access identity", err)
+		}
+	}
+
+	if origin != nil {
+		origin.DistributionID = distribution.DistributionID
+		if err = tx.QueryRow(insertOriginScript, distribution.DistributionID, origin.BucketName, origin.BucketURL).Scan(&origin.OriginID); err != nil {
+			return fail("inserting origin", err)
+		}
+
+		if origin.IAMUser.Valid {
+			if _, err = tx.Exec(updateOriginWithIAMScript, origin.OriginID, origin.IAMUser); err != nil {
+				return fail("updating iam user", err)
+			}
+		}
+
+		if origin.AccessKey.Valid {
+			if _, err = tx.Exec(updateOriginWithAccessKeyScript, origin.OriginID, origin.AccessKey, origin.SecretKey); err != nil {
+				return fail("updating access key", err)
+			}
+		}
+	}
+
+	task.DistributionID = distribution.DistributionID
+	err = tx.QueryRow(insertTaskScript, task.DistributionID, task.Status, task.Action, task.OperationKey, task.Retries, task.StartedAt, task.Metadata, task.Context).Scan(&task.TaskID)
+	if err != nil {
+		return fail("inserting task", err)
+	}
+
+	if _, err = tx.Exec(finishImportTaskScript, task.TaskID, task.Result); err != nil {
+		return fail("finishing task", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		msg := fmt.Sprintf("ImportDistribution: error committing import: %s", err.Error())
+		return errors.New(msg)
+	}
+
+	return nil
+}
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"database/sql"
+	"encoding/json"
 	"time"
 
 	"github.com/lib/pq"
@@ -9,15 +10,16 @@ import (
 
 // Service is the OSB Services table
 type Service struct {
-	ServiceID   string
-	Name        string
-	HumanName   sql.NullString
-	Description sql.NullString
-	Catagories  sql.NullString
-	Image       sql.NullString
-	CreatedAt   time.Time
-	UpdatedAt   time.Time
-	DeletedAt   pq.NullTime
+	ServiceID     string
+	Name          string
+	HumanName     sql.NullString
+	Description   sql.NullString
+	Catagories    sql.NullString
+	Image         sql.NullString
+	PlanUpdatable bool
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	DeletedAt     pq.NullTime
 }
 
 // Plan is the OSB plans table
@@ -32,6 +34,8 @@ type Plan struct {
 	CostCents   uint
 	CostUnit    string
 	Parameters  sql.NullString
+	Settings    sql.NullString
+	PlanUpdates pq.StringArray
 	CreatedAt   time.Time
 	UpdatedAt   time.Time
 	DeletedAt   pq.NullTime
@@ -41,7 +45,7 @@ type Plan struct {
 type Distribution struct {
 	DistributionID       string
 	PlanID               string
-	ServiceID            string // from plan table
+	ServiceID            string // of the provision request, from the plan table for older instances
 	CloudfrontID         sql.NullString
 	CloudfrontURL        sql.NullString
 	OriginAccessIdentity sql.NullString
@@ -49,6 +53,10 @@ type Distribution struct {
 	BillingCode          sql.NullString
 	Status               string
 	CallerReference      string
+	OriginType           string
+	Parameters           sql.NullString
+	Context              sql.NullString
+	ParametersHash       sql.NullString
 	CreatedAt            time.Time
 	UpdatedAt            time.Time
 	DeletedAt            pq.NullTime
@@ -73,7 +81,8 @@ type Origin struct {
 	DeletedAt      pq.NullTime
 }
 
-// Task is the tasks table
+// Task is the tasks table, Metadata is the description of a finished task shown to clients and
+// Context the json task context its actions pass on, with the error of a failed task
 type Task struct {
 	TaskID         string
 	DistributionID string
@@ -83,9 +92,69 @@ type Task struct {
 	Retries        int
 	Result         sql.NullString
 	Metadata       sql.NullString
+	Context        sql.NullString
 	CreatedAt      time.Time
 	UpdatedAt      time.Time
 	StartedAt      pq.NullTime
 	FinishedAt     pq.NullTime
 	DeletedAt      pq.NullTime
 }
+
+// Description returns the description of the task shown to clients, the message of the
+// error in the context of a failed task and the metadata otherwise
+func (t *Task) Description() string {
+	var tc struct {
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if t.Context.Valid && json.Unmarshal([]byte(t.Context.String), &tc) == nil && tc.Error != nil {
+		return tc.Error.Message
+	}
+	return t.Metadata.String
+}
+
+// DriftFinding is the drift_findings table, a finding is open until a check no longer sees the drift
+type DriftFinding struct {
+	FindingID      string
+	DistributionID string
+	Kind           string
+	Expected       sql.NullString
+	Actual         sql.NullString
+	DetectedAt     time.Time
+	LastSeenAt     time.Time
+	ResolvedAt     pq.NullTime
+}
+
+// WebhookDelivery is the webhook_deliveries table, the outbox of the webhooks of finished operations
+type WebhookDelivery struct {
+	DeliveryID     string
+	DistributionID string
+	TaskID         string
+	URL            string
+	Payload        string
+	Status         string
+	Attempts       int
+	LastError      sql.NullString
+	NextAttemptAt  time.Time
+	CreatedAt      time.Time
+	DeliveredAt    pq.NullTime
+}
+
+// TaskAuditEvent is the task_events table, an append-only record of each action a task ran,
+// Resources are the ids of the aws resources the action created
+type TaskAuditEvent struct {
+	EventID        string
+	TaskID         string
+	DistributionID string
+	OperationKey   sql.NullString
+	Action         string
+	NextAction     string
+	Status         string
+	Retries        int
+	Error          sql.NullString
+	Resources      map[string]string
+	StartedAt      time.Time
+	FinishedAt     time.Time
+	CreatedAt      time.Time
+}
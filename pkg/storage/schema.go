@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// defaultParametersSchema is published for plans without parameters in the catalog,
+// it describes every provision and update parameter the broker reads
+const defaultParametersSchema string = `{
+  "$schema": "http://json-schema.org/draft-04/schema#",
+  "type": "object",
+  "additionalProperties": false,
+  "properties": {
+    "billingcode": {
+      "description": "Billing code used for invoicing",
+      "type": "string"
+    },
+    "origin_type": {
+      "description": "s3 to create a bucket, custom to front an existing app",
+      "type": "string",
+      "enum": ["s3", "custom"]
+    },
+    "custom_origin": {
+      "description": "Custom origin settings, required for origin_type custom",
+      "type": "object",
+      "additionalProperties": false,
+      "required": ["domain_name"],
+      "properties": {
+        "domain_name": {"type": "string", "minLength": 1},
+        "origin_path": {"type": "string"},
+        "protocol_policy": {"type": "string", "enum": ["http-only", "match-viewer", "https-only"]},
+        "http_port": {"$ref": "#/definitions/port"},
+        "https_port": {"$ref": "#/definitions/port"},
+        "ssl_protocols": {
+          "type": "array",
+          "items": {"type": "string", "enum": ["SSLv3", "TLSv1", "TLSv1.1", "TLSv1.2"]}
+        },
+        "custom_headers": {
+          "type": "object",
+          "maxProperties": 10,
+          "additionalProperties": {"type": "string", "minLength": 1}
+        },
+        "read_timeout": {"type": "integer", "minimum": 1, "maximum": 60},
+        "keepalive_timeout": {"type": "integer", "minimum": 1, "maximum": 60}
+      }
+    },
+    "versioning": {
+      "description": "Enable versioning on the bucket",
+      "type": "boolean"
+    },
+    "lifecycle": {
+      "description": "Lifecycle rules for the bucket",
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "noncurrent_version_expiration_days": {"type": "integer", "minimum": 0},
+        "transitions": {"$ref": "#/definitions/transitions"},
+        "noncurrent_version_transitions": {"$ref": "#/definitions/transitions"},
+        "abort_incomplete_multipart_upload_days": {"type": "integer", "minimum": 0}
+      }
+    },
+    "cors": {
+      "description": "CORS rules for the bucket",
+      "type": "array",
+      "maxItems": 100,
+      "items": {
+        "type": "object",
+        "additionalProperties": false,
+        "required": ["allowed_origins", "allowed_methods"],
+        "properties": {
+          "allowed_origins": {"type": "array", "minItems": 1, "items": {"type": "string", "minLength": 1}},
+          "allowed_methods": {
+            "type": "array",
+            "minItems": 1,
+            "items": {"type": "string", "enum": ["GET", "PUT", "POST", "DELETE", "HEAD"]}
+          },
+          "allowed_headers": {"type": "array", "items": {"type": "string", "minLength": 1}},
+          "expose_headers": {"type": "array", "items": {"type": "string", "minLength": 1}},
+          "max_age_seconds": {"type": "integer", "minimum": 0}
+        }
+      }
+    },
+    "distribution": {
+      "description": "Overrides of the plan's distribution profile",
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "price_class": {"type": "string", "enum": ["PriceClass_100", "PriceClass_200", "PriceClass_All"]},
+        "min_ttl": {"type": "integer", "minimum": 0},
+        "default_ttl": {"type": "integer", "minimum": 0},
+        "max_ttl": {"type": "integer", "minimum": 0},
+        "http_version": {"type": "string", "enum": ["http1.1", "http2", "http2and3", "http3"]},
+        "ipv6": {"type": "boolean"},
+        "compress": {"type": "boolean"},
+        "default_root_object": {"type": "string"},
+        "logging": {
+          "type": "object",
+          "additionalProperties": false,
+          "required": ["bucket"],
+          "properties": {
+            "bucket": {"type": "string", "minLength": 1},
+            "prefix": {"type": "string"},
+            "include_cookies": {"type": "boolean"}
+          }
+        },
+        "web_acl_id": {"type": "string"}
+      }
+    },
+    "tags": {
+      "description": "Tags added to the distribution, bucket and iam user",
+      "type": "object",
+      "maxProperties": 40,
+      "additionalProperties": {"type": "string", "maxLength": 256}
+    },
+    "webhook_url": {
+      "description": "Url posted a signed notification when an operation on the instance finished or failed, blank removes it",
+      "type": "string",
+      "pattern": "^(https?://.+)?$"
+    }
+  },
+  "definitions": {
+    "port": {
+      "description": "80, 443 or a port from 1024 to 65535, the ports cloudfront connects to",
+      "type": "integer",
+      "oneOf": [
+        {"enum": [80, 443]},
+        {"minimum": 1024, "maximum": 65535}
+      ]
+    },
+    "transitions": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "additionalProperties": false,
+        "required": ["days", "storage_class"],
+        "properties": {
+          "days": {"type": "integer", "minimum": 0},
+          "storage_class": {
+            "type": "string",
+            "enum": ["STANDARD_IA", "ONEZONE_IA", "INTELLIGENT_TIERING", "GLACIER_IR", "GLACIER", "DEEP_ARCHIVE"]
+          }
+        }
+      }
+    }
+  }
+}`
+
+// DefaultParametersSchema returns the json schema published for plans without parameters in the catalog
+func DefaultParametersSchema() map[string]interface{} {
+	schema := map[string]interface{}{}
+	// the schema is a constant, a decode error is a programming error
+	if err := json.Unmarshal([]byte(defaultParametersSchema), &schema); err != nil {
+		panic("invalid default parameters schema: " + err.Error())
+	}
+	return schema
+}
+
+// ParametersSchema returns the json schema of the provision and update parameters of the plan
+func (plan *Plan) ParametersSchema() (map[string]interface{}, error) {
+	if !plan.Parameters.Valid || plan.Parameters.String == "" {
+		return DefaultParametersSchema(), nil
+	}
+
+	schema := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(plan.Parameters.String), &schema); err != nil {
+		msg := fmt.Sprintf("unable to decode parameters for plan %s: %s", plan.Name, err.Error())
+		return nil, errors.New(msg)
+	}
+	return schema, nil
+}
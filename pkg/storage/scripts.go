@@ -7,7 +7,8 @@ select
     human_name,
     description,
     categories,
-    image
+    image,
+    plan_updatable
 from services where deleted_at is null `
 
 const plansQuery string = `
@@ -20,7 +21,8 @@ select
     plans.categories,
     plans.free,
     plans.cost_cents,
-    plans.cost_unit
+    plans.cost_unit,
+    plans.parameters
 from plans join services on services.service_id = plans.service_id
 where services.deleted_at is null and plans.deleted_at is null
 `
@@ -68,6 +70,8 @@ DO
         deleted_at  timestamp WITH TIME ZONE
       );
 
+      ALTER TABLE services ADD COLUMN IF NOT EXISTS plan_updatable boolean NOT NULL DEFAULT FALSE;
+
       DROP TRIGGER IF EXISTS services_updated
         ON services;
 
@@ -81,7 +85,7 @@ DO
       (
         plan_id     uuid                                    NOT NULL PRIMARY KEY,
         service_id  uuid REFERENCES services ("service_id") NOT NULL,
-        name        alpha_numeric                           NOT NULL UNIQUE,
+        name        alpha_numeric                           NOT NULL,
         human_name  text,
         description text,
         categories  text,
@@ -94,6 +98,16 @@ DO
         deleted_at  timestamp WITH TIME ZONE
       );
 
+      ALTER TABLE plans ADD COLUMN IF NOT EXISTS settings text;
+      ALTER TABLE plans ADD COLUMN IF NOT EXISTS parameters text;
+      ALTER TABLE plans ADD COLUMN IF NOT EXISTS plan_updates text[];
+
+      ALTER TABLE plans DROP CONSTRAINT IF EXISTS plans_name_key;
+
+      CREATE UNIQUE INDEX IF NOT EXISTS plans_name_active
+        ON plans (name)
+        WHERE deleted_at IS NULL;
+
       DROP TRIGGER IF EXISTS plans_updated
         ON plans;
 
@@ -123,6 +137,17 @@ DO
         deleted_at      timestamp WITH TIME ZONE
       );
 
+      ALTER TABLE distributions ADD COLUMN IF NOT EXISTS origin_type varchar(32) NOT NULL DEFAULT 's3';
+      ALTER TABLE distributions ADD COLUMN IF NOT EXISTS parameters text;
+      ALTER TABLE distributions ADD COLUMN IF NOT EXISTS context text;
+      ALTER TABLE distributions ADD COLUMN IF NOT EXISTS parameters_hash varchar(64);
+      ALTER TABLE distributions ADD COLUMN IF NOT EXISTS service_id uuid;
+
+      UPDATE distributions d SET service_id = p.service_id
+        FROM plans p
+        WHERE d.service_id IS NULL
+        AND p.plan_id = d.plan_id;
+
       DROP TRIGGER IF EXISTS distributions_updated
         ON distributions;
 
@@ -176,6 +201,8 @@ DO
         deleted_at      timestamp WITH TIME ZONE
       );
 
+      ALTER TABLE tasks ADD COLUMN IF NOT EXISTS context jsonb;
+
       DROP TRIGGER IF EXISTS tasks_updated
         ON tasks;
 
@@ -184,6 +211,120 @@ DO
         ON tasks
         FOR EACH ROW
       EXECUTE PROCEDURE mark_updated_column();
+
+      CREATE OR REPLACE FUNCTION notify_task_event()
+        RETURNS trigger AS
+      $task_event$
+      BEGIN
+        IF TG_OP = 'INSERT'
+          OR NEW.action IS DISTINCT FROM OLD.action
+          OR NEW.status IS DISTINCT FROM OLD.status
+          OR NEW.retries IS DISTINCT FROM OLD.retries
+        THEN
+          PERFORM pg_notify('task_events', json_build_object(
+            'task_id', NEW.task_id,
+            'distribution_id', NEW.distribution_id,
+            'operation_key', NEW.operation_key,
+            'action', NEW.action,
+            'status', NEW.status,
+            'retries', NEW.retries,
+            'result', NEW.result,
+            'description', CASE WHEN NEW.finished_at IS NOT NULL THEN left(COALESCE(NEW.context->'error'->>'message', NEW.metadata), 1000) END,
+            'updated_at', NEW.updated_at
+          )::text);
+        END IF;
+        RETURN NEW;
+      END;
+      $task_event$
+        LANGUAGE plpgsql;
+
+      DROP TRIGGER IF EXISTS tasks_notify
+        ON tasks;
+
+      CREATE TRIGGER tasks_notify
+        AFTER INSERT OR UPDATE
+        ON tasks
+        FOR EACH ROW
+      EXECUTE PROCEDURE notify_task_event();
+
+      CREATE TABLE IF NOT EXISTS drift_findings
+      (
+        finding_id      uuid  NOT NULL PRIMARY KEY,
+        distribution_id uuid REFERENCES distributions ("distribution_id") NOT NULL,
+        kind            varchar(128) NOT NULL,
+        expected        text,
+        actual          text,
+
+        detected_at     timestamp WITH TIME ZONE NOT NULL DEFAULT now(),
+        last_seen_at    timestamp WITH TIME ZONE NOT NULL DEFAULT now(),
+        resolved_at     timestamp WITH TIME ZONE
+      );
+
+      CREATE UNIQUE INDEX IF NOT EXISTS drift_findings_open
+        ON drift_findings (distribution_id, kind)
+        WHERE resolved_at IS NULL;
+
+      CREATE TABLE IF NOT EXISTS webhook_deliveries
+      (
+        delivery_id     uuid  NOT NULL PRIMARY KEY,
+        distribution_id uuid REFERENCES distributions ("distribution_id") NOT NULL,
+        task_id         uuid REFERENCES tasks ("task_id") NOT NULL,
+        url             text NOT NULL,
+        payload         text NOT NULL,
+        status          varchar(32) NOT NULL DEFAULT 'pending',
+        attempts        int NOT NULL DEFAULT 0,
+        last_error      text,
+
+        next_attempt_at timestamp WITH TIME ZONE NOT NULL DEFAULT now(),
+        created_at      timestamp WITH TIME ZONE NOT NULL DEFAULT now(),
+        delivered_at    timestamp WITH TIME ZONE
+      );
+
+      CREATE INDEX IF NOT EXISTS webhook_deliveries_due
+        ON webhook_deliveries (next_attempt_at)
+        WHERE status = 'pending';
+
+      CREATE TABLE IF NOT EXISTS task_events
+      (
+        event_id        uuid  NOT NULL PRIMARY KEY,
+        task_id         uuid REFERENCES tasks ("task_id") NOT NULL,
+        distribution_id uuid REFERENCES distributions ("distribution_id") NOT NULL,
+        operation_key   varchar(128),
+        action          varchar(128) NOT NULL,
+        next_action     varchar(128) NOT NULL,
+        status          varchar(32) NOT NULL,
+        retries         int NOT NULL DEFAULT 0,
+        error           text,
+        resources       text,
+
+        started_at      timestamp WITH TIME ZONE NOT NULL,
+        finished_at     timestamp WITH TIME ZONE NOT NULL,
+        created_at      timestamp WITH TIME ZONE NOT NULL DEFAULT now()
+      );
+
+      CREATE INDEX IF NOT EXISTS task_events_task
+        ON task_events (task_id, created_at);
+
+      CREATE INDEX IF NOT EXISTS task_events_distribution
+        ON task_events (distribution_id, created_at);
+
+      CREATE OR REPLACE FUNCTION reject_task_event_change()
+        RETURNS trigger AS
+      $task_event_change$
+      BEGIN
+        RAISE EXCEPTION 'task_events is append-only';
+      END;
+      $task_event_change$
+        LANGUAGE plpgsql;
+
+      DROP TRIGGER IF EXISTS task_events_append_only
+        ON task_events;
+
+      CREATE TRIGGER task_events_append_only
+        BEFORE UPDATE OR DELETE
+        ON task_events
+        FOR EACH ROW
+      EXECUTE PROCEDURE reject_task_event_change();
     END
     $$
 `
@@ -208,17 +349,82 @@ const initPlansScript string = `
 );
 `
 
+const upsertServiceScript string = `
+  insert into services (service_id, name, human_name, description, categories, image, plan_updatable)
+  values ($1, $2, $3, $4, $5, $6, $7)
+  on conflict (service_id) do update set
+    name = excluded.name,
+    human_name = excluded.human_name,
+    description = excluded.description,
+    categories = excluded.categories,
+    image = excluded.image,
+    plan_updatable = excluded.plan_updatable,
+    deleted_at = null
+`
+
+const upsertPlanScript string = `
+  insert into plans (plan_id, service_id, name, human_name, description, categories, free, cost_cents, cost_unit, settings, parameters, plan_updates)
+  values ($1, $2, $3, $4, $5, $6, $7, $8, $9::costunit, $10, $11, $12)
+  on conflict (plan_id) do update set
+    service_id = excluded.service_id,
+    name = excluded.name,
+    human_name = excluded.human_name,
+    description = excluded.description,
+    categories = excluded.categories,
+    free = excluded.free,
+    cost_cents = excluded.cost_cents,
+    cost_unit = excluded.cost_unit,
+    settings = excluded.settings,
+    parameters = excluded.parameters,
+    plan_updates = excluded.plan_updates,
+    deleted_at = null
+`
+
+const deletePlansScript string = `
+  update plans
+  set deleted_at = now()
+  where deleted_at is null
+`
+
+const deleteRemovedServicesScript string = `
+  update services
+  set deleted_at = now()
+  where deleted_at is null
+  and not (service_id::text = any($1))
+`
+
 const checkPlanScript string = `
   select count(*) from plans
   where plan_id = $1
   and deleted_at is null
 `
 
+const selectPlanScript string = `
+  select
+    plan_id,
+    service_id,
+    name,
+    human_name,
+    description,
+    categories,
+    free,
+    cost_cents,
+    cost_unit,
+    parameters,
+    settings,
+    plan_updates,
+    created_at,
+    updated_at,
+    deleted_at
+  from plans
+  where plan_id = $1
+`
+
 const selectDistScript string = `
   select 
     d.distribution_id, 
     d.plan_id,
-    p.service_id,
+    COALESCE(d.service_id, p.service_id),
     d.cloudfront_id, 
     d.cloudfront_url, 
     d.origin_access_identity, 
@@ -226,6 +432,10 @@ const selectDistScript string = `
     d.status, 
     d.billing_code, 
     d.caller_reference,
+    d.origin_type,
+    d.parameters,
+    d.context,
+    d.parameters_hash,
     d.created_at,
     d.updated_at,
     d.deleted_at
@@ -235,9 +445,9 @@ const selectDistScript string = `
 `
 
 const insertDistScript string = `insert into distributions
-    (distribution_id, plan_id, billing_code, caller_reference, status) 
+    (distribution_id, plan_id, billing_code, caller_reference, status, origin_type, parameters, context, parameters_hash, service_id) 
     values 
-    ($1, $2, $3, $4, $5) returning distribution_id;`
+    ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) returning distribution_id;`
 
 const updateDistributionScript string = `
   update distributions
@@ -255,6 +465,31 @@ const updateDistributionWithCloudfrontScript string = `
   returning plan_id, cloudfront_id, cloudfront_url, origin_access_identity, claimed, status, billing_code
 `
 
+const updateDistributionParametersScript string = `
+  update distributions
+  set parameters = $2
+  where distribution_id = $1
+  and deleted_at is null
+  returning distribution_id
+`
+
+const updateDistributionPlanScript string = `
+  update distributions
+  set plan_id = $2,
+    parameters = $3
+  where distribution_id = $1
+  and deleted_at is null
+  returning distribution_id
+`
+
+const updateDistributionBillingCodeScript string = `
+  update distributions
+  set billing_code = $2
+  where distribution_id = $1
+  and deleted_at is null
+  returning distribution_id
+`
+
 const updateDistributionDeletedScript string = `
   update distributions
   set deleted_at = now()
@@ -303,13 +538,13 @@ const updateOriginWithAccessKeyScript string = `
 
 const insertTaskScript string = `
   insert into tasks
-  (task_id, distribution_id, status, action, operation_key, retries, started_at)
+  (task_id, distribution_id, status, action, operation_key, retries, started_at, metadata, context)
   values 
-  (uuid_generate_v4(), $1, $2, $3, $4, $5, $6) returning task_id
+  (uuid_generate_v4(), $1, $2, $3, $4, $5, $6, $7, $8) returning task_id
 `
 
 const selectTaskScript string = `
-  select task_id, distribution_id, operation_key, status, action, retries, metadata, result
+  select task_id, distribution_id, operation_key, status, action, retries, metadata, context, result
   from tasks
   where distribution_id = $1
   and deleted_at is null
@@ -317,7 +552,7 @@ const selectTaskScript string = `
 `
 
 const popNextTaskScript string = `
-    select task_id, distribution_id, operation_key, status, action, retries, metadata, result, started_at, updated_at
+    select task_id, distribution_id, operation_key, status, action, retries, metadata, context, result, created_at, started_at, updated_at
     from tasks 
     where status in ('new', 'pending') 
     and deleted_at is null 
@@ -334,9 +569,253 @@ const updateTaskActionScript string = `
     metadata = $6,
     finished_at = $7,
     started_at = $8,
+    context = $9,
     updated_at = now()
   where task_id = $1
   and finished_at is null
   and deleted_at is null
-  returning task_id, distribution_id, action, status, retries, result, metadata, created_at, updated_at, started_at, finished_at
+  returning task_id, distribution_id, action, status, retries, result, metadata, context, created_at, updated_at, started_at, finished_at
+`
+
+const finishImportTaskScript string = `
+  update tasks set
+    result = $2,
+    finished_at = now()
+  where task_id = $1
+`
+
+const listDistributionsScript string = `
+  select 
+    d.distribution_id, 
+    d.plan_id,
+    COALESCE(d.service_id, p.service_id),
+    d.cloudfront_id, 
+    d.cloudfront_url, 
+    d.origin_access_identity, 
+    d.claimed, 
+    d.status, 
+    d.billing_code, 
+    d.caller_reference,
+    d.origin_type,
+    d.parameters,
+    d.context,
+    d.parameters_hash,
+    d.created_at,
+    d.updated_at,
+    d.deleted_at
+  from distributions d, plans p
+  where p.plan_id = d.plan_id
+`
+
+const countDistributionsScript string = `
+  select count(*)
+  from distributions d
+  where true
+`
+
+const selectOriginsScript string = `
+  select origin_id, distribution_id, bucket_name, bucket_url, origin_path, iam_user, created_at, updated_at, deleted_at
+  from origins
+  where distribution_id = $1
+  order by created_at
+`
+
+const selectTaskHistoryScript string = `
+  select task_id, distribution_id, operation_key, status, action, retries, metadata, context, result, created_at, updated_at, started_at, finished_at
+  from tasks
+  where deleted_at is null
+`
+
+const retryTaskScript string = `
+  update tasks set
+    status = 'new',
+    retries = 0,
+    result = $2,
+    context = context - 'error',
+    finished_at = null
+  where task_id = $1
+  and status in ('failed', 'canceled')
+  and deleted_at is null
+  returning status, result, metadata, finished_at
+`
+
+const cancelTaskScript string = `
+  update tasks set
+    status = 'canceled',
+    result = 'canceled',
+    finished_at = now()
+  where task_id = $1
+  and status in ('new', 'pending')
+  and finished_at is null
+  and deleted_at is null
+  returning status, result, metadata, finished_at
+`
+
+const failTaskScript string = `
+  update tasks set
+    status = 'failed',
+    result = 'failed',
+    context = jsonb_set(COALESCE(context, '{"version": 1}'), '{error}',
+      jsonb_build_object('action', action, 'message', $2::text, 'at', now())),
+    finished_at = now()
+  where task_id = $1
+  and status in ('new', 'pending')
+  and finished_at is null
+  and deleted_at is null
+  returning status, result, metadata, finished_at
+`
+
+const checkColumnScript string = `
+  select count(*)
+  from information_schema.columns
+  where table_schema = current_schema()
+  and table_name = $1
+  and column_name = $2
+`
+
+const countTasksByStatusScript string = `
+  select status, count(*)
+  from tasks
+  where deleted_at is null
+  group by status
+`
+
+const countStalledTasksScript string = `
+  select count(*)
+  from tasks
+  where status in ('new', 'pending')
+  and finished_at is null
+  and deleted_at is null
+  and updated_at < now() - interval '1 hour'
+`
+
+const countOpenDriftScript string = `
+  select count(*)
+  from drift_findings
+  where resolved_at is null
+`
+
+const dumpPlansScript string = `
+  select plan_id, name, human_name, description, categories, free, cost_cents, cost_unit, settings, parameters, plan_updates
+  from plans
+  where service_id = $1
+  and deleted_at is null
+  order by name
+`
+
+const selectOriginReferencesScript string = `
+  select bucket_name, iam_user
+  from origins
+  where deleted_at is null
+`
+
+const selectDistributionReferencesScript string = `
+  select caller_reference, cloudfront_id, origin_access_identity, deleted_at is null
+  from distributions
+`
+
+const selectDeployedDistributionsScript string = `
+  select distribution_id
+  from distributions
+  where status = 'deployed'
+  and deleted_at is null
+  order by created_at
+`
+
+const upsertDriftFindingScript string = `
+  insert into drift_findings
+    (finding_id, distribution_id, kind, expected, actual)
+  values
+    (uuid_generate_v4(), $1, $2, $3, $4)
+  on conflict (distribution_id, kind) where resolved_at is null
+  do update set
+    expected = excluded.expected,
+    actual = excluded.actual,
+    last_seen_at = now()
+`
+
+const resolveDriftFindingsScript string = `
+  update drift_findings
+  set resolved_at = now()
+  where distribution_id = $1
+  and resolved_at is null
+  and not (kind = any($2))
+`
+
+const selectDriftFindingsScript string = `
+  select finding_id, distribution_id, kind, expected, actual, detected_at, last_seen_at, resolved_at
+  from drift_findings
+  where distribution_id = $1
+  order by detected_at desc
+`
+
+const countQueuedTasksScript string = `
+  select action, status, count(*)
+  from tasks
+  where status in ('new', 'pending')
+  and deleted_at is null
+  group by action, status
+`
+
+const selectWebhookTargetScript string = `
+  select cloudfront_url, parameters::json->>'webhook_url'
+  from distributions
+  where distribution_id = $1
+`
+
+const insertWebhookDeliveryScript string = `
+  insert into webhook_deliveries
+    (delivery_id, distribution_id, task_id, url, payload)
+  values
+    (uuid_generate_v4(), $1, $2, $3, $4)
+`
+
+const claimWebhookDeliveriesScript string = `
+  update webhook_deliveries set
+    attempts = attempts + 1,
+    next_attempt_at = now() + make_interval(secs => $2)
+  where delivery_id in (
+    select delivery_id
+    from webhook_deliveries
+    where status = 'pending'
+    and next_attempt_at <= now()
+    order by next_attempt_at
+    limit $1
+    for update skip locked
+  )
+  returning delivery_id, distribution_id, task_id, url, payload, status, attempts, last_error, next_attempt_at, created_at, delivered_at
+`
+
+const deliveredWebhookScript string = `
+  update webhook_deliveries set
+    status = 'delivered',
+    last_error = null,
+    delivered_at = now()
+  where delivery_id = $1
+`
+
+const retryWebhookScript string = `
+  update webhook_deliveries set
+    last_error = $2,
+    next_attempt_at = $3
+  where delivery_id = $1
+`
+
+const failWebhookScript string = `
+  update webhook_deliveries set
+    status = 'failed',
+    last_error = $2
+  where delivery_id = $1
+`
+
+const insertTaskAuditEventScript string = `
+  insert into task_events
+    (event_id, task_id, distribution_id, operation_key, action, next_action, status, retries, error, resources, started_at, finished_at)
+  values
+    (uuid_generate_v4(), $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+`
+
+const selectTaskAuditEventsScript string = `
+  select event_id, task_id, distribution_id, operation_key, action, next_action, status, retries, error, resources, started_at, finished_at, created_at
+  from task_events
 `
@@ -7,12 +7,11 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"os/signal"
 	"strings"
-	"syscall"
 	"time"
 
-	"github.com/golang/glog"
+	"cloudfront-broker/pkg/logging"
+
 	"github.com/lib/pq"
 
 	_ "github.com/lib/pq"
@@ -25,6 +24,9 @@ const (
 	DistributionNotFound = "DistributionNotFound"
 	DistributionFound    = "DistributionFound"
 	OriginNotFound       = "OriginNotFound"
+	PlanNotFound         = "PlanNotFound"
+	TaskNotFound         = "TaskNotFound"
+	TaskNotChanged       = "TaskNotChanged"
 )
 
 var trueVal = true
@@ -33,21 +35,20 @@ var falseVal = false
 // PostgresStorage holds connection link to database
 type PostgresStorage struct {
 	// Storage
-	db *sql.DB
-}
+	db *tracedDB
 
-func cancelOnInterrupt(ctx context.Context, db *sql.DB) {
-	term := make(chan os.Signal)
-	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
+	// webhooks is set when finished operations are queued for webhook delivery
+	webhooks    bool
+	webhookURLs []string
 
-	for {
-		select {
-		case <-term:
-			_ = db.Close()
-		case <-ctx.Done():
-			_ = db.Close()
-		}
-	}
+	// events streams the task transitions notified by the database
+	events *taskEventHub
+}
+
+// Close closes the database, it is called on shutdown after the server and the tasks stopped
+func (p *PostgresStorage) Close() error {
+	p.events.close()
+	return p.db.Close()
 }
 
 func nullStringValue(ns sql.NullString) string {
@@ -142,7 +143,7 @@ func InitStorage(ctx context.Context, DatabaseURL string) (*PostgresStorage, err
 		return nil, errors.New("unable to connect to database, none was specified in the environment via DATABASE_URL or through the -database cli option")
 	}
 
-	glog.V(0).Infof("DATABASE_URL=%s", redactDatabaseURL(DatabaseURL))
+	logging.Root().Info("database", "database_url", redactDatabaseURL(DatabaseURL))
 
 	db, err := sql.Open("postgres", DatabaseURL)
 	if err != nil {
@@ -151,12 +152,11 @@ func InitStorage(ctx context.Context, DatabaseURL string) (*PostgresStorage, err
 	}
 
 	pgStorage := PostgresStorage{
-		db: db,
+		db:     &tracedDB{DB: db},
+		events: newTaskEventHub(DatabaseURL),
 	}
 
-	go cancelOnInterrupt(ctx, db)
-
-	_, err = db.Exec(createScript)
+	_, err = db.ExecContext(ctx, createScript)
 	if err != nil {
 		// glog.Errorf("error creating database tables: %s\n", err)
 		return nil, err
@@ -185,7 +185,7 @@ func InitStorage(ctx context.Context, DatabaseURL string) (*PostgresStorage, err
 	return &pgStorage, nil
 }
 
-func getCatalogPlans(db *sql.DB, serviceID string) ([]osb.Plan, error) {
+func getCatalogPlans(db *tracedDB, serviceID string) ([]osb.Plan, error) {
 	rows, err := db.Query(plansQuery+"and services.service_id = $1 order by plans.name", serviceID)
 	if err != nil {
 		// glog.Errorf("getPlans query failed: %s\n", err.Error())
@@ -197,25 +197,20 @@ func getCatalogPlans(db *sql.DB, serviceID string) ([]osb.Plan, error) {
 
 	for rows.Next() {
 		var planID, name, serviceName, costUnit string
-		var humanName, description, catagories sql.NullString
+		var humanName, description, catagories, planParameters sql.NullString
 		var cents int32
 		var free bool
 
-		err := rows.Scan(&planID, &name, &serviceName, &humanName, &description, &catagories, &free, &cents, &costUnit)
+		err := rows.Scan(&planID, &name, &serviceName, &humanName, &description, &catagories, &free, &cents, &costUnit, &planParameters)
 		if err != nil {
 			// glog.Errorf("Scan from plans query failed: %s\n", err.Error())
 			return nil, errors.New("Scan from plans query failed: " + err.Error())
 		}
 
-		parameters := map[string]interface{}{
-			"$schema": "http://json-schema.org/draft-04/schema#",
-			"type":    "object",
-			"properties": map[string]interface{}{
-				"billingcode": map[string]interface{}{
-					"description": "Billing code used for invoicing",
-					"type":        "string",
-				},
-			},
+		plan := &Plan{Name: name, Parameters: planParameters}
+		parameters, err := plan.ParametersSchema()
+		if err != nil {
+			return nil, err
 		}
 
 		schemas := osb.Schemas{
@@ -273,8 +268,9 @@ func (p *PostgresStorage) GetServicesCatalog() ([]osb.Service, error) {
 	for rows.Next() {
 		var serviceID, serviceName string
 		var serviceDescription, serviceHumanName, serviceCatagories, serviceImage sql.NullString
+		var planUpdatable bool
 
-		err = rows.Scan(&serviceID, &serviceName, &serviceHumanName, &serviceDescription, &serviceCatagories, &serviceImage)
+		err = rows.Scan(&serviceID, &serviceName, &serviceHumanName, &serviceDescription, &serviceCatagories, &serviceImage, &planUpdatable)
 		if err != nil {
 			// glog.Errorf("Unable to get services: %s\n", err.Error())
 			return nil, errors.New("Unable to scan services: " + err.Error())
@@ -297,7 +293,7 @@ func (p *PostgresStorage) GetServicesCatalog() ([]osb.Service, error) {
 			Description:         nullStringValue(serviceDescription),
 			Bindable:            true,
 			BindingsRetrievable: true,
-			PlanUpdatable:       &falseVal,
+			PlanUpdatable:       &planUpdatable,
 			Tags:                strings.Split(nullStringValue(serviceCatagories), ","),
 			Metadata: map[string]interface{}{
 				"name":            nullStringValue(serviceHumanName),
@@ -311,6 +307,38 @@ func (p *PostgresStorage) GetServicesCatalog() ([]osb.Service, error) {
 	return services, nil
 }
 
+// GetPlan retrieves the plan from database, including deleted plans
+func (p *PostgresStorage) GetPlan(planID string) (*Plan, error) {
+	plan := &Plan{}
+
+	err := p.db.QueryRow(selectPlanScript, planID).Scan(
+		&plan.PlanID,
+		&plan.ServiceID,
+		&plan.Name,
+		&plan.HumanName,
+		&plan.Description,
+		&plan.Catagories,
+		&plan.Free,
+		&plan.CostCents,
+		&plan.CostUnit,
+		&plan.Parameters,
+		&plan.Settings,
+		&plan.PlanUpdates,
+		&plan.CreatedAt,
+		&plan.UpdatedAt,
+		&plan.DeletedAt,
+	)
+
+	if err != nil && err == sql.ErrNoRows {
+		return nil, errors.New(PlanNotFound)
+	} else if err != nil {
+		msg := fmt.Sprintf("GetPlan: error getting plan: %s", err.Error())
+		return nil, errors.New(msg)
+	}
+
+	return plan, nil
+}
+
 // GetDistributionWithDeleted retrieves the distribution from database
 func (p *PostgresStorage) GetDistributionWithDeleted(distributionID string) (*Distribution, error) {
 	distribution := &Distribution{}
@@ -326,6 +354,10 @@ func (p *PostgresStorage) GetDistributionWithDeleted(distributionID string) (*Di
 		&distribution.Status,
 		&distribution.BillingCode,
 		&distribution.CallerReference,
+		&distribution.OriginType,
+		&distribution.Parameters,
+		&distribution.Context,
+		&distribution.ParametersHash,
 		&distribution.CreatedAt,
 		&distribution.UpdatedAt,
 		&distribution.DeletedAt,
@@ -365,6 +397,10 @@ func (p *PostgresStorage) GetDistribution(distributionID string) (*Distribution,
 		&distribution.Status,
 		&distribution.BillingCode,
 		&distribution.CallerReference,
+		&distribution.OriginType,
+		&distribution.Parameters,
+		&distribution.Context,
+		&distribution.ParametersHash,
 		&distribution.CreatedAt,
 		&distribution.UpdatedAt,
 		&distribution.DeletedAt,
@@ -385,12 +421,16 @@ func (p *PostgresStorage) GetDistribution(distributionID string) (*Distribution,
 
 }
 
-// NewDistribution inserts distribution
-func (p *PostgresStorage) NewDistribution(distributionID string, planID string, billingCode *string, callerReference string, status string) error {
+// NewDistribution inserts distribution, parameters are the json encoded instance parameters
+// and context the json encoded platform context of the instance, parametersHash identifies
+// the parameters of the provision request so a repeated request can be recognized
+func (p *PostgresStorage) NewDistribution(distributionID string, serviceID string, planID string, billingCode *string, callerReference string, status string, originType string, parameters *string, context *string, parametersHash string) error {
 	var err error
 	var cnt int
 
 	billingCodeStr := SetNullStringPtr(billingCode)
+	parametersStr := SetNullStringPtr(parameters)
+	contextStr := SetNullStringPtr(context)
 
 	err = p.db.QueryRow(checkPlanScript, planID).Scan(&cnt)
 
@@ -411,18 +451,22 @@ func (p *PostgresStorage) NewDistribution(distributionID string, planID string,
 	}
 
 	distribution := &Distribution{
-		PlanID:      planID,
-		BillingCode: billingCodeStr,
+		PlanID:         planID,
+		BillingCode:    billingCodeStr,
+		OriginType:     originType,
+		Parameters:     parametersStr,
+		Context:        contextStr,
+		ParametersHash: SetNullString(parametersHash),
 	}
 
-	err = p.db.QueryRow(insertDistScript, distributionID, planID, billingCodeStr, callerReference, status).Scan(&distribution.DistributionID)
+	err = p.db.QueryRow(insertDistScript, distributionID, planID, billingCodeStr, callerReference, status, originType, parametersStr, contextStr, distribution.ParametersHash, serviceID).Scan(&distribution.DistributionID)
 	if err != nil {
 		msg := fmt.Sprintf("NewDistribution: error inserting distribution: %s", err.Error())
 		// glog.Error(msg)
 		return errors.New(msg)
 	}
 
-	glog.V(1).Infof("NewDistribution: distribution id: %s", distribution.DistributionID)
+	p.logger().Debug("new distribution", logging.KeyInstanceID, distribution.DistributionID)
 
 	return nil
 }
@@ -455,6 +499,57 @@ func (p *PostgresStorage) UpdateDistributionStatus(distributionID string, status
 	return nil
 }
 
+// UpdateDistributionParameters stores the json encoded instance parameters
+func (p *PostgresStorage) UpdateDistributionParameters(distributionID string, parameters string) error {
+	var distID string
+
+	err := p.db.QueryRow(updateDistributionParametersScript, &distributionID, &parameters).Scan(&distID)
+
+	if err != nil && err == sql.ErrNoRows {
+		msg := fmt.Sprintf("UpdateDistributionParameters: distribution not found: %s", err.Error())
+		return errors.New(msg)
+	} else if err != nil {
+		msg := fmt.Sprintf("UpdateDistributionParameters: error updating distribution: %s", err.Error())
+		return errors.New(msg)
+	}
+
+	return nil
+}
+
+// UpdateDistributionPlan moves the distribution to a new plan with the json encoded instance parameters
+func (p *PostgresStorage) UpdateDistributionPlan(distributionID string, planID string, parameters string) error {
+	var distID string
+
+	err := p.db.QueryRow(updateDistributionPlanScript, &distributionID, &planID, &parameters).Scan(&distID)
+
+	if err != nil && err == sql.ErrNoRows {
+		msg := fmt.Sprintf("UpdateDistributionPlan: distribution not found: %s", err.Error())
+		return errors.New(msg)
+	} else if err != nil {
+		msg := fmt.Sprintf("UpdateDistributionPlan: error updating distribution: %s", err.Error())
+		return errors.New(msg)
+	}
+
+	return nil
+}
+
+// UpdateDistributionBillingCode changes the billing code of the distribution
+func (p *PostgresStorage) UpdateDistributionBillingCode(distributionID string, billingCode string) error {
+	var distID string
+
+	err := p.db.QueryRow(updateDistributionBillingCodeScript, &distributionID, &billingCode).Scan(&distID)
+
+	if err != nil && err == sql.ErrNoRows {
+		msg := fmt.Sprintf("UpdateDistributionBillingCode: distribution not found: %s", err.Error())
+		return errors.New(msg)
+	} else if err != nil {
+		msg := fmt.Sprintf("UpdateDistributionBillingCode: error updating distribution: %s", err.Error())
+		return errors.New(msg)
+	}
+
+	return nil
+}
+
 // UpdateDeleteDistribution marks distribution as deleted from AWS
 func (p *PostgresStorage) UpdateDeleteDistribution(distributionID string) error {
 	var distDeleted string
@@ -503,8 +598,6 @@ func (p *PostgresStorage) UpdateDistributionCloudfront(distributionID string, cl
 
 // AddOrigin inserts origin into origins table
 func (p *PostgresStorage) AddOrigin(distributionID string, bucketName string, bucketURL string, originPath string) (*Origin, error) {
-	glog.V(4).Info("===== AddOrigin =====")
-
 	origin := &Origin{
 		DistributionID: distributionID,
 		BucketName:     bucketName,
@@ -521,7 +614,7 @@ func (p *PostgresStorage) AddOrigin(distributionID string, bucketName string, bu
 		return nil, errors.New(msg)
 	}
 
-	glog.V(1).Infof("AddOrigin: originId: %s", origin.OriginID)
+	p.logger().Debug("added origin", "origin_id", origin.OriginID)
 
 	return origin, nil
 }
@@ -55,6 +55,10 @@ func TestStorage(t *testing.T) {
 	accessKey := "ALKASJF234234H5H32K234"
 	secretKey := "ajdskf2sksdahffds2jhkjhk56hk"
 	originAccessIdentity := "EASDF23SLKJSFKJ24JLK"
+	originType := "s3"
+	parameters := `{"origin_type":"s3"}`
+	instanceContext := `{"organization_guid":"org","space_guid":"space"}`
+	parametersHash := "44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"
 
 	stg, err := InitStorage(context.TODO(), "")
 	if err != nil {
@@ -105,23 +109,45 @@ func TestStorage(t *testing.T) {
 			So(services[0].Plans, ShouldNotBeEmpty)
 			So(services[0].Plans[0].ID, ShouldEqual, planID)
 		})
+
+		Convey("get plan", func() {
+			plan, err := stg.GetPlan(planID)
+			So(err, ShouldBeNil)
+			So(plan.ServiceID, ShouldEqual, serviceID)
+		})
 	})
 
 	Convey("distributions", t, func() {
 		Convey("new distribution", func() {
-			err := stg.NewDistribution(distributionID, planID, &billingCode, callerReference, status)
+			err := stg.NewDistribution(distributionID, serviceID, planID, &billingCode, callerReference, status, originType, &parameters, &instanceContext, parametersHash)
 			So(err, ShouldBeNil)
 
 			Convey("get distribution", func() {
-				_, err = stg.GetDistribution(distributionID)
+				dist, err := stg.GetDistribution(distributionID)
 
 				So(err, ShouldBeNil)
+				So(dist.OriginType, ShouldEqual, originType)
+				So(dist.Parameters.String, ShouldEqual, parameters)
+				So(dist.Context.String, ShouldEqual, instanceContext)
+				So(dist.ParametersHash.String, ShouldEqual, parametersHash)
 				Convey("update distribution status", func() {
 					var pendingStatus = "pending"
 					err = stg.UpdateDistributionStatus(distributionID, pendingStatus, false)
 
 					So(err, ShouldBeNil)
 
+					Convey("update distribution parameters", func() {
+						err = stg.UpdateDistributionParameters(distributionID, parameters)
+
+						So(err, ShouldBeNil)
+					})
+
+					Convey("update distribution billing code", func() {
+						err = stg.UpdateDistributionBillingCode(distributionID, billingCode)
+
+						So(err, ShouldBeNil)
+					})
+
 					Convey("update with cloudfront", func() {
 						dist, err := stg.UpdateDistributionCloudfront(distributionID, cloudfrontID, cloudfrontURL)
 
@@ -207,6 +233,7 @@ func TestStorage(t *testing.T) {
 
 				So(err, ShouldBeNil)
 				So(popTask.TaskID, ShouldEqual, taskID)
+				So(time.Since(popTask.CreatedAt), ShouldBeLessThan, time.Minute)
 			})
 
 			Convey("update task action", func() {
@@ -242,6 +269,29 @@ func TestStorage(t *testing.T) {
 		})
 	})
 
+	Convey("drift findings", t, func() {
+		Convey("record findings", func() {
+			err := stg.RecordDriftFindings(distributionID, []DriftFinding{
+				{Kind: "distribution-disabled", Expected: SetNullString("true"), Actual: SetNullString("false")},
+			})
+			So(err, ShouldBeNil)
+
+			Convey("resolve findings no longer seen", func() {
+				err := stg.RecordDriftFindings(distributionID, []DriftFinding{})
+				So(err, ShouldBeNil)
+
+				findings, err := stg.GetDriftFindings(distributionID)
+				So(err, ShouldBeNil)
+				So(len(findings), ShouldEqual, 1)
+				So(findings[0].ResolvedAt.Valid, ShouldBeTrue)
+			})
+		})
+
+		Reset(func() {
+			_, err = stg.db.Exec("delete from drift_findings where distribution_id = $1", distributionID)
+		})
+	})
+
 	Convey("'delete' distribution", t, func() {
 		Convey("update distribution as deleted", func() {
 			err := stg.UpdateDeleteDistribution(distributionID)
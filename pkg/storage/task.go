@@ -1,9 +1,9 @@
 package storage
 
 import (
+	"database/sql"
 	"fmt"
 
-	"github.com/golang/glog"
 	"github.com/pkg/errors"
 	// pq "github.com/lib/pq"
 )
@@ -14,35 +14,37 @@ const (
 	StatusPending  string = "pending"
 	StatusFinished string = "finished"
 	StatusFailed   string = "failed"
+	StatusCanceled string = "canceled"
 )
 
 // AddTask inserts task into tasks table
 func (p *PostgresStorage) AddTask(task *Task) (*Task, error) {
 	var err error
 
-	glog.V(4).Info("===== AddTask =====")
-
-	err = p.db.QueryRow(insertTaskScript, &task.DistributionID, &task.Status, &task.Action, &task.OperationKey, &task.Retries, &task.StartedAt).Scan(&task.TaskID)
+	err = p.db.QueryRow(insertTaskScript, &task.DistributionID, &task.Status, &task.Action, &task.OperationKey, &task.Retries, &task.StartedAt, &task.Metadata, &task.Context).Scan(&task.TaskID)
 
 	if err != nil {
 		msg := fmt.Sprintf("AddTask: error adding task: %s", err.Error())
-		glog.Error(msg)
+		p.logger().Error(msg)
 		return nil, errors.New(msg)
 	}
 
 	return task, nil
 }
 
-// GetTaskByDistribution retrieves task by distribution id
+// GetTaskByDistribution retrieves task by distribution id, TaskNotFound is returned when
+// the distribution has no task
 func (p *PostgresStorage) GetTaskByDistribution(distributionID string) (*Task, error) {
-	glog.V(4).Infof("===== GetTaskByDistribution [%s] =====", distributionID)
 	task := Task{}
 
-	err := p.db.QueryRow(selectTaskScript, distributionID).Scan(&task.TaskID, &task.DistributionID, &task.OperationKey, &task.Status, &task.Action, &task.Retries, &task.Metadata, &task.Result)
+	err := p.db.QueryRow(selectTaskScript, distributionID).Scan(&task.TaskID, &task.DistributionID, &task.OperationKey, &task.Status, &task.Action, &task.Retries, &task.Metadata, &task.Context, &task.Result)
 
+	if err == sql.ErrNoRows {
+		return nil, errors.New(TaskNotFound)
+	}
 	if err != nil {
 		msg := fmt.Sprintf("GetTaskByDistribution: error finding task: %s", err.Error())
-		glog.Error(msg)
+		p.logger().Error(msg)
 		return nil, errors.New(msg)
 	}
 
@@ -53,9 +55,7 @@ func (p *PostgresStorage) GetTaskByDistribution(distributionID string) (*Task, e
 func (p *PostgresStorage) PopNextTask() (*Task, error) {
 	var err error
 	var task Task
-
-	glog.V(4).Info("===== PopNextTask =====")
-	err = p.db.QueryRow(popNextTaskScript).Scan(&task.TaskID, &task.DistributionID, &task.OperationKey, &task.Status, &task.Action, &task.Retries, &task.Metadata, &task.Result, &task.StartedAt, &task.UpdatedAt)
+	err = p.db.QueryRow(popNextTaskScript).Scan(&task.TaskID, &task.DistributionID, &task.OperationKey, &task.Status, &task.Action, &task.Retries, &task.Metadata, &task.Context, &task.Result, &task.CreatedAt, &task.StartedAt, &task.UpdatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -67,20 +67,51 @@ func (p *PostgresStorage) PopNextTask() (*Task, error) {
 func (p *PostgresStorage) UpdateTaskAction(task *Task) (*Task, error) {
 	var err error
 
-	glog.V(4).Info("===== UpdateTaskAction =====")
+	if p.webhooks && (task.Status == "finished" || task.Status == "failed") {
+		return p.updateTaskActionWithWebhooks(task)
+	}
 
-	err = p.db.QueryRow(updateTaskActionScript, task.TaskID, task.Action, task.Status, task.Retries, task.Result, task.Metadata, task.FinishedAt, task.StartedAt).Scan(
-		&task.TaskID, &task.DistributionID, &task.Action, &task.Status, &task.Retries, &task.Result, &task.Metadata, &task.CreatedAt, &task.UpdatedAt, &task.StartedAt, &task.FinishedAt)
+	err = p.db.QueryRow(updateTaskActionScript, task.TaskID, task.Action, task.Status, task.Retries, task.Result, task.Metadata, task.FinishedAt, task.StartedAt, task.Context).Scan(
+		&task.TaskID, &task.DistributionID, &task.Action, &task.Status, &task.Retries, &task.Result, &task.Metadata, &task.Context, &task.CreatedAt, &task.UpdatedAt, &task.StartedAt, &task.FinishedAt)
 
 	if err != nil {
 		msg := fmt.Sprintf("UpdateTaskAction: error updating task: %s", err.Error())
-		glog.Error(msg)
+		p.logger().Error(msg)
 		return nil, errors.New(msg)
 	}
 
 	if task == nil {
-		glog.Error("UpdateTaskAction: task is nil")
+		p.logger().Error("UpdateTaskAction: task is nil")
 		return nil, errors.New("UpdateTaskAction: task is nil")
 	}
 	return task, nil
 }
+
+// TaskCount is the number of tasks with an action and status
+type TaskCount struct {
+	Action string
+	Status string
+	Count  int
+}
+
+// CountQueuedTasks returns the number of new and pending tasks by action and status
+func (p *PostgresStorage) CountQueuedTasks() ([]TaskCount, error) {
+	rows, err := p.db.Query(countQueuedTasksScript)
+	if err != nil {
+		msg := fmt.Sprintf("CountQueuedTasks: error counting tasks: %s", err.Error())
+		return nil, errors.New(msg)
+	}
+	defer rows.Close()
+
+	counts := []TaskCount{}
+	for rows.Next() {
+		c := TaskCount{}
+		if err = rows.Scan(&c.Action, &c.Status, &c.Count); err != nil {
+			msg := fmt.Sprintf("CountQueuedTasks: error scanning task count: %s", err.Error())
+			return nil, errors.New(msg)
+		}
+		counts = append(counts, c)
+	}
+
+	return counts, nil
+}
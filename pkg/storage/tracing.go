@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"cloudfront-broker/pkg/logging"
+	"cloudfront-broker/pkg/tracing"
+
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracedDB makes its queries with its context and starts a span for each query when the
+// context carries a span, queries made without a span, by the gc or the checks, are not traced
+type tracedDB struct {
+	*sql.DB
+	ctx context.Context
+}
+
+// tracedTx is a transaction of a tracedDB
+type tracedTx struct {
+	*sql.Tx
+	ctx context.Context
+}
+
+// WithContext returns a storage making its queries with ctx, they are canceled with ctx and
+// traced as children of its span
+func (p *PostgresStorage) WithContext(ctx context.Context) *PostgresStorage {
+	c := *p
+	c.db = &tracedDB{DB: p.db.DB, ctx: ctx}
+	return &c
+}
+
+// startQuerySpan starts the span of the query when ctx carries a span, the span is nil otherwise
+func startQuerySpan(ctx context.Context, query string) (context.Context, trace.Span) {
+	if !trace.SpanFromContext(ctx).SpanContext().IsValid() {
+		return ctx, nil
+	}
+
+	operation := strings.ToUpper(strings.SplitN(strings.TrimSpace(query), " ", 2)[0])
+	return tracing.Tracer().Start(ctx, operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			semconv.DBOperationName(operation),
+			semconv.DBQueryText(query),
+		),
+	)
+}
+
+func endQuerySpan(span trace.Span, err error) {
+	if span == nil {
+		return
+	}
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	tracing.End(span, err)
+}
+
+func contextOrBackground(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
+
+func (db *tracedDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	ctx, span := startQuerySpan(contextOrBackground(db.ctx), query)
+	rows, err := db.DB.QueryContext(ctx, query, args...)
+	endQuerySpan(span, err)
+	return rows, err
+}
+
+func (db *tracedDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	ctx, span := startQuerySpan(contextOrBackground(db.ctx), query)
+	row := db.DB.QueryRowContext(ctx, query, args...)
+	endQuerySpan(span, row.Err())
+	return row
+}
+
+func (db *tracedDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	ctx, span := startQuerySpan(contextOrBackground(db.ctx), query)
+	res, err := db.DB.ExecContext(ctx, query, args...)
+	endQuerySpan(span, err)
+	return res, err
+}
+
+func (db *tracedDB) Begin() (*tracedTx, error) {
+	ctx := contextOrBackground(db.ctx)
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedTx{Tx: tx, ctx: ctx}, nil
+}
+
+func (tx *tracedTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	ctx, span := startQuerySpan(tx.ctx, query)
+	row := tx.Tx.QueryRowContext(ctx, query, args...)
+	endQuerySpan(span, row.Err())
+	return row
+}
+
+func (tx *tracedTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	ctx, span := startQuerySpan(tx.ctx, query)
+	res, err := tx.Tx.ExecContext(ctx, query, args...)
+	endQuerySpan(span, err)
+	return res, err
+}
+
+// logger returns the logger of the context the storage makes its queries with
+func (p *PostgresStorage) logger() *logging.Logger {
+	return logging.FromContext(p.db.ctx)
+}
@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Results of an operation in a webhook payload, they are the osb last operation states
+const (
+	WebhookSucceeded string = "succeeded"
+	WebhookFailed    string = "failed"
+)
+
+// operationOfKey names the operation by the prefix of its operation key
+var operationOfKey = map[string]string{
+	"PRV": "provision",
+	"UPD": "update",
+	"DPV": "deprovision",
+	"RCN": "reconcile",
+	"IMP": "import",
+}
+
+// WebhookPayload is the body posted to the webhooks when an operation finished or failed
+type WebhookPayload struct {
+	InstanceID    string    `json:"instance_id"`
+	Operation     string    `json:"operation"`
+	OperationKey  string    `json:"operation_key"`
+	Result        string    `json:"result"`
+	Description   string    `json:"description,omitempty"`
+	CloudFrontURL string    `json:"cloudfront_url,omitempty"`
+	FinishedAt    time.Time `json:"finished_at"`
+}
+
+// EnableWebhooks queues a webhook delivery to each url and to the webhook_url parameter
+// of the instance when UpdateTaskAction finishes or fails a task
+func (p *PostgresStorage) EnableWebhooks(urls []string) {
+	p.webhooks = true
+	p.webhookURLs = urls
+}
+
+func newWebhookPayload(task *Task, cloudfrontURL sql.NullString) *WebhookPayload {
+	payload := &WebhookPayload{
+		InstanceID:    task.DistributionID,
+		OperationKey:  task.OperationKey.String,
+		Result:        WebhookSucceeded,
+		Description:   task.Description(),
+		CloudFrontURL: cloudfrontURL.String,
+		FinishedAt:    time.Now().UTC(),
+	}
+	if task.FinishedAt.Valid {
+		payload.FinishedAt = task.FinishedAt.Time.UTC()
+	}
+	if len(payload.OperationKey) >= 3 {
+		payload.Operation = operationOfKey[payload.OperationKey[:3]]
+	}
+	if task.Status == StatusFailed || task.Status == StatusCanceled || task.Result.String == StatusFailed {
+		payload.Result = WebhookFailed
+	}
+	return payload
+}
+
+// updateTaskActionWithWebhooks stores the finished or failed task and queues its webhooks
+// in one transaction, so a delivery is queued exactly when the task is stored as finished
+func (p *PostgresStorage) updateTaskActionWithWebhooks(task *Task) (*Task, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		msg := fmt.Sprintf("UpdateTaskAction: error starting transaction: %s", err.Error())
+		p.logger().Error(msg)
+		return nil, errors.New(msg)
+	}
+
+	err = tx.QueryRow(updateTaskActionScript, task.TaskID, task.Action, task.Status, task.Retries, task.Result, task.Metadata, task.FinishedAt, task.StartedAt, task.Context).Scan(
+		&task.TaskID, &task.DistributionID, &task.Action, &task.Status, &task.Retries, &task.Result, &task.Metadata, &task.Context, &task.CreatedAt, &task.UpdatedAt, &task.StartedAt, &task.FinishedAt)
+	if err != nil {
+		_ = tx.Rollback()
+		msg := fmt.Sprintf("UpdateTaskAction: error updating task: %s", err.Error())
+		p.logger().Error(msg)
+		return nil, errors.New(msg)
+	}
+
+	if err = p.queueWebhooks(tx, task); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		msg := fmt.Sprintf("UpdateTaskAction: error committing task: %s", err.Error())
+		p.logger().Error(msg)
+		return nil, errors.New(msg)
+	}
+
+	return task, nil
+}
+
+// queueWebhooks queues a webhook delivery of the finished, failed or canceled task to each
+// url and to the webhook_url of the instance, in the transaction storing the task
+func (p *PostgresStorage) queueWebhooks(tx *tracedTx, task *Task) error {
+	var cloudfrontURL, instanceURL sql.NullString
+	if err := tx.QueryRow(selectWebhookTargetScript, task.DistributionID).Scan(&cloudfrontURL, &instanceURL); err != nil {
+		msg := fmt.Sprintf("queueWebhooks: error getting webhook of %s: %s", task.DistributionID, err.Error())
+		p.logger().Error(msg)
+		return errors.New(msg)
+	}
+
+	urls := p.webhookURLs
+	if instanceURL.String != "" {
+		urls = append(append([]string{}, urls...), instanceURL.String)
+	}
+	if len(urls) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(newWebhookPayload(task, cloudfrontURL))
+	if err != nil {
+		msg := fmt.Sprintf("queueWebhooks: error encoding webhook payload: %s", err.Error())
+		p.logger().Error(msg)
+		return errors.New(msg)
+	}
+
+	for _, url := range urls {
+		if _, err = tx.Exec(insertWebhookDeliveryScript, task.DistributionID, task.TaskID, url, string(payload)); err != nil {
+			msg := fmt.Sprintf("queueWebhooks: error queueing webhook: %s", err.Error())
+			p.logger().Error(msg)
+			return errors.New(msg)
+		}
+	}
+	return nil
+}
+
+// ClaimWebhookDeliveries returns up to limit deliveries that are due, counting an attempt
+// for each, a claimed delivery is not returned again for lease so processes do not send it twice
+func (p *PostgresStorage) ClaimWebhookDeliveries(limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	rows, err := p.db.Query(claimWebhookDeliveriesScript, limit, lease.Seconds())
+	if err != nil {
+		msg := fmt.Sprintf("ClaimWebhookDeliveries: error claiming deliveries: %s", err.Error())
+		return nil, errors.New(msg)
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		d := WebhookDelivery{}
+		err = rows.Scan(&d.DeliveryID, &d.DistributionID, &d.TaskID, &d.URL, &d.Payload, &d.Status, &d.Attempts, &d.LastError, &d.NextAttemptAt, &d.CreatedAt, &d.DeliveredAt)
+		if err != nil {
+			msg := fmt.Sprintf("ClaimWebhookDeliveries: error scanning delivery: %s", err.Error())
+			return nil, errors.New(msg)
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, nil
+}
+
+// WebhookDelivered marks the delivery as delivered
+func (p *PostgresStorage) WebhookDelivered(deliveryID string) error {
+	if _, err := p.db.Exec(deliveredWebhookScript, deliveryID); err != nil {
+		msg := fmt.Sprintf("WebhookDelivered: error updating delivery %s: %s", deliveryID, err.Error())
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// WebhookAttemptFailed records the error of an attempt, the delivery is retried at retryAt
+// or, when retryAt is nil, marked as failed
+func (p *PostgresStorage) WebhookAttemptFailed(deliveryID string, reason string, retryAt *time.Time) error {
+	var err error
+	if retryAt != nil {
+		_, err = p.db.Exec(retryWebhookScript, deliveryID, reason, *retryAt)
+	} else {
+		_, err = p.db.Exec(failWebhookScript, deliveryID, reason)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("WebhookAttemptFailed: error updating delivery %s: %s", deliveryID, err.Error())
+		return errors.New(msg)
+	}
+	return nil
+}
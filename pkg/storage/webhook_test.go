@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"database/sql"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWebhookPayload(t *testing.T) {
+	Convey("Webhook payloads", t, func() {
+		task := &Task{
+			DistributionID: "inst-1",
+			Status:         "finished",
+			OperationKey:   SetNullString("PRV1234"),
+			Result:         SetNullString("deployed"),
+			Metadata:       SetNullString("cloudfront distribution created and deployed"),
+		}
+		url := sql.NullString{String: "d111111abcdef8.cloudfront.net", Valid: true}
+
+		Convey("name the operation by its key", func() {
+			payload := newWebhookPayload(task, url)
+			So(payload.Operation, ShouldEqual, "provision")
+			So(payload.Result, ShouldEqual, WebhookSucceeded)
+			So(payload.CloudFrontURL, ShouldEqual, url.String)
+		})
+
+		Convey("report failed tasks and tasks finished with a failed result", func() {
+			task.Result = SetNullString("failed")
+			So(newWebhookPayload(task, url).Result, ShouldEqual, WebhookFailed)
+
+			task.Status = "failed"
+			task.OperationKey = SetNullString("UPD1234")
+			payload := newWebhookPayload(task, sql.NullString{})
+			So(payload.Result, ShouldEqual, WebhookFailed)
+			So(payload.Operation, ShouldEqual, "update")
+			So(payload.CloudFrontURL, ShouldBeEmpty)
+		})
+
+		Convey("report tasks canceled through the admin api as failed", func() {
+			task.Status = StatusCanceled
+			task.Result = SetNullString("canceled")
+			So(newWebhookPayload(task, url).Result, ShouldEqual, WebhookFailed)
+		})
+	})
+}
@@ -0,0 +1,53 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type awsSpanKey struct{}
+
+// AWSHandlers adds a client span for each aws api call to the handlers of a session, the
+// span is a child of the span in the context of the call, calls without one are not traced
+func AWSHandlers(handlers *request.Handlers) {
+	handlers.Validate.PushFront(startAWSSpan)
+	handlers.Complete.PushBack(endAWSSpan)
+}
+
+func startAWSSpan(r *request.Request) {
+	if !trace.SpanFromContext(r.Context()).SpanContext().IsValid() {
+		return
+	}
+
+	operation := ""
+	if r.Operation != nil {
+		operation = r.Operation.Name
+	}
+
+	ctx, span := Tracer().Start(r.Context(), r.ClientInfo.ServiceName+"."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.RPCSystemKey.String("aws-api"),
+			semconv.RPCService(r.ClientInfo.ServiceName),
+			semconv.RPCMethod(operation),
+		),
+	)
+	r.SetContext(context.WithValue(ctx, awsSpanKey{}, span))
+}
+
+func endAWSSpan(r *request.Request) {
+	span, ok := r.Context().Value(awsSpanKey{}).(trace.Span)
+	if !ok {
+		return
+	}
+
+	span.SetAttributes(attribute.String("aws.request_id", r.RequestID))
+	if r.HTTPResponse != nil {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(r.HTTPResponse.StatusCode))
+	}
+	End(span, r.Error)
+}
@@ -0,0 +1,189 @@
+// Package tracing exports OpenTelemetry spans of the osb requests, the task actions,
+// the aws api calls and the sql queries over OTLP.
+//
+// The actions of an operation run in the tasks process long after the osb request
+// started them, so all action spans of an operation share a trace derived from the
+// operation key, and the span of the osb request links to that trace.
+package tracing
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "cloudfront-broker"
+
+// Attribute keys shared with the log fields
+const (
+	KeyInstanceID   = attribute.Key("instance_id")
+	KeyOperationKey = attribute.Key("operation_key")
+	KeyTaskID       = attribute.Key("task_id")
+	KeyAction       = attribute.Key("action")
+)
+
+// Init exports the spans to the OTLP/HTTP collector at endpoint, the url of the collector
+// given on the cli. Without it the exporter reads the OTEL_EXPORTER_OTLP_ENDPOINT and
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT variables itself, and tracing stays disabled when
+// neither is set. The returned function flushes the spans on shutdown.
+func Init(ctx context.Context, endpoint string, serviceName string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var opts []otlptracehttp.Option
+	if endpoint != "" {
+		u, err := endpointURL(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, otlptracehttp.WithEndpointURL(u))
+	} else if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithFromEnv(),
+		resource.WithAttributes(semconv.ServiceName(serviceName)),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// endpointURL returns the url the spans are sent to, the traces path of OTLP/HTTP is
+// appended to a collector url without a path as OTEL_EXPORTER_OTLP_ENDPOINT does
+func endpointURL(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", errors.New("the otlp endpoint " + endpoint + " is not an http or https url")
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	return u.String(), nil
+}
+
+// Tracer returns the tracer of the broker
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// OperationSpanContext returns the span context all actions of the operation are children
+// of, it is derived from the operation key so both processes arrive at the same trace
+func OperationSpanContext(operationKey string) trace.SpanContext {
+	sum := sha256.Sum256([]byte(operationKey))
+
+	var traceID trace.TraceID
+	var spanID trace.SpanID
+	copy(traceID[:], sum[:16])
+	copy(spanID[:], sum[16:24])
+
+	return trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	})
+}
+
+// LinkOperation adds the operation key to the span of ctx and links it to the trace of the operation
+func LinkOperation(ctx context.Context, operationKey string) {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(KeyOperationKey.String(operationKey))
+	span.AddLink(trace.Link{SpanContext: OperationSpanContext(operationKey)})
+}
+
+// End records err on the span and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// StatusWriter records the status of the response, for the middlewares reporting it
+type StatusWriter struct {
+	http.ResponseWriter
+	Status int
+}
+
+// NewStatusWriter returns a writer recording the status written to w, 200 until one is written
+func NewStatusWriter(w http.ResponseWriter) *StatusWriter {
+	return &StatusWriter{ResponseWriter: w, Status: http.StatusOK}
+}
+
+// WriteHeader records the status and writes it
+func (w *StatusWriter) WriteHeader(status int) {
+	w.Status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets event streams flush through the writer
+func (w *StatusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Middleware starts a server span for each request, named after the route template
+// so all requests for instances share a name, and continues a trace the client sent
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if tpl, err := route.GetPathTemplate(); err == nil {
+				name = tpl
+			}
+		}
+
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := Tracer().Start(ctx, r.Method+" "+name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(name),
+				semconv.URLPath(r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		if id := mux.Vars(r)["instance_id"]; id != "" {
+			span.SetAttributes(KeyInstanceID.String(id))
+		}
+
+		sw := NewStatusWriter(w)
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(sw.Status))
+		if sw.Status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(sw.Status))
+		}
+	})
+}
@@ -0,0 +1,78 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	Convey("Operation traces", t, func() {
+		recorder := tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+		Convey("are derived from the operation key", func() {
+			sc := OperationSpanContext("PRV1234")
+			So(sc.IsValid(), ShouldBeTrue)
+			So(sc.IsSampled(), ShouldBeTrue)
+			So(OperationSpanContext("PRV1234").TraceID(), ShouldEqual, sc.TraceID())
+			So(OperationSpanContext("UPD1234").TraceID(), ShouldNotEqual, sc.TraceID())
+		})
+
+		Convey("contain the action spans of the operation", func() {
+			ctx := trace.ContextWithRemoteSpanContext(context.Background(), OperationSpanContext("PRV1234"))
+			_, span := Tracer().Start(ctx, "create-origin")
+			End(span, errors.New("access denied"))
+
+			spans := recorder.Ended()
+			So(len(spans), ShouldEqual, 1)
+			So(spans[0].SpanContext().TraceID(), ShouldEqual, OperationSpanContext("PRV1234").TraceID())
+			So(spans[0].Parent().SpanID(), ShouldEqual, OperationSpanContext("PRV1234").SpanID())
+			So(spans[0].Status().Code, ShouldEqual, codes.Error)
+		})
+
+		Convey("are linked from the span of the osb request", func() {
+			ctx, span := Tracer().Start(context.Background(), "PUT /v2/service_instances/{instance_id}")
+			LinkOperation(ctx, "PRV1234")
+			span.End()
+
+			spans := recorder.Ended()
+			So(len(spans), ShouldEqual, 1)
+			So(spans[0].SpanContext().TraceID(), ShouldNotEqual, OperationSpanContext("PRV1234").TraceID())
+			So(len(spans[0].Links()), ShouldEqual, 1)
+			So(spans[0].Links()[0].SpanContext.TraceID(), ShouldEqual, OperationSpanContext("PRV1234").TraceID())
+		})
+	})
+}
+
+func TestEndpointURL(t *testing.T) {
+	Convey("Collector urls", t, func() {
+		Convey("get the traces path without a path", func() {
+			u, err := endpointURL("http://collector:4318")
+			So(err, ShouldBeNil)
+			So(u, ShouldEqual, "http://collector:4318/v1/traces")
+
+			u, err = endpointURL("https://collector:4318/")
+			So(err, ShouldBeNil)
+			So(u, ShouldEqual, "https://collector:4318/v1/traces")
+		})
+
+		Convey("keep their path", func() {
+			u, err := endpointURL("http://collector:4318/custom/traces")
+			So(err, ShouldBeNil)
+			So(u, ShouldEqual, "http://collector:4318/custom/traces")
+		})
+
+		Convey("need a scheme", func() {
+			_, err := endpointURL("collector:4318")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}